@@ -0,0 +1,163 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+
+	"github.com/Qinbeans/chess-htmx/analysis"
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/Qinbeans/chess-htmx/pieces"
+	"github.com/Qinbeans/chess-htmx/websockets"
+	"github.com/flosch/pongo2/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Handler serves the admin page, listing the rooms of every server and closing them
+type Handler struct {
+	Chess    *pieces.Server
+	Chat     *websockets.WSServer
+	Analysis *analysis.Server
+}
+
+func New(chess *pieces.Server, chat *websockets.WSServer, boards *analysis.Server) *Handler {
+	return &Handler{
+		Chess:    chess,
+		Chat:     chat,
+		Analysis: boards,
+	}
+}
+
+// Auth returns a middleware requiring the configured credentials through basic auth
+func Auth(cfg config.Admin) echo.MiddlewareFunc {
+	return middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
+		Realm: "chess-htmx admin",
+		Validator: func(user, password string, c echo.Context) (bool, error) {
+			// compare both so the time taken doesn't tell which one is wrong
+			userOk := subtle.ConstantTimeCompare([]byte(user), []byte(cfg.User)) == 1
+			passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(cfg.Password)) == 1
+			return userOk && passwordOk, nil
+		},
+	})
+}
+
+// Register adds the admin routes to a group, the group should require Auth
+func (h *Handler) Register(group *echo.Group) {
+	group.GET("", h.Page)
+	group.POST("/chess/terminate", h.TerminateGame)
+	group.POST("/chess/kick", h.KickPlayer)
+	group.POST("/chat/terminate", h.TerminateChat)
+	group.POST("/chat/kick", h.KickMember)
+	group.POST("/chat/dismiss", h.DismissReport)
+	group.POST("/analysis/terminate", h.TerminateBoard)
+	group.POST("/bots/create", h.CreateBot)
+	group.POST("/bots/delete", h.DeleteBot)
+}
+
+// *****************************************************************************
+
+// Page is a callback for rendering the live rooms
+func (h *Handler) Page(c echo.Context) error {
+	return h.page(c, "")
+}
+
+// page renders the live rooms and the bot accounts, token is the token of a bot just created
+func (h *Handler) page(c echo.Context, token string) error {
+	reports, err := h.Chat.Reports()
+	if err != nil {
+		return err
+	}
+	bots, err := h.Chess.Bots.List()
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "admin.dj", pongo2.Context{
+		"title":       "Admin",
+		"description": "Live rooms of Chess-HTMX",
+		"games":       h.Chess.Status(),
+		"chats":       h.Chat.Status(),
+		"boards":      h.Analysis.Status(),
+		"reports":     reports,
+		"bots":        bots,
+		"token":       token,
+		"notice":      c.QueryParam("notice"),
+	})
+}
+
+// done sends the admin back to the page, telling what happened
+func done(c echo.Context, err error, notice string) error {
+	if err != nil {
+		notice = err.Error()
+	}
+	return c.Redirect(http.StatusSeeOther, "/admin?notice="+url.QueryEscape(notice))
+}
+
+// TerminateGame is a callback for closing a chess room
+func (h *Handler) TerminateGame(c echo.Context) error {
+	room := c.FormValue("room")
+	err := h.Chess.Terminate(room)
+	logging.FromContext(c).Info("admin terminated game", "room", room, "error", err)
+	return done(c, err, "game terminated")
+}
+
+// KickPlayer is a callback for disconnecting a client of a chess room
+func (h *Handler) KickPlayer(c echo.Context) error {
+	room, user := c.FormValue("room"), c.FormValue("user")
+	err := h.Chess.Kick(room, user)
+	logging.FromContext(c).Info("admin kicked player", "room", room, "user", user, "error", err)
+	return done(c, err, "player kicked")
+}
+
+// TerminateChat is a callback for closing a chat room
+func (h *Handler) TerminateChat(c echo.Context) error {
+	room := c.FormValue("room")
+	err := h.Chat.Terminate(room)
+	logging.FromContext(c).Info("admin terminated chat", "room", room, "error", err)
+	return done(c, err, "chat terminated")
+}
+
+// KickMember is a callback for disconnecting a member of a chat room
+func (h *Handler) KickMember(c echo.Context) error {
+	room, user := c.FormValue("room"), c.FormValue("user")
+	err := h.Chat.Kick(room, user)
+	logging.FromContext(c).Info("admin kicked member", "room", room, "user", user, "error", err)
+	return done(c, err, "member kicked")
+}
+
+// DismissReport is a callback for removing a reviewed chat report
+func (h *Handler) DismissReport(c echo.Context) error {
+	id := c.FormValue("report")
+	err := h.Chat.Dismiss(id)
+	logging.FromContext(c).Info("admin dismissed report", "report", id, "error", err)
+	return done(c, err, "report dismissed")
+}
+
+// TerminateBoard is a callback for closing an analysis board
+func (h *Handler) TerminateBoard(c echo.Context) error {
+	room := c.FormValue("room")
+	err := h.Analysis.Terminate(room)
+	logging.FromContext(c).Info("admin terminated board", "room", room, "error", err)
+	return done(c, err, "board terminated")
+}
+
+// CreateBot is a callback for adding a bot account, its token is shown on the page rather than
+// through a redirect so it doesn't end up in a URL
+func (h *Handler) CreateBot(c echo.Context) error {
+	name := c.FormValue("name")
+	_, token, err := h.Chess.Bots.Create(name)
+	logging.FromContext(c).Info("admin created bot", "bot", name, "error", err)
+	if err != nil {
+		return done(c, err, "")
+	}
+	return h.page(c, token)
+}
+
+// DeleteBot is a callback for removing a bot account, the games it plays go on without it
+func (h *Handler) DeleteBot(c echo.Context) error {
+	name := c.FormValue("name")
+	err := h.Chess.Bots.Delete(name)
+	logging.FromContext(c).Info("admin deleted bot", "bot", name, "error", err)
+	return done(c, err, "bot deleted")
+}
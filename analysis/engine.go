@@ -0,0 +1,251 @@
+package analysis
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long an engine is given to quit before it's killed
+const QUIT_TIMEOUT = time.Second
+
+var (
+	ErrNoEngine     = errors.New("no engine is configured")
+	ErrEnginesBusy  = errors.New("every engine is busy, try again later")
+	ErrEngineFailed = errors.New("the engine stopped")
+)
+
+// Eval is what the engine thinks of a position, scores are from the side of white
+//   - Node: the position of the tree that was searched
+//   - Score: centipawns, unless Mate gives the moves to mate, negative when black mates
+//   - PV: the line the engine expects in UCI notation, SAN is the start of it in standard
+//     algebraic notation
+type Eval struct {
+	Node  int      `json:"node"`
+	Depth int      `json:"depth"`
+	Score int      `json:"score"`
+	Mate  int      `json:"mate,omitempty"`
+	PV    []string `json:"pv"`
+	SAN   []string `json:"san"`
+}
+
+// search is a position given to the engine
+type search struct {
+	node  int
+	fen   string
+	black bool
+}
+
+// Engine is a UCI engine process searching the positions of a board one at a time, the commands
+// are written by a goroutine of its own so that callers never wait on the process
+//   - pending: the position to search once the current search stopped, a new position stops the
+//     current search first
+//   - stopping: whether the current search was told to stop
+//   - depth: deepest depth reported for the current search
+//   - wake: signaled when there is something to write, closed to quit
+type Engine struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	limit     int
+	lock      sync.Mutex
+	searching bool
+	stopping  bool
+	closed    bool
+	current   search
+	pending   *search
+	depth     int
+	wake      chan struct{}
+	done      chan struct{}
+}
+
+// StartEngine starts the engine at path, eval is called for every deeper evaluation of the current
+// search and exited once the process is gone, neither with a lock held, both are given the engine
+// they're about
+func StartEngine(path string, depth int, eval func(*Engine, Eval), exited func(*Engine, error)) (*Engine, error) {
+	cmd := exec.Command(path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	e := &Engine{
+		cmd:   cmd,
+		stdin: stdin,
+		limit: depth,
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	// engines take commands before they answer uciok
+	if err := e.write("uci", "isready"); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	go e.read(stdout, eval, exited)
+	go e.feed()
+	return e, nil
+}
+
+// write sends commands to the engine
+func (e *Engine) write(commands ...string) error {
+	_, err := io.WriteString(e.stdin, strings.Join(commands, "\n")+"\n")
+	return err
+}
+
+// Analyse has the engine search a position once the current search stopped, it returns at once
+func (e *Engine) Analyse(node int, fen string, black bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.closed {
+		return
+	}
+	e.pending = &search{node: node, fen: fen, black: black}
+	e.signal()
+}
+
+// signal wakes feed up, the caller holds the lock
+func (e *Engine) signal() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// feed writes the commands to the engine until it's closed, the current search is stopped before
+// the pending position is given, a failed write kills the process. The lock isn't held while
+// writing as an engine may be slow to read
+func (e *Engine) feed() {
+	for range e.wake {
+		var commands []string
+		e.lock.Lock()
+		switch {
+		case e.pending == nil:
+		case !e.searching:
+			e.current, e.searching, e.stopping, e.depth = *e.pending, true, false, 0
+			e.pending = nil
+			commands = []string{"position fen " + e.current.fen, "go depth " + strconv.Itoa(e.limit)}
+		case !e.stopping:
+			e.stopping = true
+			commands = []string{"stop"}
+		}
+		e.lock.Unlock()
+		if commands == nil {
+			continue
+		}
+		if err := e.write(commands...); err != nil {
+			e.cmd.Process.Kill()
+		}
+	}
+	e.write("stop", "quit")
+	e.stdin.Close()
+}
+
+// read reads the output of the engine until it exits
+func (e *Engine) read(stdout io.Reader, eval func(*Engine, Eval), exited func(*Engine, error)) {
+	defer close(e.done)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "info":
+			if result, ok := e.info(fields); ok {
+				eval(e, result)
+			}
+		case "bestmove":
+			e.lock.Lock()
+			e.searching = false
+			if e.pending != nil && !e.closed {
+				e.signal()
+			}
+			e.lock.Unlock()
+		}
+	}
+	err := e.cmd.Wait()
+	if err == nil {
+		err = ErrEngineFailed
+	}
+	exited(e, err)
+}
+
+// info reads an info line of the engine, only lines with a score and a line deeper than the ones
+// before are kept, bounds found on the way are not
+func (e *Engine) info(fields []string) (Eval, bool) {
+	result := Eval{Depth: -1, PV: []string{}}
+	scored := false
+	for i := 1; i < len(fields); i++ {
+		switch fields[i] {
+		case "depth":
+			if i+1 < len(fields) {
+				result.Depth, _ = strconv.Atoi(fields[i+1])
+			}
+		case "score":
+			if i+2 < len(fields) {
+				value, err := strconv.Atoi(fields[i+2])
+				if err != nil {
+					return result, false
+				}
+				if fields[i+1] == "mate" {
+					result.Mate = value
+				} else {
+					result.Score = value
+				}
+				scored = true
+			}
+		case "lowerbound", "upperbound":
+			return result, false
+		case "pv":
+			result.PV = append(result.PV, fields[i+1:]...)
+			i = len(fields)
+		}
+	}
+	if !scored || len(result.PV) == 0 || result.Depth < 0 {
+		return result, false
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.searching || e.pending != nil || result.Depth < e.depth {
+		return result, false
+	}
+	e.depth = result.Depth
+	result.Node = e.current.node
+	// engines score from the side to move
+	if e.current.black {
+		result.Score, result.Mate = -result.Score, -result.Mate
+	}
+	if result.Mate != 0 {
+		result.Score = 0
+	}
+	return result, true
+}
+
+// Close asks the engine to quit and kills it when it doesn't in time, it returns at once
+func (e *Engine) Close() {
+	e.lock.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.wake)
+	}
+	e.lock.Unlock()
+	go func() {
+		select {
+		case <-e.done:
+		case <-time.After(QUIT_TIMEOUT):
+			e.cmd.Process.Kill()
+		}
+	}()
+}
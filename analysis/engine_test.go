@@ -0,0 +1,153 @@
+package analysis
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FAKE_ENGINE is set in the environment of the test binary when it runs as an engine
+const FAKE_ENGINE = "ANALYSIS_FAKE_ENGINE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(FAKE_ENGINE) != "" {
+		fakeEngine()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakeEngine answers UCI on stdin, a search reports every depth up to the one asked for with a
+// score of ten centipawns a depth for the side to move, it searches until told to stop when
+// asked for depth 0
+func fakeEngine() {
+	stop := make(chan struct{}, 1)
+	out := make(chan string, 100)
+	go func() {
+		for line := range out {
+			fmt.Println(line)
+		}
+	}()
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "uci":
+			out <- "uciok"
+		case "isready":
+			out <- "readyok"
+		case "go":
+			depth, _ := strconv.Atoi(fields[len(fields)-1])
+			select {
+			case <-stop:
+			default:
+			}
+			go func() {
+				for d := 1; depth == 0 || d <= depth; d++ {
+					out <- fmt.Sprintf("info depth %d score cp %d pv e2e4", d, d*10)
+					select {
+					case <-stop:
+						out <- "bestmove e2e4"
+						return
+					case <-time.After(time.Millisecond):
+					}
+				}
+				out <- "bestmove e2e4"
+			}()
+		case "stop":
+			select {
+			case stop <- struct{}{}:
+			default:
+			}
+		case "quit":
+			return
+		}
+	}
+}
+
+// startFake starts the test binary as an engine searching to depth, evaluations and the exit are
+// sent on the channels returned
+func startFake(t *testing.T, depth int) (*Engine, <-chan Eval, <-chan error) {
+	t.Helper()
+	t.Setenv(FAKE_ENGINE, "1")
+	evals := make(chan Eval, 100)
+	exits := make(chan error, 1)
+	engine, err := StartEngine(os.Args[0], depth, func(_ *Engine, eval Eval) {
+		evals <- eval
+	}, func(_ *Engine, err error) {
+		exits <- err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine, evals, exits
+}
+
+// deepest waits for the evaluation of node at depth
+func deepest(t *testing.T, evals <-chan Eval, node, depth int) Eval {
+	t.Helper()
+	for {
+		select {
+		case eval := <-evals:
+			if eval.Node == node && eval.Depth == depth {
+				return eval
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("node %d wasn't searched to depth %d", node, depth)
+		}
+	}
+}
+
+func TestEngine(t *testing.T) {
+	engine, evals, exits := startFake(t, 3)
+	engine.Analyse(1, "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", false)
+	if eval := deepest(t, evals, 1, 3); eval.Score != 30 || strings.Join(eval.PV, " ") != "e2e4" {
+		t.Errorf("white to move: got %+v", eval)
+	}
+	// scores are turned to white's side
+	engine.Analyse(2, "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1", true)
+	if eval := deepest(t, evals, 2, 3); eval.Score != -30 {
+		t.Errorf("black to move: got %+v", eval)
+	}
+	engine.Close()
+	select {
+	case err := <-exits:
+		// killed when slow to exit, as the race detector is
+		if err == nil {
+			t.Error("exited without an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the engine didn't quit")
+	}
+	// closed engines take no more positions
+	engine.Analyse(3, "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", false)
+}
+
+func TestEngineStopsForNewPosition(t *testing.T) {
+	// an infinite search only ends when the engine is told to stop
+	engine, evals, _ := startFake(t, 0)
+	defer engine.Close()
+	engine.Analyse(1, "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", false)
+	deepest(t, evals, 1, 2)
+	engine.Analyse(2, "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1", true)
+	deepest(t, evals, 2, 2)
+	// nothing of the first search comes after the second one started
+	after := time.After(20 * time.Millisecond)
+	for {
+		select {
+		case eval := <-evals:
+			if eval.Node != 2 {
+				t.Fatalf("evaluation of node %d after the position changed", eval.Node)
+			}
+		case <-after:
+			return
+		}
+	}
+}
@@ -0,0 +1,623 @@
+package analysis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/auth"
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/hub"
+	"github.com/Qinbeans/chess-htmx/limits"
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/Qinbeans/chess-htmx/metrics"
+	"github.com/Qinbeans/chess-htmx/pieces"
+	"github.com/flosch/pongo2/v6"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// roles of the members, viewers follow the board of the owner without changing it
+const (
+	OWNER  = "owner"
+	VIEWER = "viewer"
+)
+
+// viewers a board takes besides its owner
+const MAX_VIEWERS = 32
+
+// the position new boards start from
+const START_FEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+
+// types of the messages sent to members
+const (
+	// the tree and the current position, sent on connect and after every change
+	STATE = "state"
+	// what the engine thinks of the current position
+	EVAL  = "eval"
+	ERROR = "error"
+	// the board was removed, Msg tells why
+	CLOSED = "closed"
+)
+
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrUserNotFound = errors.New("user is not in the room")
+	ErrReadOnly     = errors.New("viewers can't change the board")
+	ErrTooManyViews = errors.New("too many viewers")
+	ErrInvalidMsg   = errors.New("invalid message")
+)
+
+// Server hosts the analysis boards, every board has a hub room of the same id holding its owner
+// and viewers
+//   - Hub: its lock guards Boards and every board in it, helpers expect the caller to hold it
+//   - Analysis: the engine evaluating positions, evaluations are off without one
+//   - engines: engines running, at most Analysis.Engines
+type Server struct {
+	Hub      *hub.Hub
+	Boards   map[string]*Board
+	Analysis config.Analysis
+	Rooms    config.Rooms
+	Signer   *auth.Signer
+	Logger   *slog.Logger
+	engines  int
+}
+
+// Board is the analysis of a room
+//   - Engine: evaluates the current position while the owner asks for it, nil otherwise
+//   - Eval: the latest evaluation of the current position, sent to members connecting
+type Board struct {
+	Tree   *Tree
+	Engine *Engine
+	Eval   *Eval
+}
+
+// State is the board as members see it, from the side of white
+//   - Current: id of the position shown, Nodes has every position explored
+//   - Result: set when the side to move is checkmated
+//   - Engine: whether the engine evaluates the positions
+type State struct {
+	Current int                `json:"current"`
+	FEN     string             `json:"fen"`
+	Turn    string             `json:"turn"`
+	Result  string             `json:"result,omitempty"`
+	Board   []pieces.SerSquare `json:"board"`
+	Nodes   []*Node            `json:"nodes"`
+	Engine  bool               `json:"engine"`
+}
+
+// Message is what members receive, Type tells them apart
+type Message struct {
+	Type  string `json:"type"`
+	State *State `json:"state,omitempty"`
+	Eval  *Eval  `json:"eval,omitempty"`
+	Msg   string `json:"msg,omitempty"`
+}
+
+// incoming is what the owner sends, Type selects what is done
+//   - move: plays From, To and Promotion, or Move in UCI notation, from the current position
+//   - back, forward, start, end: walk the main line, goto: shows Node
+//   - fen: starts a new tree from FEN
+//   - engine: turns evaluations On or off
+type incoming struct {
+	Type      string `json:"type"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Promotion string `json:"promotion"`
+	Move      string `json:"move"`
+	Node      int    `json:"node"`
+	FEN       string `json:"fen"`
+	On        bool   `json:"on"`
+}
+
+// RoomStatus describes a board for the admin page
+type RoomStatus struct {
+	Room         string
+	Members      int
+	Positions    int
+	Engine       bool
+	LastActivity time.Time
+}
+
+// *****************************************************************************
+
+// NewServer returns a server without boards
+func NewServer(cfg *config.Config, signer *auth.Signer, logger *slog.Logger) *Server {
+	s := &Server{
+		Boards:   make(map[string]*Board),
+		Analysis: cfg.Analysis,
+		Rooms:    cfg.Rooms,
+		Signer:   signer,
+		Logger:   logger.With("server", "analysis"),
+	}
+	s.Hub = hub.New("analysis", cfg, s, s.Logger)
+	return s
+}
+
+// state describes a board for its members
+func (s *Server) state(room string) *State {
+	board := s.Boards[room]
+	state := &State{
+		Current: board.Tree.Current,
+		FEN:     board.Tree.Nodes[board.Tree.Current].FEN,
+		Nodes:   board.Tree.Nodes,
+		Engine:  board.Engine != nil,
+	}
+	if game, err := board.Tree.Game(board.Tree.Current); err == nil {
+		state.Turn = pieces.COLOR_NAMES[game.Turn]
+		state.Result = game.Result
+		state.Board = game.SquareArray(pieces.WHITE)
+	}
+	return state
+}
+
+// send encodes a message for a member of a room, an empty user sends it to every member
+func (s *Server) send(room, user string, msg Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		s.Logger.Error("failed to encode message", "type", msg.Type, "error", err)
+		return
+	}
+	if user == "" {
+		s.Hub.Room(room).Broadcast("", data)
+	} else {
+		s.Hub.Room(room).Send(user, data)
+	}
+}
+
+// SendError tells a member why their message was refused
+func (s *Server) SendError(user, room string, err error) {
+	s.send(room, user, Message{Type: ERROR, Msg: err.Error()})
+}
+
+// changed tells the members of a room the board changed and has the engine search the new position
+func (s *Server) changed(room string) {
+	board := s.Boards[room]
+	board.Eval = nil
+	s.send(room, "", Message{Type: STATE, State: s.state(room)})
+	if board.Engine == nil {
+		return
+	}
+	game, err := board.Tree.Game(board.Tree.Current)
+	if err != nil || game.Result != "" {
+		// nothing left to search
+		return
+	}
+	node := board.Tree.Nodes[board.Tree.Current]
+	board.Engine.Analyse(node.ID, node.FEN, game.Turn == pieces.BLACK)
+}
+
+// startEngine starts an engine for a board, unless every engine is already running
+func (s *Server) startEngine(room string) error {
+	board := s.Boards[room]
+	if board.Engine != nil {
+		return nil
+	}
+	if s.Analysis.Engine == "" {
+		return ErrNoEngine
+	}
+	if s.engines >= s.Analysis.Engines {
+		return ErrEnginesBusy
+	}
+	engine, err := StartEngine(s.Analysis.Engine, s.Analysis.Depth, func(engine *Engine, eval Eval) {
+		s.evaluated(room, engine, eval)
+	}, func(engine *Engine, err error) {
+		s.exited(room, engine, err)
+	})
+	if err != nil {
+		s.Logger.Error("failed to start engine", "room", room, "error", err)
+		return ErrEngineFailed
+	}
+	board.Engine = engine
+	s.engines++
+	s.Logger.Debug("engine started", "room", room, "running", s.engines)
+	return nil
+}
+
+// stopEngine stops the engine of a board
+func (s *Server) stopEngine(room string) {
+	board := s.Boards[room]
+	if board.Engine == nil {
+		return
+	}
+	board.Engine.Close()
+	board.Engine = nil
+	board.Eval = nil
+	s.engines--
+}
+
+// evaluated tells the members of a room what the engine thinks of the current position, late
+// evaluations of positions left behind are dropped
+func (s *Server) evaluated(room string, engine *Engine, eval Eval) {
+	s.Hub.Lock()
+	defer s.Hub.Unlock()
+	board := s.Boards[room]
+	if board == nil || board.Engine != engine || board.Tree.Current != eval.Node {
+		return
+	}
+	eval.SAN = Line(board.Tree.Nodes[eval.Node].FEN, eval.PV)
+	board.Eval = &eval
+	s.send(room, "", Message{Type: EVAL, Eval: &eval})
+}
+
+// exited forgets an engine that stopped on its own and tells the members of its room
+func (s *Server) exited(room string, engine *Engine, err error) {
+	s.Hub.Lock()
+	defer s.Hub.Unlock()
+	board := s.Boards[room]
+	if board == nil || board.Engine != engine {
+		// closed on purpose
+		return
+	}
+	s.Logger.Warn("engine stopped", "room", room, "error", err)
+	board.Engine = nil
+	board.Eval = nil
+	s.engines--
+	s.send(room, "", Message{Type: ERROR, Msg: ErrEngineFailed.Error()})
+	s.send(room, "", Message{Type: STATE, State: s.state(room)})
+}
+
+// remove stops the engine of a board, disconnects its members and forgets it
+func (s *Server) remove(room string) {
+	s.stopEngine(room)
+	delete(s.Boards, room)
+	s.Hub.Remove(room)
+}
+
+// terminate tells the members of a room why it closes and removes it
+func (s *Server) terminate(room, reason string) {
+	s.send(room, "", Message{Type: CLOSED, Msg: reason})
+	s.remove(room)
+}
+
+// sync sends a member the board and the latest evaluation
+func (s *Server) sync(room, user string) {
+	s.send(room, user, Message{Type: STATE, State: s.state(room)})
+	if eval := s.Boards[room].Eval; eval != nil {
+		s.send(room, user, Message{Type: EVAL, Eval: eval})
+	}
+}
+
+// Connected sends a member the board
+func (s *Server) Connected(room *hub.Room, member *hub.Member) {
+	s.sync(room.ID, member.ID)
+}
+
+// Message acts on a message of the owner, returning false when the member quits
+func (s *Server) Message(room *hub.Room, member *hub.Member, data []byte) bool {
+	var in incoming
+	if err := json.Unmarshal(data, &in); err != nil {
+		s.SendError(member.ID, room.ID, ErrInvalidMsg)
+		return true
+	}
+	if in.Type == "quit" {
+		return false
+	}
+	if member.Role != OWNER {
+		s.SendError(member.ID, room.ID, ErrReadOnly)
+		return true
+	}
+	if err := s.handle(room.ID, in); err != nil {
+		member.Logger.Debug("message refused", "type", in.Type, "error", err)
+		s.SendError(member.ID, room.ID, err)
+		// the board is drawn again over a refused move
+		s.sync(room.ID, member.ID)
+		return true
+	}
+	s.changed(room.ID)
+	return true
+}
+
+// handle changes a board as the owner asked
+func (s *Server) handle(room string, in incoming) error {
+	board := s.Boards[room]
+	switch in.Type {
+	case "move":
+		src, dst := in.From, in.To
+		promotion, err := pieces.ParsePromotion(in.Promotion)
+		if err != nil {
+			return err
+		}
+		if in.Move != "" {
+			game, err := board.Tree.Game(board.Tree.Current)
+			if err != nil {
+				return err
+			}
+			if src, dst, promotion, err = game.Squares(in.Move); err != nil {
+				return err
+			}
+		}
+		_, err = board.Tree.Play(src, dst, promotion)
+		return err
+	case "back":
+		board.Tree.Back()
+	case "forward":
+		board.Tree.Forward()
+	case "start":
+		board.Tree.Start()
+	case "end":
+		board.Tree.End()
+	case "goto":
+		return board.Tree.Goto(in.Node)
+	case "fen":
+		tree, err := NewTree(in.FEN)
+		if err != nil {
+			return err
+		}
+		board.Tree = tree
+	case "engine":
+		if !in.On {
+			s.stopEngine(room)
+			return nil
+		}
+		return s.startEngine(room)
+	default:
+		return ErrInvalidMsg
+	}
+	return nil
+}
+
+// Limited tells a member their message was dropped
+func (s *Server) Limited(room *hub.Room, member *hub.Member, err error) {
+	s.SendError(member.ID, room.ID, err)
+}
+
+// Disconnected removes a viewer once their connection is gone, the owner keeps the board until
+// it expires but the engine is stopped
+func (s *Server) Disconnected(room *hub.Room, member *hub.Member) {
+	if member.Role == OWNER {
+		if s.Boards[room.ID].Engine != nil {
+			s.stopEngine(room.ID)
+			s.send(room.ID, "", Message{Type: STATE, State: s.state(room.ID)})
+		}
+		return
+	}
+	room.Leave(member.ID)
+}
+
+// Status describes every board, ordered by room id
+func (s *Server) Status() []RoomStatus {
+	s.Hub.Lock()
+	defer s.Hub.Unlock()
+	rooms := []RoomStatus{}
+	for id, board := range s.Boards {
+		rooms = append(rooms, RoomStatus{
+			Room:         id,
+			Members:      s.Hub.Room(id).Len(),
+			Positions:    len(board.Tree.Nodes),
+			Engine:       board.Engine != nil,
+			LastActivity: s.Hub.Room(id).LastActivity,
+		})
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Room < rooms[j].Room
+	})
+	return rooms
+}
+
+// Terminate tells the members of a board it was closed and removes it
+func (s *Server) Terminate(room string) error {
+	s.Hub.Lock()
+	defer s.Hub.Unlock()
+	if s.Boards[room] == nil {
+		return ErrRoomNotFound
+	}
+	s.terminate(room, "terminated")
+	s.Logger.Info("room terminated", "room", room)
+	return nil
+}
+
+// Reaper removes idle and abandoned boards every reap interval until ctx is done
+func (s *Server) Reaper(ctx context.Context) {
+	ticker := time.NewTicker(s.Rooms.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.Reap(now)
+		}
+	}
+}
+
+// Reap removes the boards without activity for longer than their TTL, it returns how many boards
+// were removed
+func (s *Server) Reap(now time.Time) int {
+	s.Hub.Lock()
+	defer s.Hub.Unlock()
+	if s.Hub.Closing() {
+		return 0
+	}
+	reaped := 0
+	for id := range s.Boards {
+		room := s.Hub.Room(id)
+		idle := now.Sub(room.LastActivity)
+		ttl := s.Rooms.AbandonedTTL
+		if room.Online() {
+			ttl = s.Rooms.IdleTTL
+		}
+		if idle < ttl {
+			continue
+		}
+		s.Logger.Info("room expired", "room", id, "idle", idle)
+		s.terminate(id, "expired")
+		metrics.RoomsExpired.WithLabelValues("analysis").Inc()
+		reaped++
+	}
+	return reaped
+}
+
+// Shutdown stops accepting boards, tells every member the server is going away and waits for the
+// connections to finish until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.Hub.Shutdown(ctx, func() {
+		for room := range s.Boards {
+			s.terminate(room, "shutdown")
+		}
+	})
+}
+
+// *****************************************************************************
+
+// shuttingDown is the response to requests made while the server shuts down
+func shuttingDown(c echo.Context) error {
+	return c.JSON(http.StatusServiceUnavailable, map[string]string{
+		"error": "server is shutting down",
+		"type":  "analysis",
+	})
+}
+
+// issue signs a token for a member of a room, the browser gets it as a cookie and other clients
+// from the response
+func (s *Server) issue(c echo.Context, room, user string) (string, error) {
+	token, err := s.Signer.Issue(auth.ANALYSIS, room, user, "")
+	if err != nil {
+		return "", err
+	}
+	s.Signer.SetCookie(c, auth.ANALYSIS, room, token)
+	return token, nil
+}
+
+// authorize returns the member a request was made by, the token must belong to a member still in
+// the room
+func (s *Server) authorize(c echo.Context, room string) (*hub.Member, error) {
+	claims, err := s.Signer.FromRequest(c, auth.ANALYSIS, room)
+	if err != nil {
+		return nil, err
+	}
+	member := s.Hub.Room(room).Member(claims.User)
+	if member == nil {
+		return nil, ErrUserNotFound
+	}
+	return member, nil
+}
+
+// NewBoard is a callback for creating a board, from the position of the fen field when it's set,
+// whoever creates it owns it
+func (s *Server) NewBoard(c echo.Context) error {
+	fen := strings.TrimSpace(c.FormValue("fen"))
+	if fen == "" {
+		fen = START_FEN
+	}
+	tree, err := NewTree(fen)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+			"type":  "analysis",
+		})
+	}
+	s.Hub.Lock()
+	defer s.Hub.Unlock()
+	if s.Hub.Closing() {
+		return shuttingDown(c)
+	}
+	if s.Hub.Full() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": limits.ErrTooManyRooms.Error(),
+			"type":  "analysis",
+		})
+	}
+	room := uuid.New().String()
+	owner := uuid.New().String()
+	s.Boards[room] = &Board{Tree: tree}
+	s.Hub.Create(room).Join(owner, OWNER)
+	token, err := s.issue(c, room, owner)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"room":  room,
+		"id":    owner,
+		"token": token,
+		"type":  "analysis",
+	})
+}
+
+// Room is a callback for rendering a board, anyone opening the link of a board without a token
+// of it joins as a viewer
+func (s *Server) Room(c echo.Context) error {
+	logger := logging.FromContext(c)
+	room := c.QueryParam("room")
+	s.Hub.Lock()
+	defer s.Hub.Unlock()
+	if s.Boards[room] == nil || s.Hub.Closing() {
+		logger.Debug("room does not exist", "room", room)
+		return c.Redirect(http.StatusFound, "/")
+	}
+	member, err := s.authorize(c, room)
+	if err != nil {
+		if s.Hub.Room(room).Count(VIEWER) >= MAX_VIEWERS {
+			logger.Debug("room full", "room", room, "error", ErrTooManyViews)
+			return c.Redirect(http.StatusFound, "/")
+		}
+		member = s.Hub.Room(room).Join(uuid.New().String(), VIEWER)
+		if _, err := s.issue(c, room, member.ID); err != nil {
+			return err
+		}
+	}
+	ranks, files := pieces.Labels(pieces.WHITE)
+	scheme := "http"
+	if c.IsTLS() {
+		scheme = "https"
+	}
+	state := s.state(room)
+	return c.Render(http.StatusOK, "analysis.dj", pongo2.Context{
+		"title":       "Analysis board",
+		"description": "Explore chess positions",
+		"room":        room,
+		"client":      member.ID,
+		"role":        member.Role,
+		"link":        scheme + "://" + c.Request().Host + "/analysis?room=" + room,
+		"engine":      s.Analysis.Engine != "",
+		"ranks":       ranks,
+		"files":       files,
+		"board":       state.Board,
+		"fen":         state.FEN,
+	})
+}
+
+// WSHandler upgrades the connection of a member of a board
+func (s *Server) WSHandler(c echo.Context) error {
+	logger := logging.FromContext(c)
+	if c.Request().Header.Get("Connection") != "Upgrade" {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "invalid request",
+			"type":  "analysis",
+		})
+	}
+	room := c.QueryParam("room")
+	// the hub is only locked to check the member, the upgrade happens once it's unlocked
+	member, answered := func() (*hub.Member, error) {
+		s.Hub.Lock()
+		defer s.Hub.Unlock()
+		if s.Hub.Closing() {
+			return nil, shuttingDown(c)
+		}
+		if s.Boards[room] == nil {
+			logger.Debug("room does not exist", "room", room)
+			return nil, c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "room does not exist",
+				"type":  "analysis",
+			})
+		}
+		member, err := s.authorize(c, room)
+		if err != nil {
+			logger.Debug("unauthorized", "room", room, "error", err)
+			return nil, c.JSON(http.StatusUnauthorized, map[string]string{
+				"error": err.Error(),
+				"type":  "analysis",
+			})
+		}
+		return member, nil
+	}()
+	if member == nil {
+		return answered
+	}
+	return s.Hub.Connect(c, room, member.ID, logger)
+}
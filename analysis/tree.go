@@ -0,0 +1,179 @@
+package analysis
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Qinbeans/chess-htmx/pieces"
+)
+
+// positions a tree holds at most, a position set up from a FEN starts a new tree
+const MAX_NODES = 1000
+
+var (
+	ErrTreeFull     = fmt.Errorf("the board holds at most %d positions, set up a new one", MAX_NODES)
+	ErrNodeNotFound = errors.New("position not found")
+)
+
+// Node is a position of the tree, reached from its parent by a move
+//   - Parent: the id of the previous position, -1 on the root
+//   - Move, SAN: the move leading to the position in UCI and standard algebraic notation, empty on
+//     the root
+//   - Ply: half moves played since the start of the game, a move is white's when the ply is odd
+//   - Children: the moves played from the position, the first one is the main line and the others
+//     are variations
+type Node struct {
+	ID       int    `json:"id"`
+	Parent   int    `json:"parent"`
+	Move     string `json:"move,omitempty"`
+	SAN      string `json:"san,omitempty"`
+	Ply      int    `json:"ply"`
+	FEN      string `json:"fen"`
+	Children []int  `json:"children"`
+}
+
+// Tree is every position explored on a board, Nodes are indexed by their id
+type Tree struct {
+	Nodes   []*Node
+	Current int
+}
+
+// NewTree returns a tree starting from a position in Forsyth-Edwards Notation
+func NewTree(fen string) (*Tree, error) {
+	game, err := pieces.ParseFEN(fen)
+	if err != nil {
+		return nil, err
+	}
+	ply := (pieces.MoveNumber(fen) - 1) * 2
+	if game.Turn == pieces.BLACK {
+		ply++
+	}
+	root := &Node{ID: 0, Parent: -1, Ply: ply, FEN: position(game, ply), Children: []int{}}
+	return &Tree{Nodes: []*Node{root}}, nil
+}
+
+// position describes a game in Forsyth-Edwards Notation with the move number of ply, the game only
+// counts the moves it played itself
+func position(game *pieces.Game, ply int) string {
+	fields := strings.Fields(game.FEN())
+	fields[5] = strconv.Itoa(ply/2 + 1)
+	return strings.Join(fields, " ")
+}
+
+// Node returns a position of the tree
+func (t *Tree) Node(id int) (*Node, error) {
+	if id < 0 || id >= len(t.Nodes) {
+		return nil, ErrNodeNotFound
+	}
+	return t.Nodes[id], nil
+}
+
+// Game returns the game at a position of the tree
+func (t *Tree) Game(id int) (*pieces.Game, error) {
+	node, err := t.Node(id)
+	if err != nil {
+		return nil, err
+	}
+	return pieces.ParseFEN(node.FEN)
+}
+
+// Play plays a move from the current position, either color may move. A move that was already
+// played from there goes to its position, any other starts a variation. A pawn reaching the last
+// rank becomes the promotion piece, a queen when it's NONE
+func (t *Tree) Play(src, dst string, promotion int) (*Node, error) {
+	current := t.Nodes[t.Current]
+	game, err := t.Game(t.Current)
+	if err != nil {
+		return nil, err
+	}
+	before := *game
+	move, err := game.Move(game.Turn, src, dst, promotion)
+	if err != nil {
+		return nil, err
+	}
+	uci := move.UCI()
+	for _, id := range current.Children {
+		if t.Nodes[id].Move == uci {
+			t.Current = id
+			return t.Nodes[id], nil
+		}
+	}
+	if len(t.Nodes) >= MAX_NODES {
+		return nil, ErrTreeFull
+	}
+	san, err := before.SAN(uci)
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{
+		ID:       len(t.Nodes),
+		Parent:   current.ID,
+		Move:     uci,
+		SAN:      san,
+		Ply:      current.Ply + 1,
+		FEN:      position(game, current.Ply+1),
+		Children: []int{},
+	}
+	t.Nodes = append(t.Nodes, node)
+	current.Children = append(current.Children, node.ID)
+	t.Current = node.ID
+	return node, nil
+}
+
+// Goto makes a position the current one
+func (t *Tree) Goto(id int) error {
+	if _, err := t.Node(id); err != nil {
+		return err
+	}
+	t.Current = id
+	return nil
+}
+
+// Back goes to the previous position, the root stays where it is
+func (t *Tree) Back() {
+	if parent := t.Nodes[t.Current].Parent; parent >= 0 {
+		t.Current = parent
+	}
+}
+
+// Forward goes to the next position of the main line from the current one
+func (t *Tree) Forward() {
+	if children := t.Nodes[t.Current].Children; len(children) > 0 {
+		t.Current = children[0]
+	}
+}
+
+// Start goes to the root
+func (t *Tree) Start() {
+	t.Current = 0
+}
+
+// End follows the main line from the current position to its last move
+func (t *Tree) End() {
+	for len(t.Nodes[t.Current].Children) > 0 {
+		t.Current = t.Nodes[t.Current].Children[0]
+	}
+}
+
+// Line returns the moves in standard algebraic notation a game of UCI moves plays from a
+// position, it stops at the first move that isn't legal there
+func Line(fen string, moves []string) []string {
+	line := []string{}
+	game, err := pieces.ParseFEN(fen)
+	if err != nil {
+		return line
+	}
+	for _, uci := range moves {
+		san, err := game.SAN(uci)
+		if err != nil {
+			break
+		}
+		if _, err := game.Play(uci); err != nil {
+			break
+		}
+		line = append(line, san)
+	}
+	return line
+}
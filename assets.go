@@ -0,0 +1,29 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// views are the pongo2 templates
+//
+//go:embed public/views
+var views embed.FS
+
+// build is the output of `pnpm build`, it must exist before `go build`
+//
+//go:embed all:build
+var build embed.FS
+
+// embedded returns the views and built assets compiled into the binary
+func embedded() (fs.FS, fs.FS) {
+	viewsFS, err := fs.Sub(views, "public/views")
+	if err != nil {
+		panic(err)
+	}
+	buildFS, err := fs.Sub(build, "build")
+	if err != nil {
+		panic(err)
+	}
+	return viewsFS, buildFS
+}
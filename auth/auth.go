@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	CHESS    = "chess"
+	CHAT     = "chat"
+	ANALYSIS = "analysis"
+	// PROTOCOL is offered as the first websocket subprotocol by clients sending their token as the
+	// second one, e.g. new WebSocket(url, [PROTOCOL, token])
+	PROTOCOL = "chess-htmx.token"
+)
+
+var (
+	ErrMissingToken = errors.New("missing token")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+)
+
+// Claims is what a token vouches for, a user of a room of a kind, playing a color in chess
+type Claims struct {
+	Kind    string `json:"k"`
+	Room    string `json:"r"`
+	User    string `json:"u"`
+	Color   string `json:"c,omitempty"`
+	Expires int64  `json:"e"`
+}
+
+// Signer issues and verifies tokens, a token is the claims as JSON and their HMAC-SHA256, both
+// base64url encoded and joined by a dot
+type Signer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// New returns a signer using the configured secret, without one a random secret is used and
+// tokens don't survive a restart
+func New(cfg config.Auth) (*Signer, error) {
+	secret := []byte(cfg.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return &Signer{secret: secret, ttl: cfg.TTL}, nil
+}
+
+func (s *Signer) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a token for a user of a room, valid for the configured TTL
+func (s *Signer) Issue(kind, room, user, color string) (string, error) {
+	data, err := json.Marshal(Claims{
+		Kind:    kind,
+		Room:    room,
+		User:    user,
+		Color:   color,
+		Expires: time.Now().Add(s.ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.sign(payload), nil
+}
+
+// Verify checks the signature and expiry of a token and returns its claims
+func (s *Signer) Verify(token string) (Claims, error) {
+	var claims Claims
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(payload))) {
+		return claims, ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return claims, ErrInvalidToken
+	}
+	if time.Now().Unix() > claims.Expires {
+		return claims, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+// cookieName is the cookie holding the token of a room, one per room so several games can be
+// played from the same browser
+func cookieName(kind, room string) string {
+	return kind + "_" + room
+}
+
+// SetCookie stores a token for the browser to send with the page and websocket of its room, the
+// cookie is secure when the browser reached us over https, directly or through a proxy
+func (s *Signer) SetCookie(c echo.Context, kind, room, token string) {
+	c.SetCookie(&http.Cookie{
+		Name:     cookieName(kind, room),
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(s.ttl.Seconds()),
+		Secure:   c.Scheme() == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// FromRequest returns the verified claims of the token sent with a request for a room, either as
+// the websocket subprotocol following PROTOCOL, as a bearer token or in the cookie of the room
+func (s *Signer) FromRequest(c echo.Context, kind, room string) (Claims, error) {
+	// event streams and their requests can't offer subprotocols
+	token := bearer(c.Request())
+	protocols := websocketProtocols(c.Request())
+	for i, protocol := range protocols {
+		if token == "" && protocol == PROTOCOL && i+1 < len(protocols) {
+			token = protocols[i+1]
+			break
+		}
+	}
+	if token == "" {
+		if cookie, err := c.Cookie(cookieName(kind, room)); err == nil {
+			token = cookie.Value
+		}
+	}
+	return s.verifyFor(token, kind, room)
+}
+
+// FromBearer returns the verified claims of the bearer token of a request for a room, other ways
+// of sending a token are ignored so requests a browser makes on its own aren't authorized
+func (s *Signer) FromBearer(c echo.Context, kind, room string) (Claims, error) {
+	return s.verifyFor(bearer(c.Request()), kind, room)
+}
+
+// verifyFor verifies a token and checks it was issued for a room of a kind
+func (s *Signer) verifyFor(token, kind, room string) (Claims, error) {
+	if token == "" {
+		return Claims{}, ErrMissingToken
+	}
+	claims, err := s.Verify(token)
+	if err != nil {
+		return claims, err
+	}
+	if claims.Kind != kind || claims.Room != room {
+		return claims, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func bearer(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func websocketProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			protocols = append(protocols, strings.TrimSpace(protocol))
+		}
+	}
+	return protocols
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/labstack/echo/v4"
+)
+
+func newSigner(t *testing.T, secret string, ttl time.Duration) *Signer {
+	t.Helper()
+	s, err := New(config.Auth{Secret: secret, TTL: ttl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVerify(t *testing.T) {
+	signer := newSigner(t, "secret", time.Hour)
+	token, err := signer.Issue(CHESS, "room", "user", "white")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := newSigner(t, "secret", -time.Minute).Issue(CHESS, "room", "user", "white")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newSigner(t, "other", time.Hour).Issue(CHESS, "room", "user", "white")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(token, ".")
+	// a payload claiming the other color under the original signature
+	forged, err := newSigner(t, "secret", time.Hour).Issue(CHESS, "room", "user", "black")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", token, nil},
+		{"expired", expired, ErrExpiredToken},
+		{"other secret", other, ErrInvalidToken},
+		{"no signature", payload, ErrInvalidToken},
+		{"empty signature", payload + ".", ErrInvalidToken},
+		{"payload swapped", forgedPayload + "." + signature, ErrInvalidToken},
+		{"signature truncated", payload + "." + signature[:len(signature)-1], ErrInvalidToken},
+		{"empty", "", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := signer.Verify(tt.token)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && (claims.Kind != CHESS || claims.Room != "room" || claims.User != "user" || claims.Color != "white") {
+				t.Errorf("claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	signer := newSigner(t, "secret", time.Hour)
+	token, err := signer.Issue(CHESS, "room", "user", "white")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		kind   string
+		room   string
+		header http.Header
+		cookie bool
+		err    error
+	}{
+		{"bearer", CHESS, "room", http.Header{"Authorization": {"Bearer " + token}}, false, nil},
+		{"subprotocol", CHESS, "room", http.Header{"Sec-Websocket-Protocol": {PROTOCOL + ", " + token}}, false, nil},
+		{"cookie", CHESS, "room", nil, true, nil},
+		{"missing", CHESS, "room", nil, false, ErrMissingToken},
+		{"other room", CHESS, "elsewhere", http.Header{"Authorization": {"Bearer " + token}}, false, ErrInvalidToken},
+		{"other kind", CHAT, "room", http.Header{"Authorization": {"Bearer " + token}}, false, ErrInvalidToken},
+		// the cookie of another room isn't sent along
+		{"cookie of another room", CHESS, "elsewhere", nil, true, ErrMissingToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for key, values := range tt.header {
+				req.Header[key] = values
+			}
+			if tt.cookie {
+				req.AddCookie(&http.Cookie{Name: cookieName(CHESS, "room"), Value: token})
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			claims, err := signer.FromRequest(c, tt.kind, tt.room)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && claims.User != "user" {
+				t.Errorf("claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestFromBearer(t *testing.T) {
+	signer := newSigner(t, "secret", time.Hour)
+	token, err := signer.Issue(CHESS, "room", "user", "white")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		header http.Header
+		cookie bool
+		err    error
+	}{
+		{"bearer", http.Header{"Authorization": {"Bearer " + token}}, false, nil},
+		{"empty bearer", http.Header{"Authorization": {"Bearer "}}, true, ErrMissingToken},
+		{"other scheme", http.Header{"Authorization": {"Basic " + token}}, false, ErrMissingToken},
+		{"subprotocol", http.Header{"Sec-Websocket-Protocol": {PROTOCOL + ", " + token}}, false, ErrMissingToken},
+		// a browser sends the cookie on its own
+		{"cookie", nil, true, ErrMissingToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for key, values := range tt.header {
+				req.Header[key] = values
+			}
+			if tt.cookie {
+				req.AddCookie(&http.Cookie{Name: cookieName(CHESS, "room"), Value: token})
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			claims, err := signer.FromBearer(c, CHESS, "room")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && claims.User != "user" {
+				t.Errorf("claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestSetCookieSecure(t *testing.T) {
+	signer := newSigner(t, "secret", time.Hour)
+	tests := []struct {
+		name   string
+		header http.Header
+		secure bool
+	}{
+		{"plain", nil, false},
+		{"behind a TLS proxy", http.Header{"X-Forwarded-Proto": {"https"}}, true},
+		{"behind a plain proxy", http.Header{"X-Forwarded-Proto": {"http"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for key, values := range tt.header {
+				req.Header[key] = values
+			}
+			rec := httptest.NewRecorder()
+			signer.SetCookie(echo.New().NewContext(req, rec), CHESS, "room", "token")
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("got %d cookies", len(cookies))
+			}
+			if cookies[0].Secure != tt.secure {
+				t.Errorf("secure: got %v, want %v", cookies[0].Secure, tt.secure)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package backplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned when a shared value doesn't exist
+var ErrNotFound = errors.New("value not found")
+
+// Backplane connects the instances serving the same rooms, it carries the events of the rooms
+// between them and holds the state they share
+type Backplane interface {
+	// Publish sends a message to the subscribers of a channel on every instance
+	Publish(channel string, data []byte) error
+	// Subscribe calls handler with every message published on a channel until ctx is done,
+	// messages are handled one at a time in the order they were published, missed is called
+	// instead when some may have been lost, e.g. after the connection was lost
+	Subscribe(ctx context.Context, channel string, handler func([]byte), missed func()) error
+	// Get returns a shared value or ErrNotFound
+	Get(key string) ([]byte, error)
+	// Set creates or replaces a shared value, it expires after ttl unless ttl is 0
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete removes a shared value, deleting a missing value is not an error
+	Delete(key string) error
+	// Claim makes owner the owner of key for ttl unless someone else owns it, claiming a key
+	// again extends the ttl
+	Claim(key, owner string, ttl time.Duration) (bool, error)
+	// Release gives up a key, it's left alone when owner doesn't own it
+	Release(key, owner string) error
+	// Shared tells whether other instances may use the backplane too
+	Shared() bool
+	// Ping checks that the backplane can be reached
+	Ping() error
+	Close() error
+}
+
+// New returns the backplane selected by the configuration
+func New(cfg config.Backplane) (Backplane, error) {
+	switch cfg.Backend {
+	case config.LOCAL:
+		return NewLocal(), nil
+	case config.REDIS:
+		return NewRedis(cfg)
+	}
+	return nil, fmt.Errorf("unknown backplane backend %q", cfg.Backend)
+}
+
+// Instance returns the name of this instance, the configured one or the host name followed by
+// a random suffix so restarts don't take over what the previous process held
+func Instance(cfg config.Backplane) string {
+	if cfg.Instance != "" {
+		return cfg.Instance
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "instance"
+	}
+	return host + "-" + uuid.New().String()[:8]
+}
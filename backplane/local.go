@@ -0,0 +1,143 @@
+package backplane
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// messages waiting for a subscriber of the local backplane before publishers wait
+const LOCAL_QUEUE = 256
+
+// Local is a backplane within the process, for a single instance
+type Local struct {
+	values      map[string]entry
+	subscribers map[string][]*subscription
+	lock        sync.Mutex
+}
+
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+type subscription struct {
+	messages chan []byte
+	done     <-chan struct{}
+}
+
+func NewLocal() *Local {
+	return &Local{
+		values:      make(map[string]entry),
+		subscribers: make(map[string][]*subscription),
+	}
+}
+
+func (l *Local) Publish(channel string, data []byte) error {
+	l.lock.Lock()
+	subscribers := append([]*subscription(nil), l.subscribers[channel]...)
+	l.lock.Unlock()
+	// keep a copy so the caller can reuse its buffer
+	data = append([]byte(nil), data...)
+	for _, sub := range subscribers {
+		select {
+		case sub.messages <- data:
+		case <-sub.done:
+		}
+	}
+	return nil
+}
+
+// Subscribe never misses messages, publishers wait for a full queue
+func (l *Local) Subscribe(ctx context.Context, channel string, handler func([]byte), missed func()) error {
+	sub := &subscription{messages: make(chan []byte, LOCAL_QUEUE), done: ctx.Done()}
+	l.lock.Lock()
+	l.subscribers[channel] = append(l.subscribers[channel], sub)
+	l.lock.Unlock()
+	go func() {
+		defer func() {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			for i, s := range l.subscribers[channel] {
+				if s == sub {
+					l.subscribers[channel] = append(l.subscribers[channel][:i], l.subscribers[channel][i+1:]...)
+					break
+				}
+			}
+		}()
+		for {
+			select {
+			case data := <-sub.messages:
+				handler(data)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (l *Local) Get(key string) ([]byte, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e, ok := l.values[key]
+	if !ok || e.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+func (l *Local) Set(key string, value []byte, ttl time.Duration) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e := entry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	l.values[key] = e
+	return nil
+}
+
+func (l *Local) Delete(key string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.values, key)
+	return nil
+}
+
+func (l *Local) Claim(key, owner string, ttl time.Duration) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if e, ok := l.values[key]; ok && !e.expired(now) && string(e.value) != owner {
+		return false, nil
+	}
+	l.values[key] = entry{value: []byte(owner), expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (l *Local) Release(key, owner string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if e, ok := l.values[key]; ok && string(e.value) == owner {
+		delete(l.values, key)
+	}
+	return nil
+}
+
+// Shared is false, nothing leaves the process
+func (l *Local) Shared() bool {
+	return false
+}
+
+func (l *Local) Ping() error {
+	return nil
+}
+
+func (l *Local) Close() error {
+	return nil
+}
@@ -0,0 +1,329 @@
+package backplane
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+)
+
+const (
+	// how long connecting to the server may take
+	DIAL_TIMEOUT = 5 * time.Second
+	// how long a command may take to be answered
+	COMMAND_TIMEOUT = 5 * time.Second
+	// how long a lost subscription waits before connecting again
+	RESUBSCRIBE_DELAY = time.Second
+)
+
+// redisError is an error answered by the server, the connection is still usable after it
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Redis is a backplane on a Redis server, or anything speaking its protocol, shared by every
+// instance using the same server and database
+//   - conn: the connection commands are sent on, dialed again after it fails
+//   - lock: guards conn, one command is in flight at a time
+//   - resubscribeDelay: RESUBSCRIBE_DELAY, shorter in tests
+type Redis struct {
+	cfg              config.Backplane
+	conn             net.Conn
+	reader           *bufio.Reader
+	lock             sync.Mutex
+	resubscribeDelay time.Duration
+}
+
+// NewRedis connects to the server of the configuration
+func NewRedis(cfg config.Backplane) (*Redis, error) {
+	r := &Redis{cfg: cfg, resubscribeDelay: RESUBSCRIBE_DELAY}
+	if err := r.Ping(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// dial opens a connection, authenticated and on the configured database
+func (r *Redis) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", r.cfg.Address, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	var setup [][]string
+	if r.cfg.Password != "" {
+		setup = append(setup, []string{"AUTH", r.cfg.Password})
+	}
+	if r.cfg.Database != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.cfg.Database)})
+	}
+	for _, args := range setup {
+		conn.SetDeadline(time.Now().Add(COMMAND_TIMEOUT))
+		if err := writeCommand(conn, args); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if _, err := readReply(reader); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reader, nil
+}
+
+// do sends a command and returns its reply: a string, an int64, []byte, nil or []interface{}
+func (r *Redis) do(args ...string) (interface{}, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.conn == nil {
+		conn, reader, err := r.dial()
+		if err != nil {
+			return nil, err
+		}
+		r.conn, r.reader = conn, reader
+	}
+	r.conn.SetDeadline(time.Now().Add(COMMAND_TIMEOUT))
+	err := writeCommand(r.conn, args)
+	var reply interface{}
+	if err == nil {
+		reply, err = readReply(r.reader)
+	}
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// the connection is in an unknown state, the next command dials again
+		r.conn.Close()
+		r.conn = nil
+	}
+	return reply, err
+}
+
+// writeCommand writes a command as an array of bulk strings
+func writeCommand(w io.Writer, args []string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readReply reads one reply, errors answered by the server are returned as redisError
+func readReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = readReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// millis formats a ttl for the PX option, rounded up so short ttls don't become 0
+func millis(ttl time.Duration) string {
+	return strconv.FormatInt(int64((ttl+time.Millisecond-1)/time.Millisecond), 10)
+}
+
+func (r *Redis) Publish(channel string, data []byte) error {
+	_, err := r.do("PUBLISH", channel, string(data))
+	return err
+}
+
+// Subscribe listens on a connection of its own, when it's lost it connects again and calls
+// missed since messages published meanwhile are lost
+func (r *Redis) Subscribe(ctx context.Context, channel string, handler func([]byte), missed func()) error {
+	conn, reader, err := r.subscribe(channel)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			stop := context.AfterFunc(ctx, func() {
+				conn.Close()
+			})
+			r.listen(reader, handler)
+			stop()
+			conn.Close()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(r.resubscribeDelay):
+				}
+				if conn, reader, err = r.subscribe(channel); err == nil {
+					break
+				}
+			}
+			missed()
+		}
+	}()
+	return nil
+}
+
+// subscribe opens a connection subscribed to a channel
+func (r *Redis) subscribe(channel string) (net.Conn, *bufio.Reader, error) {
+	conn, reader, err := r.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(COMMAND_TIMEOUT))
+	if err := writeCommand(conn, []string{"SUBSCRIBE", channel}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if _, err := readReply(reader); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// messages may take any time to come
+	conn.SetDeadline(time.Time{})
+	return conn, reader, nil
+}
+
+// listen hands the messages of a subscription to handler until the connection fails
+func (r *Redis) listen(reader *bufio.Reader, handler func([]byte)) {
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 {
+			continue
+		}
+		if kind, _ := items[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		if data, ok := items[2].([]byte); ok {
+			handler(data)
+		}
+	}
+}
+
+func (r *Redis) Get(key string) ([]byte, error) {
+	reply, err := r.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply to GET: %v", reply)
+	}
+	return data, nil
+}
+
+func (r *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", millis(ttl))
+	}
+	_, err := r.do(args...)
+	return err
+}
+
+func (r *Redis) Delete(key string) error {
+	_, err := r.do("DEL", key)
+	return err
+}
+
+// CLAIM_SCRIPT sets the key to the owner unless someone else holds it, in one step so two
+// instances can't both take a key that just expired
+const CLAIM_SCRIPT = `
+local current = redis.call('GET', KEYS[1])
+if current and current ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`
+
+// RELEASE_SCRIPT deletes the key only if the owner still holds it, a key taken over once its
+// ttl ran out is left to the new owner
+const RELEASE_SCRIPT = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+// Claim sets the key when it doesn't exist or extends it when owner already holds it
+func (r *Redis) Claim(key, owner string, ttl time.Duration) (bool, error) {
+	reply, err := r.do("EVAL", CLAIM_SCRIPT, "1", key, owner, millis(ttl))
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+// Release deletes the key when owner holds it
+func (r *Redis) Release(key, owner string) error {
+	_, err := r.do("EVAL", RELEASE_SCRIPT, "1", key, owner)
+	return err
+}
+
+// Shared is true, every instance on the same server and database sees the same backplane
+func (r *Redis) Shared() bool {
+	return true
+}
+
+func (r *Redis) Ping() error {
+	_, err := r.do("PING")
+	return err
+}
+
+func (r *Redis) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
@@ -0,0 +1,158 @@
+package backplane
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newRedis(t *testing.T) (*Redis, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	r, err := NewRedis(config.Backplane{Address: server.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.resubscribeDelay = 10 * time.Millisecond
+	t.Cleanup(func() {
+		r.Close()
+	})
+	return r, server
+}
+
+func TestRedisValues(t *testing.T) {
+	r, server := newRedis(t)
+	if _, err := r.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing value: got %v, want %v", err, ErrNotFound)
+	}
+	if err := r.Set("key", []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Set("forever", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	data, err := r.Get("key")
+	if err != nil || string(data) != "value" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	server.FastForward(time.Minute)
+	if _, err := r.Get("key"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expired value: got %v, want %v", err, ErrNotFound)
+	}
+	if _, err := r.Get("forever"); err != nil {
+		t.Fatalf("value without ttl: %v", err)
+	}
+	if err := r.Delete("forever"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete("forever"); err != nil {
+		t.Fatalf("deleting a missing value: %v", err)
+	}
+	if _, err := r.Get("forever"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleted value: got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestRedisClaim(t *testing.T) {
+	r, server := newRedis(t)
+	steps := []struct {
+		name    string
+		do      func() (bool, error)
+		claimed bool
+		owner   string
+	}{
+		{"first owner", func() (bool, error) { return r.Claim("claim", "a", time.Second) }, true, "a"},
+		{"second owner", func() (bool, error) { return r.Claim("claim", "b", time.Second) }, false, "a"},
+		{"extended", func() (bool, error) { return r.Claim("claim", "a", time.Second) }, true, "a"},
+		{"released by the second owner", func() (bool, error) { return false, r.Release("claim", "b") }, false, "a"},
+		{"expired", func() (bool, error) {
+			server.FastForward(time.Second)
+			return r.Claim("claim", "b", time.Second)
+		}, true, "b"},
+		{"released by the first owner after expiring", func() (bool, error) { return false, r.Release("claim", "a") }, false, "b"},
+		{"taken back by the first owner", func() (bool, error) { return r.Claim("claim", "a", time.Second) }, false, "b"},
+		{"released", func() (bool, error) { return false, r.Release("claim", "b") }, false, ""},
+		{"released twice", func() (bool, error) { return false, r.Release("claim", "b") }, false, ""},
+		{"claimed after release", func() (bool, error) { return r.Claim("claim", "a", time.Second) }, true, "a"},
+	}
+	for _, step := range steps {
+		claimed, err := step.do()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if claimed != step.claimed {
+			t.Errorf("%s: claimed %v, want %v", step.name, claimed, step.claimed)
+		}
+		owner, _ := server.Get("claim")
+		if owner != step.owner {
+			t.Errorf("%s: owner %q, want %q", step.name, owner, step.owner)
+		}
+	}
+	if ttl := server.TTL("claim"); ttl <= 0 || ttl > time.Second {
+		t.Errorf("claim ttl %v", ttl)
+	}
+}
+
+func TestRedisSubscribe(t *testing.T) {
+	r, server := newRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := make(chan string, 10)
+	missed := make(chan struct{}, 10)
+	err := r.Subscribe(ctx, "events", func(data []byte) {
+		messages <- string(data)
+	}, func() {
+		missed <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case got := <-messages:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q wasn't received", want)
+		}
+	}
+	for _, message := range []string{"first", "second"} {
+		if err := r.Publish("events", []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive("first")
+	receive("second")
+
+	// the subscription is lost and the subscriber is told once it's back
+	server.Close()
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-missed:
+	case <-time.After(time.Second):
+		t.Fatal("missed wasn't called after the connection was lost")
+	}
+	// the connection of the commands was lost too, the first command fails and the next dials again
+	r.Publish("events", []byte("lost"))
+	if err := r.Publish("events", []byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	receive("third")
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	r.Publish("events", []byte("after cancel"))
+	select {
+	case got := <-messages:
+		t.Fatalf("received %q after ctx was done", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
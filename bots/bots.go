@@ -0,0 +1,161 @@
+package bots
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/storage"
+	"github.com/labstack/echo/v4"
+)
+
+// KIND is the kind of the records holding bot accounts
+const KIND = "bots"
+
+var (
+	ErrInvalidName  = errors.New("bot names are 2 to 30 letters, digits, dashes or underscores")
+	ErrNameTaken    = errors.New("a bot with this name already exists")
+	ErrBotNotFound  = errors.New("bot not found")
+	ErrMissingToken = errors.New("missing bot token")
+	ErrInvalidToken = errors.New("invalid bot token")
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]{2,30}$`)
+
+// Bot is an account playing through the bot API
+//   - TokenHash: SHA-256 of the secret part of the token, the token itself is only shown once
+type Bot struct {
+	Name      string    `json:"name"`
+	TokenHash string    `json:"token_hash"`
+	Created   time.Time `json:"created"`
+}
+
+// Registry keeps the bot accounts in storage
+type Registry struct {
+	Store storage.Store
+}
+
+func New(store storage.Store) *Registry {
+	return &Registry{
+		Store: store,
+	}
+}
+
+// hash returns the hash a secret is stored as
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create adds a bot account and returns it with its token, a token is the name of the bot and a
+// secret joined by a dot
+func (r *Registry) Create(name string) (Bot, string, error) {
+	if !validName.MatchString(name) {
+		return Bot{}, "", ErrInvalidName
+	}
+	if _, err := r.Get(name); err == nil {
+		return Bot{}, "", ErrNameTaken
+	} else if !errors.Is(err, ErrBotNotFound) {
+		return Bot{}, "", err
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return Bot{}, "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	bot := Bot{
+		Name:      name,
+		TokenHash: hash(secret),
+		Created:   time.Now().UTC(),
+	}
+	data, err := json.Marshal(bot)
+	if err != nil {
+		return Bot{}, "", err
+	}
+	if err := r.Store.Save(KIND, name, data); err != nil {
+		return Bot{}, "", err
+	}
+	return bot, name + "." + secret, nil
+}
+
+// Get returns a bot account or ErrBotNotFound
+func (r *Registry) Get(name string) (Bot, error) {
+	if !validName.MatchString(name) {
+		return Bot{}, ErrBotNotFound
+	}
+	data, err := r.Store.Load(KIND, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Bot{}, ErrBotNotFound
+	}
+	if err != nil {
+		return Bot{}, err
+	}
+	var bot Bot
+	if err := json.Unmarshal(data, &bot); err != nil {
+		return Bot{}, err
+	}
+	return bot, nil
+}
+
+// List returns every bot account by name
+func (r *Registry) List() ([]Bot, error) {
+	names, err := r.Store.List(KIND)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	bots := []Bot{}
+	for _, name := range names {
+		bot, err := r.Get(name)
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+		bots = append(bots, bot)
+	}
+	return bots, nil
+}
+
+// Delete removes a bot account, its token stops working at once
+func (r *Registry) Delete(name string) error {
+	if _, err := r.Get(name); err != nil {
+		return err
+	}
+	return r.Store.Delete(KIND, name)
+}
+
+// Verify returns the bot account a token belongs to
+func (r *Registry) Verify(token string) (Bot, error) {
+	name, secret, ok := strings.Cut(token, ".")
+	if !ok || secret == "" {
+		return Bot{}, ErrInvalidToken
+	}
+	bot, err := r.Get(name)
+	if errors.Is(err, ErrBotNotFound) {
+		return Bot{}, ErrInvalidToken
+	}
+	if err != nil {
+		return Bot{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hash(secret)), []byte(bot.TokenHash)) != 1 {
+		return Bot{}, ErrInvalidToken
+	}
+	return bot, nil
+}
+
+// FromRequest returns the bot account of the bearer token of a request
+func (r *Registry) FromRequest(c echo.Context) (Bot, error) {
+	token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if !ok || token == "" {
+		return Bot{}, ErrMissingToken
+	}
+	return r.Verify(token)
+}
@@ -0,0 +1,127 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often the certificate and key files are checked for changes
+const RELOAD_INTERVAL = 10 * time.Second
+
+// Reloader serves a certificate loaded from disk and loads it again when the files change, e.g.
+// after a renewal, without restarting the server
+type Reloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+	logger   *slog.Logger
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+// New loads the certificate and key, failing if they can't be used
+func New(certFile, keyFile string, logger *slog.Logger) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: RELOAD_INTERVAL,
+		logger:   logger.With("component", "certs"),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the certificate and key pair
+func (r *Reloader) load() error {
+	modified := r.lastModified()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.cert = &cert
+	r.modified = modified
+	r.lock.Unlock()
+	return nil
+}
+
+// lastModified returns the latest modification time of the files
+func (r *Reloader) lastModified() time.Time {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// Watch loads the certificate again whenever the files change until ctx is done
+func (r *Reloader) Watch(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.lock.RLock()
+			modified := r.modified
+			r.lock.RUnlock()
+			if !r.lastModified().After(modified) {
+				continue
+			}
+			if err := r.load(); err != nil {
+				// the files may be written one after the other, keep serving the previous pair
+				r.logger.Error("certificate reload failed", "error", err)
+				continue
+			}
+			r.logger.Info("certificate reloaded", "cert", r.certFile)
+		}
+	}
+}
+
+// GetCertificate returns the current certificate for every handshake
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// Config returns the TLS configuration of the server, offering HTTP/2
+func (r *Reloader) Config() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// Redirect returns a plain HTTP server sending every request to the same URL over HTTPS on the
+// port of the TLS address
+func Redirect(address, tlsAddress string) *http.Server {
+	_, port, _ := net.SplitHostPort(tlsAddress)
+	return &http.Server{
+		Addr:              address,
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			host := req.Host
+			if h, _, err := net.SplitHostPort(req.Host); err == nil {
+				host = h
+			}
+			if port != "443" && port != "" {
+				host = net.JoinHostPort(host, port)
+			}
+			http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+		}),
+	}
+}
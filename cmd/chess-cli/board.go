@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/pieces"
+)
+
+// GLYPHS are the pieces as drawn on colored squares, both sides use the solid glyphs and are
+// told apart by their color
+var GLYPHS = map[int]string{
+	pieces.PAWN:   "♟",
+	pieces.ROOK:   "♜",
+	pieces.KNIGHT: "♞",
+	pieces.BISHOP: "♝",
+	pieces.QUEEN:  "♛",
+	pieces.KING:   "♚",
+}
+
+// PLAIN_GLYPHS are the pieces as drawn without colors, white has the hollow glyphs
+var PLAIN_GLYPHS = map[int]string{
+	pieces.PAWN:   "♙",
+	pieces.ROOK:   "♖",
+	pieces.KNIGHT: "♘",
+	pieces.BISHOP: "♗",
+	pieces.QUEEN:  "♕",
+	pieces.KING:   "♔",
+}
+
+// ANSI escapes of the squares and pieces
+const (
+	LIGHT_SQUARE = "\x1b[48;5;180m"
+	DARK_SQUARE  = "\x1b[48;5;137m"
+	WHITE_PIECE  = "\x1b[1;97m"
+	BLACK_PIECE  = "\x1b[1;30m"
+	RESET        = "\x1b[0m"
+)
+
+// render draws the board from the side of the player, with the clocks, the last moves and whose
+// turn it is
+func (c *Client) render() {
+	if c.game == nil {
+		return
+	}
+	var out strings.Builder
+	ranks, files := pieces.Labels(c.color)
+	out.WriteString("\n")
+	for _, rank := range ranks {
+		out.WriteString(" " + rank + " ")
+		for _, file := range files {
+			out.WriteString(c.square(file[0]-'a', rank[0]-'1'))
+		}
+		out.WriteString("\n")
+	}
+	out.WriteString("   ")
+	for _, file := range files {
+		out.WriteString(" " + file + " ")
+	}
+	out.WriteString("\n")
+	if c.clocks != nil {
+		fmt.Fprintf(&out, "white %s  black %s\n", c.clock(pieces.WHITE), c.clock(pieces.BLACK))
+	}
+	if len(c.history) > 0 {
+		out.WriteString(c.movelist(6) + "\n")
+	}
+	if c.game.Result != "" {
+		fmt.Fprintf(&out, "game over %s (%s)\n", c.game.Result, c.game.Reason)
+	} else if !c.spectator && c.game.Turn == c.color {
+		out.WriteString("your move\n")
+	} else {
+		fmt.Fprintf(&out, "%s to move\n", pieces.COLOR_NAMES[c.game.Turn])
+	}
+	fmt.Fprint(c.out, out.String())
+}
+
+// square draws a square of the board, file and rank count from 0
+func (c *Client) square(file, rank byte) string {
+	square := c.game.Board[rank][file]
+	piece := square.Piece &^ pieces.BLACK
+	black := square.Piece&pieces.BLACK == pieces.BLACK
+	if c.plain {
+		switch {
+		case square.Piece == pieces.NONE:
+			return " · "
+		case black:
+			return " " + GLYPHS[piece] + " "
+		}
+		return " " + PLAIN_GLYPHS[piece] + " "
+	}
+	background := LIGHT_SQUARE
+	if square.Color == "dark" {
+		background = DARK_SQUARE
+	}
+	glyph := " "
+	if square.Piece != pieces.NONE {
+		glyph = WHITE_PIECE + GLYPHS[piece]
+		if black {
+			glyph = BLACK_PIECE + GLYPHS[piece]
+		}
+	}
+	return background + " " + glyph + " " + RESET
+}
+
+// clock formats the time left for a color, the clock of the color to move keeps running
+func (c *Client) clock(color int) string {
+	left := time.Duration(c.clocks[color]) * time.Millisecond
+	if c.game.Result == "" && c.game.Turn == color && len(c.history) > 0 {
+		left -= time.Since(c.clockAt)
+	}
+	if left < 0 {
+		left = 0
+	}
+	return fmt.Sprintf("%d:%02d", int(left.Minutes()), int(left.Seconds())%60)
+}
+
+// movelist numbers the last moves played, at most count plies
+func (c *Client) movelist(count int) string {
+	start := len(c.history) - count
+	if start < 0 {
+		start = 0
+	}
+	// whole moves read better, start on a white one
+	start -= start % 2
+	var out strings.Builder
+	for i := start; i < len(c.history); i++ {
+		if i%2 == 0 {
+			fmt.Fprintf(&out, "%d. ", i/2+1)
+		}
+		out.WriteString(c.history[i] + " ")
+	}
+	return strings.TrimSpace(out.String())
+}
@@ -0,0 +1,462 @@
+// Command chess-cli plays chess-htmx from a terminal over the same websocket protocol as the
+// browser, it's also handy to watch the messages of a game while working on the protocol
+//
+//	go run ./cmd/chess-cli -server http://localhost:8090
+//	go run ./cmd/chess-cli -server http://localhost:8090 -room <room> [-spectate]
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/auth"
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/pieces"
+	"github.com/gorilla/websocket"
+)
+
+const HELP = `moves are typed in SAN (Nf3, exd5, O-O) or UCI (g1f3, e1g1), commands start with a slash:
+  /say <text>   chat with the players, or the spectators when watching
+  /resign       resign the game
+  /draw         offer a draw, /accept or /decline the one offered
+  /reset        ask for a new game, /reset-ok agrees to the opponent's request
+  /moves        list the legal moves
+  /history      list the moves played
+  /board        draw the board again
+  /debug        print every message received, again to stop
+  /quit         leave the game`
+
+// the page sets the CSRF token as a header of every htmx request
+var csrfPattern = regexp.MustCompile(`"X-CSRF-Token": "([^"]+)"`)
+
+// Client is a player or spectator of a game connected to the server
+//   - game: copy of the game kept from the messages of the server, used to read moves and draw
+//     the board, the server stays the judge of every move
+//   - history: the moves played so far in SAN
+//   - clocks: milliseconds left for each color when clockAt was received, only in timed games
+//   - debug: messages are printed as they're sent and received
+type Client struct {
+	server    *url.URL
+	http      *http.Client
+	conn      *websocket.Conn
+	room      string
+	id        string
+	token     string
+	spectator bool
+	color     int
+	opponent  string
+	game      *pieces.Game
+	history   []string
+	clocks    map[int]int64
+	clockAt   time.Time
+	plain     bool
+	debug     atomic.Bool
+	out       io.Writer
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:8090", "address of the server")
+	room := flag.String("room", "", "room to join, a new game is created when empty")
+	spectate := flag.Bool("spectate", false, "watch the game instead of playing it")
+	plain := flag.Bool("plain", false, "draw the board without colors")
+	flag.Parse()
+	base, err := url.Parse(*server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid server address:", err)
+		os.Exit(2)
+	}
+	jar, _ := cookiejar.New(nil)
+	c := &Client{
+		server:    base,
+		http:      &http.Client{Jar: jar, Timeout: 10 * time.Second},
+		spectator: *spectate,
+		plain:     *plain,
+		out:       os.Stdout,
+	}
+	if err := c.join(*room); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to join:", err)
+		os.Exit(1)
+	}
+	if err := c.dial(); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to connect:", err)
+		os.Exit(1)
+	}
+	defer c.conn.Close()
+	fmt.Fprintf(c.out, "room %s, you are %s\n", c.room, c.id)
+	if *room == "" {
+		fmt.Fprintf(c.out, "the opponent joins with: chess-cli -server %s -room %s\n", base, c.room)
+	}
+	fmt.Fprintln(c.out, "type /help for the commands")
+	if err := c.run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// *****************************************************************************
+
+// join creates a game, or joins room as the second player or a spectator, the way the menu does
+func (c *Client) join(room string) error {
+	res, err := c.http.Get(c.server.JoinPath("/").String())
+	if err != nil {
+		return err
+	}
+	page, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	match := csrfPattern.FindSubmatch(page)
+	if match == nil {
+		return errors.New("no CSRF token on the menu page")
+	}
+	path, form := "/chess/new", url.Values{}
+	if room != "" {
+		path = "/chess/join"
+		form.Set("room", room)
+		if c.spectator {
+			form.Set("spectate", "1")
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, c.server.JoinPath(path).String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-CSRF-Token", string(match[1]))
+	res, err = c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var joined map[string]string
+	if err := json.NewDecoder(res.Body).Decode(&joined); err != nil {
+		return fmt.Errorf("unexpected response %s", res.Status)
+	}
+	// joining answers failures with a message
+	if msg := joined["error"] + joined["message"]; msg != "" {
+		return errors.New(msg)
+	}
+	c.room, c.id, c.token = joined["room"], joined["id"], joined["token"]
+	return nil
+}
+
+// dial connects to the websocket of the room, the token is offered as a subprotocol as the
+// browser does
+func (c *Client) dial() error {
+	ws := *c.server
+	ws.Scheme = "ws"
+	if c.server.Scheme == "https" {
+		ws.Scheme = "wss"
+	}
+	ws.Path = "/chess/ws"
+	ws.RawQuery = url.Values{"room": {c.room}}.Encode()
+	header := http.Header{}
+	header.Set("Origin", c.server.Scheme+"://"+c.server.Host)
+	dialer := websocket.Dialer{
+		Subprotocols:     []string{auth.PROTOCOL, c.token},
+		HandshakeTimeout: 10 * time.Second,
+	}
+	conn, res, err := dialer.Dial(ws.String(), header)
+	if err != nil {
+		if res != nil {
+			body, _ := io.ReadAll(res.Body)
+			return fmt.Errorf("%w: %s %s", err, res.Status, strings.TrimSpace(string(body)))
+		}
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+// run handles the messages of the server and the lines typed until either side quits
+func (c *Client) run() error {
+	messages := make(chan pieces.Message)
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			_, data, err := c.conn.ReadMessage()
+			if err != nil {
+				closed <- err
+				return
+			}
+			if c.debug.Load() {
+				fmt.Fprintf(c.out, "<- %s\n", data)
+			}
+			var msg pieces.Message
+			if err := json.Unmarshal(data, &msg); err == nil {
+				messages <- msg
+			}
+		}
+	}()
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	for {
+		select {
+		case msg := <-messages:
+			if !c.handle(msg) {
+				return nil
+			}
+		case line, ok := <-lines:
+			if !ok || !c.input(strings.TrimSpace(line)) {
+				c.send(map[string]interface{}{"type": "cmd", "msg": "quit"})
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return nil
+			}
+		case err := <-closed:
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Text != "" {
+				return fmt.Errorf("connection closed: %s", closeErr.Text)
+			}
+			return fmt.Errorf("connection closed: %w", err)
+		}
+	}
+}
+
+// send writes a message of the protocol
+func (c *Client) send(message map[string]interface{}) {
+	data, _ := json.Marshal(message)
+	if c.debug.Load() {
+		fmt.Fprintf(c.out, "-> %s\n", data)
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		fmt.Fprintln(c.out, "failed to send:", err)
+	}
+}
+
+// input acts on a line typed by the player, returning false when they quit
+func (c *Client) input(line string) bool {
+	if line == "" {
+		return true
+	}
+	if !strings.HasPrefix(line, "/") {
+		c.move(line)
+		return true
+	}
+	command, arg, _ := strings.Cut(line[1:], " ")
+	switch command {
+	case "help":
+		fmt.Fprintln(c.out, HELP)
+	case "say":
+		c.send(map[string]interface{}{"type": "chat", "msg": arg})
+	case "resign":
+		c.send(map[string]interface{}{"type": "cmd", "msg": command})
+	case "draw", "accept", "decline":
+		action := map[string]string{"draw": "offer", "accept": "accept", "decline": "decline"}
+		c.send(map[string]interface{}{"type": "cmd", "msg": "draw-" + action[command]})
+	case "reset":
+		c.send(map[string]interface{}{"type": "cmd", "msg": "reset-req"})
+	case "reset-ok":
+		c.send(map[string]interface{}{"type": "cmd", "msg": "reset-ack"})
+	case "moves":
+		moves := []string{}
+		for _, move := range c.game.LegalMoves() {
+			san, _ := c.game.SAN(move)
+			moves = append(moves, san)
+		}
+		fmt.Fprintln(c.out, strings.Join(moves, " "))
+	case "history":
+		fmt.Fprintln(c.out, c.movelist(len(c.history)))
+	case "board":
+		c.render()
+	case "debug":
+		c.debug.Store(!c.debug.Load())
+	case "quit":
+		return false
+	default:
+		fmt.Fprintf(c.out, "unknown command /%s, type /help for the commands\n", command)
+	}
+	return true
+}
+
+// move sends a move typed in SAN or UCI, castling is sent as the king dragged onto its rook
+func (c *Client) move(text string) {
+	if c.spectator {
+		fmt.Fprintln(c.out, "spectators can't move")
+		return
+	}
+	if c.game == nil {
+		fmt.Fprintln(c.out, "waiting for the board")
+		return
+	}
+	if c.game.Turn != c.color {
+		fmt.Fprintln(c.out, "it's not your turn")
+		return
+	}
+	uci, err := c.game.ParseMove(text)
+	if err != nil {
+		fmt.Fprintln(c.out, err)
+		return
+	}
+	src, dst, _, err := c.game.Squares(uci)
+	if err != nil {
+		fmt.Fprintln(c.out, err)
+		return
+	}
+	c.send(map[string]interface{}{"type": "move", "from": src, "to": dst, "promotion": uci[4:]})
+}
+
+// handle acts on a message of the server, returning false once the game is closed
+func (c *Client) handle(msg pieces.Message) bool {
+	content := msg.Content
+	c.readClocks(content)
+	switch content["type"] {
+	case "board":
+		c.color = pieces.WHITE
+		if content["orientation"] == pieces.COLOR_NAMES[pieces.BLACK] {
+			c.color = pieces.BLACK
+		}
+		c.replay(strings.Fields(content["moves"]))
+		c.render()
+	case "move":
+		c.played(content["src"] + content["dst"] + content["promotion"])
+	case "castle":
+		c.played(content["k_src"] + content["k_dst"])
+	case "checkmate":
+		fmt.Fprintf(c.out, "checkmate, %s wins\n", content["color"])
+	case "timeout":
+		fmt.Fprintf(c.out, "%s wins on time\n", content["color"])
+	case "resigned":
+		fmt.Fprintf(c.out, "%s resigned, %s wins\n", c.other(content["color"]), content["color"])
+	case "abandoned":
+		fmt.Fprintf(c.out, "%s left the game, %s wins\n", c.other(content["color"]), content["color"])
+	case "draw":
+		switch content["msg"] {
+		case "offer":
+			fmt.Fprintf(c.out, "%s offers a draw, /accept or /decline\n", content["color"])
+		case "agreement":
+			fmt.Fprintln(c.out, "draw agreed")
+		case "stalemate":
+			fmt.Fprintln(c.out, "stalemate, the game is drawn")
+		case "fifty-move rule":
+			fmt.Fprintln(c.out, "fifty moves without a capture or a pawn move, the game is drawn")
+		case "decline":
+			fmt.Fprintf(c.out, "%s declined the draw\n", content["color"])
+		}
+	case "chat":
+		who := content["color"]
+		if content["channel"] == pieces.SPECTATORS {
+			who = "spectator"
+		}
+		if msg.Author == c.id {
+			who = "you"
+		}
+		fmt.Fprintf(c.out, "[%s] %s\n", who, content["msg"])
+	case "error":
+		fmt.Fprintln(c.out, "error:", content["msg"])
+	case "cmd":
+		return c.command(msg)
+	}
+	return true
+}
+
+// command acts on a command of the server, returning false once the game is closed
+func (c *Client) command(msg pieces.Message) bool {
+	player := msg.Content["channel"] != pieces.SPECTATORS
+	switch msg.Content["msg"] {
+	case "connected":
+		if player {
+			c.opponent = msg.Author
+			fmt.Fprintf(c.out, "%s connected\n", msg.Author)
+		}
+		// tells the newcomer who is already here
+		c.send(map[string]interface{}{"type": "cmd", "msg": "acknowledge"})
+	case "acknowledge":
+		if player && c.opponent != msg.Author {
+			c.opponent = msg.Author
+			fmt.Fprintf(c.out, "%s is here\n", msg.Author)
+		}
+	case "disconnected":
+		if msg.Author == c.opponent {
+			fmt.Fprintf(c.out, "%s disconnected\n", msg.Author)
+		}
+	case "reset-req":
+		fmt.Fprintln(c.out, "the opponent asks for a new game, /reset-ok to agree")
+	case "reset-ack":
+		c.replay(nil)
+		fmt.Fprintln(c.out, "new game")
+		c.render()
+	case "kicked", "terminated", "expired", "declined", "shutdown":
+		reasons := map[string]string{
+			"kicked":     "you were removed from the game",
+			"terminated": "the game was closed",
+			"expired":    "the game was closed after being inactive",
+			"declined":   "the bot declined the challenge",
+			"shutdown":   "the server is shutting down",
+		}
+		fmt.Fprintln(c.out, reasons[msg.Content["msg"]])
+		return false
+	}
+	return true
+}
+
+// replay rebuilds the copy of the game from the moves played so far
+func (c *Client) replay(moves []string) {
+	c.game = pieces.NewGame("", config.TimeControl{})
+	c.history = nil
+	for _, move := range moves {
+		san, err := c.game.SAN(move)
+		if err != nil {
+			fmt.Fprintf(c.out, "can't follow move %s: %v\n", move, err)
+			return
+		}
+		c.game.Play(move)
+		c.history = append(c.history, san)
+	}
+}
+
+// played applies a move of either player to the copy of the game and draws the board
+func (c *Client) played(uci string) {
+	if c.game == nil {
+		return
+	}
+	san, err := c.game.SAN(uci)
+	if err == nil {
+		_, err = c.game.Play(uci)
+	}
+	if err != nil {
+		// out of step with the server, its board is the one that counts
+		fmt.Fprintf(c.out, "can't follow move %s: %v, use /board after reconnecting\n", uci, err)
+		return
+	}
+	c.history = append(c.history, san)
+	c.render()
+}
+
+// readClocks keeps the clocks sent along with the moves of a timed game
+func (c *Client) readClocks(content map[string]string) {
+	white, err1 := strconv.ParseInt(content["clock_white"], 10, 64)
+	black, err2 := strconv.ParseInt(content["clock_black"], 10, 64)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	c.clocks = map[int]int64{pieces.WHITE: white, pieces.BLACK: black}
+	c.clockAt = time.Now()
+}
+
+// other returns the opposite of a color name
+func (c *Client) other(color string) string {
+	if color == pieces.COLOR_NAMES[pieces.WHITE] {
+		return pieces.COLOR_NAMES[pieces.BLACK]
+	}
+	return pieces.COLOR_NAMES[pieces.WHITE]
+}
@@ -0,0 +1,525 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	DEBUG   = "debug"
+	RELEASE = "release"
+)
+
+const (
+	MEMORY = "memory"
+	FILE   = "file"
+)
+
+const (
+	LOCAL = "local"
+	REDIS = "redis"
+)
+
+const (
+	// file read when no -config flag or CHESS_CONFIG is given, it's fine if it doesn't exist
+	DEFAULT_FILE = "config.toml"
+	// prefix of the environment variables, the flag name is appended in upper snake case
+	ENV_PREFIX = "CHESS_"
+)
+
+var LOG_LEVELS = []string{"debug", "info", "warn", "error"}
+
+// Config is the configuration of the server
+//   - Mode: debug or release, release binds to port 80 by default
+//   - Override: directory holding public/views and build, read instead of the embedded copies
+//   - Admin: credentials of the /admin page, no password leaves it disabled
+type Config struct {
+	Mode        string      `toml:"mode"`
+	Address     string      `toml:"address"`
+	Override    string      `toml:"override"`
+	TLS         TLS         `toml:"tls"`
+	Websocket   Websocket   `toml:"websocket"`
+	Cache       Cache       `toml:"cache"`
+	Storage     Storage     `toml:"storage"`
+	Backplane   Backplane   `toml:"backplane"`
+	TimeControl TimeControl `toml:"time_control"`
+	Log         Log         `toml:"log"`
+	Shutdown    Shutdown    `toml:"shutdown"`
+	Admin       Admin       `toml:"admin"`
+	Rooms       Rooms       `toml:"rooms"`
+	Limits      Limits      `toml:"limits"`
+	Security    Security    `toml:"security"`
+	Auth        Auth        `toml:"auth"`
+	Chat        Chat        `toml:"chat"`
+	Analysis    Analysis    `toml:"analysis"`
+}
+
+// TLS holds the paths of the certificate and key, both empty serves plain HTTP
+//   - Redirect: address of a plain HTTP listener redirecting to HTTPS, empty for none
+type TLS struct {
+	Cert     string `toml:"cert"`
+	Key      string `toml:"key"`
+	Redirect string `toml:"redirect"`
+}
+
+// Websocket holds the buffer sizes of the websocket upgraders and the keepalive of connections
+//   - PingInterval: how often peers are pinged
+//   - PongTimeout: how long a peer may stay silent before it's disconnected, longer than PingInterval
+//   - WriteTimeout: how long a single write may take
+//   - SendQueue: messages waiting to be written to a peer before it's considered too slow
+//   - AbandonTimeout: how long a player may be gone before the game is lost
+type Websocket struct {
+	ReadSize       int           `toml:"read_size"`
+	WriteSize      int           `toml:"write_size"`
+	PingInterval   time.Duration `toml:"ping_interval"`
+	PongTimeout    time.Duration `toml:"pong_timeout"`
+	WriteTimeout   time.Duration `toml:"write_timeout"`
+	SendQueue      int           `toml:"send_queue"`
+	AbandonTimeout time.Duration `toml:"abandon_timeout"`
+}
+
+// Cache holds how long clients may cache responses
+type Cache struct {
+	TTL time.Duration `toml:"ttl"`
+}
+
+// Storage selects where games are kept, path is only used by the file backend
+type Storage struct {
+	Backend string `toml:"backend"`
+	Path    string `toml:"path"`
+}
+
+// Backplane connects the instances serving the same games, local keeps everything in the process
+//   - Address, Password, Database: the Redis server of the redis backend
+//   - Instance: name of this instance on the backplane, random when empty
+type Backplane struct {
+	Backend  string `toml:"backend"`
+	Address  string `toml:"address"`
+	Password string `toml:"password"`
+	Database int    `toml:"database"`
+	Instance string `toml:"instance"`
+}
+
+// TimeControl is the clock of new games, an initial time of zero means untimed
+type TimeControl struct {
+	Initial   time.Duration `toml:"initial"`
+	Increment time.Duration `toml:"increment"`
+}
+
+// Shutdown holds how long connections are given to finish once a shutdown signal is received
+type Shutdown struct {
+	Timeout time.Duration `toml:"timeout"`
+}
+
+// Rooms holds when rooms without activity are removed
+//   - IdleTTL: rooms with connected clients
+//   - AbandonedTTL: rooms nobody is connected to, whether they left or never came
+//   - ReapInterval: how often rooms are checked
+type Rooms struct {
+	IdleTTL      time.Duration `toml:"idle_ttl"`
+	AbandonedTTL time.Duration `toml:"abandoned_ttl"`
+	ReapInterval time.Duration `toml:"reap_interval"`
+}
+
+// Limits holds how much a single client may ask of the server
+//   - Requests, RequestBurst: requests per second and burst per IP on the room endpoints
+//   - Messages, MessageBurst: websocket messages per second and burst per connection
+//   - MessageSize: largest websocket message in bytes, larger ones close the connection
+//   - MaxRooms: rooms each server holds at most, 0 for no limit
+type Limits struct {
+	Requests     float64 `toml:"requests"`
+	RequestBurst int     `toml:"request_burst"`
+	Messages     float64 `toml:"messages"`
+	MessageBurst int     `toml:"message_burst"`
+	MessageSize  int64   `toml:"message_size"`
+	MaxRooms     int     `toml:"max_rooms"`
+}
+
+// Security holds the origins trusted by the browser side of the server
+//   - AllowedOrigins: origins that may open websockets besides the server's own, "*" allows any
+//   - AssetOrigins: origins scripts, styles and images may be loaded from besides the server's own
+//   - HSTS: how long browsers should only use HTTPS, sent over HTTPS only, 0 to not send it
+type Security struct {
+	AllowedOrigins []string      `toml:"allowed_origins"`
+	AssetOrigins   []string      `toml:"asset_origins"`
+	HSTS           time.Duration `toml:"hsts"`
+}
+
+// Auth holds how player tokens are signed, without a secret a random one is used and tokens
+// don't survive a restart
+type Auth struct {
+	Secret string        `toml:"secret"`
+	TTL    time.Duration `toml:"ttl"`
+}
+
+// Chat holds how chat rooms remember their messages
+//   - History: messages kept per room and replayed to members when they connect, 0 keeps none
+//   - Persist: keep the history in the storage backend instead of memory
+//   - Length: longest chat message in characters, in chat rooms and games
+//   - Filter: words masked in chat messages and refused in nicknames
+type Chat struct {
+	History int      `toml:"history"`
+	Persist bool     `toml:"persist"`
+	Length  int      `toml:"length"`
+	Filter  []string `toml:"filter"`
+}
+
+// Analysis holds the engine evaluating the positions of analysis boards
+//   - Engine: path of a UCI engine such as Stockfish, empty turns evaluations off
+//   - Depth: how deep the engine searches a position
+//   - Engines: engines running at once, one per board asking for evaluations
+type Analysis struct {
+	Engine  string `toml:"engine"`
+	Depth   int    `toml:"depth"`
+	Engines int    `toml:"engines"`
+}
+
+// Admin holds the basic auth credentials of the admin page
+type Admin struct {
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+}
+
+// Log holds the minimum level that is logged
+type Log struct {
+	Level string `toml:"level"`
+}
+
+// Default returns the configuration used when nothing is set
+func Default() Config {
+	mode := DEBUG
+	// kept for deployments that still set Mode
+	if os.Getenv("Mode") == RELEASE {
+		mode = RELEASE
+	}
+	return Config{
+		Mode: mode,
+		Websocket: Websocket{
+			ReadSize:       1024,
+			WriteSize:      1024,
+			PingInterval:   30 * time.Second,
+			PongTimeout:    60 * time.Second,
+			WriteTimeout:   10 * time.Second,
+			SendQueue:      64,
+			AbandonTimeout: time.Minute,
+		},
+		Cache: Cache{
+			TTL: time.Hour,
+		},
+		Storage: Storage{
+			Backend: MEMORY,
+			Path:    "data",
+		},
+		Backplane: Backplane{
+			Backend: LOCAL,
+			Address: "localhost:6379",
+		},
+		Log: Log{
+			Level: "info",
+		},
+		Shutdown: Shutdown{
+			Timeout: 10 * time.Second,
+		},
+		Admin: Admin{
+			User: "admin",
+		},
+		Rooms: Rooms{
+			IdleTTL:      30 * time.Minute,
+			AbandonedTTL: 5 * time.Minute,
+			ReapInterval: time.Minute,
+		},
+		Auth: Auth{
+			TTL: 24 * time.Hour,
+		},
+		Chat: Chat{
+			History: 50,
+			Length:  200,
+		},
+		Analysis: Analysis{
+			Depth:   18,
+			Engines: 4,
+		},
+		Security: Security{
+			// the favicon
+			AssetOrigins: []string{"https://ajawtrubycbmbqfwkiyw.supabase.co"},
+			HSTS:         180 * 24 * time.Hour,
+		},
+		Limits: Limits{
+			Requests:     1,
+			RequestBurst: 10,
+			Messages:     10,
+			MessageBurst: 20,
+			MessageSize:  4096,
+			MaxRooms:     1000,
+		},
+	}
+}
+
+// flags registers a flag for every setting, pointing at the fields of cfg
+func flags(cfg *Config) *flag.FlagSet {
+	set := flag.NewFlagSet("chess-htmx", flag.ContinueOnError)
+	set.String("config", DEFAULT_FILE, "path of the TOML configuration file")
+	set.StringVar(&cfg.Mode, "mode", cfg.Mode, "debug or release")
+	set.StringVar(&cfg.Address, "address", cfg.Address, "address to listen on, defaults to :8090 in debug and 0.0.0.0:80, or 0.0.0.0:443 with TLS, in release")
+	set.StringVar(&cfg.Override, "override", cfg.Override, "directory holding public/views and build to use instead of the embedded copies")
+	set.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "path of the TLS certificate")
+	set.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "path of the TLS key")
+	set.StringVar(&cfg.TLS.Redirect, "tls-redirect", cfg.TLS.Redirect, "address of a plain HTTP listener redirecting to HTTPS, e.g. :80")
+	set.IntVar(&cfg.Websocket.ReadSize, "ws-read-size", cfg.Websocket.ReadSize, "websocket read buffer size in bytes")
+	set.IntVar(&cfg.Websocket.WriteSize, "ws-write-size", cfg.Websocket.WriteSize, "websocket write buffer size in bytes")
+	set.DurationVar(&cfg.Websocket.PingInterval, "ws-ping-interval", cfg.Websocket.PingInterval, "how often websocket peers are pinged")
+	set.DurationVar(&cfg.Websocket.PongTimeout, "ws-pong-timeout", cfg.Websocket.PongTimeout, "how long a websocket peer may stay silent before it's disconnected")
+	set.DurationVar(&cfg.Websocket.WriteTimeout, "ws-write-timeout", cfg.Websocket.WriteTimeout, "how long a websocket write may take")
+	set.IntVar(&cfg.Websocket.SendQueue, "ws-send-queue", cfg.Websocket.SendQueue, "messages queued for a websocket peer before it's disconnected as too slow")
+	set.DurationVar(&cfg.Websocket.AbandonTimeout, "ws-abandon-timeout", cfg.Websocket.AbandonTimeout, "how long a player may be disconnected before the game is lost")
+	set.DurationVar(&cfg.Cache.TTL, "cache-ttl", cfg.Cache.TTL, "how long clients may cache responses")
+	set.StringVar(&cfg.Storage.Backend, "storage-backend", cfg.Storage.Backend, "memory or file")
+	set.StringVar(&cfg.Storage.Path, "storage-path", cfg.Storage.Path, "directory used by the file storage backend")
+	set.StringVar(&cfg.Backplane.Backend, "backplane-backend", cfg.Backplane.Backend, "local or redis")
+	set.StringVar(&cfg.Backplane.Address, "backplane-address", cfg.Backplane.Address, "address of the Redis server of the redis backplane")
+	set.StringVar(&cfg.Backplane.Password, "backplane-password", cfg.Backplane.Password, "password of the Redis server, empty for none")
+	set.IntVar(&cfg.Backplane.Database, "backplane-database", cfg.Backplane.Database, "Redis database number")
+	set.StringVar(&cfg.Backplane.Instance, "backplane-instance", cfg.Backplane.Instance, "name of this instance on the backplane, random when empty")
+	set.DurationVar(&cfg.TimeControl.Initial, "time-initial", cfg.TimeControl.Initial, "initial time on each clock, 0 for untimed games")
+	set.DurationVar(&cfg.TimeControl.Increment, "time-increment", cfg.TimeControl.Increment, "time added to a clock after each move")
+	set.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "debug, info, warn or error")
+	set.DurationVar(&cfg.Shutdown.Timeout, "shutdown-timeout", cfg.Shutdown.Timeout, "how long connections are given to finish on shutdown")
+	set.StringVar(&cfg.Admin.User, "admin-user", cfg.Admin.User, "user name of the admin page")
+	set.StringVar(&cfg.Admin.Password, "admin-password", cfg.Admin.Password, "password of the admin page, the page is disabled when empty")
+	set.DurationVar(&cfg.Rooms.IdleTTL, "room-idle-ttl", cfg.Rooms.IdleTTL, "how long a room with connected clients may go without activity")
+	set.DurationVar(&cfg.Rooms.AbandonedTTL, "room-abandoned-ttl", cfg.Rooms.AbandonedTTL, "how long a room nobody is connected to is kept")
+	set.DurationVar(&cfg.Rooms.ReapInterval, "room-reap-interval", cfg.Rooms.ReapInterval, "how often idle rooms are looked for")
+	set.Float64Var(&cfg.Limits.Requests, "limit-requests", cfg.Limits.Requests, "requests per second an IP may make to the room endpoints")
+	set.IntVar(&cfg.Limits.RequestBurst, "limit-request-burst", cfg.Limits.RequestBurst, "requests an IP may make at once to the room endpoints")
+	set.Float64Var(&cfg.Limits.Messages, "limit-messages", cfg.Limits.Messages, "websocket messages per second a connection may send")
+	set.IntVar(&cfg.Limits.MessageBurst, "limit-message-burst", cfg.Limits.MessageBurst, "websocket messages a connection may send at once")
+	set.Int64Var(&cfg.Limits.MessageSize, "limit-message-size", cfg.Limits.MessageSize, "largest websocket message in bytes")
+	set.IntVar(&cfg.Limits.MaxRooms, "limit-rooms", cfg.Limits.MaxRooms, "rooms each server holds at most, 0 for no limit")
+	set.StringVar(&cfg.Auth.Secret, "auth-secret", cfg.Auth.Secret, "secret signing player tokens, random when empty")
+	set.DurationVar(&cfg.Auth.TTL, "auth-ttl", cfg.Auth.TTL, "how long player tokens are valid")
+	set.IntVar(&cfg.Chat.History, "chat-history", cfg.Chat.History, "messages kept per chat room and replayed on connect, 0 keeps none")
+	set.BoolVar(&cfg.Chat.Persist, "chat-persist", cfg.Chat.Persist, "keep chat history in the storage backend instead of memory")
+	set.IntVar(&cfg.Chat.Length, "chat-length", cfg.Chat.Length, "longest chat message in characters")
+	set.Var((*list)(&cfg.Chat.Filter), "chat-filter", "comma separated words masked in chat messages")
+	set.StringVar(&cfg.Analysis.Engine, "analysis-engine", cfg.Analysis.Engine, "path of a UCI engine evaluating analysis boards, empty for none")
+	set.IntVar(&cfg.Analysis.Depth, "analysis-depth", cfg.Analysis.Depth, "how deep the engine searches a position")
+	set.IntVar(&cfg.Analysis.Engines, "analysis-engines", cfg.Analysis.Engines, "engines running at once")
+	set.Var((*list)(&cfg.Security.AllowedOrigins), "allowed-origins", "comma separated origins that may open websockets besides the server's own")
+	set.DurationVar(&cfg.Security.HSTS, "hsts", cfg.Security.HSTS, "max age of the Strict-Transport-Security header, 0 to not send it")
+	set.Var((*list)(&cfg.Security.AssetOrigins), "asset-origins", "comma separated origins assets may be loaded from besides the server's own")
+	return set
+}
+
+// list is a flag holding comma separated values
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable read for a flag
+func envName(flagName string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Load builds the configuration from the defaults, the configuration file, the environment
+// and the command line arguments, each overriding the previous one
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	set := flags(&cfg)
+	if err := set.Parse(args); err != nil {
+		return nil, err
+	}
+	// remember the flags given on the command line, they're applied last
+	given := map[string]string{}
+	set.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+	path, explicit := given["config"]
+	if !explicit {
+		path, explicit = os.LookupEnv(envName("config"))
+	}
+	if path == "" {
+		path = DEFAULT_FILE
+	}
+	cfg = Default()
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		if explicit || !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	var err error
+	set.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && f.Name != "config" {
+			if setErr := set.Set(f.Name, value); setErr != nil {
+				err = errors.Join(err, fmt.Errorf("%s: %w", envName(f.Name), setErr))
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range given {
+		set.Set(name, value)
+	}
+	if cfg.Address == "" {
+		cfg.Address = ":8090"
+		if cfg.Mode == RELEASE {
+			cfg.Address = "0.0.0.0:80"
+			if cfg.TLS.Cert != "" {
+				cfg.Address = "0.0.0.0:443"
+			}
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that every setting is usable, all problems are reported at once
+func (cfg *Config) Validate() error {
+	var errs []error
+	if cfg.Mode != DEBUG && cfg.Mode != RELEASE {
+		errs = append(errs, fmt.Errorf("mode must be %s or %s, got %q", DEBUG, RELEASE, cfg.Mode))
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		errs = append(errs, fmt.Errorf("address: %w", err))
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		errs = append(errs, errors.New("tls: cert and key must be set together"))
+	}
+	for _, path := range []string{cfg.TLS.Cert, cfg.TLS.Key} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("tls: %w", err))
+		}
+	}
+	if cfg.TLS.Redirect != "" {
+		if cfg.TLS.Cert == "" {
+			errs = append(errs, errors.New("tls: redirect needs a cert and key"))
+		}
+		if _, _, err := net.SplitHostPort(cfg.TLS.Redirect); err != nil {
+			errs = append(errs, fmt.Errorf("tls: redirect: %w", err))
+		}
+	}
+	if cfg.Security.HSTS < 0 {
+		errs = append(errs, errors.New("security: hsts can't be negative"))
+	}
+	if cfg.Websocket.ReadSize <= 0 || cfg.Websocket.WriteSize <= 0 {
+		errs = append(errs, errors.New("websocket: buffer sizes must be positive"))
+	}
+	if cfg.Websocket.PingInterval <= 0 || cfg.Websocket.WriteTimeout <= 0 || cfg.Websocket.AbandonTimeout <= 0 {
+		errs = append(errs, errors.New("websocket: durations must be positive"))
+	}
+	if cfg.Websocket.PongTimeout <= cfg.Websocket.PingInterval {
+		errs = append(errs, errors.New("websocket: pong timeout must be longer than the ping interval"))
+	}
+	if cfg.Websocket.SendQueue <= 0 {
+		errs = append(errs, errors.New("websocket: send queue must be positive"))
+	}
+	if cfg.Cache.TTL < 0 {
+		errs = append(errs, errors.New("cache: ttl can't be negative"))
+	}
+	switch cfg.Storage.Backend {
+	case MEMORY:
+	case FILE:
+		if cfg.Storage.Path == "" {
+			errs = append(errs, errors.New("storage: the file backend needs a path"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage: backend must be %s or %s, got %q", MEMORY, FILE, cfg.Storage.Backend))
+	}
+	switch cfg.Backplane.Backend {
+	case LOCAL:
+	case REDIS:
+		if _, _, err := net.SplitHostPort(cfg.Backplane.Address); err != nil {
+			errs = append(errs, fmt.Errorf("backplane: address: %w", err))
+		}
+		if cfg.Backplane.Database < 0 {
+			errs = append(errs, errors.New("backplane: database can't be negative"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("backplane: backend must be %s or %s, got %q", LOCAL, REDIS, cfg.Backplane.Backend))
+	}
+	if cfg.TimeControl.Initial < 0 || cfg.TimeControl.Increment < 0 {
+		errs = append(errs, errors.New("time_control: durations can't be negative"))
+	}
+	if cfg.Shutdown.Timeout <= 0 {
+		errs = append(errs, errors.New("shutdown: timeout must be positive"))
+	}
+	if cfg.Admin.Password != "" && cfg.Admin.User == "" {
+		errs = append(errs, errors.New("admin: a password needs a user"))
+	}
+	if cfg.Rooms.IdleTTL <= 0 || cfg.Rooms.AbandonedTTL <= 0 || cfg.Rooms.ReapInterval <= 0 {
+		errs = append(errs, errors.New("rooms: durations must be positive"))
+	}
+	if cfg.Limits.Requests <= 0 || cfg.Limits.RequestBurst <= 0 || cfg.Limits.Messages <= 0 || cfg.Limits.MessageBurst <= 0 {
+		errs = append(errs, errors.New("limits: rates and bursts must be positive"))
+	}
+	if cfg.Limits.MessageSize <= 0 {
+		errs = append(errs, errors.New("limits: message size must be positive"))
+	}
+	if cfg.Limits.MaxRooms < 0 {
+		errs = append(errs, errors.New("limits: max rooms can't be negative"))
+	}
+	for _, origin := range append(cfg.Security.AllowedOrigins, cfg.Security.AssetOrigins...) {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("security: %q is not an origin like https://example.com", origin))
+		}
+	}
+	if cfg.Auth.Secret != "" && len(cfg.Auth.Secret) < 32 {
+		errs = append(errs, errors.New("auth: the secret must be at least 32 bytes"))
+	}
+	if cfg.Auth.TTL <= 0 {
+		errs = append(errs, errors.New("auth: ttl must be positive"))
+	}
+	if cfg.Chat.History < 0 {
+		errs = append(errs, errors.New("chat: history can't be negative"))
+	}
+	if cfg.Chat.Length <= 0 {
+		errs = append(errs, errors.New("chat: length must be positive"))
+	}
+	if cfg.Analysis.Depth <= 0 || cfg.Analysis.Engines <= 0 {
+		errs = append(errs, errors.New("analysis: depth and engines must be positive"))
+	}
+	if cfg.Analysis.Engine != "" {
+		if _, err := exec.LookPath(cfg.Analysis.Engine); err != nil {
+			errs = append(errs, fmt.Errorf("analysis: engine: %w", err))
+		}
+	}
+	validLevel := false
+	for _, level := range LOG_LEVELS {
+		if cfg.Log.Level == level {
+			validLevel = true
+		}
+	}
+	if !validLevel {
+		errs = append(errs, fmt.Errorf("log: level must be one of %s, got %q", strings.Join(LOG_LEVELS, ", "), cfg.Log.Level))
+	}
+	return errors.Join(errs...)
+}
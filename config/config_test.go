@@ -0,0 +1,155 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unset removes environment variables for the duration of the test
+func unset(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		// Setenv restores the previous value once the test is done
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+// file writes a configuration file and returns its path
+func file(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := file(t, "mode = \"release\"\n[limits]\nmax_rooms = 10\n")
+	// only the existence of the certificate and key is checked
+	cert := file(t, "")
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		rooms   int
+		mode    string
+		address string
+	}{
+		{"defaults", nil, nil, Default().Limits.MaxRooms, DEBUG, ":8090"},
+		{"file over defaults", []string{"-config", path}, nil, 10, RELEASE, "0.0.0.0:80"},
+		{"file from the environment", nil, map[string]string{"CHESS_CONFIG": path}, 10, RELEASE, "0.0.0.0:80"},
+		{"environment over file", []string{"-config", path}, map[string]string{"CHESS_LIMIT_ROOMS": "20"}, 20, RELEASE, "0.0.0.0:80"},
+		{"flags over environment", []string{"-config", path, "-limit-rooms", "30", "-mode", "debug"}, map[string]string{"CHESS_LIMIT_ROOMS": "20", "CHESS_MODE": "release"}, 30, DEBUG, ":8090"},
+		{"tls in release", []string{"-mode", "release", "-tls-cert", cert, "-tls-key", cert}, nil, Default().Limits.MaxRooms, RELEASE, "0.0.0.0:443"},
+		{"explicit address", []string{"-config", path, "-address", ":9000"}, nil, 10, RELEASE, ":9000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			unset(t, "Mode", "CHESS_CONFIG", "CHESS_MODE", "CHESS_ADDRESS", "CHESS_LIMIT_ROOMS")
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			cfg, err := Load(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Limits.MaxRooms != test.rooms {
+				t.Errorf("max rooms = %d, want %d", cfg.Limits.MaxRooms, test.rooms)
+			}
+			if cfg.Mode != test.mode {
+				t.Errorf("mode = %q, want %q", cfg.Mode, test.mode)
+			}
+			if cfg.Address != test.address {
+				t.Errorf("address = %q, want %q", cfg.Address, test.address)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"missing explicit file", []string{"-config", filepath.Join(t.TempDir(), "missing.toml")}, nil, "config file"},
+		{"broken file", []string{"-config", file(t, "mode = \n")}, nil, "config file"},
+		{"unparsable environment", nil, map[string]string{"CHESS_LIMIT_ROOMS": "many"}, "CHESS_LIMIT_ROOMS"},
+		{"unknown flag", []string{"-colour", "white"}, nil, "colour"},
+		{"invalid value", []string{"-log-level", "loud"}, nil, "log: level"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			unset(t, "Mode", "CHESS_CONFIG", "CHESS_LIMIT_ROOMS")
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			if _, err := Load(test.args); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("error = %v, want one mentioning %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		want   string
+	}{
+		{"mode", func(cfg *Config) { cfg.Mode = "prod" }, "mode must be"},
+		{"address", func(cfg *Config) { cfg.Address = "8090" }, "address"},
+		{"half a certificate", func(cfg *Config) { cfg.TLS.Cert = "cert.pem" }, "cert and key"},
+		{"pong timeout", func(cfg *Config) { cfg.Websocket.PongTimeout = cfg.Websocket.PingInterval }, "pong timeout"},
+		{"storage backend", func(cfg *Config) { cfg.Storage.Backend = "disk" }, "storage: backend"},
+		{"file storage without a path", func(cfg *Config) { cfg.Storage.Backend, cfg.Storage.Path = FILE, "" }, "needs a path"},
+		{"backplane backend", func(cfg *Config) { cfg.Backplane.Backend = "kafka" }, "backplane: backend"},
+		{"negative time control", func(cfg *Config) { cfg.TimeControl.Initial = -time.Minute }, "time_control"},
+		{"admin password without a user", func(cfg *Config) { cfg.Admin.User, cfg.Admin.Password = "", "secret" }, "admin"},
+		{"rates", func(cfg *Config) { cfg.Limits.Requests = 0 }, "limits: rates"},
+		{"negative max rooms", func(cfg *Config) { cfg.Limits.MaxRooms = -1 }, "max rooms"},
+		{"origin", func(cfg *Config) { cfg.Security.AllowedOrigins = []string{"example.com"} }, "not an origin"},
+		{"short secret", func(cfg *Config) { cfg.Auth.Secret = "short" }, "at least 32 bytes"},
+		{"chat length", func(cfg *Config) { cfg.Chat.Length = 0 }, "chat: length"},
+		{"analysis depth", func(cfg *Config) { cfg.Analysis.Depth = 0 }, "analysis"},
+		{"log level", func(cfg *Config) { cfg.Log.Level = "loud" }, "log: level"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Address = ":8090"
+			test.change(&cfg)
+			if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("error = %v, want one mentioning %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	cfg := Default()
+	cfg.Address = ":8090"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// every problem is reported, not just the first one
+	cfg.Mode = "prod"
+	cfg.Log.Level = "loud"
+	err := cfg.Validate()
+	for _, want := range []string{"mode must be", "log: level"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want one mentioning %q", err, want)
+		}
+	}
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) || len(joined.Unwrap()) != 2 {
+		t.Errorf("error = %v, want two joined errors", err)
+	}
+}
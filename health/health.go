@@ -0,0 +1,44 @@
+package health
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Check reports why a dependency can't serve requests, nil when it can
+type Check func() error
+
+// Healthz is a callback answering as long as the process serves requests
+func Healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{
+		"status": "ok",
+	})
+}
+
+// Readyz returns a callback answering 200 once every check passes and 503 with the failures otherwise
+func Readyz(checks map[string]Check) echo.HandlerFunc {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return func(c echo.Context) error {
+		failures := map[string]string{}
+		for _, name := range names {
+			if err := checks[name](); err != nil {
+				failures[name] = err.Error()
+			}
+		}
+		if len(failures) > 0 {
+			return c.JSON(http.StatusServiceUnavailable, map[string]interface{}{
+				"status": "unavailable",
+				"checks": failures,
+			})
+		}
+		return c.JSON(http.StatusOK, map[string]string{
+			"status": "ok",
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package health
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+)
+
+// how long Probe waits for the server to answer
+const PROBE_TIMEOUT = 3 * time.Second
+
+// Probe asks the server configured by cfg for /healthz on the loopback interface, over HTTPS when
+// it serves TLS, e.g. as the health check of a container, the certificate isn't checked since it
+// names the public host
+func Probe(cfg *config.Config) error {
+	host, port, err := net.SplitHostPort(cfg.Address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	scheme := "http"
+	if cfg.TLS.Cert != "" {
+		scheme = "https"
+	}
+	client := &http.Client{
+		Timeout: PROBE_TIMEOUT,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	res, err := client.Get(scheme + "://" + net.JoinHostPort(host, port) + "/healthz")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("healthz answered %s", res.Status)
+	}
+	return nil
+}
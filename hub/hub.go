@@ -0,0 +1,286 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/auth"
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/limits"
+	"github.com/Qinbeans/chess-htmx/metrics"
+	"github.com/Qinbeans/chess-htmx/security"
+	"github.com/Qinbeans/chess-htmx/socket"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// ErrNotStreaming is returned for messages pushed by a member without an event stream
+var ErrNotStreaming = errors.New("not connected to the event stream")
+
+// Hooks is what a room type does as members connect, talk and go, every hook is called with the
+// hub locked
+type Hooks interface {
+	// Connected is called once a connection is registered, before its messages are read
+	Connected(room *Room, member *Member)
+	// Message is called for every message within the rate limit, returning false disconnects
+	// the member
+	Message(room *Room, member *Member, data []byte) bool
+	// Limited is called for a message dropped by the rate limit
+	Limited(room *Room, member *Member, err error)
+	// Disconnected is called once a connection is gone, unless the member connected again,
+	// left the room or the room was removed
+	Disconnected(room *Room, member *Member)
+}
+
+// Hub holds the rooms of a room type and serves the websockets of their members
+//   - Name: the room type, labels the metrics and logs
+//   - lock: guards the rooms and what the room type keeps beside them, see Lock
+//   - conns: running connection goroutines, waited on during shutdown
+//   - closing: set once shutdown starts, no rooms or connections are accepted after
+type Hub struct {
+	Name      string
+	Upgrader  websocket.Upgrader
+	Websocket config.Websocket
+	Limits    config.Limits
+	Rooms     map[string]*Room
+	Hooks     Hooks
+	Logger    *slog.Logger
+	lock      sync.Mutex
+	conns     sync.WaitGroup
+	closing   bool
+}
+
+// New returns a hub for a room type
+func New(name string, cfg *config.Config, hooks Hooks, logger *slog.Logger) *Hub {
+	return &Hub{
+		Name: name,
+		Upgrader: websocket.Upgrader{
+			ReadBufferSize:  cfg.Websocket.ReadSize,
+			WriteBufferSize: cfg.Websocket.WriteSize,
+			CheckOrigin:     security.CheckOrigin(cfg.Security),
+			Subprotocols:    []string{auth.PROTOCOL},
+		},
+		Websocket: cfg.Websocket,
+		Limits:    cfg.Limits,
+		Rooms:     make(map[string]*Room),
+		Hooks:     hooks,
+		Logger:    logger,
+	}
+}
+
+// Lock locks the hub, room types hold it while they read or change their rooms
+func (h *Hub) Lock() {
+	h.lock.Lock()
+}
+
+// Unlock unlocks the hub
+func (h *Hub) Unlock() {
+	h.lock.Unlock()
+}
+
+// Closing tells whether shutdown started
+func (h *Hub) Closing() bool {
+	return h.closing
+}
+
+// Full tells whether the hub may not open another room
+func (h *Hub) Full() bool {
+	return limits.Full(h.Limits, len(h.Rooms))
+}
+
+// Room returns a room, nil when there is none with the id
+func (h *Hub) Room(id string) *Room {
+	return h.Rooms[id]
+}
+
+// Create returns a new empty room, replacing any room with the same id
+func (h *Hub) Create(id string) *Room {
+	room := newRoom(id)
+	h.Rooms[id] = room
+	return room
+}
+
+// Remove closes every connection of a room and forgets it, the read loops find it gone and stop
+func (h *Hub) Remove(id string) {
+	if room, ok := h.Rooms[id]; ok {
+		room.close()
+		delete(h.Rooms, id)
+	}
+}
+
+// Connect upgrades the request of a member to a websocket and serves it, the newest connection of
+// a member wins and the previous one is closed. The hub must be unlocked, the upgrade waits on the
+// client, and the websocket is closed when the room or the member went away meanwhile
+func (h *Hub) Connect(c echo.Context, roomID, memberID string, logger *slog.Logger) error {
+	upgraded, err := h.Upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		logger.Warn("websocket upgrade failed", "error", err)
+		return err
+	}
+	conn := socket.New(upgraded, h.Websocket)
+	conn.SetReadLimit(h.Limits.MessageSize)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	room := h.Rooms[roomID]
+	var member *Member
+	if room != nil {
+		member = room.Member(memberID)
+	}
+	if h.closing || member == nil {
+		logger.Debug("room or member gone during the upgrade", "room", roomID, "user", memberID)
+		conn.CloseWith(websocket.CloseGoingAway, "room closed")
+		return nil
+	}
+	h.Attach(room, member, conn, logger.With("transport", "websocket"))
+	return nil
+}
+
+// Stream connects a member through a server-sent event stream, the caller serves the stream once
+// the hub is unlocked and hands the messages of the member to Push
+func (h *Hub) Stream(room *Room, member *Member, logger *slog.Logger) *socket.Stream {
+	stream := socket.NewStream(h.Websocket)
+	stream.SetReadLimit(h.Limits.MessageSize)
+	h.Attach(room, member, stream, logger.With("transport", "sse"))
+	return stream
+}
+
+// Push hands a message of a member to their event stream, where it's read like a websocket message
+func (h *Hub) Push(member *Member, data []byte) error {
+	stream, ok := member.Conn.(*socket.Stream)
+	if !ok {
+		return ErrNotStreaming
+	}
+	err := stream.Push(data)
+	if errors.Is(err, socket.ErrMessageTooLarge) {
+		metrics.Limited.WithLabelValues("message_size").Inc()
+		member.Logger.Warn("message too large", "limit", h.Limits.MessageSize)
+	}
+	return err
+}
+
+// Attach makes conn the connection of a member and starts serving it, a previous connection of
+// the member is closed, room types with a connection of their own attach it directly
+func (h *Hub) Attach(room *Room, member *Member, conn Conn, logger *slog.Logger) {
+	if member.Conn != nil {
+		// e.g. the page was opened again
+		member.Conn.CloseWith(websocket.CloseNormalClosure, "connected elsewhere")
+	}
+	member.Conn = conn
+	// every log line of the session can be correlated through the connection id
+	member.Logger = logger.With("room", room.ID, "user", member.ID, "conn", uuid.New().String())
+	room.LastActivity = time.Now()
+	h.conns.Add(1)
+	go h.serve(room, member, conn, member.Logger)
+}
+
+// current tells whether conn is still the connection of a member of a live room
+func (h *Hub) current(room *Room, member *Member, conn Conn) bool {
+	return h.Rooms[room.ID] == room && room.Member(member.ID) == member && member.Conn == conn
+}
+
+// serve reads the messages of a connection until it closes
+func (h *Hub) serve(room *Room, member *Member, conn Conn, logger *slog.Logger) {
+	start := time.Now()
+	messages := 0
+	logger.Info("client connected")
+	defer h.conns.Done()
+	defer func() {
+		h.lock.Lock()
+		conn.Close()
+		if h.current(room, member, conn) {
+			member.Conn = nil
+			room.LastActivity = time.Now()
+			h.Hooks.Disconnected(room, member)
+		} else if member.Conn == conn {
+			member.Conn = nil
+		}
+		h.lock.Unlock()
+		logger.Info("client disconnected", "duration", time.Since(start), "messages", messages)
+	}()
+	h.lock.Lock()
+	if !h.current(room, member, conn) {
+		// removed or replaced before the connection started
+		h.lock.Unlock()
+		return
+	}
+	h.Hooks.Connected(room, member)
+	h.lock.Unlock()
+	limiter := limits.Messages(h.Limits)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				// the client is told through the close code
+				metrics.Limited.WithLabelValues("message_size").Inc()
+				logger.Warn("message too large", "limit", h.Limits.MessageSize)
+			} else if socket.Timeout(err) {
+				logger.Info("peer went silent", "timeout", h.Websocket.PongTimeout)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Warn("websocket read failed", "error", err)
+			}
+			return
+		}
+		messages++
+		metrics.MessageSize.WithLabelValues(h.Name).Observe(float64(len(data)))
+		keep := func() bool {
+			h.lock.Lock()
+			defer h.lock.Unlock()
+			// kicked, replaced or the room is gone
+			if !h.current(room, member, conn) {
+				return false
+			}
+			if !limiter.Allow() {
+				metrics.Limited.WithLabelValues("messages").Inc()
+				logger.Debug("message dropped, rate limit reached")
+				h.Hooks.Limited(room, member, limits.ErrTooManyMessages)
+				return true
+			}
+			room.LastActivity = time.Now()
+			return h.Hooks.Message(room, member, data)
+		}()
+		if !keep {
+			return
+		}
+	}
+}
+
+// Count counts the rooms and the connected members with each role
+func (h *Hub) Count() (int, map[string]int) {
+	roles := map[string]int{}
+	for _, room := range h.Rooms {
+		for _, member := range room.members {
+			if member.Conn != nil {
+				roles[member.Role]++
+			}
+		}
+	}
+	return len(h.Rooms), roles
+}
+
+// Shutdown stops accepting rooms and connections, calls before so the room type can say goodbye,
+// closes every connection and waits for them to finish until ctx is done
+func (h *Hub) Shutdown(ctx context.Context, before func()) error {
+	h.lock.Lock()
+	h.closing = true
+	h.Logger.Info("closing rooms", "count", len(h.Rooms))
+	before()
+	for id := range h.Rooms {
+		h.Remove(id)
+	}
+	h.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		h.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
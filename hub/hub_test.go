@@ -0,0 +1,261 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+)
+
+var errClosed = errors.New("closed")
+
+// fakeConn is a connection whose member never writes, reading waits until it's closed
+type fakeConn struct {
+	lock   sync.Mutex
+	sent   [][]byte
+	reason string
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConn() *fakeConn {
+	return &fakeConn{closed: make(chan struct{})}
+}
+
+func (c *fakeConn) Send(data []byte) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sent = append(c.sent, data)
+	return true
+}
+
+func (c *fakeConn) ReadMessage() (int, []byte, error) {
+	<-c.closed
+	return 0, nil, errClosed
+}
+
+func (c *fakeConn) Close() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+func (c *fakeConn) CloseWith(code int, text string) {
+	c.lock.Lock()
+	c.reason = text
+	c.lock.Unlock()
+	c.Close()
+}
+
+// received returns the messages sent to the connection
+func (c *fakeConn) received() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	messages := []string{}
+	for _, data := range c.sent {
+		messages = append(messages, string(data))
+	}
+	return messages
+}
+
+// hooks counts the calls of every hook, they're made with the hub locked
+type hooks struct {
+	connected    int
+	disconnected int
+}
+
+func (h *hooks) Connected(room *Room, member *Member) { h.connected++ }
+
+func (h *hooks) Message(room *Room, member *Member, data []byte) bool { return true }
+
+func (h *hooks) Limited(room *Room, member *Member, err error) {}
+
+func (h *hooks) Disconnected(room *Room, member *Member) { h.disconnected++ }
+
+func newTestHub(t *testing.T, maxRooms int) (*Hub, *hooks) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Limits.MaxRooms = maxRooms
+	calls := &hooks{}
+	return New("test", &cfg, calls, slog.New(slog.NewTextHandler(io.Discard, nil))), calls
+}
+
+// attach connects a member of a room the way the room types do, with the hub locked
+func attach(h *Hub, room *Room, id string) *fakeConn {
+	conn := newConn()
+	h.Lock()
+	defer h.Unlock()
+	h.Attach(room, room.Member(id), conn, h.Logger)
+	return conn
+}
+
+// wait polls the hub until done holds, done is called with the hub locked
+func wait(t *testing.T, h *Hub, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		h.Lock()
+		ok := done()
+		h.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAttachReplaces(t *testing.T) {
+	h, calls := newTestHub(t, 0)
+	room := h.Create("room")
+	member := room.Join("member", "player")
+	first := attach(h, room, "member")
+	wait(t, h, "the first connection is served", func() bool { return calls.connected == 1 })
+	second := attach(h, room, "member")
+	wait(t, h, "the second connection is served", func() bool { return calls.connected == 2 })
+	select {
+	case <-first.closed:
+	default:
+		t.Fatal("the first connection is still open")
+	}
+	if first.reason != "connected elsewhere" {
+		t.Errorf("first connection closed with %q", first.reason)
+	}
+	h.Lock()
+	defer h.Unlock()
+	if member.Conn != second {
+		t.Error("the member isn't on the second connection")
+	}
+	// the replaced connection going away isn't the member going away
+	if calls.disconnected != 0 {
+		t.Errorf("disconnected %d times", calls.disconnected)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	h, calls := newTestHub(t, 0)
+	room := h.Create("room")
+	room.Join("stays", "player")
+	room.Join("leaves", "player")
+	conn := attach(h, room, "leaves")
+	wait(t, h, "the connection is served", func() bool { return calls.connected == 1 })
+	h.Lock()
+	room.Leave("leaves")
+	room.Leave("stranger")
+	h.Unlock()
+	// the read loop finds the member gone once the connection is closed
+	<-conn.closed
+	h.Lock()
+	defer h.Unlock()
+	if room.Member("leaves") != nil || room.Len() != 1 || room.Members()[0].ID != "stays" {
+		t.Errorf("members left: %v", room.Members())
+	}
+	if calls.disconnected != 0 {
+		t.Errorf("disconnected %d times after leaving", calls.disconnected)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	h, _ := newTestHub(t, 0)
+	room := h.Create("room")
+	for _, id := range []string{"author", "reader", "offline"} {
+		room.Join(id, "player")
+	}
+	author := attach(h, room, "author")
+	reader := attach(h, room, "reader")
+	h.Lock()
+	room.Broadcast("author", []byte("to the others"))
+	room.Broadcast("", []byte("to everyone"))
+	sent := room.Send("offline", []byte("to nobody"))
+	h.Unlock()
+	if sent {
+		t.Error("a member without a connection was sent a message")
+	}
+	tests := []struct {
+		name string
+		conn *fakeConn
+		want []string
+	}{
+		{"author", author, []string{"to everyone"}},
+		{"reader", reader, []string{"to the others", "to everyone"}},
+	}
+	for _, test := range tests {
+		got := test.conn.received()
+		if len(got) != len(test.want) {
+			t.Errorf("%s received %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s received %v, want %v", test.name, got, test.want)
+			}
+		}
+	}
+}
+
+func TestFull(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxRooms int
+		rooms    int
+		full     bool
+	}{
+		{"no limit", 0, 5, false},
+		{"below the limit", 2, 1, false},
+		{"at the limit", 2, 2, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, _ := newTestHub(t, test.maxRooms)
+			for i := 0; i < test.rooms; i++ {
+				h.Create(string(rune('a' + i)))
+			}
+			if full := h.Full(); full != test.full {
+				t.Errorf("full = %v, want %v", full, test.full)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	h, calls := newTestHub(t, 0)
+	room := h.Create("room")
+	room.Join("member", "player")
+	conn := attach(h, room, "member")
+	wait(t, h, "the connection is served", func() bool { return calls.connected == 1 })
+	if h.Closing() {
+		t.Fatal("closing before the shutdown")
+	}
+	said := false
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := h.Shutdown(ctx, func() {
+		// the room type says goodbye while the connections are still open
+		said = h.Closing() && room.Send("member", []byte("goodbye"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !said {
+		t.Error("before wasn't called with the connections open and the hub closing")
+	}
+	select {
+	case <-conn.closed:
+	default:
+		t.Error("the connection is still open")
+	}
+	h.Lock()
+	defer h.Unlock()
+	if len(h.Rooms) != 0 {
+		t.Errorf("%d rooms are left", len(h.Rooms))
+	}
+	// the room was removed, so its member isn't disconnected one by one
+	if calls.disconnected != 0 {
+		t.Errorf("disconnected %d times", calls.disconnected)
+	}
+}
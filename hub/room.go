@@ -0,0 +1,153 @@
+package hub
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Conn is the connection of a member, a websocket or an event stream, see socket
+type Conn interface {
+	// Send queues a message for the member
+	Send(data []byte) bool
+	// ReadMessage waits for the next message of the member
+	ReadMessage() (int, []byte, error)
+	// Close flushes the queued messages and closes the connection
+	Close()
+	// CloseWith closes the connection with a websocket close code and reason
+	CloseWith(code int, text string)
+}
+
+// Member is someone who joined a room, whether or not they are connected
+//   - Role: what the member may do, each room type has its own, e.g. white or spectator
+//   - Conn: the connection of the member, nil while they aren't connected
+//   - Logger: logs of the current connection
+type Member struct {
+	ID     string
+	Role   string
+	Conn   Conn
+	Joined time.Time
+	Logger *slog.Logger
+}
+
+// Send queues a message for the member, it's dropped when the member isn't connected
+func (m *Member) Send(data []byte) bool {
+	if m.Conn == nil {
+		return false
+	}
+	return m.Conn.Send(data)
+}
+
+// Room is a set of members kept in the order they joined
+//   - LastActivity: last time someone joined, connected, left or sent a message
+type Room struct {
+	ID           string
+	LastActivity time.Time
+	members      map[string]*Member
+	order        []string
+}
+
+func newRoom(id string) *Room {
+	return &Room{
+		ID:           id,
+		LastActivity: time.Now(),
+		members:      map[string]*Member{},
+	}
+}
+
+// Join adds a member with a role, joining again only changes the role
+func (r *Room) Join(id, role string) *Member {
+	r.LastActivity = time.Now()
+	if member, ok := r.members[id]; ok {
+		member.Role = role
+		return member
+	}
+	member := &Member{ID: id, Role: role, Joined: time.Now()}
+	r.members[id] = member
+	r.order = append(r.order, id)
+	return member
+}
+
+// Leave removes a member and closes their connection, the messages queued before are still
+// delivered
+func (r *Room) Leave(id string) {
+	member, ok := r.members[id]
+	if !ok {
+		return
+	}
+	if member.Conn != nil {
+		member.Conn.Close()
+	}
+	delete(r.members, id)
+	for i, v := range r.order {
+		if v == id {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+	r.LastActivity = time.Now()
+}
+
+// Member returns a member of the room, nil when there is none with the id
+func (r *Room) Member(id string) *Member {
+	return r.members[id]
+}
+
+// Members returns the members, oldest first
+func (r *Room) Members() []*Member {
+	members := make([]*Member, 0, len(r.order))
+	for _, id := range r.order {
+		members = append(members, r.members[id])
+	}
+	return members
+}
+
+// Len counts the members
+func (r *Room) Len() int {
+	return len(r.order)
+}
+
+// Count counts the members with a role
+func (r *Room) Count(role string) int {
+	count := 0
+	for _, member := range r.members {
+		if member.Role == role {
+			count++
+		}
+	}
+	return count
+}
+
+// Online tells whether any member is connected
+func (r *Room) Online() bool {
+	for _, member := range r.members {
+		if member.Conn != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Send queues a message for a member, it's dropped when the member isn't connected
+func (r *Room) Send(id string, data []byte) bool {
+	member, ok := r.members[id]
+	return ok && member.Send(data)
+}
+
+// Broadcast queues a message for every connected member but exclude, an empty exclude sends it
+// to everyone
+func (r *Room) Broadcast(exclude string, data []byte) {
+	for _, member := range r.members {
+		if member.ID != exclude {
+			member.Send(data)
+		}
+	}
+}
+
+// close closes every connection, the members stay
+func (r *Room) close() {
+	for _, member := range r.members {
+		if member.Conn != nil {
+			member.Conn.Close()
+		}
+	}
+}
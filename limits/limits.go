@@ -0,0 +1,63 @@
+package limits
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/metrics"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+// how long an IP is remembered after its last request
+const EXPIRY = 10 * time.Minute
+
+var (
+	ErrTooManyRequests = errors.New("too many requests, try again in a moment")
+	ErrTooManyMessages = errors.New("too many messages, slow down")
+	ErrTooManyRooms    = errors.New("the server is full, try again later")
+)
+
+// Requests returns a middleware limiting how often an IP may call a route, every route using
+// the same middleware shares the allowance
+func Requests(cfg config.Limits) echo.MiddlewareFunc {
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:      rate.Limit(cfg.Requests),
+			Burst:     cfg.RequestBurst,
+			ExpiresIn: EXPIRY,
+		}),
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return c.RealIP(), nil
+		},
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			metrics.Limited.WithLabelValues("requests").Inc()
+			c.Response().Header().Set("Retry-After", "1")
+			return c.JSON(http.StatusTooManyRequests, map[string]string{
+				"error": ErrTooManyRequests.Error(),
+			})
+		},
+		ErrorHandler: func(c echo.Context, err error) error {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": err.Error(),
+			})
+		},
+	})
+}
+
+// Messages returns the limiter of a single websocket connection
+func Messages(cfg config.Limits) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(cfg.Messages), cfg.MessageBurst)
+}
+
+// Full tells whether a server holding count rooms may not open another one
+func Full(cfg config.Limits, count int) bool {
+	full := cfg.MaxRooms > 0 && count >= cfg.MaxRooms
+	if full {
+		metrics.Limited.WithLabelValues("rooms").Inc()
+	}
+	return full
+}
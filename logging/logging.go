@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/labstack/echo/v4"
+)
+
+// LOGGER is the key of the request logger in the Echo context
+const LOGGER = "logger"
+
+var LEVELS = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// New returns the logger of the server, text while debugging and JSON in release so it can be collected
+func New(cfg *config.Config) *slog.Logger {
+	options := &slog.HandlerOptions{Level: LEVELS[cfg.Log.Level]}
+	if cfg.Mode == config.RELEASE {
+		return slog.New(slog.NewJSONHandler(os.Stderr, options))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, options))
+}
+
+// Middleware attaches a logger carrying the request id to every request and logs the request once it's done,
+// it must run after the request id middleware
+func Middleware(logger *slog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			requestLogger := logger.With("request_id", c.Response().Header().Get(echo.HeaderXRequestID))
+			c.Set(LOGGER, requestLogger)
+			err := next(c)
+			if err != nil {
+				// let Echo write the error response so the status is known
+				c.Error(err)
+			}
+			requestLogger.Info("request",
+				"method", c.Request().Method,
+				"path", c.Request().URL.Path,
+				"status", c.Response().Status,
+				"duration", time.Since(start),
+				"remote", c.RealIP(),
+			)
+			return nil
+		}
+	}
+}
+
+// FromContext returns the logger of a request, falling back to the default logger
+func FromContext(c echo.Context) *slog.Logger {
+	if logger, ok := c.Get(LOGGER).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -1,79 +1,280 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
+	"github.com/Qinbeans/chess-htmx/admin"
+	"github.com/Qinbeans/chess-htmx/analysis"
+	"github.com/Qinbeans/chess-htmx/auth"
+	"github.com/Qinbeans/chess-htmx/backplane"
+	"github.com/Qinbeans/chess-htmx/certs"
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/health"
+	"github.com/Qinbeans/chess-htmx/limits"
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/Qinbeans/chess-htmx/metrics"
 	"github.com/Qinbeans/chess-htmx/pieces"
+	"github.com/Qinbeans/chess-htmx/security"
 	"github.com/Qinbeans/chess-htmx/static"
+	"github.com/Qinbeans/chess-htmx/storage"
 	"github.com/Qinbeans/chess-htmx/template"
+	"github.com/Qinbeans/chess-htmx/themes"
 	"github.com/Qinbeans/chess-htmx/websockets"
 	"github.com/flosch/pongo2/v6"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	gommon "github.com/labstack/gommon/log"
 )
 
 func menu(c echo.Context) error {
 	return c.Render(200, "menu.dj", pongo2.Context{
 		"title":       "Menu",
 		"description": "Choose a what you want to do at Chess-HTMX",
+		"boards":      themes.BoardNames(),
+		"piece_sets":  themes.PIECE_SETS,
 	})
 }
 
-func room(c echo.Context) error {
-	params := c.QueryParams()
-	room := params.Get("room")
-	if room == "" {
-		return c.Redirect(302, "/")
-	}
-	client := params.Get("user")
-	if client == "" {
-		return c.Redirect(302, "/")
-	}
-	return c.Render(200, "room.dj", pongo2.Context{
-		"title":       "Chat Room",
-		"description": "Chat with a friend",
-		"room":        room,
-		"client":      client,
-	})
+// LOG_LEVELS maps the configured log level to the level of the Echo logger
+var LOG_LEVELS = map[string]gommon.Lvl{
+	"debug": gommon.DEBUG,
+	"info":  gommon.INFO,
+	"warn":  gommon.WARN,
+	"error": gommon.ERROR,
 }
 
 func main() {
-	mode := os.Getenv("Mode")
+	// the health check of the Docker image, reading the same configuration as the server
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		cfg, err := config.Load(os.Args[2:])
+		if err == nil {
+			err = health.Probe(cfg)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := logging.New(cfg)
+	slog.SetDefault(logger)
+	// fatal logs an error that prevents the server from running and exits
+	fatal := func(msg string, err error) {
+		logger.Error(msg, "error", err)
+		os.Exit(1)
+	}
 
-	address := ":8090"
+	logger.Info("starting", "mode", cfg.Mode, "address", cfg.Address, "backplane", cfg.Backplane.Backend)
 
-	log.Println(mode)
+	override := cfg.Override
+	if _, err := os.Stat("public/views"); err == nil && override == "" && cfg.Mode != config.RELEASE {
+		// running from the repository, pick up template changes without rebuilding
+		override = "."
+	}
 
-	if mode == "release" {
-		address = "0.0.0.0:80"
+	viewsFS, buildFS := embedded()
+	viewsDir := ""
+	if override != "" {
+		viewsDir = filepath.Join(override, "public/views")
+		buildFS = os.DirFS(filepath.Join(override, "build"))
 	}
 
 	// init Echo
 	server := echo.New()
-	server.Use(static.Middleware())
+	server.Logger.SetLevel(LOG_LEVELS[cfg.Log.Level])
+	server.Use(middleware.RequestID())
+	server.Use(logging.Middleware(logger))
+	server.Use(static.Middleware(cfg.Cache.TTL))
+	server.Use(security.Headers(cfg.Security))
+	server.Use(security.CSRF(cfg.TLS.Cert != ""))
 	// set renderer to our template
-	server.Renderer = template.New()
+	renderer, err := template.New(viewsFS, viewsDir, logger)
+	if err != nil {
+		fatal("failed to load templates", err)
+	}
+	server.Renderer = renderer
+	store, err := storage.New(cfg.Storage)
+	if err != nil {
+		fatal("failed to open storage", err)
+	}
+	bp, err := backplane.New(cfg.Backplane)
+	if err != nil {
+		fatal("failed to connect to the backplane", err)
+	}
+	defer bp.Close()
+	signer, err := auth.New(cfg.Auth)
+	if err != nil {
+		fatal("failed to create token signer", err)
+	}
+	if cfg.Auth.Secret == "" {
+		logger.Warn("no auth secret set, player tokens are invalidated on restart")
+	}
 	// gorilla/websocket middleware
-	ws := websockets.NewWSServer()
-	defer ws.Close()
-	chess := pieces.NewServer()
+	ws := websockets.NewWSServer(cfg, store, signer, websockets.NewHistory(cfg.Chat, store, logger), logger)
+	chess := pieces.NewServer(cfg, store, bp, signer, logger)
+	boards := analysis.NewServer(cfg, signer, logger)
+	if err := chess.Restore(); err != nil {
+		fatal("failed to restore games", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := chess.Listen(ctx); err != nil {
+		fatal("failed to subscribe to the backplane", err)
+	}
+	go chess.Reaper(ctx)
+	go ws.Reaper(ctx)
+	go boards.Reaper(ctx)
+	metrics.RegisterChess(chess.Stats)
+	metrics.RegisterChat(ws.Stats)
+	// the room endpoints share one allowance per IP
+	limited := limits.Requests(cfg.Limits)
 	// Chat
-	server.Static("/", "build")
-	server.POST("/getroom", ws.GetRoom)
-	server.POST("/joinroom", ws.ConnectToRoom)
+	server.StaticFS("/", buildFS)
+	server.POST("/getroom", ws.GetRoom, limited)
+	server.POST("/joinroom", ws.ConnectToRoom, limited)
 	server.GET("/", menu)
-	server.GET("/room", room)
-	server.GET("/room/ws", ws.WSHandler)
+	server.GET("/room", ws.Room)
+	server.GET("/room/ws", ws.WSHandler, limited)
+	server.POST("/room/report", ws.Report, limited)
 	// Chess
-	server.POST("/chess/new", chess.NewGame)
-	server.POST("/chess/join", chess.ConnectToRoom)
+	server.POST("/chess/new", chess.NewGame, limited)
+	server.POST("/chess/join", chess.ConnectToRoom, limited)
 	server.GET("/chess", chess.Room)
-	server.GET("/chess/ws", chess.WSHandler)
+	server.GET("/chess/ws", chess.WSHandler, limited)
+	// fallback for proxies refusing websocket upgrades, the messages are rate limited by the hub
+	// and the posts carrying them per IP as well
+	server.GET("/chess/events", chess.Events, limited)
+	server.POST("/chess/move", chess.PostMove, limited)
+	server.POST("/chess/cmd", chess.PostCommand, limited)
+	// finished games, live or archived, stepped through with htmx
+	server.GET("/chess/replay", chess.Replay)
+	// API
+	api := server.Group("/api")
+	api.GET("/openapi.json", chess.OpenAPI)
+	api.POST("/games", chess.APICreate, limited)
+	api.POST("/games/:room/join", chess.APIJoin, limited)
+	api.GET("/games/:room", chess.APIState)
+	api.GET("/games/:room/legal", chess.APILegal)
+	api.POST("/games/:room/moves", chess.APIMove, limited)
+	api.POST("/games/:room/resign", chess.APIResign, limited)
+	api.POST("/games/:room/draw", chess.APIDraw, limited)
+	api.GET("/games/:room/events", chess.APIEvents, limited)
+	// Bots, modelled on the Lichess bot API
+	server.POST("/chess/challenge", chess.Challenge, limited)
+	api.POST("/challenge/:bot", chess.BotChallenge, limited)
+	api.POST("/challenge/:room/accept", chess.BotAccept)
+	api.POST("/challenge/:room/decline", chess.BotDecline)
+	api.GET("/bot/account", chess.BotAccount)
+	api.GET("/stream/event", chess.BotEvents, limited)
+	api.GET("/bot/game/stream/:room", chess.BotGameStream, limited)
+	api.POST("/bot/game/:room/move/:move", chess.BotMove)
+	api.POST("/bot/game/:room/chat", chess.BotChat)
+	api.POST("/bot/game/:room/resign", chess.BotResign)
+	api.POST("/bot/game/:room/draw/:accept", chess.BotDraw)
+	// Analysis
+	server.POST("/analysis/new", boards.NewBoard, limited)
+	server.GET("/analysis", boards.Room, limited)
+	server.GET("/analysis/ws", boards.WSHandler, limited)
+	// Themes
+	server.StaticFS("/themes/pieces", themes.PieceFS())
+	server.GET("/themes/board.css", themes.Stylesheet)
+	server.POST("/themes", themes.Select)
+	// Monitoring
+	server.GET("/metrics", metrics.Handler())
+	server.GET("/healthz", health.Healthz)
+	server.GET("/readyz", health.Readyz(map[string]health.Check{
+		"templates": renderer.Loaded,
+		"storage":   store.Ping,
+		"backplane": bp.Ping,
+		"shutdown": func() error {
+			// stop receiving traffic while the connections drain
+			if ctx.Err() != nil {
+				return errors.New("shutting down")
+			}
+			return nil
+		},
+	}))
+	// Admin
+	if cfg.Admin.Password != "" {
+		admin.New(chess, ws, boards).Register(server.Group("/admin", admin.Auth(cfg.Admin)))
+	} else {
+		logger.Info("admin page disabled, no password set")
+	}
 	data, err := json.MarshalIndent(server.Routes(), "", "  ")
 	if err != nil {
-		server.Logger.Fatal(err)
+		fatal("failed to encode routes", err)
+	}
+	if err := os.WriteFile("routes.json", data, 0644); err != nil {
+		logger.Warn("failed to write routes.json", "error", err)
+	}
+	var redirect *http.Server
+	if cfg.TLS.Cert != "" {
+		reloader, err := certs.New(cfg.TLS.Cert, cfg.TLS.Key, logger)
+		if err != nil {
+			fatal("failed to load certificate", err)
+		}
+		go reloader.Watch(ctx)
+		server.TLSServer.Addr = cfg.Address
+		server.TLSServer.TLSConfig = reloader.Config()
+		if cfg.TLS.Redirect != "" {
+			redirect = certs.Redirect(cfg.TLS.Redirect, cfg.Address)
+			go func() {
+				if err := redirect.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					fatal("redirect server stopped", err)
+				}
+			}()
+		}
+	}
+	go func() {
+		var err error
+		if cfg.TLS.Cert != "" {
+			err = server.StartServer(server.TLSServer)
+		} else {
+			err = server.Start(cfg.Address)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("server stopped", err)
+		}
+	}()
+	<-ctx.Done()
+	stop()
+
+	// drain the games, chats and boards before closing the listener, websockets are not tracked by Echo
+	logger.Info("shutting down", "timeout", cfg.Shutdown.Timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout)
+	defer cancel()
+	if err := chess.Shutdown(shutdownCtx); err != nil {
+		logger.Error("chess shutdown", "error", err)
+	}
+	if err := ws.Shutdown(shutdownCtx); err != nil {
+		logger.Error("chat shutdown", "error", err)
+	}
+	if err := boards.Shutdown(shutdownCtx); err != nil {
+		logger.Error("analysis shutdown", "error", err)
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("http shutdown", "error", err)
+	}
+	if redirect != nil {
+		if err := redirect.Shutdown(shutdownCtx); err != nil {
+			logger.Error("redirect shutdown", "error", err)
+		}
 	}
-	os.WriteFile("routes.json", data, 0644)
-	server.Logger.Fatal(server.Start(address))
+	logger.Info("shutdown complete")
 }
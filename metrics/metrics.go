@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const NAMESPACE = "chess_htmx"
+
+// ChessStats is a snapshot of the chess server read on every scrape
+type ChessStats struct {
+	Games      int
+	Players    int
+	Spectators int
+}
+
+// ChatStats is a snapshot of the chat server read on every scrape
+type ChatStats struct {
+	Rooms       int
+	Connections int
+}
+
+var (
+	Moves = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "moves_total",
+		Help:      "Moves applied to a board.",
+	})
+	IllegalMoves = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "illegal_moves_total",
+		Help:      "Moves rejected by the server by reason.",
+	}, []string{"reason"})
+	GamesFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "games_finished_total",
+		Help:      "Games that ended by result and reason.",
+	}, []string{"result", "reason"})
+	RoomsExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "rooms_expired_total",
+		Help:      "Rooms removed for inactivity by server.",
+	}, []string{"server"})
+	Limited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "limited_total",
+		Help:      "Requests and messages refused by limit.",
+	}, []string{"limit"})
+	MoveValidation = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "move_validation_seconds",
+		Help:      "Time spent validating and applying a move.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 8),
+	})
+	MessageSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "websocket_message_bytes",
+		Help:      "Size of the websocket messages received by server.",
+		Buckets:   prometheus.ExponentialBuckets(16, 2, 10),
+	}, []string{"server"})
+)
+
+// RegisterChess exposes the live counts of the chess server
+func RegisterChess(stats func() ChessStats) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "chess_games",
+		Help:      "Chess rooms held by the server.",
+	}, func() float64 { return float64(stats().Games) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "chess_players",
+		Help:      "Players connected to a chess room.",
+	}, func() float64 { return float64(stats().Players) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "chess_spectators",
+		Help:      "Spectators connected to a chess room.",
+	}, func() float64 { return float64(stats().Spectators) })
+}
+
+// RegisterChat exposes the live counts of the chat server
+func RegisterChat(stats func() ChatStats) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "chat_rooms",
+		Help:      "Chat rooms held by the server.",
+	}, func() float64 { return float64(stats().Rooms) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "chat_connections",
+		Help:      "Connections to a chat room.",
+	}, func() float64 { return float64(stats().Connections) })
+}
+
+// Handler is a callback serving the metrics in the Prometheus text format
+func Handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
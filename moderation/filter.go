@@ -0,0 +1,72 @@
+package moderation
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Filter masks unwanted words in chat messages
+type Filter struct {
+	pattern *regexp.Regexp
+}
+
+// NewFilter returns a filter matching the words as whole words regardless of case, without
+// words nothing is masked
+func NewFilter(words []string) *Filter {
+	quoted := []string{}
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return &Filter{}
+	}
+	return &Filter{pattern: regexp.MustCompile(`(?i)(` + strings.Join(quoted, "|") + `)`)}
+}
+
+// wordRune tells whether r belongs to a word, \b of regexp only knows ASCII letters
+func wordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// matches returns the bounds of the filtered words of text standing as whole words
+func (f *Filter) matches(text string) [][]int {
+	if f.pattern == nil {
+		return nil
+	}
+	var found [][]int
+	for _, loc := range f.pattern.FindAllStringIndex(text, -1) {
+		before, _ := utf8.DecodeLastRuneInString(text[:loc[0]])
+		after, _ := utf8.DecodeRuneInString(text[loc[1]:])
+		if loc[0] > 0 && wordRune(before) || loc[1] < len(text) && wordRune(after) {
+			continue
+		}
+		found = append(found, loc)
+	}
+	return found
+}
+
+// Clean replaces every filtered word of text with as many asterisks as it has characters
+func (f *Filter) Clean(text string) string {
+	found := f.matches(text)
+	if len(found) == 0 {
+		return text
+	}
+	var clean strings.Builder
+	last := 0
+	for _, loc := range found {
+		clean.WriteString(text[last:loc[0]])
+		clean.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[loc[0]:loc[1]])))
+		last = loc[1]
+	}
+	clean.WriteString(text[last:])
+	return clean.String()
+}
+
+// Match tells whether text holds a filtered word
+func (f *Filter) Match(text string) bool {
+	return len(f.matches(text)) > 0
+}
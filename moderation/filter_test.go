@@ -0,0 +1,39 @@
+package moderation
+
+import "testing"
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		words []string
+		text  string
+		clean string
+	}{
+		{"no words", nil, "darn it", "darn it"},
+		{"blank words", []string{" ", ""}, "darn it", "darn it"},
+		{"whole word", []string{"darn"}, "darn it", "**** it"},
+		{"any case", []string{"darn"}, "DaRn it", "**** it"},
+		{"every occurrence", []string{"darn"}, "darn, darn!", "****, ****!"},
+		{"inside a word", []string{"ass"}, "pass the class", "pass the class"},
+		{"next to a digit", []string{"darn"}, "darn2 2darn", "darn2 2darn"},
+		{"next to an underscore", []string{"darn"}, "darn_it", "darn_it"},
+		{"several words", []string{"darn", "heck"}, "heck, darn", "****, ****"},
+		{"phrase", []string{"go away"}, "just go away now", "just ******* now"},
+		{"spaces trimmed", []string{"  darn "}, "darn", "****"},
+		{"regexp characters", []string{"a.b"}, "a.b axb", "*** axb"},
+		{"accented word", []string{"ñoño"}, "qué ñoño eres", "qué **** eres"},
+		{"accented neighbour", []string{"no"}, "ñno noé no", "ñno noé **"},
+		{"accented case", []string{"ÉCOLE"}, "l'école", "l'*****"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := NewFilter(tt.words)
+			if got := filter.Clean(tt.text); got != tt.clean {
+				t.Errorf("Clean(%q) = %q, want %q", tt.text, got, tt.clean)
+			}
+			if got, want := filter.Match(tt.text), tt.clean != tt.text; got != want {
+				t.Errorf("Match(%q) = %v, want %v", tt.text, got, want)
+			}
+		})
+	}
+}
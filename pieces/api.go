@@ -0,0 +1,350 @@
+package pieces
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Qinbeans/chess-htmx/limits"
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// OPENAPI describes the API, served at /api/openapi.json
+//
+//go:embed openapi.json
+var OPENAPI []byte
+
+// GameState is a game as the API describes it
+//   - Color: color of the client asking, empty for spectators
+//   - Moves: the moves played so far in UCI notation
+//   - Clocks: milliseconds left for each color, only in timed games
+//   - DrawOffer: color of the player offering a draw
+type GameState struct {
+	Room      string           `json:"room"`
+	Color     string           `json:"color,omitempty"`
+	FEN       string           `json:"fen"`
+	Turn      string           `json:"turn"`
+	Moves     []string         `json:"moves"`
+	Clocks    map[string]int64 `json:"clocks,omitempty"`
+	Result    string           `json:"result,omitempty"`
+	Reason    string           `json:"reason,omitempty"`
+	DrawOffer string           `json:"draw_offer,omitempty"`
+}
+
+// MoveRequest is a move posted to the API, either as UCI or as its squares, Promotion is the
+// letter of the piece a pawn reaching the last rank becomes when given as squares
+type MoveRequest struct {
+	Move      string `json:"move" form:"move"`
+	From      string `json:"from" form:"from"`
+	To        string `json:"to" form:"to"`
+	Promotion string `json:"promotion" form:"promotion"`
+}
+
+// *****************************************************************************
+
+// apiError answers an API request with an error
+func apiError(c echo.Context, status int, err error) error {
+	return c.JSON(status, map[string]string{
+		"error": err.Error(),
+		"type":  "chess",
+	})
+}
+
+// state describes a game for a client of the room
+func (g *Server) state(room, user string) GameState {
+	game := g.Games[room]
+	state := GameState{
+		Room:      room,
+		FEN:       game.FEN(),
+		Turn:      COLOR_NAMES[game.Turn],
+		Moves:     append([]string{}, game.Moves...),
+		Result:    game.Result,
+		Reason:    game.Reason,
+		DrawOffer: game.DrawOffer,
+	}
+	if color, ok := game.ClientColors[user]; ok {
+		state.Color = COLOR_NAMES[color]
+	}
+	if game.timed() {
+		state.Clocks = map[string]int64{
+			COLOR_NAMES[WHITE]: game.Remaining(WHITE).Milliseconds(),
+			COLOR_NAMES[BLACK]: game.Remaining(BLACK).Milliseconds(),
+		}
+	}
+	return state
+}
+
+// squares returns the squares and promotion of a move posted to the API, a king moving two squares
+// castles with the rook it moves towards as the board expects a king dragged onto its rook
+func squares(game *Game, req MoveRequest) (string, string, int, error) {
+	src, dst, letter := req.From, req.To, req.Promotion
+	if req.Move != "" {
+		if len(req.Move) != 4 && len(req.Move) != 5 {
+			return "", "", NONE, fmt.Errorf("%w %q, expected UCI such as e2e4 or e7e8q", ErrIllegalMove, req.Move)
+		}
+		src, dst, letter = req.Move[:2], req.Move[2:4], req.Move[4:]
+	}
+	promotion, err := ParsePromotion(letter)
+	if err != nil {
+		return "", "", NONE, err
+	}
+	x1, y1, err := parseSquare(src)
+	if err != nil {
+		return "", "", NONE, err
+	}
+	x2, y2, err := parseSquare(dst)
+	if err != nil {
+		return "", "", NONE, err
+	}
+	if game.Board[x1][y1].Piece&^BLACK == KING && y1 == 4 && x1 == x2 && (y2 == 2 || y2 == 6) {
+		rook := 0
+		if y2 == 6 {
+			rook = 7
+		}
+		dst = squareName(x2, rook)
+	}
+	return src, dst, promotion, nil
+}
+
+// ParsePromotion returns the piece of a promotion letter in UCI, NONE when there is no letter
+func ParsePromotion(letter string) (int, error) {
+	if letter == "" {
+		return NONE, nil
+	}
+	if len(letter) != 1 {
+		return NONE, ErrInvalidPromotion
+	}
+	promotion, ok := PROMOTIONS[strings.ToLower(letter)[0]]
+	if !ok {
+		return NONE, ErrInvalidPromotion
+	}
+	return promotion, nil
+}
+
+// LegalMoves lists the moves in UCI notation the color to move may play, a castle is the king
+// moving two squares
+func (g *Game) LegalMoves() []string {
+	if g.Result != "" {
+		return []string{}
+	}
+	return g.legalMoves(g.Turn)
+}
+
+// Squares returns the squares and promotion a move in UCI notation is made of on the board, a king
+// moving two squares is dragged onto the rook it castles with
+func (g *Game) Squares(uci string) (string, string, int, error) {
+	return squares(g, MoveRequest{Move: uci})
+}
+
+// Play plays a move in UCI notation for the color to move
+func (g *Game) Play(uci string) (Move, error) {
+	src, dst, promotion, err := g.Squares(uci)
+	if err != nil {
+		return Move{}, err
+	}
+	return g.Move(g.Turn, src, dst, promotion)
+}
+
+// withGame holds the game of an API request while fn acts on it, the client is the one of the
+// bearer token
+func (g *Server) withGame(c echo.Context, fn func(room, user string) error) error {
+	logger := logging.FromContext(c)
+	room := c.Param("room")
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if g.Hub.Closing() {
+		return shuttingDown(c)
+	}
+	if err := g.acquire(room); err != nil {
+		logger.Debug("room unavailable", "room", room, "error", err)
+		if errors.Is(err, ErrRoomNotFound) {
+			return apiError(c, http.StatusNotFound, err)
+		}
+		return apiError(c, http.StatusServiceUnavailable, err)
+	}
+	defer g.release(room)
+	user, err := g.authorizeBearer(c, room)
+	if err != nil {
+		logger.Debug("unauthorized", "room", room, "error", err)
+		return apiError(c, http.StatusUnauthorized, err)
+	}
+	return fn(room, user)
+}
+
+// OpenAPI is a callback for the OpenAPI description of the API
+func (g *Server) OpenAPI(c echo.Context) error {
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSON, OPENAPI)
+}
+
+// APICreate is a callback for creating a game through the API, the client plays white
+func (g *Server) APICreate(c echo.Context) error {
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if g.Hub.Closing() {
+		return shuttingDown(c)
+	}
+	if g.Hub.Full() {
+		return apiError(c, http.StatusServiceUnavailable, limits.ErrTooManyRooms)
+	}
+	room := uuid.New().String()
+	client := uuid.New().String()
+	g.create(room, client)
+	if err := g.share(room); err != nil {
+		return err
+	}
+	token, err := g.token(room, client)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, map[string]string{
+		"room":  room,
+		"id":    client,
+		"token": token,
+		"color": COLOR_NAMES[WHITE],
+	})
+}
+
+// APIJoin is a callback for joining a game through the API, as black or as a spectator when
+// spectate is set
+func (g *Server) APIJoin(c echo.Context) error {
+	room := c.Param("room")
+	var req struct {
+		Spectate bool `json:"spectate" form:"spectate"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return apiError(c, http.StatusBadRequest, err)
+	}
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if g.Hub.Closing() {
+		return shuttingDown(c)
+	}
+	if err := g.acquire(room); err != nil {
+		if errors.Is(err, ErrRoomNotFound) {
+			return apiError(c, http.StatusNotFound, err)
+		}
+		return apiError(c, http.StatusServiceUnavailable, err)
+	}
+	defer g.release(room)
+	client, err := g.join(room, req.Spectate)
+	if err != nil {
+		return apiError(c, http.StatusConflict, err)
+	}
+	token, err := g.token(room, client.String())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"room":  room,
+		"id":    client.String(),
+		"token": token,
+		"color": g.state(room, client.String()).Color,
+	})
+}
+
+// APIState is a callback for the state of a game
+func (g *Server) APIState(c echo.Context) error {
+	return g.withGame(c, func(room, user string) error {
+		return c.JSON(http.StatusOK, g.state(room, user))
+	})
+}
+
+// APILegal is a callback for the legal moves of the color to move, square narrows them to the
+// moves of the piece on it
+func (g *Server) APILegal(c echo.Context) error {
+	return g.withGame(c, func(room, user string) error {
+		game := g.Games[room]
+		moves := game.LegalMoves()
+		if square := c.QueryParam("square"); square != "" {
+			filtered := []string{}
+			for _, move := range moves {
+				if strings.HasPrefix(move, square) {
+					filtered = append(filtered, move)
+				}
+			}
+			moves = filtered
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"turn":  COLOR_NAMES[game.Turn],
+			"moves": moves,
+		})
+	})
+}
+
+// APIMove is a callback for a move of a player, the clients connected to the game are told as if
+// it was played over a websocket
+func (g *Server) APIMove(c echo.Context) error {
+	var req MoveRequest
+	if err := c.Bind(&req); err != nil {
+		return apiError(c, http.StatusBadRequest, err)
+	}
+	return g.withGame(c, func(room, user string) error {
+		src, dst, promotion, err := squares(g.Games[room], req)
+		if err != nil {
+			return apiError(c, http.StatusUnprocessableEntity, err)
+		}
+		move, err := g.play(user, room, src, dst, promotion, logging.FromContext(c).With("room", room, "user", user))
+		if errors.Is(err, ErrSpectator) {
+			return apiError(c, http.StatusForbidden, err)
+		}
+		if err != nil {
+			return apiError(c, http.StatusUnprocessableEntity, err)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"move":      move.UCI(),
+			"taken":     move.Taken,
+			"checkmate": move.Checkmate,
+			"state":     g.state(room, user),
+		})
+	})
+}
+
+// APIResign is a callback for a player resigning
+func (g *Server) APIResign(c echo.Context) error {
+	return g.withGame(c, func(room, user string) error {
+		if err := g.resign(user, room); err != nil {
+			return apiError(c, actionStatus(err), err)
+		}
+		return c.JSON(http.StatusOK, g.state(room, user))
+	})
+}
+
+// APIDraw is a callback for a player offering, accepting or declining a draw
+func (g *Server) APIDraw(c echo.Context) error {
+	var req struct {
+		Action string `json:"action" form:"action"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return apiError(c, http.StatusBadRequest, err)
+	}
+	return g.withGame(c, func(room, user string) error {
+		if err := g.draw(user, room, req.Action); err != nil {
+			return apiError(c, actionStatus(err), err)
+		}
+		return c.JSON(http.StatusOK, g.state(room, user))
+	})
+}
+
+// actionStatus is the status of an action refused to a client
+func actionStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSpectator):
+		return http.StatusForbidden
+	case errors.Is(err, ErrGameOver), errors.Is(err, ErrNoDrawOffer):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// APIEvents is a callback for the event stream of a client, the same stream /chess/events serves
+func (g *Server) APIEvents(c echo.Context) error {
+	stream, err := g.stream(c, c.Param("room"), g.authorizeBearer, logging.FromContext(c))
+	if stream == nil {
+		return err
+	}
+	return stream.Serve(c.Request().Context(), c.Response())
+}
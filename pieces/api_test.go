@@ -0,0 +1,121 @@
+package pieces
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Qinbeans/chess-htmx/auth"
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/labstack/echo/v4"
+)
+
+// newAPI returns a test server serving the game API
+func newAPI(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	g := newTestServer(t)
+	e := echo.New()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(logging.LOGGER, g.Logger)
+			return next(c)
+		}
+	})
+	e.POST("/api/games", g.APICreate)
+	e.GET("/api/games/:room", g.APIState)
+	e.GET("/api/games/:room/legal", g.APILegal)
+	e.GET("/api/games/:room/events", g.APIEvents)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	return g, server
+}
+
+// request sends a request to the API with header and returns the status and the decoded answer
+func request(t *testing.T, server *httptest.Server, method, path string, header http.Header) (int, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body := map[string]interface{}{}
+	json.NewDecoder(res.Body).Decode(&body)
+	return res.StatusCode, body
+}
+
+// newAPIGame creates a game through the API and returns its room and the token of white
+func newAPIGame(t *testing.T, server *httptest.Server) (string, string) {
+	t.Helper()
+	status, body := request(t, server, http.MethodPost, "/api/games", nil)
+	if status != http.StatusCreated {
+		t.Fatalf("creating a game answered %d: %v", status, body)
+	}
+	return body["room"].(string), body["token"].(string)
+}
+
+func TestAPIAuth(t *testing.T) {
+	_, server := newAPI(t)
+	room, token := newAPIGame(t, server)
+	cookie := (&http.Cookie{Name: "chess_" + room, Value: token}).String()
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+	}{
+		{"bearer", "/api/games/" + room, http.Header{"Authorization": {"Bearer " + token}}, http.StatusOK},
+		{"missing", "/api/games/" + room, nil, http.StatusUnauthorized},
+		{"empty bearer", "/api/games/" + room, http.Header{"Authorization": {"Bearer "}}, http.StatusUnauthorized},
+		{"empty bearer with a cookie", "/api/games/" + room, http.Header{"Authorization": {"Bearer "}, "Cookie": {cookie}}, http.StatusUnauthorized},
+		{"cookie", "/api/games/" + room, http.Header{"Cookie": {cookie}}, http.StatusUnauthorized},
+		{"subprotocol", "/api/games/" + room, http.Header{"Sec-Websocket-Protocol": {auth.PROTOCOL + ", " + token}}, http.StatusUnauthorized},
+		{"events with a cookie", "/api/games/" + room + "/events", http.Header{"Authorization": {"Bearer "}, "Cookie": {cookie}}, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, body := request(t, server, http.MethodGet, test.path, test.header); status != test.status {
+				t.Fatalf("got %d, want %d: %v", status, test.status, body)
+			}
+		})
+	}
+}
+
+func TestAPILegalCastles(t *testing.T) {
+	g, server := newAPI(t)
+	room, token := newAPIGame(t, server)
+	position, err := ParseFEN("r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Hub.Lock()
+	g.Games[room].Board = position.Board
+	g.Games[room].Castling = position.Castling
+	g.Hub.Unlock()
+	status, body := request(t, server, http.MethodGet, "/api/games/"+room+"/legal", http.Header{"Authorization": {"Bearer " + token}})
+	if status != http.StatusOK {
+		t.Fatalf("got %d: %v", status, body)
+	}
+	count := map[string]int{}
+	for _, move := range body["moves"].([]interface{}) {
+		count[move.(string)]++
+	}
+	// the rook moving onto its king isn't another castle
+	for _, castle := range []string{"e1g1", "e1c1"} {
+		if count[castle] != 1 {
+			t.Errorf("%s is listed %d times", castle, count[castle])
+		}
+	}
+	for move, n := range count {
+		if n > 1 {
+			t.Errorf("%s is listed %d times", move, n)
+		}
+	}
+}
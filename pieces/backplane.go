@@ -0,0 +1,438 @@
+package pieces
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/backplane"
+)
+
+const (
+	// channel the instances publish the events of every game on
+	EVENTS = "chess:events"
+	// how long an instance may hold a game, it's let go as soon as the message at hand is handled
+	CLAIM_TTL = 5 * time.Second
+	// how long an instance waits for another one to let go of a game
+	CLAIM_TIMEOUT = 2 * time.Second
+	CLAIM_RETRY   = 10 * time.Millisecond
+)
+
+var ErrBusy = errors.New("the game is busy, try again")
+
+// Shared is the state of a game on the backplane
+//   - Members: the clients of the room, Instance names the instance a client is connected to
+type Shared struct {
+	Game         *Game        `json:"game"`
+	Members      []Membership `json:"members"`
+	LastActivity time.Time    `json:"last_activity"`
+}
+
+// Membership is a client of a shared game
+type Membership struct {
+	ID       string `json:"id"`
+	Role     string `json:"role"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// Event is a message of a game passed between instances, each delivers it to its own clients
+//   - To: the only client to deliver to, empty for every client but Exclude
+//   - Sync: the clients of the room changed, instances load it again instead of delivering
+//   - Bot: the bot whose event stream Data goes to, whatever instance it's connected to
+type Event struct {
+	Instance string          `json:"instance"`
+	Room     string          `json:"room,omitempty"`
+	Bot      string          `json:"bot,omitempty"`
+	To       string          `json:"to,omitempty"`
+	Exclude  string          `json:"exclude,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	Sync     bool            `json:"sync,omitempty"`
+}
+
+func gameKey(room string) string {
+	return "chess:game:" + room
+}
+
+func claimKey(room string) string {
+	return "chess:claim:" + room
+}
+
+// take waits for the other goroutines of this instance acting on a game to be done with it and
+// marks it busy until free is called, the hub is unlocked while waiting so the goroutines can do
+// backplane I/O without holding up every other game
+func (g *Server) take(room string) error {
+	deadline := time.NewTimer(CLAIM_TIMEOUT)
+	defer deadline.Stop()
+	for g.busy[room] != nil {
+		busy := g.busy[room]
+		g.Hub.Unlock()
+		select {
+		case <-busy:
+		case <-deadline.C:
+			g.Hub.Lock()
+			g.Logger.Warn("game held by another request", "room", room)
+			return ErrBusy
+		}
+		g.Hub.Lock()
+	}
+	g.busy[room] = make(chan struct{})
+	return nil
+}
+
+// free lets the next goroutine waiting in take act on a game
+func (g *Server) free(room string) {
+	close(g.busy[room])
+	delete(g.busy, room)
+}
+
+// acquire claims a game for this instance and loads its latest state, every acquire is followed
+// by a release once the game was acted on. The hub is locked on entry and on return but unlocked
+// while the backplane is used, the game stays busy meanwhile
+func (g *Server) acquire(room string) error {
+	if !g.Backplane.Shared() {
+		if g.Games[room] == nil {
+			return ErrRoomNotFound
+		}
+		return nil
+	}
+	if err := g.take(room); err != nil {
+		return err
+	}
+	g.Hub.Unlock()
+	shared, err := g.claim(room)
+	g.Hub.Lock()
+	if err := g.apply(room, shared, err); err != nil {
+		g.free(room)
+		return err
+	}
+	data, _ := json.Marshal(g.members(room))
+	g.claimed[room] = string(data)
+	return nil
+}
+
+// claim claims a game on the backplane and fetches its state, the claim is let go when the
+// state can't be fetched
+func (g *Server) claim(room string) (*Shared, error) {
+	deadline := time.Now().Add(CLAIM_TIMEOUT)
+	for {
+		ok, err := g.Backplane.Claim(claimKey(room), g.Instance, CLAIM_TTL)
+		if err != nil {
+			g.Logger.Error("failed to claim game", "room", room, "error", err)
+			return nil, ErrBusy
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			g.Logger.Warn("game held by another instance", "room", room)
+			return nil, ErrBusy
+		}
+		time.Sleep(CLAIM_RETRY)
+	}
+	shared, err := g.fetch(room)
+	if err != nil {
+		if err := g.Backplane.Release(claimKey(room), g.Instance); err != nil {
+			g.Logger.Error("failed to release game", "room", room, "error", err)
+		}
+		return nil, err
+	}
+	return shared, nil
+}
+
+// release stores a game claimed by acquire and lets it go, a game removed meanwhile is deleted
+// from the backplane and the other instances are told when its clients changed. Like acquire it
+// unlocks the hub while the backplane is used
+func (g *Server) release(room string) {
+	before, ok := g.claimed[room]
+	if !ok {
+		return
+	}
+	delete(g.claimed, room)
+	var data []byte
+	after := ""
+	if g.Games[room] != nil {
+		var err error
+		if data, err = g.encode(room); err != nil {
+			g.Logger.Error("failed to encode game", "room", room, "error", err)
+		}
+		members, _ := json.Marshal(g.members(room))
+		after = string(members)
+	}
+	g.Hub.Unlock()
+	if after == "" {
+		if err := g.Backplane.Delete(gameKey(room)); err != nil {
+			g.Logger.Error("failed to delete shared game", "room", room, "error", err)
+		}
+	} else if data != nil {
+		if err := g.Backplane.Set(gameKey(room), data, g.sharedTTL()); err != nil {
+			g.Logger.Error("failed to store game", "room", room, "error", err)
+		}
+	}
+	if err := g.Backplane.Release(claimKey(room), g.Instance); err != nil {
+		g.Logger.Error("failed to release game", "room", room, "error", err)
+	}
+	g.Hub.Lock()
+	g.free(room)
+	if after != before {
+		g.publish(Event{Room: room, Sync: true})
+	}
+}
+
+// share stores a game just created here on the backplane before anyone is told about it, the
+// game is busy while the hub is unlocked for it
+func (g *Server) share(room string) error {
+	if !g.Backplane.Shared() {
+		return nil
+	}
+	data, err := g.encode(room)
+	if err != nil {
+		return err
+	}
+	if err := g.take(room); err != nil {
+		return err
+	}
+	g.Hub.Unlock()
+	err = g.Backplane.Set(gameKey(room), data, g.sharedTTL())
+	g.Hub.Lock()
+	g.free(room)
+	return err
+}
+
+// refresh loads a game again after another instance changed it, unless a goroutine of this
+// instance is acting on it and so already holds its latest state
+func (g *Server) refresh(room string) {
+	if g.Hub.Room(room) == nil || g.busy[room] != nil {
+		return
+	}
+	g.take(room)
+	g.Hub.Unlock()
+	shared, err := g.fetch(room)
+	g.Hub.Lock()
+	g.apply(room, shared, err)
+	g.free(room)
+}
+
+// resync loads every game again once events may have been missed
+func (g *Server) resync() {
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	g.Logger.Warn("events may have been missed, loading the games again", "count", len(g.Games))
+	for _, room := range g.rooms() {
+		g.refresh(room)
+	}
+}
+
+// rooms lists the ids of the games, for loops that unlock the hub as they go
+func (g *Server) rooms() []string {
+	rooms := make([]string, 0, len(g.Games))
+	for room := range g.Games {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// fetch returns the state of a game on the backplane
+func (g *Server) fetch(room string) (*Shared, error) {
+	data, err := g.Backplane.Get(gameKey(room))
+	if errors.Is(err, backplane.ErrNotFound) {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		g.Logger.Error("failed to load game", "room", room, "error", err)
+		return nil, ErrBusy
+	}
+	var shared Shared
+	if err := json.Unmarshal(data, &shared); err != nil || shared.Game == nil {
+		g.Logger.Error("invalid shared game", "room", room, "error", err)
+		return nil, ErrBusy
+	}
+	return &shared, nil
+}
+
+// apply replaces the state of a game with the one fetched, or the error fetching it, a game
+// missing on the backplane is removed along with the connections to it
+func (g *Server) apply(room string, shared *Shared, err error) error {
+	if errors.Is(err, ErrRoomNotFound) {
+		if g.Games[room] != nil {
+			g.drop(room)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if g.Games[room] == nil {
+		g.Games[room] = shared.Game
+		g.Hub.Create(room)
+	} else {
+		// the game is updated in place, timers hold on to it
+		*g.Games[room] = *shared.Game
+	}
+	hubRoom := g.Hub.Room(room)
+	last := hubRoom.LastActivity
+	members := map[string]bool{}
+	remote := map[string]string{}
+	for _, m := range shared.Members {
+		members[m.ID] = true
+		if member := hubRoom.Member(m.ID); member != nil {
+			member.Role = m.Role
+		} else {
+			hubRoom.Join(m.ID, m.Role)
+		}
+		if m.Instance != "" && m.Instance != g.Instance {
+			remote[m.ID] = m.Instance
+		}
+	}
+	for _, member := range hubRoom.Members() {
+		if !members[member.ID] {
+			// kicked or gone through another instance
+			hubRoom.Leave(member.ID)
+		}
+	}
+	hubRoom.LastActivity = last
+	if shared.LastActivity.After(last) {
+		hubRoom.LastActivity = shared.LastActivity
+	}
+	g.Remote[room] = remote
+	return nil
+}
+
+// members lists the clients of a game with the instance each is connected to
+func (g *Server) members(room string) []Membership {
+	members := []Membership{}
+	for _, member := range g.Hub.Room(room).Members() {
+		m := Membership{ID: member.ID, Role: member.Role, Instance: g.Remote[room][member.ID]}
+		// clients of an instance shutting down are about to be disconnected
+		if member.Conn != nil && !g.Hub.Closing() {
+			m.Instance = g.Instance
+		}
+		members = append(members, m)
+	}
+	return members
+}
+
+// encode returns the state of a game to store on the backplane
+func (g *Server) encode(room string) ([]byte, error) {
+	return json.Marshal(Shared{
+		Game:         g.Games[room],
+		Members:      g.members(room),
+		LastActivity: g.Hub.Room(room).LastActivity,
+	})
+}
+
+// sharedTTL is how long a game is kept on the backplane, a while longer than any room may stay
+// idle in case every instance holding it goes away
+func (g *Server) sharedTTL() time.Duration {
+	return g.Rooms.IdleTTL + g.Rooms.AbandonedTTL
+}
+
+// drop forgets a game on this instance and closes the connections to it
+func (g *Server) drop(room string) {
+	delete(g.Games, room)
+	delete(g.Remote, room)
+	g.Hub.Remove(room)
+}
+
+// outbox holds the events of this instance until they're published, they're queued while the
+// hub is locked and sent in order by a single goroutine at a time
+//   - sending: held while a batch is published so batches don't overtake each other
+//   - ready: signaled once events are queued
+type outbox struct {
+	lock    sync.Mutex
+	sending sync.Mutex
+	events  [][]byte
+	ready   chan struct{}
+}
+
+// push queues an event
+func (o *outbox) push(data []byte) {
+	o.lock.Lock()
+	o.events = append(o.events, data)
+	o.lock.Unlock()
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take empties the queue
+func (o *outbox) take() [][]byte {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	events := o.events
+	o.events = nil
+	return events
+}
+
+// publish queues an event of this instance for the others
+func (g *Server) publish(event Event) {
+	if !g.Backplane.Shared() {
+		return
+	}
+	event.Instance = g.Instance
+	data, err := json.Marshal(event)
+	if err != nil {
+		g.Logger.Error("failed to encode event", "room", event.Room, "error", err)
+		return
+	}
+	g.outbox.push(data)
+}
+
+// dispatch publishes the queued events as they come until ctx is done
+func (g *Server) dispatch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-g.outbox.ready:
+			g.flush()
+		}
+	}
+}
+
+// flush publishes the queued events in order
+func (g *Server) flush() {
+	g.outbox.sending.Lock()
+	defer g.outbox.sending.Unlock()
+	for _, data := range g.outbox.take() {
+		if err := g.Backplane.Publish(EVENTS, data); err != nil {
+			g.Logger.Error("failed to publish event", "error", err)
+		}
+	}
+}
+
+// deliver hands an event of another instance to the clients connected here
+func (g *Server) deliver(data []byte) {
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		g.Logger.Warn("invalid event", "error", err)
+		return
+	}
+	if event.Instance == g.Instance {
+		return
+	}
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if event.Bot != "" {
+		if stream := g.botStreams[event.Bot]; stream != nil {
+			stream.Send(event.Data)
+		}
+		return
+	}
+	room := g.Hub.Room(event.Room)
+	if room == nil {
+		// nobody here is in the game
+		return
+	}
+	if event.Sync {
+		g.refresh(event.Room)
+		return
+	}
+	if event.To != "" {
+		room.Send(event.To, event.Data)
+	} else {
+		room.Broadcast(event.Exclude, event.Data)
+	}
+}
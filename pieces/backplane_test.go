@@ -0,0 +1,98 @@
+package pieces
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/backplane"
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newSharedServer returns a test server on a Redis backplane
+func newSharedServer(t *testing.T, server *miniredis.Miniredis, instance string) *Server {
+	t.Helper()
+	bp, err := backplane.NewRedis(config.Backplane{Address: server.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bp.Close()
+	})
+	g := newTestServer(t)
+	g.Backplane = bp
+	g.Instance = instance
+	return g
+}
+
+func TestAcquireUnlocksHub(t *testing.T) {
+	server := miniredis.RunT(t)
+	g := newSharedServer(t, server, "a")
+	g.Hub.Lock()
+	for _, room := range []string{"held", "free"} {
+		g.create(room, room+"-white")
+		if err := g.share(room); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.Hub.Unlock()
+	// another instance is acting on the game
+	server.Set(claimKey("held"), "b")
+
+	waited := make(chan error)
+	go func() {
+		g.Hub.Lock()
+		defer g.Hub.Unlock()
+		err := g.acquire("held")
+		if err == nil {
+			g.release("held")
+		}
+		waited <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// the other game is played while the first one waits for its claim
+	acquired := make(chan error)
+	go func() {
+		g.Hub.Lock()
+		defer g.Hub.Unlock()
+		err := g.acquire("free")
+		if err == nil {
+			g.release("free")
+		}
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("acquiring the free game: %v", err)
+		}
+	case <-time.After(CLAIM_TIMEOUT / 2):
+		t.Fatal("the free game waited for the held one")
+	}
+	if err := <-waited; !errors.Is(err, ErrBusy) {
+		t.Fatalf("acquiring the held game: got %v, want %v", err, ErrBusy)
+	}
+
+	// once let go the game is acquired with the state the other instance stored
+	server.Del(claimKey("held"))
+	other := newSharedServer(t, server, "b")
+	other.Hub.Lock()
+	if err := other.acquire("held"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Games["held"].Play("e2e4"); err != nil {
+		t.Fatal(err)
+	}
+	other.release("held")
+	other.Hub.Unlock()
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if err := g.acquire("held"); err != nil {
+		t.Fatal(err)
+	}
+	defer g.release("held")
+	if moves := g.Games["held"].Moves; len(moves) != 1 || moves[0] != "e2e4" {
+		t.Fatalf("moves %v, want the move played by the other instance", moves)
+	}
+}
@@ -0,0 +1,709 @@
+package pieces
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/Qinbeans/chess-htmx/bots"
+	"github.com/Qinbeans/chess-htmx/limits"
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/Qinbeans/chess-htmx/metrics"
+	"github.com/Qinbeans/chess-htmx/socket"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	ErrChallengeNotFound = errors.New("challenge not found")
+	ErrNotPlaying        = errors.New("the bot doesn't play this game")
+	ErrInvalidColor      = errors.New("color is white, black or random")
+	ErrChallengerGone    = errors.New("the challenger left the game")
+)
+
+// BOT_STATUS is the status of a game in the bot API for each reason a game ends, as Lichess names
+// them, a game being played has no reason
+var BOT_STATUS = map[string]string{
+	"":                "started",
+	"checkmate":       "mate",
+	"timeout":         "outoftime",
+	"abandoned":       "timeout",
+	"resignation":     "resign",
+	"agreement":       "draw",
+	"stalemate":       "stalemate",
+	"fifty-move rule": "draw",
+}
+
+// BotPlayer is a side of a game or challenge in the bot API, ID is the name of a bot and the
+// client id of anyone else
+type BotPlayer struct {
+	ID  string `json:"id"`
+	Bot bool   `json:"bot"`
+}
+
+// BotTimeControl is the clock of a challenge in seconds, unlimited games have no limit
+type BotTimeControl struct {
+	Type      string `json:"type"`
+	Limit     int64  `json:"limit,omitempty"`
+	Increment int64  `json:"increment,omitempty"`
+}
+
+// Challenge is a game offered to a bot, the game waits in its room with the challenger seated
+// until the bot accepts or declines
+//   - ID: the room of the game
+//   - Color: the color the challenger asked for, white, black or random
+//   - FinalColor: the color the challenger plays
+type Challenge struct {
+	ID          string         `json:"id"`
+	Status      string         `json:"status"`
+	Challenger  BotPlayer      `json:"challenger"`
+	DestUser    BotPlayer      `json:"destUser"`
+	Rated       bool           `json:"rated"`
+	TimeControl BotTimeControl `json:"timeControl"`
+	Color       string         `json:"color"`
+	FinalColor  string         `json:"finalColor"`
+}
+
+// BotGameState is the state of a game in the game stream of a bot
+//   - Moves: the moves played so far in UCI notation, separated by spaces
+//   - WTime, BTime: milliseconds left for each color, WInc and BInc their increments
+//   - Winner: the winning color once the game is over, empty for draws
+//   - WDraw, BDraw: whether a color offers a draw
+type BotGameState struct {
+	Type   string `json:"type"`
+	Moves  string `json:"moves"`
+	WTime  int64  `json:"wtime"`
+	BTime  int64  `json:"btime"`
+	WInc   int64  `json:"winc"`
+	BInc   int64  `json:"binc"`
+	Status string `json:"status"`
+	Winner string `json:"winner,omitempty"`
+	WDraw  bool   `json:"wdraw"`
+	BDraw  bool   `json:"bdraw"`
+}
+
+// BotGameFull is the first line of the game stream of a bot, later lines only carry the state
+type BotGameFull struct {
+	Type       string       `json:"type"`
+	ID         string       `json:"id"`
+	White      BotPlayer    `json:"white"`
+	Black      BotPlayer    `json:"black"`
+	InitialFen string       `json:"initialFen"`
+	State      BotGameState `json:"state"`
+}
+
+// BotGame is a game in the event stream of a bot
+type BotGame struct {
+	GameID   string    `json:"gameId"`
+	Color    string    `json:"color"`
+	FEN      string    `json:"fen"`
+	IsMyTurn bool      `json:"isMyTurn"`
+	Opponent BotPlayer `json:"opponent"`
+	Status   string    `json:"status"`
+	Winner   string    `json:"winner,omitempty"`
+}
+
+// BotEvent is a line of the event stream of a bot, carrying either a challenge or a game
+type BotEvent struct {
+	Type      string     `json:"type"`
+	Challenge *Challenge `json:"challenge,omitempty"`
+	Game      *BotGame   `json:"game,omitempty"`
+}
+
+// *****************************************************************************
+
+// botSeat returns the client a bot plays a game as
+func (g *Game) botSeat(name string) (string, bool) {
+	for user, bot := range g.Bots {
+		if bot == name {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// player describes the client playing a color for the bot API
+func (g *Game) player(color int) BotPlayer {
+	for user, c := range g.ClientColors {
+		if c != color {
+			continue
+		}
+		if name, ok := g.Bots[user]; ok {
+			return BotPlayer{ID: name, Bot: true}
+		}
+		return BotPlayer{ID: user}
+	}
+	return BotPlayer{}
+}
+
+// botState returns the state of a game for the game stream of a bot
+func (g *Game) botState() BotGameState {
+	state := BotGameState{
+		Type:   "gameState",
+		Moves:  strings.Join(g.Moves, " "),
+		WTime:  g.Remaining(WHITE).Milliseconds(),
+		BTime:  g.Remaining(BLACK).Milliseconds(),
+		WInc:   g.TimeControl.Increment.Milliseconds(),
+		BInc:   g.TimeControl.Increment.Milliseconds(),
+		Status: BOT_STATUS[g.Reason],
+		WDraw:  g.DrawOffer == COLOR_NAMES[WHITE],
+		BDraw:  g.DrawOffer == COLOR_NAMES[BLACK],
+	}
+	if g.Result == WHITE_WINS {
+		state.Winner = COLOR_NAMES[WHITE]
+	} else if g.Result == BLACK_WINS {
+		state.Winner = COLOR_NAMES[BLACK]
+	}
+	return state
+}
+
+// botGame describes a game for the event stream of the bot playing it as user
+func (g *Server) botGame(room, user string) *BotGame {
+	game := g.Games[room]
+	color := game.ClientColors[user]
+	state := game.botState()
+	return &BotGame{
+		GameID:   room,
+		Color:    COLOR_NAMES[color],
+		FEN:      game.FEN(),
+		IsMyTurn: game.Result == "" && game.Turn == color,
+		Opponent: game.player(color ^ BLACK),
+		Status:   state.Status,
+		Winner:   state.Winner,
+	}
+}
+
+// notify sends an event to the event stream of a bot, through the instance it's connected to
+func (g *Server) notify(name string, event BotEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		g.Logger.Error("failed to encode bot event", "bot", name, "error", err)
+		return
+	}
+	if stream := g.botStreams[name]; stream != nil {
+		stream.Send(data)
+		return
+	}
+	g.publish(Event{Bot: name, Data: data})
+}
+
+// finished counts a game that just ended and tells the bots playing it
+func (g *Server) finished(room string) {
+	game := g.Games[room]
+	metrics.GamesFinished.WithLabelValues(game.Result, game.Reason).Inc()
+	for user, name := range game.Bots {
+		g.notify(name, BotEvent{Type: "gameFinish", Game: g.botGame(room, user)})
+	}
+}
+
+// challenge creates a game offered to a bot, the challenger is seated with the color they asked
+// for and the bot is told about it
+func (g *Server) challenge(name, color string) (string, string, error) {
+	bot, err := g.Bots.Get(name)
+	if err != nil {
+		return "", "", err
+	}
+	final := color
+	switch color {
+	case "", "random":
+		color = "random"
+		final = COLOR_NAMES[rand.Intn(2)*BLACK]
+	case COLOR_NAMES[WHITE], COLOR_NAMES[BLACK]:
+	default:
+		return "", "", ErrInvalidColor
+	}
+	room := uuid.New().String()
+	client := uuid.New().String()
+	g.create(room, client)
+	game := g.Games[room]
+	if final == COLOR_NAMES[BLACK] {
+		game.ClientColors[client] = BLACK
+		g.Hub.Room(room).Join(client, COLOR_NAMES[BLACK])
+	}
+	timeControl := BotTimeControl{Type: "unlimited"}
+	if game.timed() {
+		timeControl = BotTimeControl{
+			Type:      "clock",
+			Limit:     int64(game.TimeControl.Initial.Seconds()),
+			Increment: int64(game.TimeControl.Increment.Seconds()),
+		}
+	}
+	game.Challenge = &Challenge{
+		ID:          room,
+		Status:      "created",
+		Challenger:  BotPlayer{ID: client},
+		DestUser:    BotPlayer{ID: bot.Name, Bot: true},
+		TimeControl: timeControl,
+		Color:       color,
+		FinalColor:  final,
+	}
+	if err := g.share(room); err != nil {
+		g.drop(room)
+		return "", "", err
+	}
+	g.notify(bot.Name, BotEvent{Type: "challenge", Challenge: game.Challenge})
+	return room, client, nil
+}
+
+// acceptChallenge seats a bot in the game it was challenged to, the color left by the challenger,
+// the game is closed when the challenger left it meanwhile and the challenge is canceled when its
+// seat was taken
+func (g *Server) acceptChallenge(bot bots.Bot, room string) error {
+	game := g.Games[room]
+	if game.Challenge == nil || game.Challenge.DestUser.ID != bot.Name {
+		return ErrChallengeNotFound
+	}
+	if _, ok := game.ClientColors[game.Challenge.Challenger.ID]; !ok {
+		g.terminate(room, "terminated")
+		return ErrChallengerGone
+	}
+	color := WHITE
+	if game.Challenge.FinalColor == COLOR_NAMES[WHITE] {
+		color = BLACK
+	}
+	for _, c := range game.ClientColors {
+		if c == color {
+			// the seat of the bot went to someone else, the game goes on without it
+			game.Challenge.Status = "canceled"
+			g.notify(bot.Name, BotEvent{Type: "challengeCanceled", Challenge: game.Challenge})
+			game.Challenge = nil
+			return ErrRoomFull
+		}
+	}
+	user := uuid.New().String()
+	game.ClientColors[user] = color
+	if game.Bots == nil {
+		game.Bots = map[string]string{}
+	}
+	game.Bots[user] = bot.Name
+	game.Challenge = nil
+	g.Hub.Room(room).Join(user, COLOR_NAMES[color])
+	g.notify(bot.Name, BotEvent{Type: "gameStart", Game: g.botGame(room, user)})
+	return nil
+}
+
+// declineChallenge closes the room of a challenge, the challenger is told the bot declined
+func (g *Server) declineChallenge(bot bots.Bot, room string) error {
+	game := g.Games[room]
+	if game.Challenge == nil || game.Challenge.DestUser.ID != bot.Name {
+		return ErrChallengeNotFound
+	}
+	game.Challenge = nil
+	g.terminate(room, "declined")
+	return nil
+}
+
+// *****************************************************************************
+
+// botConn is the connection of a bot streaming a game, the messages of the room are turned into
+// the lines of the game stream as they are sent
+//   - state: the state of the game as told by the messages so far, kept here as the game may be
+//     held by another instance when its messages are delivered
+//   - initial: milliseconds on the clocks of a new game, for boards being reset
+type botConn struct {
+	*socket.Stream
+	server  *Server
+	room    string
+	user    string
+	state   BotGameState
+	initial int64
+}
+
+// Send writes the line a message of the room stands for, messages a bot has no use for are dropped
+func (b *botConn) Send(data []byte) bool {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return true
+	}
+	content := msg.Content
+	switch content["type"] {
+	case "board":
+		// sent once the bot connected, the game is held by this instance
+		game := b.server.Games[b.room]
+		b.state = game.botState()
+		b.initial = game.TimeControl.Initial.Milliseconds()
+		return b.emit(BotGameFull{
+			Type:       "gameFull",
+			ID:         b.room,
+			White:      game.player(WHITE),
+			Black:      game.player(BLACK),
+			InitialFen: "startpos",
+			State:      b.state,
+		})
+	case "move":
+		b.played(content["src"]+content["dst"]+content["promotion"], content)
+	case "castle":
+		b.played(content["k_src"]+content["k_dst"], content)
+	case "checkmate", "timeout", "resigned", "abandoned":
+		status := map[string]string{
+			"checkmate": "mate",
+			"timeout":   "outoftime",
+			"resigned":  "resign",
+			"abandoned": "timeout",
+		}
+		b.state.Status = status[content["type"]]
+		b.state.Winner = content["color"]
+	case "draw":
+		white := content["color"] == COLOR_NAMES[WHITE]
+		switch content["msg"] {
+		case "offer":
+			b.state.WDraw, b.state.BDraw = white, !white
+		case "agreement", "stalemate", "fifty-move rule":
+			b.state.Status = BOT_STATUS[content["msg"]]
+			b.state.WDraw, b.state.BDraw = false, false
+		default:
+			b.state.WDraw, b.state.BDraw = false, false
+		}
+	case "chat":
+		username := content["color"]
+		line := "player"
+		if content["channel"] == SPECTATORS {
+			username, line = SPECTATOR, "spectator"
+		}
+		return b.emit(map[string]string{
+			"type":     "chatLine",
+			"room":     line,
+			"username": username,
+			"text":     content["msg"],
+		})
+	case "cmd":
+		return b.command(msg)
+	default:
+		return true
+	}
+	return b.emit(b.state)
+}
+
+// played adds a move to the state along with the clocks it was played with
+func (b *botConn) played(move string, content map[string]string) {
+	if b.state.Moves == "" {
+		b.state.Moves = move
+	} else {
+		b.state.Moves += " " + move
+	}
+	fmt.Sscan(content["clock_white"], &b.state.WTime)
+	fmt.Sscan(content["clock_black"], &b.state.BTime)
+	b.state.WDraw, b.state.BDraw = false, false
+}
+
+// command writes the line a command stands for, the opponent coming and going and the board
+// being reset
+func (b *botConn) command(msg Message) bool {
+	switch msg.Content["msg"] {
+	case "connected", "disconnected":
+		member := b.server.Hub.Room(b.room).Member(msg.Author)
+		if member == nil || member.Role == SPECTATOR || msg.Author == b.user {
+			return true
+		}
+		return b.emit(map[string]interface{}{
+			"type": "opponentGone",
+			"gone": msg.Content["msg"] == "disconnected",
+		})
+	case "reset-ack":
+		b.state = BotGameState{
+			Type:   "gameState",
+			WTime:  b.initial,
+			BTime:  b.initial,
+			WInc:   b.state.WInc,
+			BInc:   b.state.BInc,
+			Status: BOT_STATUS[""],
+		}
+		return b.emit(b.state)
+	}
+	return true
+}
+
+// emit writes a line of the game stream
+func (b *botConn) emit(line interface{}) bool {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return true
+	}
+	return b.Stream.Send(data)
+}
+
+// *****************************************************************************
+
+// withBot answers a request of a bot, the bot is the one of the bearer token
+func (g *Server) withBot(c echo.Context, fn func(bot bots.Bot) error) error {
+	bot, err := g.Bots.FromRequest(c)
+	if errors.Is(err, bots.ErrMissingToken) || errors.Is(err, bots.ErrInvalidToken) {
+		logging.FromContext(c).Debug("unauthorized bot", "error", err)
+		return apiError(c, http.StatusUnauthorized, err)
+	}
+	if err != nil {
+		return err
+	}
+	return fn(bot)
+}
+
+// withBotGame holds the game of a request of a bot while fn acts on it, the bot must be playing it
+func (g *Server) withBotGame(c echo.Context, fn func(room, user string) error) error {
+	return g.withBot(c, func(bot bots.Bot) error {
+		room := c.Param("room")
+		g.Hub.Lock()
+		defer g.Hub.Unlock()
+		if g.Hub.Closing() {
+			return shuttingDown(c)
+		}
+		if err := g.acquire(room); err != nil {
+			if errors.Is(err, ErrRoomNotFound) {
+				return apiError(c, http.StatusNotFound, err)
+			}
+			return apiError(c, http.StatusServiceUnavailable, err)
+		}
+		defer g.release(room)
+		user, ok := g.Games[room].botSeat(bot.Name)
+		if !ok {
+			return apiError(c, http.StatusNotFound, ErrNotPlaying)
+		}
+		return fn(room, user)
+	})
+}
+
+// ok is the response to an action of a bot that went through
+func ok(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]bool{"ok": true})
+}
+
+// BotAccount is a callback for the account of a bot
+func (g *Server) BotAccount(c echo.Context) error {
+	return g.withBot(c, func(bot bots.Bot) error {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"id":        bot.Name,
+			"username":  bot.Name,
+			"title":     "BOT",
+			"createdAt": bot.Created.UnixMilli(),
+		})
+	})
+}
+
+// BotEvents is a callback for the event stream of a bot, the challenges waiting on it and the
+// games it plays are sent first, then challenges, games starting and games finishing as they
+// happen, a bot streaming again replaces its previous stream
+func (g *Server) BotEvents(c echo.Context) error {
+	return g.withBot(c, func(bot bots.Bot) error {
+		logger := logging.FromContext(c).With("bot", bot.Name, "transport", "ndjson")
+		g.Hub.Lock()
+		if g.Hub.Closing() {
+			g.Hub.Unlock()
+			return shuttingDown(c)
+		}
+		stream := socket.NewLines(g.Websocket)
+		if previous := g.botStreams[bot.Name]; previous != nil {
+			previous.Close()
+		}
+		g.botStreams[bot.Name] = stream
+		// the events are copied under the lock and encoded once it's let go
+		events := []BotEvent{}
+		for room, game := range g.Games {
+			if game.Challenge != nil && game.Challenge.DestUser.ID == bot.Name {
+				challenge := *game.Challenge
+				events = append(events, BotEvent{Type: "challenge", Challenge: &challenge})
+			}
+			if user, ok := game.botSeat(bot.Name); ok && game.Result == "" {
+				events = append(events, BotEvent{Type: "gameStart", Game: g.botGame(room, user)})
+			}
+		}
+		g.Hub.Unlock()
+		for _, event := range events {
+			if data, err := json.Marshal(event); err == nil {
+				stream.Send(data)
+			}
+		}
+		logger.Info("bot connected")
+		err := stream.Serve(c.Request().Context(), c.Response())
+		g.Hub.Lock()
+		if g.botStreams[bot.Name] == stream {
+			delete(g.botStreams, bot.Name)
+		}
+		g.Hub.Unlock()
+		logger.Info("bot disconnected")
+		return err
+	})
+}
+
+// BotGameStream is a callback for the game stream of a bot, it's the connection of the bot to
+// the room, the whole game is sent first and then its state after every change
+func (g *Server) BotGameStream(c echo.Context) error {
+	var stream *socket.Stream
+	err := g.withBotGame(c, func(room, user string) error {
+		stream = socket.NewLines(g.Websocket)
+		conn := &botConn{Stream: stream, server: g, room: room, user: user}
+		logger := logging.FromContext(c).With("transport", "ndjson", "bot", g.Games[room].Bots[user])
+		g.Hub.Attach(g.Hub.Room(room), g.Hub.Room(room).Member(user), conn, logger)
+		return nil
+	})
+	if stream == nil || err != nil {
+		return err
+	}
+	return stream.Serve(c.Request().Context(), c.Response())
+}
+
+// BotMove is a callback for a move of a bot in UCI notation
+func (g *Server) BotMove(c echo.Context) error {
+	return g.withBotGame(c, func(room, user string) error {
+		src, dst, promotion, err := squares(g.Games[room], MoveRequest{Move: c.Param("move")})
+		if err == nil {
+			_, err = g.play(user, room, src, dst, promotion, logging.FromContext(c).With("room", room, "user", user))
+		}
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, err)
+		}
+		return ok(c)
+	})
+}
+
+// BotChat is a callback for a chat message of a bot, bots only talk to the players
+func (g *Server) BotChat(c echo.Context) error {
+	text := c.FormValue("text")
+	return g.withBotGame(c, func(room, user string) error {
+		if _, err := chatText(map[string]interface{}{"msg": text}, g.Chat.Length); err != nil {
+			return apiError(c, http.StatusBadRequest, err)
+		}
+		g.handleChat(user, room, map[string]interface{}{"type": "chat", "msg": text})
+		return ok(c)
+	})
+}
+
+// BotResign is a callback for a bot resigning
+func (g *Server) BotResign(c echo.Context) error {
+	return g.withBotGame(c, func(room, user string) error {
+		if err := g.resign(user, room); err != nil {
+			return apiError(c, http.StatusBadRequest, err)
+		}
+		return ok(c)
+	})
+}
+
+// BotDraw is a callback for a bot answering a draw, yes offers or accepts one and no declines it
+func (g *Server) BotDraw(c echo.Context) error {
+	return g.withBotGame(c, func(room, user string) error {
+		game := g.Games[room]
+		action := "decline"
+		if c.Param("accept") == "yes" {
+			action = "offer"
+			if game.DrawOffer == COLOR_NAMES[game.ClientColors[user]^BLACK] {
+				action = "accept"
+			}
+		}
+		if err := g.draw(user, room, action); err != nil {
+			return apiError(c, http.StatusBadRequest, err)
+		}
+		return ok(c)
+	})
+}
+
+// BotChallenge is a callback for challenging a bot through the API, the challenger gets the
+// room and a token as if they created the game
+func (g *Server) BotChallenge(c echo.Context) error {
+	color := c.FormValue("color")
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if g.Hub.Closing() {
+		return shuttingDown(c)
+	}
+	if g.Hub.Full() {
+		return apiError(c, http.StatusServiceUnavailable, limits.ErrTooManyRooms)
+	}
+	room, client, err := g.challenge(c.Param("bot"), color)
+	if err != nil {
+		return apiError(c, challengeStatus(err), err)
+	}
+	token, err := g.token(room, client)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"room":      room,
+		"id":        client,
+		"token":     token,
+		"color":     g.Games[room].Challenge.FinalColor,
+		"challenge": g.Games[room].Challenge,
+	})
+}
+
+// Challenge is a callback for challenging a bot from the menu, the challenger gets a cookie for
+// the room as with a new game
+func (g *Server) Challenge(c echo.Context) error {
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if g.Hub.Closing() {
+		return shuttingDown(c)
+	}
+	if g.Hub.Full() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": limits.ErrTooManyRooms.Error(),
+			"type":  "chess",
+		})
+	}
+	room, client, err := g.challenge(c.FormValue("bot"), c.FormValue("color"))
+	if err != nil {
+		return c.JSON(challengeStatus(err), map[string]string{
+			"error": err.Error(),
+			"type":  "chess",
+		})
+	}
+	token, err := g.issue(c, room, client)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"room":  room,
+		"id":    client,
+		"token": token,
+		"type":  "chess",
+	})
+}
+
+// challengeStatus is the status of a challenge that couldn't be made
+func challengeStatus(err error) int {
+	switch {
+	case errors.Is(err, bots.ErrBotNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidColor):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// BotAccept is a callback for a bot accepting a challenge
+func (g *Server) BotAccept(c echo.Context) error {
+	return g.answerChallenge(c, g.acceptChallenge)
+}
+
+// BotDecline is a callback for a bot declining a challenge, the room is closed
+func (g *Server) BotDecline(c echo.Context) error {
+	return g.answerChallenge(c, g.declineChallenge)
+}
+
+// answerChallenge holds the game of a challenge while a bot answers it
+func (g *Server) answerChallenge(c echo.Context, answer func(bot bots.Bot, room string) error) error {
+	return g.withBot(c, func(bot bots.Bot) error {
+		room := c.Param("room")
+		g.Hub.Lock()
+		defer g.Hub.Unlock()
+		if g.Hub.Closing() {
+			return shuttingDown(c)
+		}
+		if err := g.acquire(room); err != nil {
+			if errors.Is(err, ErrRoomNotFound) {
+				return apiError(c, http.StatusNotFound, ErrChallengeNotFound)
+			}
+			return apiError(c, http.StatusServiceUnavailable, err)
+		}
+		defer g.release(room)
+		if err := answer(bot, room); errors.Is(err, ErrChallengerGone) {
+			return apiError(c, http.StatusGone, err)
+		} else if errors.Is(err, ErrRoomFull) {
+			return apiError(c, http.StatusConflict, err)
+		} else if err != nil {
+			return apiError(c, http.StatusNotFound, err)
+		}
+		logging.FromContext(c).Info("challenge answered", "bot", bot.Name, "room", room, "path", c.Path())
+		return ok(c)
+	})
+}
@@ -0,0 +1,239 @@
+package pieces
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/labstack/echo/v4"
+)
+
+// newBotAPI returns a test server serving the bot API and the token of a bot named after each of
+// names
+func newBotAPI(t *testing.T, names ...string) (*Server, *httptest.Server, map[string]string) {
+	t.Helper()
+	g := newTestServer(t)
+	tokens := map[string]string{}
+	for _, name := range names {
+		_, token, err := g.Bots.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[name] = token
+	}
+	e := echo.New()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(logging.LOGGER, g.Logger)
+			return next(c)
+		}
+	})
+	e.POST("/api/challenge/:bot", g.BotChallenge)
+	e.POST("/api/challenge/:room/accept", g.BotAccept)
+	e.POST("/api/challenge/:room/decline", g.BotDecline)
+	e.GET("/api/stream/event", g.BotEvents)
+	e.POST("/api/bot/game/:room/move/:move", g.BotMove)
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	return g, server, tokens
+}
+
+// call posts to the bot API as the bot of token and returns the status and the decoded answer
+func call(t *testing.T, server *httptest.Server, token, path string, form url.Values) (int, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body := map[string]interface{}{}
+	json.NewDecoder(res.Body).Decode(&body)
+	return res.StatusCode, body
+}
+
+// events opens the event stream of the bot of token and returns its lines as they come
+func events(t *testing.T, server *httptest.Server, token string) <-chan BotEvent {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/stream/event", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan BotEvent, 10)
+	go func() {
+		defer res.Body.Close()
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			var event BotEvent
+			if json.Unmarshal(scanner.Bytes(), &event) == nil {
+				lines <- event
+			}
+		}
+	}()
+	return lines
+}
+
+// next returns the next event of a stream
+func next(t *testing.T, lines <-chan BotEvent) BotEvent {
+	t.Helper()
+	select {
+	case event := <-lines:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event was sent")
+	}
+	return BotEvent{}
+}
+
+func TestBotChallenge(t *testing.T) {
+	g, server, tokens := newBotAPI(t, "bot", "other")
+	stream := events(t, server, tokens["bot"])
+	status, body := call(t, server, "", "/api/challenge/bot", url.Values{"color": {"white"}})
+	if status != http.StatusCreated {
+		t.Fatalf("challenging: got %d %v", status, body)
+	}
+	room, challenger := body["room"].(string), body["id"].(string)
+	if event := next(t, stream); event.Type != "challenge" || event.Challenge.ID != room || event.Challenge.FinalColor != "white" {
+		t.Fatalf("got %+v, want the challenge", event)
+	}
+
+	if status, _ := call(t, server, tokens["other"], "/api/challenge/"+room+"/accept", nil); status != http.StatusNotFound {
+		t.Fatalf("accepted by another bot: got %d", status)
+	}
+	if status, body := call(t, server, tokens["bot"], "/api/challenge/"+room+"/accept", nil); status != http.StatusOK {
+		t.Fatalf("accepting: got %d %v", status, body)
+	}
+	if event := next(t, stream); event.Type != "gameStart" || event.Game.GameID != room || event.Game.Color != "black" || event.Game.IsMyTurn {
+		t.Fatalf("got %+v, want the game starting", event)
+	}
+	if status, _ := call(t, server, tokens["bot"], "/api/challenge/"+room+"/accept", nil); status != http.StatusNotFound {
+		t.Fatalf("accepted twice: got %d", status)
+	}
+
+	if status, _ := call(t, server, tokens["bot"], "/api/bot/game/"+room+"/move/e7e5", nil); status != http.StatusBadRequest {
+		t.Fatalf("moving out of turn: got %d", status)
+	}
+	g.Hub.Lock()
+	if _, err := g.play(challenger, room, "e2", "e4", NONE, g.Logger); err != nil {
+		t.Fatal(err)
+	}
+	g.Hub.Unlock()
+	if status, body := call(t, server, tokens["bot"], "/api/bot/game/"+room+"/move/e7e5", nil); status != http.StatusOK {
+		t.Fatalf("moving: got %d %v", status, body)
+	}
+	if status, _ := call(t, server, tokens["other"], "/api/bot/game/"+room+"/move/d2d4", nil); status != http.StatusNotFound {
+		t.Fatalf("moving in the game of another bot: got %d", status)
+	}
+	g.Hub.Lock()
+	moves := strings.Join(g.Games[room].Moves, " ")
+	g.Hub.Unlock()
+	if moves != "e2e4 e7e5" {
+		t.Fatalf("moves %q", moves)
+	}
+
+	// a bot streaming again is told about the games it plays and the challenges waiting on it
+	status, body = call(t, server, "", "/api/challenge/bot", url.Values{"color": {"black"}})
+	if status != http.StatusCreated {
+		t.Fatalf("challenging again: got %d %v", status, body)
+	}
+	waiting := body["room"].(string)
+	again := events(t, server, tokens["bot"])
+	seen := map[string]string{}
+	for i := 0; i < 2; i++ {
+		event := next(t, again)
+		if event.Challenge != nil {
+			seen[event.Type] = event.Challenge.ID
+		} else if event.Game != nil {
+			seen[event.Type] = event.Game.GameID
+		}
+	}
+	if seen["challenge"] != waiting || seen["gameStart"] != room {
+		t.Fatalf("got %v on connecting again", seen)
+	}
+}
+
+func TestBotAnswersChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		leave  bool
+		status int
+	}{
+		{"declined", "decline", false, http.StatusOK},
+		{"challenger left", "accept", true, http.StatusGone},
+		{"declined after the challenger left", "decline", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, server, tokens := newBotAPI(t, "bot")
+			status, body := call(t, server, "", "/api/challenge/bot", nil)
+			if status != http.StatusCreated {
+				t.Fatalf("challenging: got %d %v", status, body)
+			}
+			room := body["room"].(string)
+			if tt.leave {
+				if err := g.Kick(room, body["id"].(string)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if status, body := call(t, server, tokens["bot"], "/api/challenge/"+room+"/"+tt.path, nil); status != tt.status {
+				t.Fatalf("got %d %v, want %d", status, body, tt.status)
+			}
+			g.Hub.Lock()
+			defer g.Hub.Unlock()
+			if g.Games[room] != nil {
+				t.Fatal("the game of the challenge is still open")
+			}
+		})
+	}
+}
+
+func TestBotSeatKept(t *testing.T) {
+	g, server, tokens := newBotAPI(t, "bot")
+	status, body := call(t, server, "", "/api/challenge/bot", url.Values{"color": {"white"}})
+	if status != http.StatusCreated {
+		t.Fatalf("challenging: got %d %v", status, body)
+	}
+	room := body["room"].(string)
+	g.Hub.Lock()
+	if _, err := g.join(room, false); !errors.Is(err, ErrAwaitingBot) {
+		t.Errorf("joining the seat of the bot: got %v, want %v", err, ErrAwaitingBot)
+	}
+	if _, err := g.join(room, true); err != nil {
+		t.Errorf("spectating: %v", err)
+	}
+	// seated by hand, the bot doesn't take the seat as well
+	g.Games[room].ClientColors["intruder"] = BLACK
+	g.Hub.Unlock()
+	if status, body := call(t, server, tokens["bot"], "/api/challenge/"+room+"/accept", nil); status != http.StatusConflict {
+		t.Fatalf("accepting: got %d %v, want %d", status, body, http.StatusConflict)
+	}
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	game := g.Games[room]
+	if game.Challenge != nil || len(game.Bots) != 0 {
+		t.Errorf("the bot was seated: challenge %+v, bots %v", game.Challenge, game.Bots)
+	}
+}
@@ -0,0 +1,120 @@
+package pieces
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// chat channels, players and spectators don't see each other's messages
+const (
+	PLAYERS    = "players"
+	SPECTATORS = "spectators"
+)
+
+// Preset is a quick message players can send with a single click
+type Preset struct {
+	ID   string
+	Text string
+}
+
+// CHAT_PRESETS are the quick messages, in the order they're offered
+var CHAT_PRESETS = []Preset{
+	{ID: "gl", Text: "Good luck"},
+	{ID: "hf", Text: "Have fun"},
+	{ID: "wp", Text: "Well played"},
+	{ID: "gg", Text: "Good game"},
+	{ID: "ty", Text: "Thank you"},
+}
+
+var (
+	ErrEmptyChat     = errors.New("empty chat message")
+	ErrUnknownPreset = errors.New("unknown quick message")
+)
+
+// channel returns the chat channel of a client
+func (g *Game) channel(user string) string {
+	if _, ok := g.ClientColors[user]; ok {
+		return PLAYERS
+	}
+	return SPECTATORS
+}
+
+// chatText returns the text a chat message asks to send, either a preset or a message no longer
+// than length characters
+func chatText(message map[string]interface{}, length int) (string, error) {
+	if id, _ := message["preset"].(string); id != "" {
+		for _, preset := range CHAT_PRESETS {
+			if preset.ID == id {
+				return preset.Text, nil
+			}
+		}
+		return "", ErrUnknownPreset
+	}
+	text, _ := message["msg"].(string)
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", ErrEmptyChat
+	}
+	if utf8.RuneCountInString(text) > length {
+		return "", fmt.Errorf("chat messages are up to %d characters", length)
+	}
+	return text, nil
+}
+
+// handleChat sends a chat message to the clients of the author's channel, clients who muted the
+// chat only get their own messages
+func (g *Server) handleChat(user, room string, message map[string]interface{}) {
+	game := g.Games[room]
+	text, err := chatText(message, g.Chat.Length)
+	if err != nil {
+		g.SendError(user, room, err)
+		return
+	}
+	channel := game.channel(user)
+	color := ""
+	if channel == PLAYERS {
+		color = COLOR_NAMES[game.ClientColors[user]]
+	}
+	chatMsg, _ := json.Marshal(Message{
+		Author: user,
+		Content: map[string]string{
+			"type":    "chat",
+			"id":      uuid.New().String(),
+			"channel": channel,
+			"color":   color,
+			"msg":     g.Filter.Clean(text),
+			"time":    time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	for _, member := range g.Hub.Room(room).Members() {
+		if game.channel(member.ID) == channel && (!game.Muted[member.ID] || member.ID == user) {
+			g.send(room, member.ID, chatMsg)
+		}
+	}
+}
+
+// handleMute turns the chat of a client off or on
+func (g *Server) handleMute(user, room string, message map[string]interface{}) {
+	game := g.Games[room]
+	muted, _ := message["muted"].(bool)
+	if muted {
+		game.Muted[user] = true
+	} else {
+		delete(game.Muted, user)
+	}
+	muteMsg, _ := json.Marshal(Message{
+		Author: user,
+		Content: map[string]string{
+			"type":  "mute",
+			"muted": strconv.FormatBool(muted),
+		},
+	})
+	g.Hub.Room(room).Send(user, muteMsg)
+}
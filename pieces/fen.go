@@ -0,0 +1,194 @@
+package pieces
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidFEN = errors.New("invalid FEN")
+
+// FEN_PIECES are the letters of the pieces in FEN, upper case for white
+var FEN_PIECES = map[int]byte{
+	PAWN:   'P',
+	ROOK:   'R',
+	KNIGHT: 'N',
+	BISHOP: 'B',
+	QUEEN:  'Q',
+	KING:   'K',
+}
+
+// FEN describes the position in Forsyth-Edwards Notation
+func (g *Game) FEN() string {
+	var fen strings.Builder
+	for x := 7; x >= 0; x-- {
+		empty := 0
+		for y := 0; y < 8; y++ {
+			piece := g.Board[x][y].Piece
+			if piece == NONE {
+				empty++
+				continue
+			}
+			if empty > 0 {
+				fen.WriteString(strconv.Itoa(empty))
+				empty = 0
+			}
+			letter := FEN_PIECES[piece&^BLACK]
+			if piece&BLACK == BLACK {
+				letter += 'a' - 'A'
+			}
+			fen.WriteByte(letter)
+		}
+		if empty > 0 {
+			fen.WriteString(strconv.Itoa(empty))
+		}
+		if x > 0 {
+			fen.WriteByte('/')
+		}
+	}
+	castling := g.Castling
+	if castling == "" {
+		castling = g.homeCastling()
+	}
+	fen.WriteString(" " + COLOR_NAMES[g.Turn][:1] + " " + castling)
+	enPassant := g.EnPassant
+	if enPassant == "" {
+		enPassant = "-"
+	}
+	fen.WriteString(" " + enPassant + " " + strconv.Itoa(g.Halfmoves) + " " + strconv.Itoa(len(g.Moves)/2+1))
+	return fen.String()
+}
+
+// ParseFEN returns a game set up in a position in Forsyth-Edwards Notation, the halfmove clock and
+// move number may be left out. Castling rights of a king or rook away from its starting square are
+// dropped, so is an en passant square no pawn could just have passed
+func ParseFEN(fen string) (*Game, error) {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 || len(fields) > 6 {
+		return nil, fmt.Errorf("%w, expected the board, color, castling and en passant fields", ErrInvalidFEN)
+	}
+	game := &Game{
+		Board:        STARTING_POSITION,
+		ClientColors: map[string]int{},
+		Clocks:       map[int]time.Duration{WHITE: 0, BLACK: 0},
+		Bots:         map[string]string{},
+		Muted:        map[string]bool{},
+	}
+	ranks := strings.Split(fields[0], "/")
+	if len(ranks) != 8 {
+		return nil, fmt.Errorf("%w, expected 8 ranks", ErrInvalidFEN)
+	}
+	kings := map[int]int{}
+	for i, rank := range ranks {
+		x := 7 - i
+		y := 0
+		for _, letter := range []byte(rank) {
+			if letter >= '1' && letter <= '8' {
+				for n := 0; n < int(letter-'0'); n++ {
+					if y >= 8 {
+						return nil, fmt.Errorf("%w rank %q, expected 8 squares", ErrInvalidFEN, rank)
+					}
+					game.Board[x][y].Piece = NONE
+					y++
+				}
+				continue
+			}
+			piece, color := NONE, WHITE
+			if letter >= 'a' && letter <= 'z' {
+				letter -= 'a' - 'A'
+				color = BLACK
+			}
+			for kind, l := range FEN_PIECES {
+				if l == letter {
+					piece = kind
+				}
+			}
+			if piece == NONE || y >= 8 {
+				return nil, fmt.Errorf("%w rank %q", ErrInvalidFEN, rank)
+			}
+			if piece == PAWN && (x == 0 || x == 7) {
+				return nil, fmt.Errorf("%w, pawns can't stand on the first or last rank", ErrInvalidFEN)
+			}
+			if piece == KING {
+				kings[color]++
+			}
+			game.Board[x][y].Piece = piece + color
+			y++
+		}
+		if y != 8 {
+			return nil, fmt.Errorf("%w rank %q, expected 8 squares", ErrInvalidFEN, rank)
+		}
+	}
+	if kings[WHITE] != 1 || kings[BLACK] != 1 {
+		return nil, fmt.Errorf("%w, expected one king of each color", ErrInvalidFEN)
+	}
+	switch fields[1] {
+	case "w":
+		game.Turn = WHITE
+	case "b":
+		game.Turn = BLACK
+	default:
+		return nil, fmt.Errorf("%w color %q", ErrInvalidFEN, fields[1])
+	}
+	if fields[2] != "-" && strings.Trim(fields[2], CASTLING) != "" {
+		return nil, fmt.Errorf("%w castling %q", ErrInvalidFEN, fields[2])
+	}
+	game.Castling = ""
+	for _, right := range game.homeCastling() {
+		if strings.ContainsRune(fields[2], right) {
+			game.Castling += string(right)
+		}
+	}
+	if game.Castling == "" {
+		game.Castling = "-"
+	}
+	game.EnPassant = "-"
+	if fields[3] != "-" {
+		x, y, err := parseSquare(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("%w en passant %q", ErrInvalidFEN, fields[3])
+		}
+		// black passes the sixth rank and white the third, the pawn stands on the next one
+		rank, pawn, moved := 5, 4, BLACK
+		if game.Turn == BLACK {
+			rank, pawn, moved = 2, 3, WHITE
+		}
+		if x == rank && game.Board[pawn][y].Piece == PAWN+moved && game.Board[x][y].Piece == NONE {
+			game.EnPassant = fields[3]
+		}
+	}
+	if len(fields) > 4 {
+		halfmoves, err := strconv.Atoi(fields[4])
+		if err != nil || halfmoves < 0 {
+			return nil, fmt.Errorf("%w halfmove clock %q", ErrInvalidFEN, fields[4])
+		}
+		game.Halfmoves = halfmoves
+	}
+	if len(fields) > 5 {
+		if number, err := strconv.Atoi(fields[5]); err != nil || number < 1 {
+			return nil, fmt.Errorf("%w move number %q", ErrInvalidFEN, fields[5])
+		}
+	}
+	// the side that just moved can't have left its king in check
+	if x, y := game.whereIsKing(game.Turn ^ BLACK); game.isCheck(x, y) {
+		return nil, fmt.Errorf("%w, %s is in check but it's not their move", ErrInvalidFEN, COLOR_NAMES[game.Turn^BLACK])
+	}
+	game.conclude()
+	return game, nil
+}
+
+// MoveNumber returns the move number field of a position in Forsyth-Edwards Notation, 1 when it's
+// missing or invalid
+func MoveNumber(fen string) int {
+	fields := strings.Fields(fen)
+	if len(fields) < 6 {
+		return 1
+	}
+	number, err := strconv.Atoi(fields[5])
+	if err != nil || number < 1 {
+		return 1
+	}
+	return number
+}
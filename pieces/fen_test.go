@@ -0,0 +1,79 @@
+package pieces
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFENRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		fen   string
+		moves []string
+	}{
+		{"starting position", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", nil},
+		{"black to move", "r3k2r/8/8/8/8/8/8/R3K2R b Kq - 12 1", nil},
+		{"en passant", "rnbqkbnr/ppp1pppp/8/8/3pP3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1", nil},
+		{"after a pawn passed", "", []string{"e2e4"}},
+		{"after castling", "", []string{"e2e4", "e7e5", "g1f3", "b8c6", "f1c4", "g8f6", "e1g1"}},
+		{"after a promotion", "", []string{"a2a4", "b7b5", "a4b5", "a7a6", "b5a6", "c8b7", "a6b7", "b8c6", "b7a8q"}},
+		{"after an underpromotion", "", []string{"h2h4", "g7g5", "h4g5", "h7h6", "g5h6", "f8g7", "h6g7", "g8f6", "g7h8n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fen := tt.fen
+			if fen == "" {
+				fen = play(t, tt.moves...).FEN()
+			}
+			game, err := ParseFEN(fen)
+			if err != nil {
+				t.Fatalf("%s: %v", fen, err)
+			}
+			// the move number isn't kept on the game
+			want := strings.Fields(fen)[:5]
+			if got := strings.Fields(game.FEN())[:5]; strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("got %s, want %s", strings.Join(got, " "), strings.Join(want, " "))
+			}
+		})
+	}
+}
+
+func TestParseFEN(t *testing.T) {
+	tests := []struct {
+		name      string
+		fen       string
+		err       error
+		enPassant string
+		result    string
+	}{
+		{"en passant", "4k3/8/8/3pP3/8/8/8/4K3 w - d6 0 1", nil, "d6", ""},
+		{"en passant on the wrong rank", "4k3/8/8/8/3pP3/8/8/4K3 w - d3 0 1", nil, "-", ""},
+		{"en passant without the pawn", "4k3/8/8/4P3/8/8/8/4K3 w - d6 0 1", nil, "-", ""},
+		{"en passant square taken", "4k3/8/3n4/3pP3/8/8/8/4K3 w - d6 0 1", nil, "-", ""},
+		{"en passant off the board", "4k3/8/8/3pP3/8/8/8/4K3 w - d9 0 1", ErrInvalidFEN, "", ""},
+		{"pawn on the last rank", "P3k3/8/8/8/8/8/8/4K3 b - - 0 1", ErrInvalidFEN, "", ""},
+		{"two white kings", "4k3/8/8/8/8/8/8/3KK3 w - - 0 1", ErrInvalidFEN, "", ""},
+		{"side that moved left in check", "4k3/4Q3/8/8/8/8/8/4K3 w - - 0 1", ErrInvalidFEN, "", ""},
+		{"checkmate", "4k3/4Q3/4K3/8/8/8/8/8 b - - 0 1", nil, "-", WHITE_WINS},
+		{"stalemate", "7k/5Q2/8/8/8/8/8/K7 b - - 0 1", nil, "-", DRAW},
+		{"fifty moves", "7k/8/8/8/8/8/8/K6R b - - 100 80", nil, "-", DRAW},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			game, err := ParseFEN(tt.fen)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if game.EnPassant != tt.enPassant {
+				t.Errorf("en passant %q, want %q", game.EnPassant, tt.enPassant)
+			}
+			if game.Result != tt.result {
+				t.Errorf("result %q, want %q", game.Result, tt.result)
+			}
+		})
+	}
+}
@@ -1,25 +1,77 @@
 package pieces
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Qinbeans/chess-htmx/auth"
+	"github.com/Qinbeans/chess-htmx/backplane"
+	"github.com/Qinbeans/chess-htmx/bots"
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/hub"
+	"github.com/Qinbeans/chess-htmx/limits"
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/Qinbeans/chess-htmx/metrics"
+	"github.com/Qinbeans/chess-htmx/moderation"
+	"github.com/Qinbeans/chess-htmx/socket"
+	"github.com/Qinbeans/chess-htmx/storage"
 	"github.com/flosch/pongo2/v6"
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 )
 
 const (
-	READSIZE  = 1024
-	WRITESIZE = 1024
-	ALL       = ""
+	ALL = ""
+	// role of the clients watching a game, players have the name of their color as role
+	SPECTATOR = "spectator"
 )
 
+var (
+	ErrRoomNotFound      = errors.New("room not found")
+	ErrUserNotFound      = errors.New("user is not in the room")
+	ErrRoomFull          = errors.New("room full")
+	ErrTooManySpectators = errors.New("too many spectators")
+	ErrAwaitingBot       = errors.New("the room waits on a bot to accept its challenge")
+)
+
+// Server hosts the games of chess, every game has a hub room of the same id holding its clients
+//   - Hub: its lock guards Games and every game in it, helpers expect the caller to hold it
+//   - Backplane: shares the games with the other instances, see acquire
+//   - Instance: name of this instance on the backplane
+//   - Remote: clients of each game connected to other instances, by the instance they are on
+//   - Bots: the bot accounts that may be challenged and play through the bot API
+//   - claimed: games acquired from the backplane, with their clients at the time
+//   - busy: games a goroutine of this instance is acting on while the hub is unlocked, see take
+//   - outbox: events waiting to be published once the hub is unlocked
+//   - botStreams: event streams of the bots connected here, by bot name
 type Server struct {
-	Upgrader websocket.Upgrader
-	Games    map[string]*Game
+	Hub         *hub.Hub
+	Websocket   config.Websocket
+	Games       map[string]*Game
+	TimeControl config.TimeControl
+	Rooms       config.Rooms
+	Chat        config.Chat
+	Filter      *moderation.Filter
+	Store       storage.Store
+	Backplane   backplane.Backplane
+	Instance    string
+	Remote      map[string]map[string]string
+	Signer      *auth.Signer
+	Bots        *bots.Registry
+	Logger      *slog.Logger
+	claimed     map[string]string
+	busy        map[string]chan struct{}
+	outbox      outbox
+	botStreams  map[string]*socket.Stream
 }
 
 type Message struct {
@@ -27,84 +79,468 @@ type Message struct {
 	Content map[string]string `json:"content"`
 }
 
+// RoomStatus describes a game for the admin page
+type RoomStatus struct {
+	Room         string
+	Clients      []ClientStatus
+	Turn         string
+	Result       string
+	Reason       string
+	LastActivity time.Time
+}
+
+// ClientStatus describes a client of a game, spectators have no color
+type ClientStatus struct {
+	ID        string
+	Color     string
+	Connected bool
+}
+
 // *****************************************************************************
 
 // NewServer returns a new server
-func NewServer() *Server {
-	return &Server{
-		Upgrader: websocket.Upgrader{
-			ReadBufferSize:  READSIZE,
-			WriteBufferSize: WRITESIZE,
+func NewServer(cfg *config.Config, store storage.Store, bp backplane.Backplane, signer *auth.Signer, logger *slog.Logger) *Server {
+	g := &Server{
+		Websocket:   cfg.Websocket,
+		Games:       make(map[string]*Game),
+		TimeControl: cfg.TimeControl,
+		Rooms:       cfg.Rooms,
+		Chat:        cfg.Chat,
+		Filter:      moderation.NewFilter(cfg.Chat.Filter),
+		Store:       store,
+		Backplane:   bp,
+		Instance:    backplane.Instance(cfg.Backplane),
+		Remote:      make(map[string]map[string]string),
+		Signer:      signer,
+		Bots:        bots.New(store),
+		Logger:      logger.With("server", "chess"),
+		claimed:     make(map[string]string),
+		busy:        make(map[string]chan struct{}),
+		outbox:      outbox{ready: make(chan struct{}, 1)},
+		botStreams:  make(map[string]*socket.Stream),
+	}
+	g.Hub = hub.New("chess", cfg, g, g.Logger)
+	return g
+}
+
+// Listen delivers the events other instances publish about their games and publishes those of
+// this instance until ctx is done, the events left are published by Shutdown
+func (g *Server) Listen(ctx context.Context) error {
+	if err := g.Backplane.Subscribe(ctx, EVENTS, g.deliver, g.resync); err != nil {
+		return err
+	}
+	go g.dispatch(ctx)
+	return nil
+}
+
+// Restore loads the games that were in flight when the server last shut down
+func (g *Server) Restore() error {
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	ids, err := g.Store.List(GAMES)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		data, err := g.Store.Load(GAMES, id)
+		if err != nil {
+			return err
+		}
+		var snapshot Snapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			g.Logger.Warn("skipping stored game", "room", id, "error", err)
+			continue
+		}
+		game := FromSnapshot(snapshot)
+		g.Games[id] = game
+		g.watchFlag(id)
+		// the downtime doesn't count against the idle timeout
+		room := g.Hub.Create(id)
+		for _, color := range []int{WHITE, BLACK} {
+			for client, c := range game.ClientColors {
+				if c == color {
+					room.Join(client, COLOR_NAMES[color])
+				}
+			}
+		}
+		if err := g.share(id); err != nil {
+			return err
+		}
+		// the record is written again on the next shutdown
+		if err := g.Store.Delete(GAMES, id); err != nil {
+			return err
+		}
+	}
+	g.Logger.Info("restored games", "count", len(g.Games))
+	return nil
+}
+
+// Stats counts the games and the connected clients, clients without a color are spectators
+func (g *Server) Stats() metrics.ChessStats {
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	games, roles := g.Hub.Count()
+	return metrics.ChessStats{
+		Games:      games,
+		Players:    roles[COLOR_NAMES[WHITE]] + roles[COLOR_NAMES[BLACK]],
+		Spectators: roles[SPECTATOR],
+	}
+}
+
+// Status describes every game, ordered by room id, with the clients in the order they joined
+func (g *Server) Status() []RoomStatus {
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	rooms := []RoomStatus{}
+	for room, game := range g.Games {
+		status := RoomStatus{
+			Room:         room,
+			Turn:         COLOR_NAMES[game.Turn],
+			Result:       game.Result,
+			Reason:       game.Reason,
+			LastActivity: g.Hub.Room(room).LastActivity,
+		}
+		for _, member := range g.Hub.Room(room).Members() {
+			client := ClientStatus{ID: member.ID, Connected: member.Conn != nil}
+			if member.Role != SPECTATOR {
+				client.Color = member.Role
+			}
+			status.Clients = append(status.Clients, client)
+		}
+		rooms = append(rooms, status)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Room < rooms[j].Room
+	})
+	return rooms
+}
+
+// Terminate tells the clients of a room it was closed, disconnects them and forgets the game
+func (g *Server) Terminate(room string) error {
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if err := g.acquire(room); err != nil {
+		return err
+	}
+	defer g.release(room)
+	g.terminate(room, "terminated")
+	g.Logger.Info("room terminated", "room", room)
+	return nil
+}
+
+// terminate sends the clients of a room a command telling why it closes, disconnects them and
+// forgets the game, a bot challenged to it is told the challenge is canceled
+func (g *Server) terminate(room, reason string) {
+	if challenge := g.Games[room].Challenge; challenge != nil {
+		challenge.Status = "canceled"
+		g.notify(challenge.DestUser.ID, BotEvent{Type: "challengeCanceled", Challenge: challenge})
+	}
+	terminatedMsg, _ := json.Marshal(Message{
+		Author: ALL,
+		Content: map[string]string{
+			"type": "cmd",
+			"msg":  reason,
 		},
-		Games: make(map[string]*Game),
+	})
+	g.Broadcast(ALL, room, terminatedMsg)
+	// release deletes the game from the backplane
+	g.drop(room)
+}
+
+// Reaper removes idle and abandoned games every reap interval until ctx is done
+func (g *Server) Reaper(ctx context.Context) {
+	ticker := time.NewTicker(g.Rooms.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			g.Reap(now)
+		}
+	}
+}
+
+// Reap removes the games without activity for longer than their TTL, finished games are
+// archived first, it returns how many games were removed
+func (g *Server) Reap(now time.Time) int {
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if g.Hub.Closing() {
+		return 0
+	}
+	reaped := 0
+	for _, room := range g.rooms() {
+		if g.reap(room, now) {
+			reaped++
+		}
+	}
+	return reaped
+}
+
+// reap removes a game without activity for longer than its TTL, a finished game is archived first
+func (g *Server) reap(room string, now time.Time) bool {
+	if err := g.acquire(room); err != nil {
+		return false
+	}
+	defer g.release(room)
+	game := g.Games[room]
+	idle := now.Sub(g.Hub.Room(room).LastActivity)
+	ttl := g.Rooms.AbandonedTTL
+	if g.Hub.Room(room).Online() || len(g.Remote[room]) > 0 {
+		ttl = g.Rooms.IdleTTL
 	}
+	if idle < ttl {
+		return false
+	}
+	if game.Result != "" {
+		if err := g.archive(room); err != nil {
+			// keep the game so the next pass tries again
+			g.Logger.Error("failed to archive game", "room", room, "error", err)
+			return false
+		}
+	}
+	g.terminate(room, "expired")
+	metrics.RoomsExpired.WithLabelValues("chess").Inc()
+	g.Logger.Info("room expired", "room", room, "idle", idle, "result", game.Result)
+	return true
+}
+
+// Kick tells a client it was removed and closes its connection, the game goes on for the others
+func (g *Server) Kick(room, user string) error {
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if err := g.acquire(room); err != nil {
+		return err
+	}
+	defer g.release(room)
+	game := g.Games[room]
+	member := g.Hub.Room(room).Member(user)
+	if member == nil {
+		return ErrUserNotFound
+	}
+	kickedMsg, _ := json.Marshal(Message{
+		Author: user,
+		Content: map[string]string{
+			"type": "cmd",
+			"msg":  "kicked",
+		},
+	})
+	g.send(room, user, kickedMsg)
+	remote := g.Remote[room][user] != ""
+	// the seat is free for the next client to join, until then the opponent may win by abandon
+	color, seated := game.ClientColors[user]
+	delete(game.ClientColors, user)
+	// the id can't be used to connect again, the hub won't report the connection closing
+	g.Hub.Room(room).Leave(user)
+	delete(g.Remote[room], user)
+	if member.Conn != nil || remote {
+		g.leave(room, user)
+	}
+	if seated {
+		g.watchAbandon(room, color)
+	}
+	g.Logger.Info("client kicked", "room", room, "user", user)
+	return nil
+}
+
+// save writes a game to storage
+func (g *Server) save(room string) error {
+	data, err := json.Marshal(g.Games[room].Snapshot(g.Hub.Room(room).LastActivity))
+	if err != nil {
+		return err
+	}
+	return g.Store.Save(GAMES, room, data)
+}
+
+// archive writes a finished game to storage where it's kept after the room is gone
+func (g *Server) archive(room string) error {
+	data, err := json.Marshal(g.Games[room].Snapshot(g.Hub.Room(room).LastActivity))
+	if err != nil {
+		return err
+	}
+	return g.Store.Save(ARCHIVE, room, data)
+}
+
+// Shutdown stops accepting rooms, tells every player the server is going away, stores the games
+// unless the backplane keeps them and waits for the connections to finish until ctx is done
+func (g *Server) Shutdown(ctx context.Context) error {
+	// the events of the last moves and of the shutdown are published once the hub is closed
+	defer g.flush()
+	return g.Hub.Shutdown(ctx, func() {
+		shutdownMsg, _ := json.Marshal(Message{
+			Author: ALL,
+			Content: map[string]string{
+				"type": "cmd",
+				"msg":  "shutdown",
+			},
+		})
+		for _, room := range g.rooms() {
+			if g.Backplane.Shared() {
+				// the game goes on through the other instances, only the clients here are told
+				if err := g.acquire(room); err == nil {
+					g.Hub.Room(room).Broadcast(ALL, shutdownMsg)
+					g.release(room)
+				}
+			} else {
+				if err := g.save(room); err != nil {
+					g.Logger.Error("failed to store game", "room", room, "error", err)
+				}
+				g.Broadcast(ALL, room, shutdownMsg)
+			}
+			delete(g.Games, room)
+		}
+		// event streams of bots aren't connections of the hub
+		for name, stream := range g.botStreams {
+			stream.Close()
+			delete(g.botStreams, name)
+		}
+	})
+}
+
+// create starts a game in a new room, user plays white
+func (g *Server) create(room, user string) {
+	g.Games[room] = NewGame(user, g.TimeControl)
+	g.Hub.Create(room).Join(user, COLOR_NAMES[WHITE])
 }
 
 // Subscribe returns a unique id for the client to use to subscribe to the websocket
 func (g *Server) SubscribeNewUser(room string) uuid.UUID {
 	id := uuid.New()
 	if g.Games[room] == nil {
-		g.Games[room] = NewGame(id.String())
+		g.create(room, id.String())
 	} else {
-		g.Games[room].Clients[id.String()] = nil
-		g.Games[room].ClientColors[id.String()] = BLACK
+		// white's seat is free again when its player was kicked
+		color := BLACK
+		if !g.Games[room].seated(WHITE) {
+			color = WHITE
+		}
+		g.Games[room].ClientColors[id.String()] = color
+		g.Hub.Room(room).Join(id.String(), COLOR_NAMES[color])
 	}
 	return id
 }
 
-// Unsubscribe removes the client from the list of connections
+// SubscribeSpectator returns a unique id for a client watching the game without a color
+func (g *Server) SubscribeSpectator(room string) uuid.UUID {
+	id := uuid.New()
+	g.Hub.Room(room).Join(id.String(), SPECTATOR)
+	return id
+}
+
+// Unsubscribe removes the client from the room
 func (g *Server) Unsubscribe(id uuid.UUID, room string) {
-	delete(g.Games[room].Clients, id.String())
+	g.Hub.Room(room).Leave(id.String())
 }
 
-// GracefulDisconnect removes the client from the list of connections and broadcasts the intent to disconnect
-func (g *Server) GracefulDisconnect(id uuid.UUID, room string) error {
-	var err error
-	var intnt []byte
-	if g.Games[room] == nil {
-		return nil
+// players counts the seats taken, kicked players give up theirs
+func (g *Server) players(room string) int {
+	return len(g.Games[room].ClientColors)
+}
+
+// connected tells whether a client playing a color is connected, here or to another instance
+func (g *Server) connected(room string, color int) bool {
+	for _, member := range g.Hub.Room(room).Members() {
+		if member.Role == COLOR_NAMES[color] && (member.Conn != nil || g.Remote[room][member.ID] != "") {
+			return true
+		}
 	}
-	if len(g.Games[room].Clients) > 0 {
-		// broadcast intent to disconnect
-		intnt, err = json.Marshal(Message{
-			Author: id.String(),
+	return false
+}
+
+// leave broadcasts that a client disconnected, players keep their seat and have the abandon
+// timeout to connect again while spectators are removed
+func (g *Server) leave(room, user string) {
+	intnt, _ := json.Marshal(Message{
+		Author: user,
+		Content: map[string]string{
+			"type": "cmd",
+			"msg":  "disconnected",
+		},
+	})
+	g.Broadcast(user, room, intnt)
+	if color, ok := g.Games[room].ClientColors[user]; ok {
+		g.watchAbandon(room, color)
+	} else {
+		g.Unsubscribe(uuid.MustParse(user), room)
+	}
+}
+
+// watchAbandon gives the players of a color the abandon timeout to connect again, after which their
+// opponent wins the game
+func (g *Server) watchAbandon(room string, color int) {
+	game := g.Games[room]
+	if game.Result != "" || !game.seated(color^BLACK) {
+		return
+	}
+	time.AfterFunc(g.Websocket.AbandonTimeout, func() {
+		g.Hub.Lock()
+		defer g.Hub.Unlock()
+		if g.Hub.Closing() || g.acquire(room) != nil {
+			return
+		}
+		defer g.release(room)
+		// the room may have been removed, or even created again with the same id
+		if g.Games[room] != game || game.Result != "" || g.connected(room, color) {
+			return
+		}
+		game.win(color^BLACK, "abandoned")
+		g.finished(room)
+		g.Logger.Info("game abandoned", "room", room, "color", COLOR_NAMES[color])
+		abandonMsg, _ := json.Marshal(Message{
+			Author: ALL,
 			Content: map[string]string{
-				"type": "cmd",
-				"msg":  "disconnected",
+				"type":  "abandoned",
+				"color": COLOR_NAMES[color^BLACK],
 			},
 		})
-		g.Broadcast(id.String(), room, intnt)
-	}
-	if g.Games[room].Clients[id.String()] != nil {
-		g.Games[room].Clients[id.String()].Close()
+		g.Broadcast(ALL, room, abandonMsg)
+	})
+}
+
+// watchFlag ends the game once the color to move runs out of time, the flag falls even when the
+// player never moves again
+func (g *Server) watchFlag(room string) {
+	game := g.Games[room]
+	if !game.timed() || game.Result != "" || game.LastMove.IsZero() {
+		return
 	}
-	g.Unsubscribe(id, room)
-	return err
+	time.AfterFunc(game.Remaining(game.Turn), func() {
+		g.Hub.Lock()
+		defer g.Hub.Unlock()
+		if g.Hub.Closing() || g.acquire(room) != nil {
+			return
+		}
+		defer g.release(room)
+		// a move since started another timer, the room may also be gone or created again
+		if g.Games[room] != game || !game.flag() {
+			return
+		}
+		g.finished(room)
+		g.Logger.Info("flag fell", "room", room, "color", COLOR_NAMES[game.Turn])
+		timeoutMsg, _ := json.Marshal(Message{
+			Author: ALL,
+			Content: map[string]string{
+				"type":  "timeout",
+				"color": COLOR_NAMES[game.Turn^BLACK],
+			},
+		})
+		g.Broadcast(ALL, room, timeoutMsg)
+	})
 }
 
 // Broadcast sends a message to all clients in a room; empty user means broadcast to all
 func (g *Server) Broadcast(user, room string, message []byte) {
-	game := g.Games[room]
-	for id, conn := range game.Clients {
-		if id != user && conn != nil {
-			conn.WriteMessage(websocket.TextMessage, message)
-		}
-	}
+	g.Hub.Room(room).Broadcast(user, message)
+	g.publish(Event{Room: room, Exclude: user, Data: message})
 }
 
-// Close closes the server
-func (g *Server) Close() {
-	for _, game := range g.Games {
-		for id, conn := range game.Clients {
-			if conn != nil {
-				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-				conn.Close()
-			}
-			delete(game.Clients, id)
-		}
-	}
-	for room := range g.Games {
-		delete(g.Games, room)
+// send sends a message to a client, through the instance it's connected to
+func (g *Server) send(room, user string, message []byte) {
+	if member := g.Hub.Room(room).Member(user); member != nil && member.Conn != nil {
+		member.Send(message)
+	} else if g.Remote[room][user] != "" {
+		g.publish(Event{Room: room, To: user, Data: message})
 	}
 }
 
@@ -117,338 +553,786 @@ func (g *Server) SendError(user, room string, err error) {
 			"msg":  err.Error(),
 		},
 	})
-	g.Games[room].Clients[user].WriteMessage(websocket.TextMessage, errorMsg)
+	g.send(room, user, errorMsg)
 }
 
 func (g *Server) SendErrorBytes(user, room string, err []byte) {
-	g.Games[room].Clients[user].WriteMessage(websocket.TextMessage, err)
+	g.send(room, user, err)
 }
 
-// SendMoveError sends a move error message to a client
-func (g *Server) SendMoveError(user, room string, err error, src, dst int) {
-	x1, y1 := src/8, src%8
-	x2, y2 := dst/8, dst%8
+// SendMoveError sends a move error message to a client along with the squares to restore
+func (g *Server) SendMoveError(user, room string, err error, src, dst string) {
+	squares := []SerSquare{}
+	for _, name := range []string{src, dst} {
+		if x, y, err := parseSquare(name); err == nil {
+			squares = append(squares, g.Games[room].toSerSquare(x, y))
+		}
+	}
+	serSquares, _ := json.Marshal(squares)
 	errorMsg, _ := json.Marshal(Message{
 		Author: user,
 		Content: map[string]string{
-			"type":      "error",
-			"msg":       err.Error(),
-			"src":       fmt.Sprintf("%d", src),
-			"src_color": g.Games[room].Board[x1][y1].Color,
-			"src_piece": PIECES[g.Games[room].Board[x1][y1].Piece],
-			"dst":       fmt.Sprintf("%d", dst),
-			"dst_color": g.Games[room].Board[x2][y2].Color,
-			"dst_piece": PIECES[g.Games[room].Board[x2][y2].Piece],
+			"type":    "error",
+			"msg":     err.Error(),
+			"src":     src,
+			"dst":     dst,
+			"squares": string(serSquares),
 		},
 	})
 	g.SendErrorBytes(user, room, errorMsg)
 }
 
-func (g *Server) SendTakeAck(user, room string, src, dst int) {
+// SendBoard sends the whole board to a client in the orientation of their color, with the moves
+// played so far in UCI notation for clients keeping their own copy of the game
+func (g *Server) SendBoard(user, room string) {
+	color := g.Games[room].ClientColors[user]
+	board, _ := json.Marshal(g.Games[room].toSquareArray(color))
+	content := map[string]string{
+		"type":        "board",
+		"orientation": COLOR_NAMES[color],
+		"board":       string(board),
+		"moves":       strings.Join(g.Games[room].Moves, " "),
+	}
+	g.addClocks(room, content)
+	boardMsg, _ := json.Marshal(Message{
+		Author:  user,
+		Content: content,
+	})
+	g.send(room, user, boardMsg)
+}
+
+func (g *Server) SendTakeAck(user, room string, src, dst string) {
 	moveMsg, _ := json.Marshal(Message{
 		Author: user,
 		Content: map[string]string{
 			"type": "take-ack",
-			"src":  fmt.Sprintf("%d", src),
-			"dst":  fmt.Sprintf("%d", dst),
+			"src":  src,
+			"dst":  dst,
 		},
 	})
-	g.Games[room].Clients[user].WriteMessage(websocket.TextMessage, moveMsg)
+	g.send(room, user, moveMsg)
 }
 
-func (g *Server) SendCastle(user, room string, k_src, r_src, k_dst, r_dst int) {
+func (g *Server) SendCastle(user, room string, move Move) {
+	squares := []SerSquare{}
+	for _, name := range []string{move.KingSrc, move.RookSrc, move.KingDst, move.RookDst} {
+		x, y, _ := parseSquare(name)
+		squares = append(squares, g.Games[room].toSerSquare(x, y))
+	}
+	serSquares, _ := json.Marshal(squares)
+	content := map[string]string{
+		"type":    "castle",
+		"k_src":   move.KingSrc,
+		"r_src":   move.RookSrc,
+		"k_dst":   move.KingDst,
+		"r_dst":   move.RookDst,
+		"squares": string(serSquares),
+	}
+	g.addClocks(room, content)
 	moveMsg, _ := json.Marshal(Message{
-		Author: user,
-		Content: map[string]string{
-			"type":  "castle",
-			"k_src": fmt.Sprintf("%d", k_src),
-			"r_src": fmt.Sprintf("%d", r_src),
-			"k_dst": fmt.Sprintf("%d", k_dst),
-			"r_dst": fmt.Sprintf("%d", r_dst),
-		},
+		Author:  user,
+		Content: content,
+	})
+	g.Broadcast(ALL, room, moveMsg)
+}
+
+// SendMove broadcasts a regular move to every client in the room, the squares include the one of
+// a pawn taken en passant
+func (g *Server) SendMove(user, room string, move Move) {
+	serSquares := []SerSquare{}
+	for _, name := range []string{move.Src, move.Dst, move.EnPassant} {
+		if x, y, err := parseSquare(name); err == nil {
+			serSquares = append(serSquares, g.Games[room].toSerSquare(x, y))
+		}
+	}
+	squares, _ := json.Marshal(serSquares)
+	content := map[string]string{
+		"type":    "move",
+		"src":     move.Src,
+		"dst":     move.Dst,
+		"taken":   fmt.Sprintf("%t", move.Taken),
+		"squares": string(squares),
+	}
+	if uci := move.UCI(); len(uci) == 5 {
+		content["promotion"] = uci[4:]
+	}
+	g.addClocks(room, content)
+	moveMsg, _ := json.Marshal(Message{
+		Author:  user,
+		Content: content,
 	})
 	g.Broadcast(ALL, room, moveMsg)
 }
 
+// addClocks adds the remaining time of both players in milliseconds to a message of a timed game
+func (g *Server) addClocks(room string, content map[string]string) {
+	game := g.Games[room]
+	if !game.timed() {
+		return
+	}
+	content["clock_white"] = strconv.FormatInt(game.Remaining(WHITE).Milliseconds(), 10)
+	content["clock_black"] = strconv.FormatInt(game.Remaining(BLACK).Milliseconds(), 10)
+	content["turn"] = COLOR_NAMES[game.Turn]
+}
+
 // *****************************************************************************
 
+// shuttingDown is the response to requests made while the server shuts down
+func shuttingDown(c echo.Context) error {
+	return c.JSON(http.StatusServiceUnavailable, map[string]string{
+		"error": "server is shutting down",
+		"type":  "chess",
+	})
+}
+
 // NewGame is a callback for creating a new game of chess
 func (g *Server) NewGame(c echo.Context) error {
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if g.Hub.Closing() {
+		return shuttingDown(c)
+	}
+	if g.Hub.Full() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": limits.ErrTooManyRooms.Error(),
+			"type":  "chess",
+		})
+	}
 	room := uuid.New().String()
 	client := uuid.New().String()
-	g.Games[room] = NewGame(client)
+	g.create(room, client)
+	if err := g.share(room); err != nil {
+		return err
+	}
+	token, err := g.issue(c, room, client)
+	if err != nil {
+		return err
+	}
 	return c.JSON(200, map[string]string{
-		"room": room,
-		"id":   client,
-		"type": "chess",
+		"room":  room,
+		"id":    client,
+		"token": token,
+		"type":  "chess",
 	})
 }
 
-// ConnectToRoom is a callback for connecting to a room
+// issue signs a token for a client of a room bound to its color, the browser gets it as a cookie
+// and other clients from the response
+func (g *Server) issue(c echo.Context, room, client string) (string, error) {
+	token, err := g.token(room, client)
+	if err != nil {
+		return "", err
+	}
+	g.Signer.SetCookie(c, auth.CHESS, room, token)
+	return token, nil
+}
+
+// token signs a token for a client of a room bound to its color
+func (g *Server) token(room, client string) (string, error) {
+	color := ""
+	if value, ok := g.Games[room].ClientColors[client]; ok {
+		color = COLOR_NAMES[value]
+	}
+	return g.Signer.Issue(auth.CHESS, room, client, color)
+}
+
+// join adds a client to a room, as the second player or as a spectator when spectate is set
+func (g *Server) join(room string, spectate bool) (uuid.UUID, error) {
+	if spectate && g.Hub.Room(room).Count(SPECTATOR) >= MAX_SPECTATORS {
+		return uuid.UUID{}, ErrTooManySpectators
+	}
+	if !spectate && g.players(room) >= MAX_CLIENTS {
+		return uuid.UUID{}, ErrRoomFull
+	}
+	if !spectate && g.Games[room].Challenge != nil {
+		// the free seat is the bot's
+		return uuid.UUID{}, ErrAwaitingBot
+	}
+	if spectate {
+		return g.SubscribeSpectator(room), nil
+	}
+	return g.SubscribeNewUser(room), nil
+}
+
+// ConnectToRoom is a callback for connecting to a room, as the second player or as a spectator
+// when spectate is set
 func (g *Server) ConnectToRoom(c echo.Context) error {
 	room_id := c.FormValue("room")
-	if _, ok := g.Games[room_id]; !ok {
+	spectate := c.FormValue("spectate") != ""
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if g.Hub.Closing() {
+		return shuttingDown(c)
+	}
+	if err := g.acquire(room_id); err != nil {
 		return c.JSON(200, map[string]string{
-			"message": "room not found",
+			"message": err.Error(),
 			"type":    "chess",
 		})
 	}
-	if len(g.Games[room_id].Clients) >= MAX_CLIENTS {
+	defer g.release(room_id)
+	client, err := g.join(room_id, spectate)
+	if err != nil {
 		return c.JSON(200, map[string]string{
-			"message": "room full",
+			"message": err.Error(),
 			"type":    "chess",
 		})
 	}
-	client := g.SubscribeNewUser(room_id)
+	token, err := g.issue(c, room_id, client.String())
+	if err != nil {
+		return err
+	}
 	return c.JSON(200, map[string]string{
-		"room": room_id,
-		"id":   client.String(),
-		"type": "chess",
+		"room":  room_id,
+		"id":    client.String(),
+		"token": token,
+		"type":  "chess",
 	})
 }
 
 // Room is a callback for rendering the chess room
 func (g *Server) Room(c echo.Context) error {
+	logger := logging.FromContext(c)
 	params := c.QueryParams()
 	room := params.Get("room")
 	if room == "" {
-		log.Print("Room parameter is required")
+		logger.Debug("room parameter is required")
 		return c.Redirect(302, "/")
 	}
-	client := params.Get("user")
-	if client == "" {
-		log.Print("User parameter is required")
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if err := g.acquire(room); err != nil {
+		logger.Debug("room unavailable", "room", room, "error", err)
 		return c.Redirect(302, "/")
 	}
-	if _, ok := g.Games[room]; !ok {
-		log.Print("Room does not exist")
+	defer g.release(room)
+	client, err := g.authorize(c, room)
+	if err != nil {
+		logger.Debug("unauthorized", "room", room, "error", err)
 		return c.Redirect(302, "/")
 	}
+	color := g.Games[room].ClientColors[client]
+	ranks, files := Labels(color)
 	return c.Render(200, "chess.dj", pongo2.Context{
 		"title":       "Let's play chess",
 		"description": "Play chess with a friend",
 		"room":        room,
 		"client":      client,
-		"board":       g.Games[room].toSquareArray(),
+		"channel":     g.Games[room].channel(client),
+		"presets":     CHAT_PRESETS,
+		"chat_length": g.Chat.Length,
+		"orientation": COLOR_NAMES[color],
+		"ranks":       ranks,
+		"files":       files,
+		"board":       g.Games[room].toSquareArray(color),
+		"finished":    g.Games[room].Result != "",
 	})
 }
 
+// authorize returns the client a request was made by, the token must belong to a client still in
+// the room and playing the color it was issued for
+func (g *Server) authorize(c echo.Context, room string) (string, error) {
+	claims, err := g.Signer.FromRequest(c, auth.CHESS, room)
+	if err != nil {
+		return "", err
+	}
+	return g.member(room, claims)
+}
+
+// authorizeBearer is authorize taking nothing but a bearer token, cookies aren't accepted so the
+// API needs no CSRF token
+func (g *Server) authorizeBearer(c echo.Context, room string) (string, error) {
+	claims, err := g.Signer.FromBearer(c, auth.CHESS, room)
+	if err != nil {
+		return "", err
+	}
+	return g.member(room, claims)
+}
+
+// member returns the client of verified claims, checking it's still in the room and playing the
+// color the token was issued for
+func (g *Server) member(room string, claims auth.Claims) (string, error) {
+	game := g.Games[room]
+	if g.Hub.Room(room).Member(claims.User) == nil {
+		return "", ErrUserNotFound
+	}
+	if color, ok := game.ClientColors[claims.User]; ok && COLOR_NAMES[color] != claims.Color {
+		return "", auth.ErrInvalidToken
+	}
+	return claims.User, nil
+}
+
 func (g *Server) WSHandler(c echo.Context) error {
+	logger := logging.FromContext(c)
 	if c.Request().Header.Get("Connection") == "Upgrade" {
 		params := c.QueryParams()
 		room := params.Get("room")
 		if room == "" {
-			log.Println("Room parameter is required")
+			logger.Debug("room parameter is required")
 			return c.JSON(400, map[string]string{
 				"error": "room parameter is required",
 			})
 		}
-		user := params.Get("user")
+		// the hub is only locked to check the client, the upgrade happens once it's unlocked
+		user, answered := func() (string, error) {
+			g.Hub.Lock()
+			defer g.Hub.Unlock()
+			if g.Hub.Closing() {
+				return "", shuttingDown(c)
+			}
+			if err := g.acquire(room); err != nil {
+				logger.Debug("room unavailable", "room", room, "error", err)
+				if errors.Is(err, ErrRoomNotFound) {
+					err = errors.New("room does not exist")
+				}
+				return "", c.JSON(400, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			defer g.release(room)
+			user, err := g.authorize(c, room)
+			if err != nil {
+				logger.Debug("unauthorized", "room", room, "error", err)
+				return "", c.JSON(http.StatusUnauthorized, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			return user, nil
+		}()
 		if user == "" {
-			log.Println("User parameter is required")
-			return c.JSON(400, map[string]string{
-				"error": "user parameter is required",
-			})
+			return answered
 		}
-		if g.Games[room] == nil {
-			log.Println("Room does not exist")
-			return c.JSON(400, map[string]string{
-				"error": "room does not exist",
-			})
+		return g.Hub.Connect(c, room, user, logger)
+	}
+	return c.JSON(400, map[string]string{
+		"error": "invalid request",
+	})
+}
+
+// Events is a callback for the server-sent event stream of a client, the fallback for proxies
+// that refuse websocket upgrades, every event carries the message a websocket would receive
+func (g *Server) Events(c echo.Context) error {
+	stream, err := g.stream(c, c.QueryParam("room"), g.authorize, logging.FromContext(c))
+	if stream == nil {
+		return err
+	}
+	return stream.Serve(c.Request().Context(), c.Response())
+}
+
+// stream connects the client of a request through an event stream, authorized by authorize, it
+// answers the request itself when the client can't connect
+func (g *Server) stream(c echo.Context, room string, authorize func(echo.Context, string) (string, error), logger *slog.Logger) (*socket.Stream, error) {
+	if room == "" {
+		logger.Debug("room parameter is required")
+		return nil, c.JSON(400, map[string]string{
+			"error": "room parameter is required",
+		})
+	}
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if g.Hub.Closing() {
+		return nil, shuttingDown(c)
+	}
+	if err := g.acquire(room); err != nil {
+		logger.Debug("room unavailable", "room", room, "error", err)
+		if errors.Is(err, ErrRoomNotFound) {
+			err = errors.New("room does not exist")
 		}
-		check := false
-		for id := range g.Games[room].Clients {
-			if id == user {
-				check = true
-			}
+		return nil, c.JSON(400, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	defer g.release(room)
+	user, err := authorize(c, room)
+	if err != nil {
+		logger.Debug("unauthorized", "room", room, "error", err)
+		return nil, c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": err.Error(),
+		})
+	}
+	return g.Hub.Stream(g.Hub.Room(room), g.Hub.Room(room).Member(user), logger), nil
+}
+
+// PostMove is a callback for a move of a client of the event stream, the form fields or JSON body
+// are those of a move message
+func (g *Server) PostMove(c echo.Context) error {
+	return g.push(c, "move")
+}
+
+// PostCommand is a callback for any other message of a client of the event stream, a JSON body
+// is the message as sent over a websocket and a form only carries the msg of a command
+func (g *Server) PostCommand(c echo.Context) error {
+	return g.push(c, "cmd")
+}
+
+// push hands the message of a request to the event stream of its client, the outcome is sent
+// through the stream
+func (g *Server) push(c echo.Context, msgType string) error {
+	logger := logging.FromContext(c)
+	room := c.QueryParam("room")
+	if room == "" {
+		room = c.FormValue("room")
+	}
+	if room == "" {
+		logger.Debug("room parameter is required")
+		return c.JSON(400, map[string]string{
+			"error": "room parameter is required",
+			"type":  "chess",
+		})
+	}
+	data, err := g.decode(c, msgType)
+	if err != nil {
+		logger.Debug("invalid message", "error", err)
+		status := 400
+		if errors.Is(err, socket.ErrMessageTooLarge) {
+			metrics.Limited.WithLabelValues("message_size").Inc()
+			status = http.StatusRequestEntityTooLarge
 		}
-		if !check {
-			log.Println("User is not in the room")
-			return c.JSON(400, map[string]string{
-				"error": "user is not in the room",
-			})
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+			"type":  "chess",
+		})
+	}
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	if g.Hub.Closing() {
+		return shuttingDown(c)
+	}
+	if err := g.acquire(room); err != nil {
+		logger.Debug("room unavailable", "room", room, "error", err)
+		if errors.Is(err, ErrRoomNotFound) {
+			err = errors.New("room does not exist")
 		}
-		conn, err := g.Upgrader.Upgrade(c.Response(), c.Request(), nil)
-		if err != nil {
-			log.Println(err)
-			return err
+		return c.JSON(400, map[string]string{
+			"error": err.Error(),
+			"type":  "chess",
+		})
+	}
+	defer g.release(room)
+	user, err := g.authorize(c, room)
+	if err != nil {
+		logger.Debug("unauthorized", "room", room, "error", err)
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": err.Error(),
+			"type":  "chess",
+		})
+	}
+	if err := g.Hub.Push(g.Hub.Room(room).Member(user), data); err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, socket.ErrQueueFull) {
+			status = http.StatusTooManyRequests
+		} else if errors.Is(err, socket.ErrMessageTooLarge) {
+			status = http.StatusRequestEntityTooLarge
 		}
-		g.Games[room].Clients[user] = conn
-		go g.handleConnection(conn, user, room)
-		log.Printf("User %s connected to room %s\n", user, room)
-		return nil
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+			"type":  "chess",
+		})
 	}
-	return c.JSON(400, map[string]string{
-		"error": "invalid request",
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"room": room,
+		"type": "chess",
 	})
 }
 
-func (g *Server) handleConnection(conn *websocket.Conn, user, room string) {
-	defer g.GracefulDisconnect(uuid.MustParse(user), room)
-	joinMsg, err := json.Marshal(Message{
-		Author: user,
+// decode returns the message of a request as a websocket would carry it, a JSON body is taken as
+// is while form fields are the fields of the message type
+func (g *Server) decode(c echo.Context, msgType string) ([]byte, error) {
+	message := map[string]interface{}{}
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		data, err := io.ReadAll(io.LimitReader(c.Request().Body, g.Hub.Limits.MessageSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > g.Hub.Limits.MessageSize {
+			return nil, socket.ErrMessageTooLarge
+		}
+		if err := json.Unmarshal(data, &message); err != nil {
+			return nil, errors.New("invalid message")
+		}
+	} else {
+		fields := map[string][]string{
+			"move": {"from", "to", "promotion"},
+			"cmd":  {"msg"},
+		}
+		for _, field := range fields[msgType] {
+			message[field] = c.FormValue(field)
+		}
+	}
+	if kind, _ := message["type"].(string); kind == "" || msgType == "move" {
+		message["type"] = msgType
+	} else if kind == "move" {
+		return nil, errors.New("moves are sent to /chess/move")
+	}
+	return json.Marshal(message)
+}
+
+// Connected tells the others a client connected and sends it the board
+func (g *Server) Connected(room *hub.Room, member *hub.Member) {
+	if err := g.acquire(room.ID); err != nil {
+		member.Logger.Warn("game unavailable", "error", err)
+		member.Conn.Close()
+		return
+	}
+	defer g.release(room.ID)
+	joinMsg, _ := json.Marshal(Message{
+		Author: member.ID,
 		Content: map[string]string{
-			"type": "cmd",
-			"msg":  "connected",
+			"type":    "cmd",
+			"msg":     "connected",
+			"channel": g.Games[room.ID].channel(member.ID),
 		},
 	})
-	if err != nil {
-		log.Println(err)
-		return
+	g.Broadcast(member.ID, room.ID, joinMsg)
+	g.SendBoard(member.ID, room.ID)
+}
+
+// Message decodes a message of a client and acts on it, returning false when the client quits
+func (g *Server) Message(room *hub.Room, member *hub.Member, data []byte) bool {
+	var message map[string]interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		member.Logger.Debug("invalid message", "error", err)
+		return true
 	}
-	g.Broadcast(user, room, joinMsg)
-	for {
-		_, raw_message, err := conn.ReadMessage()
-		if err != nil {
-			log.Println(err)
-			break
+	if err := g.acquire(room.ID); err != nil {
+		if errors.Is(err, ErrRoomNotFound) {
+			return false
 		}
-		var message map[string]interface{}
-		err = json.Unmarshal(raw_message, &message)
-		if err != nil {
-			log.Println(err)
-			continue
+		g.SendError(member.ID, room.ID, err)
+		return true
+	}
+	defer g.release(room.ID)
+	return g.handleMessage(member.ID, room.ID, message, member.Logger)
+}
+
+// Limited tells a client its message was dropped
+func (g *Server) Limited(room *hub.Room, member *hub.Member, err error) {
+	g.SendError(member.ID, room.ID, err)
+}
+
+// Disconnected tells the others a client is gone
+func (g *Server) Disconnected(room *hub.Room, member *hub.Member) {
+	if err := g.acquire(room.ID); err != nil {
+		member.Logger.Warn("game unavailable", "error", err)
+		return
+	}
+	defer g.release(room.ID)
+	g.leave(room.ID, member.ID)
+}
+
+// handleMessage acts on a message sent by a client, returning false when the client quits
+func (g *Server) handleMessage(user, room string, message map[string]interface{}, logger *slog.Logger) bool {
+	msgType, _ := message["type"].(string)
+	// spectators may only talk and leave
+	spectator := g.Games[room].channel(user) == SPECTATORS
+	switch msgType {
+	case "chat":
+		g.handleChat(user, room, message)
+	case "mute":
+		g.handleMute(user, room, message)
+	case "cmd":
+		msg, _ := message["msg"].(string)
+		if spectator && msg != "quit" && msg != "acknowledge" {
+			g.SendError(user, room, ErrSpectator)
+			return true
 		}
-		switch message["type"].(string) {
-		case "cmd":
-			switch message["msg"].(string) {
-			case "quit":
-				log.Println("User quit")
-				return
-			case "acknowledge":
-				log.Println("User acknowledged")
-				ackMsg, _ := json.Marshal(Message{
-					Author: user,
-					Content: map[string]string{
-						"type": "cmd",
-						"msg":  "acknowledge",
-					},
-				})
-				g.Broadcast(user, room, ackMsg)
-			case "reset-req":
-				log.Println("User requested reset")
-				if len(g.Games[room].Clients) < 2 {
-					resetMsg, _ := json.Marshal(Message{
-						Author: user,
-						Content: map[string]string{
-							"type": "error",
-							"msg":  "reset denied, not enough players",
-						},
-					})
-					g.SendErrorBytes(user, room, resetMsg)
-				}
-				resetMsg, _ := json.Marshal(Message{
-					Author: user,
-					Content: map[string]string{
-						"type": "cmd",
-						"msg":  "reset-req",
-					},
-				})
-				g.Broadcast(user, room, resetMsg)
-			case "reset-ack":
-				log.Println("User acknowledged reset")
-				g.Games[room].ResetBoard()
-				board, _ := json.Marshal(g.Games[room].toSquareArray())
+		switch msg {
+		case "quit":
+			logger.Debug("user quit")
+			return false
+		case "acknowledge":
+			logger.Debug("user acknowledged")
+			ackMsg, _ := json.Marshal(Message{
+				Author: user,
+				Content: map[string]string{
+					"type":    "cmd",
+					"msg":     "acknowledge",
+					"channel": g.Games[room].channel(user),
+				},
+			})
+			g.Broadcast(user, room, ackMsg)
+		case "reset-req":
+			logger.Debug("user requested reset")
+			if g.players(room) < 2 {
 				resetMsg, _ := json.Marshal(Message{
 					Author: user,
 					Content: map[string]string{
-						"type":  "cmd",
-						"msg":   "reset-ack",
-						"board": string(board),
+						"type": "error",
+						"msg":  "reset denied, not enough players",
 					},
 				})
-				g.Broadcast(user, room, resetMsg)
-			default:
-				log.Println(message["msg"])
-			}
-		case "move":
-			src_pos := int(message["from"].(float64))
-			dst_pos := int(message["to"].(float64))
-			x1, y1 := src_pos/8, src_pos%8
-			x2, y2 := dst_pos/8, dst_pos%8
-			// Check if src is client's color
-			if g.Games[room].Board[x1][y1].Piece&BLACK != g.Games[room].ClientColors[user] {
-				g.SendMoveError(user, room, fmt.Errorf("not your piece"), src_pos, dst_pos)
-				continue
-			} else if g.Games[room].Turn != g.Games[room].ClientColors[user] {
-				g.SendMoveError(user, room, fmt.Errorf("not your turn"), src_pos, dst_pos)
-				continue
-			}
-			err = g.Games[room].movePiece(x1, y1, x2, y2)
-			if err != nil {
-				g.SendMoveError(user, room, err, src_pos, dst_pos)
-				continue
-			}
-			if g.Games[room].Board[x1][y1].Piece == KING && g.Games[room].isCheck(x2, y2) {
-				g.SendMoveError(user, room, fmt.Errorf("cannot move into check"), src_pos, dst_pos)
-				continue
+				g.SendErrorBytes(user, room, resetMsg)
+				return true
 			}
-			if g.Games[room].Board[x1][y1].Piece != KING {
-				// check if king is in check
-				src_color := g.Games[room].Board[x1][y1].Piece &^ BLACK
-				kingX, kingY := g.Games[room].whereIsKing(src_color)
-				if g.Games[room].isCheck(kingX, kingY) {
-					g.SendMoveError(user, room, fmt.Errorf("king is in check"), src_pos, dst_pos)
-					continue
-				}
-			}
-			if g.Games[room].isCastle(x1, y1, x2, y2) {
-				var oKingX, oKingY, oRookX, oRookY int
-				if g.Games[room].Board[x1][y1].Piece != KING {
-					oKingX, oKingY = x2, y2
-					oRookX, oRookY = x1, y1
-				} else {
-					oKingX, oKingY = x1, y1
-					oRookX, oRookY = x2, y2
-				}
-				kingX, kingY, rookX, rookY, err := g.Games[room].castle(x1, y1, x2, y2)
-				if err != nil {
-					g.SendMoveError(user, room, err, src_pos, dst_pos)
-					continue
-				}
-				o_king_pos := oKingX*8 + oKingY
-				o_rook_pos := oRookX*8 + oRookY
-				king_pos := kingX*8 + kingY
-				rook_pos := rookX*8 + rookY
-				g.SendCastle(user, room, o_king_pos, o_rook_pos, king_pos, rook_pos)
-			}
-			taken := false
-			// check if piece exists at dst
-			if g.Games[room].Board[x2][y2].Piece != NONE {
-				g.Games[room].takePiece(x1, y1, x2, y2)
-				taken = true
+			g.Games[room].requestReset(g.Games[room].ClientColors[user])
+			resetMsg, _ := json.Marshal(Message{
+				Author: user,
+				Content: map[string]string{
+					"type": "cmd",
+					"msg":  "reset-req",
+				},
+			})
+			g.Broadcast(user, room, resetMsg)
+		case "reset-ack":
+			logger.Debug("user acknowledged reset")
+			// only the opponent of whoever asked may start the game over
+			if err := g.Games[room].acceptReset(g.Games[room].ClientColors[user]); err != nil {
+				g.SendError(user, room, err)
+				return true
 			}
-			moveMsg, _ := json.Marshal(Message{
+			board, _ := json.Marshal(g.Games[room].toSquareArray(WHITE))
+			resetMsg, _ := json.Marshal(Message{
 				Author: user,
 				Content: map[string]string{
-					"type":  "move",
-					"src":   fmt.Sprintf("%d", src_pos),
-					"dst":   fmt.Sprintf("%d", dst_pos),
-					"taken": fmt.Sprintf("%t", taken),
+					"type":  "cmd",
+					"msg":   "reset-ack",
+					"board": string(board),
 				},
 			})
-			// check if opponent is in checkmate
-			color := g.Games[room].Board[x2][y2].Piece &^ BLACK
-			opp_color := color ^ BLACK
-			g.Broadcast(user, room, moveMsg)
-			if g.Games[room].isCheckmate(opp_color) {
-				moveMsg, _ = json.Marshal(Message{
-					Author: user,
-					Content: map[string]string{
-						"type":  "checkmate",
-						"color": g.Games[room].Board[x2][y2].Color,
-					},
-				})
-				g.Broadcast(ALL, room, moveMsg)
+			g.Broadcast(ALL, room, resetMsg)
+		case "resign":
+			if err := g.resign(user, room); err != nil {
+				g.SendError(user, room, err)
 			}
-			switch g.Games[room].Turn {
-			case WHITE:
-				g.Games[room].Turn = BLACK
-			case BLACK:
-				g.Games[room].Turn = WHITE
+		case "draw-offer", "draw-accept", "draw-decline":
+			if err := g.draw(user, room, strings.TrimPrefix(msg, "draw-")); err != nil {
+				g.SendError(user, room, err)
 			}
 		default:
-			log.Println("Unknown message type")
+			logger.Debug("unknown command", "msg", msg)
+		}
+	case "move":
+		src, _ := message["from"].(string)
+		dst, _ := message["to"].(string)
+		letter, _ := message["promotion"].(string)
+		promotion, err := ParsePromotion(letter)
+		if err == nil {
+			_, err = g.play(user, room, src, dst, promotion, logger)
+		}
+		if err != nil {
+			g.SendMoveError(user, room, err, src, dst)
+		}
+	default:
+		logger.Debug("unknown message type", "type", msgType)
+	}
+	return true
+}
+
+// play applies a move of a client and tells the room, the client is told why a move failed by
+// the caller, promotion is the piece a pawn reaching the last rank becomes, NONE for a queen
+func (g *Server) play(user, room, src, dst string, promotion int, logger *slog.Logger) (Move, error) {
+	game := g.Games[room]
+	if game.channel(user) == SPECTATORS {
+		metrics.IllegalMoves.WithLabelValues(moveErrorReason(ErrSpectator)).Inc()
+		return Move{}, ErrSpectator
+	}
+	start := time.Now()
+	move, err := game.Move(game.ClientColors[user], src, dst, promotion)
+	metrics.MoveValidation.Observe(time.Since(start).Seconds())
+	logger.Debug("move", "src", src, "dst", dst, "error", err)
+	if err != nil {
+		metrics.IllegalMoves.WithLabelValues(moveErrorReason(err)).Inc()
+		if errors.Is(err, ErrOutOfTime) {
+			g.finished(room)
+			timeoutMsg, _ := json.Marshal(Message{
+				Author: user,
+				Content: map[string]string{
+					"type":  "timeout",
+					"color": COLOR_NAMES[game.ClientColors[user]^BLACK],
+				},
+			})
+			g.Broadcast(ALL, room, timeoutMsg)
 		}
+		return move, err
+	}
+	metrics.Moves.Inc()
+	g.watchFlag(room)
+	if move.Castle {
+		g.SendCastle(user, room, move)
+	} else {
+		g.SendMove(user, room, move)
 	}
+	// check if opponent is in checkmate
+	if move.Checkmate {
+		g.finished(room)
+		moveMsg, _ := json.Marshal(Message{
+			Author: user,
+			Content: map[string]string{
+				"type":  "checkmate",
+				"color": COLOR_NAMES[game.ClientColors[user]],
+			},
+		})
+		g.Broadcast(ALL, room, moveMsg)
+	} else if game.Result == DRAW {
+		g.finished(room)
+		drawMsg, _ := json.Marshal(Message{
+			Author: user,
+			Content: map[string]string{
+				"type": "draw",
+				"msg":  game.Reason,
+			},
+		})
+		g.Broadcast(ALL, room, drawMsg)
+	}
+	return move, nil
+}
+
+// resign ends the game in favour of the opponent of a player and tells the room
+func (g *Server) resign(user, room string) error {
+	game := g.Games[room]
+	color, ok := game.ClientColors[user]
+	if !ok {
+		return ErrSpectator
+	}
+	if err := game.resign(color); err != nil {
+		return err
+	}
+	g.finished(room)
+	resignMsg, _ := json.Marshal(Message{
+		Author: user,
+		Content: map[string]string{
+			"type":  "resigned",
+			"color": COLOR_NAMES[color^BLACK],
+		},
+	})
+	g.Broadcast(ALL, room, resignMsg)
+	return nil
+}
+
+// draw offers, accepts or declines a draw for a player and tells the room, an accepted draw
+// is sent as agreement
+func (g *Server) draw(user, room, action string) error {
+	game := g.Games[room]
+	color, ok := game.ClientColors[user]
+	if !ok {
+		return ErrSpectator
+	}
+	var err error
+	switch action {
+	case "offer":
+		err = game.offerDraw(color)
+	case "accept":
+		err = game.answerDraw(color, true)
+		action = "agreement"
+	case "decline":
+		err = game.answerDraw(color, false)
+	default:
+		err = fmt.Errorf("unknown draw action %q", action)
+	}
+	if err != nil {
+		return err
+	}
+	if game.Result != "" {
+		g.finished(room)
+	}
+	drawMsg, _ := json.Marshal(Message{
+		Author: user,
+		Content: map[string]string{
+			"type":  "draw",
+			"msg":   action,
+			"color": COLOR_NAMES[color],
+		},
+	})
+	g.Broadcast(ALL, room, drawMsg)
+	return nil
 }
@@ -0,0 +1,146 @@
+package pieces
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/auth"
+	"github.com/Qinbeans/chess-htmx/backplane"
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/storage"
+)
+
+// newTestServer returns a server keeping its games in memory, alone on its backplane
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	cfg := config.Default()
+	signer, err := auth.New(cfg.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewServer(&cfg, storage.NewMemory(), backplane.NewLocal(), signer, logger)
+}
+
+// seat joins a client to a room the way ConnectToRoom does
+func seat(t *testing.T, g *Server, room string) string {
+	t.Helper()
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	id, err := g.join(room, false)
+	if err != nil {
+		t.Fatalf("joining %s: %v", room, err)
+	}
+	return id.String()
+}
+
+func TestKickFreesSeat(t *testing.T) {
+	g := newTestServer(t)
+	g.Hub.Lock()
+	g.create("room", "white")
+	g.Hub.Unlock()
+	black := seat(t, g, "room")
+	if color := g.Games["room"].ClientColors[black]; color != BLACK {
+		t.Fatalf("second player got %s", COLOR_NAMES[color])
+	}
+	g.Hub.Lock()
+	_, err := g.join("room", false)
+	g.Hub.Unlock()
+	if !errors.Is(err, ErrRoomFull) {
+		t.Fatalf("third player: got %v, want %v", err, ErrRoomFull)
+	}
+
+	if err := g.Kick("room", "white"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.Games["room"].ClientColors["white"]; ok {
+		t.Fatal("kicked player kept its seat")
+	}
+	joined := seat(t, g, "room")
+	if color, ok := g.Games["room"].ClientColors[joined]; !ok || color != WHITE {
+		t.Fatalf("player joining after the kick got %s, want white", COLOR_NAMES[color])
+	}
+	if member := g.Hub.Room("room").Member(joined); member == nil || member.Role != COLOR_NAMES[WHITE] {
+		t.Fatalf("player joining after the kick isn't a white member: %+v", member)
+	}
+}
+
+func TestReset(t *testing.T) {
+	g := newTestServer(t)
+	g.Hub.Lock()
+	g.create("room", "white")
+	g.Hub.Unlock()
+	black := seat(t, g, "room")
+	// cmd sends a command of a client the way its websocket would
+	cmd := func(user, msg string) {
+		g.Hub.Lock()
+		defer g.Hub.Unlock()
+		g.handleMessage(user, "room", map[string]interface{}{"type": "cmd", "msg": msg}, g.Logger)
+	}
+	g.Hub.Lock()
+	if _, err := g.play("white", "room", "e2", "e4", NONE, g.Logger); err != nil {
+		t.Fatal(err)
+	}
+	g.Hub.Unlock()
+	game := g.Games["room"]
+
+	cmd(black, "reset-ack")
+	if len(game.Moves) != 1 {
+		t.Fatal("reset without a request")
+	}
+	cmd("white", "reset-req")
+	cmd("white", "reset-ack")
+	if len(game.Moves) != 1 {
+		t.Fatal("reset accepted by the player who asked for it")
+	}
+	// a move withdraws the request
+	g.Hub.Lock()
+	if _, err := g.play(black, "room", "e7", "e5", NONE, g.Logger); err != nil {
+		t.Fatal(err)
+	}
+	g.Hub.Unlock()
+	cmd(black, "reset-ack")
+	if len(game.Moves) != 2 {
+		t.Fatal("reset after the request was withdrawn")
+	}
+	cmd("white", "reset-req")
+	cmd(black, "reset-ack")
+	if len(game.Moves) != 0 || game.ResetRequest != "" {
+		t.Fatalf("reset accepted by the opponent: moves %v, request %q", game.Moves, game.ResetRequest)
+	}
+}
+
+func TestFlagFalls(t *testing.T) {
+	g := newTestServer(t)
+	g.TimeControl = config.TimeControl{Initial: 50 * time.Millisecond}
+	g.Hub.Lock()
+	g.create("room", "white")
+	g.Hub.Unlock()
+	seat(t, g, "room")
+	g.Hub.Lock()
+	if _, err := g.play("white", "room", "e2", "e4", NONE, g.Logger); err != nil {
+		t.Fatal(err)
+	}
+	g.Hub.Unlock()
+	// black never moves, its flag falls all the same
+	deadline := time.Now().Add(time.Second)
+	for {
+		g.Hub.Lock()
+		game := g.Games["room"]
+		result, reason, clock := game.Result, game.Reason, game.Clocks[BLACK]
+		g.Hub.Unlock()
+		if result != "" {
+			if result != WHITE_WINS || reason != "timeout" || clock != 0 {
+				t.Fatalf("got %s by %s with %v left", result, reason, clock)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the flag didn't fall")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,10 +2,12 @@ package pieces
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/Qinbeans/chess-htmx/config"
 	"github.com/Qinbeans/chess-htmx/utils"
-	"github.com/gorilla/websocket"
 )
 
 // Square is the container for a square on the chess board
@@ -15,9 +17,41 @@ type Square struct {
 }
 
 // SerSquare is the container for a square on the chess board for serialization
+//   - Color: "light" or "dark", the active theme decides how it's drawn
+//   - Piece: piece code such as "wK", the active piece set decides how it's drawn
 type SerSquare struct {
-	Color string `json:"color"`
-	Piece string `json:"piece"`
+	Square string `json:"square"`
+	Color  string `json:"color"`
+	Piece  string `json:"piece"`
+}
+
+// Move describes a move that has been applied to the board, squares are in algebraic notation
+//   - Promotion: the piece a pawn reaching the last rank became, NONE for any other move
+//   - EnPassant: the square of the pawn taken en passant, empty for any other move
+type Move struct {
+	Src       string
+	Dst       string
+	Taken     bool
+	Castle    bool
+	KingSrc   string
+	KingDst   string
+	RookSrc   string
+	RookDst   string
+	Promotion int
+	EnPassant string
+	Checkmate bool
+}
+
+// UCI returns the move in UCI notation, a castle is the king moving two squares and a promotion
+// ends with the letter of the new piece, e.g. e7e8q
+func (m Move) UCI() string {
+	if m.Castle {
+		return m.KingSrc + m.KingDst
+	}
+	if m.Promotion != NONE {
+		return m.Src + m.Dst + strings.ToLower(string(FEN_PIECES[m.Promotion]))
+	}
+	return m.Src + m.Dst
 }
 
 const (
@@ -37,22 +71,103 @@ const (
 
 const (
 	MAX_CLIENTS = 2
+	// spectators a game takes besides its players
+	MAX_SPECTATORS = 32
+)
+
+// errors returned when a move is rejected, the message is shown to the player
+var (
+	ErrInvalidSquare       = errors.New("invalid square")
+	ErrNotYourPiece        = errors.New("not your piece")
+	ErrGameOver            = errors.New("game is over")
+	ErrNotYourTurn         = errors.New("not your turn")
+	ErrOutOfTime           = errors.New("out of time")
+	ErrMoveIntoCheck       = errors.New("cannot move into check")
+	ErrKingInCheck         = errors.New("king is in check")
+	ErrIllegalMove         = errors.New("illegal move")
+	ErrSameColor           = errors.New("can't move to a square with a piece of the same color")
+	ErrIllegalCastle       = errors.New("illegal castle")
+	ErrCastleThroughPieces = errors.New("can't castle through pieces")
+	ErrCastleInCheck       = errors.New("can't castle while in check")
+	ErrCastleIntoCheck     = errors.New("can't castle into check")
+	ErrSpectator           = errors.New("spectators can't play")
+	ErrInvalidPromotion    = errors.New("pawns promote to a queen, rook, bishop or knight")
+)
+
+var ErrNoDrawOffer = errors.New("no draw offer to answer")
+
+var ErrNoResetRequest = errors.New("no reset request to accept")
+
+// MOVE_ERRORS lists every reason a move can be rejected for
+var MOVE_ERRORS = []error{
+	ErrInvalidSquare,
+	ErrNotYourPiece,
+	ErrGameOver,
+	ErrNotYourTurn,
+	ErrOutOfTime,
+	ErrMoveIntoCheck,
+	ErrKingInCheck,
+	ErrIllegalMove,
+	ErrSameColor,
+	ErrIllegalCastle,
+	ErrCastleThroughPieces,
+	ErrCastleInCheck,
+	ErrCastleIntoCheck,
+	ErrSpectator,
+	ErrInvalidPromotion,
+}
+
+// moveErrorReason returns which of MOVE_ERRORS err is, the set of reasons is bounded so it can label metrics
+func moveErrorReason(err error) string {
+	for _, reason := range MOVE_ERRORS {
+		if errors.Is(err, reason) {
+			return reason.Error()
+		}
+	}
+	return "unknown"
+}
+
+const (
+	WHITE_WINS = "1-0"
+	BLACK_WINS = "0-1"
+	DRAW       = "1/2-1/2"
+)
+
+// FIFTY_MOVES is the number of halfmoves without a capture or a pawn move that draws the game
+const FIFTY_MOVES = 100
+
+const (
+	FILES = "abcdefgh"
+	RANKS = "12345678"
+	// castling rights at the start of a game, K and Q are the sides white may castle on
+	CASTLING = "KQkq"
 )
 
+// CASTLING_SQUARES are the starting squares of the kings and rooks, moving from or to one of them
+// loses the castling rights it stands for
+var CASTLING_SQUARES = map[string]string{
+	"e1": "KQ",
+	"h1": "K",
+	"a1": "Q",
+	"e8": "kq",
+	"h8": "k",
+	"a8": "q",
+}
+
 var (
 	PIECES = map[int]string{
-		PAWN + BLACK:   "c/c7/Chess_pdt45.svg",
-		ROOK + BLACK:   "f/ff/Chess_rdt45.svg",
-		KNIGHT + BLACK: "e/ef/Chess_ndt45.svg",
-		BISHOP + BLACK: "9/98/Chess_bdt45.svg",
-		QUEEN + BLACK:  "4/47/Chess_qdt45.svg",
-		KING + BLACK:   "f/f0/Chess_kdt45.svg",
-		PAWN:           "4/45/Chess_plt45.svg",
-		ROOK:           "7/72/Chess_rlt45.svg",
-		KNIGHT:         "7/70/Chess_nlt45.svg",
-		BISHOP:         "b/b1/Chess_blt45.svg",
-		QUEEN:          "1/15/Chess_qlt45.svg",
-		KING:           "4/42/Chess_klt45.svg",
+		PAWN + BLACK:   "bP",
+		ROOK + BLACK:   "bR",
+		KNIGHT + BLACK: "bN",
+		BISHOP + BLACK: "bB",
+		QUEEN + BLACK:  "bQ",
+		KING + BLACK:   "bK",
+		PAWN:           "wP",
+		ROOK:           "wR",
+		KNIGHT:         "wN",
+		BISHOP:         "wB",
+		QUEEN:          "wQ",
+		KING:           "wK",
 	}
 
 	PIECE_NAMES = map[int]string{
@@ -71,58 +186,448 @@ var (
 		NONE:           "<NONE>",
 	}
 
+	// PROMOTIONS are the pieces a pawn may become by the letter UCI gives them
+	PROMOTIONS = map[byte]int{
+		'q': QUEEN,
+		'r': ROOK,
+		'b': BISHOP,
+		'n': KNIGHT,
+	}
+
+	COLOR_NAMES = map[int]string{
+		WHITE: "white",
+		BLACK: "black",
+	}
+
 	STARTING_POSITION = [8][8]Square{
-		{{Color: "white/35", Piece: ROOK}, {Color: "white/15", Piece: KNIGHT}, {Color: "white/35", Piece: BISHOP}, {Color: "white/15", Piece: QUEEN}, {Color: "white/35", Piece: KING}, {Color: "white/15", Piece: BISHOP}, {Color: "white/35", Piece: KNIGHT}, {Color: "white/15", Piece: ROOK}},
-		{{Color: "white/15", Piece: PAWN}, {Color: "white/35", Piece: PAWN}, {Color: "white/15", Piece: PAWN}, {Color: "white/35", Piece: PAWN}, {Color: "white/15", Piece: PAWN}, {Color: "white/35", Piece: PAWN}, {Color: "white/15", Piece: PAWN}, {Color: "white/35", Piece: PAWN}},
-		{{Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}},
-		{{Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}},
-		{{Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}},
-		{{Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}, {Color: "white/15", Piece: NONE}, {Color: "white/35", Piece: NONE}},
-		{{Color: "white/35", Piece: PAWN + BLACK}, {Color: "white/15", Piece: PAWN + BLACK}, {Color: "white/35", Piece: PAWN + BLACK}, {Color: "white/15", Piece: PAWN + BLACK}, {Color: "white/35", Piece: PAWN + BLACK}, {Color: "white/15", Piece: PAWN + BLACK}, {Color: "white/35", Piece: PAWN + BLACK}, {Color: "white/15", Piece: PAWN + BLACK}},
-		{{Color: "white/15", Piece: ROOK + BLACK}, {Color: "white/35", Piece: KNIGHT + BLACK}, {Color: "white/15", Piece: BISHOP + BLACK}, {Color: "white/35", Piece: QUEEN + BLACK}, {Color: "white/15", Piece: KING + BLACK}, {Color: "white/35", Piece: BISHOP + BLACK}, {Color: "white/15", Piece: KNIGHT + BLACK}, {Color: "white/35", Piece: ROOK + BLACK}},
+		{{Color: "dark", Piece: ROOK}, {Color: "light", Piece: KNIGHT}, {Color: "dark", Piece: BISHOP}, {Color: "light", Piece: QUEEN}, {Color: "dark", Piece: KING}, {Color: "light", Piece: BISHOP}, {Color: "dark", Piece: KNIGHT}, {Color: "light", Piece: ROOK}},
+		{{Color: "light", Piece: PAWN}, {Color: "dark", Piece: PAWN}, {Color: "light", Piece: PAWN}, {Color: "dark", Piece: PAWN}, {Color: "light", Piece: PAWN}, {Color: "dark", Piece: PAWN}, {Color: "light", Piece: PAWN}, {Color: "dark", Piece: PAWN}},
+		{{Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}},
+		{{Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}},
+		{{Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}},
+		{{Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}, {Color: "light", Piece: NONE}, {Color: "dark", Piece: NONE}},
+		{{Color: "dark", Piece: PAWN + BLACK}, {Color: "light", Piece: PAWN + BLACK}, {Color: "dark", Piece: PAWN + BLACK}, {Color: "light", Piece: PAWN + BLACK}, {Color: "dark", Piece: PAWN + BLACK}, {Color: "light", Piece: PAWN + BLACK}, {Color: "dark", Piece: PAWN + BLACK}, {Color: "light", Piece: PAWN + BLACK}},
+		{{Color: "light", Piece: ROOK + BLACK}, {Color: "dark", Piece: KNIGHT + BLACK}, {Color: "light", Piece: BISHOP + BLACK}, {Color: "dark", Piece: QUEEN + BLACK}, {Color: "light", Piece: KING + BLACK}, {Color: "dark", Piece: BISHOP + BLACK}, {Color: "light", Piece: KNIGHT + BLACK}, {Color: "dark", Piece: ROOK + BLACK}},
 	}
 )
 
 // Game is a struct for a game of chess
 //   - Board: 8x8 array of Squares
-//   - Clients: list of client ids
-//   - Conn: websocket connection
+//   - ClientColors: color of each player, spectators and connections are kept by the hub room
+//   - Clocks: time left for each color, only used when the time control has an initial time
+//   - Moves: the moves played so far in UCI notation
+//   - Halfmoves: moves since the last capture or pawn move
+//   - Castling: the castling rights as in FEN, e.g. "KQkq", "-" once neither color may castle
+//   - EnPassant: the square a pawn that just moved two squares passed, "-" after any other move
+//   - Result: empty while the game is being played, Reason explains how it ended
+//   - DrawOffer: color of the player offering a draw, empty when there is no offer
+//   - ResetRequest: color of the player asking to start over, empty when nobody is
+//   - Bots: players who are bot accounts, by the name of their account
+//   - Challenge: the challenge of a bot the game waits on, nil once it's accepted
+//   - Muted: clients who turned the chat off
 type Game struct {
 	Board        [8][8]Square
-	Clients      map[string]*websocket.Conn
 	ClientColors map[string]int
 	Turn         int
+	TimeControl  config.TimeControl
+	Clocks       map[int]time.Duration
+	LastMove     time.Time
+	Moves        []string
+	Halfmoves    int
+	Castling     string
+	EnPassant    string
+	Result       string
+	Reason       string
+	DrawOffer    string
+	ResetRequest string
+	Bots         map[string]string
+	Challenge    *Challenge
+	Muted        map[string]bool
 }
 
 // Creates a new game of chess
-func NewGame(user1 string) *Game {
+func NewGame(user1 string, timeControl config.TimeControl) *Game {
 	return &Game{
 		Board:        STARTING_POSITION,
-		Clients:      map[string]*websocket.Conn{user1: nil},
 		ClientColors: map[string]int{user1: WHITE},
 		Turn:         WHITE,
+		TimeControl:  timeControl,
+		Clocks: map[int]time.Duration{
+			WHITE: timeControl.Initial,
+			BLACK: timeControl.Initial,
+		},
+		Castling:  CASTLING,
+		EnPassant: "-",
+		Bots:      map[string]string{},
+		Muted:     map[string]bool{},
 	}
 }
 
 func (g *Game) ResetBoard() {
 	g.Board = STARTING_POSITION
+	g.Turn = WHITE
+	g.Clocks[WHITE] = g.TimeControl.Initial
+	g.Clocks[BLACK] = g.TimeControl.Initial
+	g.LastMove = time.Time{}
+	g.Moves = nil
+	g.Halfmoves = 0
+	g.Castling = CASTLING
+	g.EnPassant = "-"
+	g.Result = ""
+	g.Reason = ""
+	g.DrawOffer = ""
+	g.ResetRequest = ""
+}
+
+// timed tells whether the game is played with clocks
+func (g *Game) timed() bool {
+	return g.TimeControl.Initial > 0
+}
+
+// spend deducts the time since the last move from the clock of color and reports if any is left,
+// the clocks start with the first move
+func (g *Game) spend(color int) bool {
+	if !g.timed() {
+		return true
+	}
+	now := time.Now()
+	if !g.LastMove.IsZero() {
+		g.Clocks[color] -= now.Sub(g.LastMove)
+	}
+	g.LastMove = now
+	return g.Clocks[color] > 0
 }
 
-// toSquareArray converts the board to a 1D array of SerSquares
-func (g *Game) toSquareArray() []SerSquare {
+// Remaining returns the time left on the clock of color, counting the running clock
+func (g *Game) Remaining(color int) time.Duration {
+	remaining := g.Clocks[color]
+	if g.timed() && g.Result == "" && g.Turn == color && !g.LastMove.IsZero() {
+		remaining -= time.Since(g.LastMove)
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// win ends the game in favour of color
+func (g *Game) win(color int, reason string) {
+	g.Result = WHITE_WINS
+	if color == BLACK {
+		g.Result = BLACK_WINS
+	}
+	g.Reason = reason
+}
+
+// flag ends the game on time once the color to move ran out of it, reporting whether it did
+func (g *Game) flag() bool {
+	if !g.timed() || g.Result != "" || g.Remaining(g.Turn) > 0 {
+		return false
+	}
+	g.Clocks[g.Turn] = 0
+	g.win(g.Turn^BLACK, "timeout")
+	return true
+}
+
+// resign ends the game in favour of the opponent of color
+func (g *Game) resign(color int) error {
+	if g.Result != "" {
+		return ErrGameOver
+	}
+	g.win(color^BLACK, "resignation")
+	return nil
+}
+
+// offerDraw offers the opponent of color a draw, an offer stands until it's answered or a move is
+// played
+func (g *Game) offerDraw(color int) error {
+	if g.Result != "" {
+		return ErrGameOver
+	}
+	g.DrawOffer = COLOR_NAMES[color]
+	return nil
+}
+
+// answerDraw accepts or declines the draw offered by the opponent of color
+func (g *Game) answerDraw(color int, accept bool) error {
+	if g.Result != "" {
+		return ErrGameOver
+	}
+	if g.DrawOffer != COLOR_NAMES[color^BLACK] {
+		return ErrNoDrawOffer
+	}
+	g.DrawOffer = ""
+	if accept {
+		g.Result = DRAW
+		g.Reason = "agreement"
+	}
+	return nil
+}
+
+// requestReset asks the opponent of color to start the game over, finished or not
+func (g *Game) requestReset(color int) {
+	g.ResetRequest = COLOR_NAMES[color]
+}
+
+// acceptReset starts the game over when the opponent of color asked for it
+func (g *Game) acceptReset(color int) error {
+	if g.ResetRequest != COLOR_NAMES[color^BLACK] {
+		return ErrNoResetRequest
+	}
+	g.ResetBoard()
+	return nil
+}
+
+// seated tells whether a client plays a color
+func (g *Game) seated(color int) bool {
+	for _, c := range g.ClientColors {
+		if c == color {
+			return true
+		}
+	}
+	return false
+}
+
+// squareName converts board coordinates to algebraic notation, x is the rank and y is the file
+func squareName(x, y int) string {
+	return string(FILES[y]) + string(RANKS[x])
+}
+
+// parseSquare converts a square in algebraic notation to board coordinates
+func parseSquare(name string) (int, int, error) {
+	if len(name) != 2 {
+		return -1, -1, fmt.Errorf("%w %q", ErrInvalidSquare, name)
+	}
+	y := strings.IndexByte(FILES, name[0])
+	x := strings.IndexByte(RANKS, name[1])
+	if x < 0 || y < 0 {
+		return -1, -1, fmt.Errorf("%w %q", ErrInvalidSquare, name)
+	}
+	return x, y, nil
+}
+
+// orientation returns the order in which ranks and files are drawn for a player of the given color
+//   - white sees rank 8 at the top and the a-file on the left
+//   - black sees rank 1 at the top and the h-file on the left
+func orientation(color int) ([]int, []int) {
+	ranks := make([]int, 8)
+	files := make([]int, 8)
+	for i := 0; i < 8; i++ {
+		if color == BLACK {
+			ranks[i], files[i] = i, 7-i
+		} else {
+			ranks[i], files[i] = 7-i, i
+		}
+	}
+	return ranks, files
+}
+
+// Labels returns the rank and file coordinate labels in drawing order for the given color
+func Labels(color int) ([]string, []string) {
+	ranks, files := orientation(color)
+	rankLabels := make([]string, 8)
+	fileLabels := make([]string, 8)
+	for i := 0; i < 8; i++ {
+		rankLabels[i] = string(RANKS[ranks[i]])
+		fileLabels[i] = string(FILES[files[i]])
+	}
+	return rankLabels, fileLabels
+}
+
+// toSerSquare converts a single square to its serializable form
+func (g *Game) toSerSquare(x, y int) SerSquare {
+	return SerSquare{
+		Square: squareName(x, y),
+		Color:  g.Board[x][y].Color,
+		Piece:  PIECES[g.Board[x][y].Piece],
+	}
+}
+
+// toSquareArray converts the board to a 1D array of SerSquares as seen by a player of the given color
+func (g *Game) toSquareArray(color int) []SerSquare {
 	var board []SerSquare
-	// if len(g.Clients) < MAX_CLIENTS {
-	// 	return board
-	// }
-	for _, row := range g.Board {
-		for _, square := range row {
-			board = append(board, SerSquare{Color: square.Color, Piece: PIECES[square.Piece]})
+	ranks, files := orientation(color)
+	for _, x := range ranks {
+		for _, y := range files {
+			board = append(board, g.toSerSquare(x, y))
 		}
 	}
 	return board
 }
 
-// movePiece moves a piece from one square to another
+// SquareArray returns the board as seen by a player of the given color, for room types drawing it
+// themselves
+func (g *Game) SquareArray(color int) []SerSquare {
+	return g.toSquareArray(color)
+}
+
+// Move applies a move for a player of the given color, src and dst are in algebraic notation, a
+// pawn reaching the last rank becomes the promotion piece, a queen when it's NONE
+func (g *Game) Move(color int, src, dst string, promotion int) (Move, error) {
+	move := Move{Src: src, Dst: dst, Promotion: promotion}
+	x1, y1, err := parseSquare(src)
+	if err != nil {
+		return move, err
+	}
+	x2, y2, err := parseSquare(dst)
+	if err != nil {
+		return move, err
+	}
+	if g.Board[x1][y1].Piece == NONE || g.Board[x1][y1].Piece&BLACK != color {
+		return move, ErrNotYourPiece
+	}
+	if g.Result != "" {
+		return move, ErrGameOver
+	}
+	if g.Turn != color {
+		return move, ErrNotYourTurn
+	}
+	if !g.spend(color) {
+		g.Clocks[color] = 0
+		g.win(color^BLACK, "timeout")
+		return move, ErrOutOfTime
+	}
+	pawn := g.Board[x1][y1].Piece&^BLACK == PAWN
+	move, err = g.apply(move, x1, y1, x2, y2)
+	if err != nil {
+		return move, err
+	}
+	if pawn || move.Taken {
+		g.Halfmoves = 0
+	} else {
+		g.Halfmoves++
+	}
+	g.EnPassant = "-"
+	if pawn && utils.Abs(x2-x1) == 2 {
+		g.EnPassant = squareName((x1+x2)/2, y1)
+	}
+	g.loseCastling(move)
+	g.Moves = append(g.Moves, move.UCI())
+	// moving declines a draw offered by the opponent and withdraws one's own, so it goes for resets
+	g.DrawOffer = ""
+	g.ResetRequest = ""
+	if g.timed() {
+		g.Clocks[color] += g.TimeControl.Increment
+	}
+	g.Turn ^= BLACK
+	g.conclude()
+	move.Checkmate = g.Reason == "checkmate"
+	return move, nil
+}
+
+// conclude ends the game when the color to move is checkmated or stalemated, or when fifty moves
+// were played without a capture or a pawn move
+func (g *Game) conclude() {
+	if len(g.legalMoves(g.Turn)) == 0 {
+		if kingX, kingY := g.whereIsKing(g.Turn); kingX >= 0 && g.isCheck(kingX, kingY) {
+			g.win(g.Turn^BLACK, "checkmate")
+			return
+		}
+		g.Result = DRAW
+		g.Reason = "stalemate"
+		return
+	}
+	if g.Halfmoves >= FIFTY_MOVES {
+		g.Result = DRAW
+		g.Reason = "fifty-move rule"
+	}
+}
+
+// apply plays a move on the board without looking at turns or clocks, a piece dragged onto a rook
+// of its own color castles, the board is left as it was when the move is illegal
+func (g *Game) apply(move Move, x1, y1, x2, y2 int) (Move, error) {
+	if g.isCastle(x1, y1, x2, y2) {
+		kingX, kingY, rookX, rookY := x1, y1, x2, y2
+		if g.Board[x1][y1].Piece&^BLACK == ROOK {
+			kingX, kingY, rookX, rookY = x2, y2, x1, y1
+		}
+		kingDX, kingDY, rookDX, rookDY, err := g.castle(kingX, kingY, rookX, rookY)
+		if err != nil {
+			return move, err
+		}
+		move.Castle = true
+		move.Promotion = NONE
+		move.KingSrc, move.RookSrc = squareName(kingX, kingY), squareName(rookX, rookY)
+		move.KingDst, move.RookDst = squareName(kingDX, kingDY), squareName(rookDX, rookDY)
+		return move, nil
+	}
+	pawn := g.Board[x1][y1].Piece&^BLACK == PAWN
+	if !pawn || (x2 != 0 && x2 != 7) {
+		move.Promotion = NONE
+	} else if move.Promotion == NONE {
+		move.Promotion = QUEEN
+	} else if move.Promotion != QUEEN && move.Promotion != ROOK && move.Promotion != BISHOP && move.Promotion != KNIGHT {
+		return move, ErrInvalidPromotion
+	}
+	if err := g.movePiece(x1, y1, x2, y2); err != nil {
+		return move, err
+	}
+	color := g.Board[x1][y1].Piece & BLACK
+	captured := g.Board[x2][y2].Piece
+	// a pawn moving diagonally onto an empty square takes the pawn it passed en passant
+	passed := NONE
+	if pawn && y1 != y2 && captured == NONE {
+		passed = g.Board[x1][y2].Piece
+		g.Board[x1][y2].Piece = NONE
+		move.EnPassant = squareName(x1, y2)
+	}
+	g.takePiece(x1, y1, x2, y2)
+	kingX, kingY := g.whereIsKing(color)
+	if kingX >= 0 && g.isCheck(kingX, kingY) {
+		g.Board[x1][y1].Piece, g.Board[x2][y2].Piece = g.Board[x2][y2].Piece, captured
+		if passed != NONE {
+			g.Board[x1][y2].Piece = passed
+		}
+		if g.Board[x1][y1].Piece&^BLACK == KING {
+			return move, ErrMoveIntoCheck
+		}
+		return move, ErrKingInCheck
+	}
+	if move.Promotion != NONE {
+		g.Board[x2][y2].Piece = move.Promotion + color
+	}
+	move.Taken = captured != NONE || passed != NONE
+	return move, nil
+}
+
+// legalMoves lists the moves in UCI notation a color could play on the board as it stands,
+// whoever's turn it is, a pawn reaching the last rank is listed once for each promotion
+func (g *Game) legalMoves(color int) []string {
+	moves := []string{}
+	board := g.Board
+	for x1, row := range board {
+		for y1, square := range row {
+			if square.Piece == NONE || square.Piece&BLACK != color {
+				continue
+			}
+			for x2 := 0; x2 < 8; x2++ {
+				for y2 := 0; y2 < 8; y2++ {
+					if x1 == x2 && y1 == y2 {
+						continue
+					}
+					move, err := g.apply(Move{Src: squareName(x1, y1), Dst: squareName(x2, y2)}, x1, y1, x2, y2)
+					g.Board = board
+					// a castle is listed once, from the king
+					if err != nil || move.Castle && move.RookSrc == move.Src {
+						continue
+					}
+					if move.Promotion == NONE {
+						moves = append(moves, move.UCI())
+						continue
+					}
+					// the piece a pawn becomes doesn't change which squares it leaves open
+					for _, promotion := range []int{QUEEN, ROOK, BISHOP, KNIGHT} {
+						move.Promotion = promotion
+						moves = append(moves, move.UCI())
+					}
+				}
+			}
+		}
+	}
+	return moves
+}
+
+// movePiece checks that a piece can move from one square to another
 func (g *Game) movePiece(x1, y1, x2, y2 int) error {
 	// Check target square
 	piece := (g.Board[x1][y1].Piece | BLACK) - BLACK
@@ -130,12 +635,11 @@ func (g *Game) movePiece(x1, y1, x2, y2 int) error {
 	pieceColor := g.Board[x1][y1].Piece & BLACK
 	otherPieceColor := g.Board[x2][y2].Piece & BLACK
 	if !g.checkIsLegalMove(x1, y1, x2, y2) {
-		return errors.New("illegal move")
+		return ErrIllegalMove
 	}
 	if piece != NONE && otherPiece != NONE && pieceColor == otherPieceColor {
-		return errors.New("can't move to a square with a piece of the same color")
+		return ErrSameColor
 	}
-	g.Board[x2][y2].Piece, g.Board[x1][y1].Piece = g.Board[x1][y1].Piece, g.Board[x2][y2].Piece
 	return nil
 }
 
@@ -144,37 +648,102 @@ func (g *Game) takePiece(x1, y1, x2, y2 int) {
 	g.Board[x1][y1].Piece = NONE
 }
 
-func (g *Game) castle(x1, y1, x2, y2 int) (int, int, int, int, error) {
-	if g.isCheck(x1, y1) || g.isCheck(x2, y2) {
-		return -1, -1, -1, -1, errors.New("can't castle while in check")
+// castle moves the king and the rook to their castled squares and returns their new positions
+func (g *Game) castle(kingX, kingY, rookX, rookY int) (int, int, int, int, error) {
+	if kingX != rookX || kingY != 4 || (rookY != 0 && rookY != 7) {
+		return -1, -1, -1, -1, ErrIllegalCastle
+	}
+	if !strings.Contains(g.Castling, castlingRight(g.Board[kingX][kingY].Piece&BLACK, rookY)) {
+		return -1, -1, -1, -1, ErrIllegalCastle
 	}
-	// find out which piece is rook and which is king
-	// (x1, y1) or (x2, y2) can be the king or the rook as the action is to drag one of the two pieces to the other
-	var rookX, kingX, kingDY, rookDY int
+	for i := utils.Min(kingY, rookY) + 1; i < utils.Max(kingY, rookY); i++ {
+		if g.Board[kingX][i].Piece != NONE {
+			return -1, -1, -1, -1, ErrCastleThroughPieces
+		}
+	}
+	if g.isCheck(kingX, kingY) {
+		return -1, -1, -1, -1, ErrCastleInCheck
+	}
+	// queen side castles to the c-file, king side to the g-file
+	kingDY, rookDY, step := 2, 3, -1
+	if rookY == 7 {
+		kingDY, rookDY, step = 6, 5, 1
+	}
+	king := g.Board[kingX][kingY].Piece
+	// the king may not pass through or land on an attacked square
+	for i := kingY + step; i != kingDY+step; i += step {
+		g.Board[kingX][i].Piece = king
+		attacked := g.isCheck(kingX, i)
+		g.Board[kingX][i].Piece = NONE
+		if attacked {
+			return -1, -1, -1, -1, ErrCastleIntoCheck
+		}
+	}
+
+	g.Board[kingX][kingDY].Piece = king
+	g.Board[rookX][rookDY].Piece = g.Board[rookX][rookY].Piece
+	g.Board[kingX][kingY].Piece = NONE
+	g.Board[rookX][rookY].Piece = NONE
+	return kingX, kingDY, rookX, rookDY, nil
+}
 
-	if y1 == 0 {
-		// this is probably the rook
-		rookX = x1
-		kingX = x2
-		kingDY = 1
-		rookDY = 2
-	} else if y1 == 7 {
-		// this is probably the rook
-		rookX = x1
-		kingX = x2
-		kingDY = 6
-		rookDY = 5
+// castlingRight returns the letter of the right to castle with the rook on file rookY
+func castlingRight(color, rookY int) string {
+	right := "Q"
+	if rookY == 7 {
+		right = "K"
 	}
+	if color == BLACK {
+		return strings.ToLower(right)
+	}
+	return right
+}
 
-	if g.isCheck(kingX, kingDY) {
-		return -1, -1, -1, -1, errors.New("can't castle into check")
+// loseCastling takes away the castling rights of the kings and rooks a move moved or took
+func (g *Game) loseCastling(move Move) {
+	squares := []string{move.Src, move.Dst}
+	if move.Castle {
+		squares = []string{move.KingSrc}
+	}
+	for _, square := range squares {
+		for _, right := range CASTLING_SQUARES[square] {
+			g.Castling = strings.ReplaceAll(g.Castling, string(right), "")
+		}
+	}
+	if g.Castling == "" {
+		g.Castling = "-"
 	}
+}
 
-	g.Board[kingX][kingDY].Piece = g.Board[kingX][y1].Piece
-	g.Board[rookX][rookDY].Piece = g.Board[rookX][y1].Piece
-	g.Board[kingX][y1].Piece = NONE
-	g.Board[rookX][y1].Piece = NONE
-	return kingX, kingDY, rookX, rookDY, nil
+// homeCastling returns the castling rights of the kings and rooks on their starting squares, the
+// most a position may have whatever was played before
+func (g *Game) homeCastling() string {
+	rights := ""
+	for _, color := range []int{WHITE, BLACK} {
+		x := 0
+		if color == BLACK {
+			x = 7
+		}
+		if g.Board[x][4].Piece != KING+color {
+			continue
+		}
+		for _, side := range []struct {
+			y      int
+			letter string
+		}{{7, "K"}, {0, "Q"}} {
+			if g.Board[x][side.y].Piece == ROOK+color {
+				if color == BLACK {
+					rights += strings.ToLower(side.letter)
+				} else {
+					rights += side.letter
+				}
+			}
+		}
+	}
+	if rights == "" {
+		return "-"
+	}
+	return rights
 }
 
 func (g *Game) whereIsKing(color int) (int, int) {
@@ -188,56 +757,44 @@ func (g *Game) whereIsKing(color int) (int, int) {
 	return -1, -1
 }
 
-// This function is used after we check legal moves
+// isCastle checks if a move is a king and rook of the same color being dragged onto each other
 func (g *Game) isCastle(x1, y1, x2, y2 int) bool {
 	piece := g.Board[x1][y1].Piece &^ BLACK
 	otherPiece := g.Board[x2][y2].Piece &^ BLACK
-	if piece == KING && otherPiece == ROOK {
+	if g.Board[x1][y1].Piece&BLACK != g.Board[x2][y2].Piece&BLACK {
+		return false
+	}
+	if (piece == KING && otherPiece == ROOK) || (piece == ROOK && otherPiece == KING) {
 		return true
 	}
 	return false
 }
 
+// checkPawnMovement checks a pawn moving one square forward, two from its starting rank or
+// capturing diagonally, en passant too, white moves up the ranks and black down
 func (g *Game) checkPawnMovement(x1, y1, x2, y2 int) bool {
-	piece := g.Board[x1][y1].Piece
+	color := g.Board[x1][y1].Piece & BLACK
 	otherPiece := g.Board[x2][y2].Piece
-	color := piece & BLACK
-	if color == WHITE {
-		if (x1 == 1 && x2 == 3 && y1 == y2) || (x1-x2 == -1 && y1 == y2) || (x1-x2 == -1 && utils.Abs(y1-y2) == 1 && otherPiece != NONE && otherPiece&BLACK == WHITE) {
-			if utils.Abs(y1-y2) == 2 {
-				// check if any piece is in the way
-				for i := 1; i < 3; i++ {
-					if g.Board[x1-i][y1].Piece != NONE {
-						return false
-					}
-				}
-			}
-			if otherPiece != NONE && otherPiece&BLACK == WHITE && y1 == y2 && x1-x2 == -1 {
-				return false
-			}
-			return true
-		}
-	} else {
-		if (x1 == 6 && x2 == 4 && y1 == y2) || (x1-x2 == 1 && y1 == y2) || (x1-x2 == 1 && utils.Abs(y1-y2) == 1 && otherPiece != NONE && otherPiece&BLACK == WHITE) {
-			if utils.Abs(y1-y2) == 2 {
-				// check if any piece is in the way
-				for i := 1; i < 3; i++ {
-					if g.Board[x1+i][y1].Piece != NONE {
-						return false
-					}
-				}
-			}
-			if otherPiece != NONE && otherPiece&BLACK == BLACK && y1 == y2 && x1-x2 == 1 {
-				return false
-			}
-			return true
-		}
+	dir, start := 1, 1
+	if color == BLACK {
+		dir, start = -1, 6
+	}
+	switch {
+	case y1 == y2 && x2-x1 == dir:
+		return otherPiece == NONE
+	case y1 == y2 && x1 == start && x2-x1 == 2*dir:
+		// check if any piece is in the way
+		return otherPiece == NONE && g.Board[x1+dir][y1].Piece == NONE
+	case utils.Abs(y1-y2) == 1 && x2-x1 == dir && otherPiece == NONE:
+		// the pawn passed by a move of two squares can be taken as if it moved one
+		return squareName(x2, y2) == g.EnPassant && g.Board[x1][y2].Piece == PAWN+(color^BLACK)
+	case utils.Abs(y1-y2) == 1 && x2-x1 == dir:
+		return otherPiece&BLACK != color
 	}
 	return false
 }
 
 func (g *Game) checkRookMovement(x1, y1, x2, y2 int) bool {
-	piece := g.Board[x1][y1].Piece
 	// check if any piece is in the way, make sure to exclude the target square
 	y_min := utils.Min(y1, y2)
 	y_max := utils.Max(y1, y2)
@@ -256,21 +813,7 @@ func (g *Game) checkRookMovement(x1, y1, x2, y2 int) bool {
 			}
 		}
 	}
-	if (x1 == x2 && y1 != y2) || (x1 != x2 && y1 == y2) {
-		return true
-	}
-	// castling check
-	switch piece & BLACK {
-	case WHITE:
-		if (((x1 == 7 && y1 == 4) || (x2 == 7 && y2 == 6)) && g.Board[7][7].Piece == ROOK && g.Board[7][5].Piece == NONE) || ((x1 == 7 && y1 == 4) || (x2 == 7 && y2 == 2)) && g.Board[7][0].Piece == ROOK && g.Board[7][3].Piece == NONE {
-			return true
-		}
-	case BLACK:
-		if (((x1 == 0 && y1 == 4) || (x2 == 0 && y2 == 6)) && g.Board[0][7].Piece == ROOK && g.Board[0][5].Piece == NONE) || ((x1 == 0 && y1 == 4) || (x2 == 0 && y2 == 2)) && g.Board[0][0].Piece == ROOK && g.Board[0][3].Piece == NONE {
-			return true
-		}
-	}
-	return false
+	return (x1 == x2 && y1 != y2) || (x1 != x2 && y1 == y2)
 }
 
 func (g *Game) checkKnightMovement(x1, y1, x2, y2 int) bool {
@@ -283,6 +826,10 @@ func (g *Game) checkKnightMovement(x1, y1, x2, y2 int) bool {
 }
 
 func (g *Game) checkBishopMovement(x1, y1, x2, y2 int) bool {
+	// only diagonals can be walked without leaving the board
+	if utils.Abs(x1-x2) != utils.Abs(y1-y2) {
+		return false
+	}
 	// check if any piece is in the way, make sure to exclude the target square
 	x_min := utils.Min(x1, x2)
 	x_max := utils.Max(x1, x2)
@@ -317,22 +864,10 @@ func (g *Game) checkBishopMovement(x1, y1, x2, y2 int) bool {
 	return false
 }
 
+// checkKingMovement checks a king moving a single square, castling is dragging it onto a rook, see
+// isCastle
 func (g *Game) checkKingMovement(x1, y1, x2, y2 int) bool {
-	if utils.Abs(x1-x2) <= 1 && utils.Abs(y1-y2) <= 1 {
-		return true
-	}
-	// castling check
-	switch g.Board[x1][y1].Piece & BLACK {
-	case WHITE:
-		if (((x1 == 7 && y1 == 4) || (x2 == 7 && y2 == 6)) && g.Board[7][7].Piece == ROOK && g.Board[7][5].Piece == NONE) || ((x1 == 7 && y1 == 4) || (x2 == 7 && y2 == 2)) && g.Board[7][0].Piece == ROOK && g.Board[7][3].Piece == NONE {
-			return true
-		}
-	case BLACK:
-		if (((x1 == 0 && y1 == 4) || (x2 == 0 && y2 == 6)) && g.Board[0][7].Piece == ROOK && g.Board[0][5].Piece == NONE) || ((x1 == 0 && y1 == 4) || (x2 == 0 && y2 == 2)) && g.Board[0][0].Piece == ROOK && g.Board[0][3].Piece == NONE {
-			return true
-		}
-	}
-	return false
+	return utils.Abs(x1-x2) <= 1 && utils.Abs(y1-y2) <= 1
 }
 
 func (g *Game) isCheck(x1, y1 int) bool {
@@ -350,46 +885,9 @@ func (g *Game) isCheck(x1, y1 int) bool {
 	return false
 }
 
-func (g *Game) isCheckmate(color int) bool {
-	// check if the king is in check
-	kingX, kingY := g.whereIsKing(color)
-	if !g.isCheck(kingX, kingY) {
-		return false
-	}
-	// check if the king can move
-	for i := -1; i < 2; i++ {
-		for j := -1; j < 2; j++ {
-			if i == 0 && j == 0 {
-				continue
-			}
-			if kingX+i >= 0 && kingX+i < 8 && kingY+j >= 0 && kingY+j < 8 {
-				if g.checkIsLegalMove(kingX, kingY, kingX+i, kingY+j) {
-					return false
-				}
-			}
-		}
-	}
-	// check if any piece can take the attacking piece
-	for i, row := range g.Board {
-		for j, square := range row {
-			if square.Piece&BLACK == color {
-				for k := 0; k < 8; k++ {
-					for l := 0; l < 8; l++ {
-						if g.checkIsLegalMove(i, j, k, l) {
-							return false
-						}
-					}
-				}
-			}
-		}
-	}
-	return true
-}
-
 // checkIsLegalMove checks if a move is legal
 func (g *Game) checkIsLegalMove(x1, y1, x2, y2 int) bool {
 	// get piece
-	log.Printf("%s<%d, %d> -> %s<%d, %d> ", PIECE_NAMES[g.Board[x1][y1].Piece], x1, y1, PIECE_NAMES[g.Board[x2][y2].Piece], x2, y2)
 	piece := g.Board[x1][y1].Piece
 	switch piece &^ BLACK {
 	case PAWN:
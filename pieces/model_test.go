@@ -0,0 +1,223 @@
+package pieces
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Qinbeans/chess-htmx/config"
+)
+
+// play plays moves in UCI notation from the starting position
+func play(t *testing.T, moves ...string) *Game {
+	t.Helper()
+	game := NewGame("", config.TimeControl{})
+	for _, uci := range moves {
+		if _, err := game.Play(uci); err != nil {
+			t.Fatalf("%s: %v", uci, err)
+		}
+	}
+	return game
+}
+
+func TestCastling(t *testing.T) {
+	// both sides cleared for white, black's pieces are left where they are
+	cleared := []string{"e2e4", "e7e5", "g1f3", "b8c6", "f1c4", "g8f6", "d2d3", "d7d6", "b1c3", "c8g4", "c1e3", "d8d7", "d1d2", "a7a6"}
+	tests := []struct {
+		name     string
+		moves    []string
+		castle   string
+		err      error
+		castling string
+	}{
+		{"king side", cleared, "e1g1", nil, "kq"},
+		{"queen side", cleared, "e1c1", nil, "kq"},
+		{"dragged onto the rook", cleared, "e1h1", nil, "kq"},
+		{"king moved and came back", append(cleared, "e1f1", "h7h6", "f1e1", "h6h5"), "e1g1", ErrIllegalCastle, "kq"},
+		{"king side rook moved and came back", append(cleared, "h1g1", "h7h6", "g1h1", "h6h5"), "e1g1", ErrIllegalCastle, "Qkq"},
+		{"queen side still allowed", append(cleared, "h1g1", "h7h6", "g1h1", "h6h5"), "e1c1", nil, "kq"},
+		{"through pieces", []string{"e2e4", "e7e5"}, "e1g1", ErrCastleThroughPieces, CASTLING},
+		{"rook taken", []string{"g2g4", "b7b6", "g1h3", "c8b7", "f1g2", "b7g2", "a2a3", "g2h1", "a3a4", "e7e6"}, "e1g1", ErrIllegalMove, "Qkq"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			game := play(t, tt.moves...)
+			_, err := game.Play(tt.castle)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("castling: got %v, want %v", err, tt.err)
+			}
+			if game.Castling != tt.castling {
+				t.Errorf("rights: got %q, want %q", game.Castling, tt.castling)
+			}
+		})
+	}
+}
+
+func TestCastlingRightsInFEN(t *testing.T) {
+	tests := []struct {
+		fen      string
+		castling string
+	}{
+		{"r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "KQkq"},
+		{"r3k2r/8/8/8/8/8/8/R3K2R w Kq - 0 1", "Kq"},
+		{"r3k2r/8/8/8/8/8/8/R3K2R w - - 0 1", "-"},
+		// rights of pieces away from home are dropped
+		{"r3k3/8/8/8/8/8/8/R3K1R1 w KQkq - 0 1", "Qq"},
+	}
+	for _, tt := range tests {
+		game, err := ParseFEN(tt.fen)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.fen, err)
+		}
+		if game.Castling != tt.castling {
+			t.Errorf("%s: got %q, want %q", tt.fen, game.Castling, tt.castling)
+		}
+		want := tt.castling[0] == 'K'
+		if _, err := game.Play("e1g1"); (err == nil) != want {
+			t.Errorf("%s: castling king side returned %v", tt.fen, err)
+		}
+	}
+}
+
+// setup returns a game from a position in FEN or from moves played from the starting position
+func setup(t *testing.T, fen string, moves []string) *Game {
+	t.Helper()
+	if fen == "" {
+		return play(t, moves...)
+	}
+	game, err := ParseFEN(fen)
+	if err != nil {
+		t.Fatalf("%s: %v", fen, err)
+	}
+	return game
+}
+
+func TestPromotion(t *testing.T) {
+	fen := "1n5k/P7/8/8/8/8/8/K7 w - - 0 1"
+	tests := []struct {
+		name  string
+		move  string
+		err   error
+		uci   string
+		piece int
+		taken bool
+	}{
+		{"queen when left out", "a7a8", nil, "a7a8q", QUEEN, false},
+		{"queen", "a7a8q", nil, "a7a8q", QUEEN, false},
+		{"knight", "a7a8n", nil, "a7a8n", KNIGHT, false},
+		{"rook taking", "a7b8r", nil, "a7b8r", ROOK, true},
+		{"bishop in upper case", "a7a8B", nil, "a7a8b", BISHOP, false},
+		{"king", "a7a8k", ErrInvalidPromotion, "", NONE, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			game := setup(t, fen, nil)
+			move, err := game.Play(tt.move)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if move.UCI() != tt.uci || move.Taken != tt.taken {
+				t.Errorf("move %s taken %v, want %s taken %v", move.UCI(), move.Taken, tt.uci, tt.taken)
+			}
+			x, y, _ := parseSquare(move.Dst)
+			if piece := game.Board[x][y].Piece; piece != tt.piece {
+				t.Errorf("%s holds %s, want %s", move.Dst, PIECE_NAMES[piece], PIECE_NAMES[tt.piece])
+			}
+			if game.Moves[0] != tt.uci {
+				t.Errorf("recorded %s, want %s", game.Moves[0], tt.uci)
+			}
+		})
+	}
+
+	promotions := 0
+	for _, move := range setup(t, fen, nil).LegalMoves() {
+		if move[:2] == "a7" {
+			promotions++
+		}
+	}
+	if promotions != 8 {
+		t.Errorf("got %d promotions of the a7 pawn, want 8", promotions)
+	}
+}
+
+func TestEnPassant(t *testing.T) {
+	tests := []struct {
+		name  string
+		fen   string
+		moves []string
+		move  string
+		err   error
+		taken string
+	}{
+		{"white takes", "", []string{"e2e4", "a7a6", "e4e5", "d7d5"}, "e5d6", nil, "d5"},
+		{"black takes", "", []string{"a2a3", "d7d5", "a3a4", "d5d4", "e2e4"}, "d4e3", nil, "e4"},
+		{"only right after the pawn passed", "", []string{"e2e4", "a7a6", "e4e5", "d7d5", "a2a3", "a6a5"}, "e5d6", ErrIllegalMove, ""},
+		{"pawn that moved one square at a time", "", []string{"e2e4", "d7d6", "e4e5", "a7a6", "a2a3", "d6d5"}, "e5d6", ErrIllegalMove, ""},
+		{"from FEN", "4k3/8/8/3pP3/8/8/8/4K3 w - d6 0 1", nil, "e5d6", nil, "d5"},
+		{"both pawns leave the rank of the king", "8/8/8/K2pP2r/8/8/8/7k w - d6 0 1", nil, "e5d6", ErrKingInCheck, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			game := setup(t, tt.fen, tt.moves)
+			move, err := game.Play(tt.move)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			x, y, _ := parseSquare(tt.move[:2])
+			if err != nil {
+				if game.Board[x][y].Piece&^BLACK != PAWN {
+					t.Errorf("the pawn left %s after a refused move", tt.move[:2])
+				}
+				return
+			}
+			if !move.Taken || move.EnPassant != tt.taken {
+				t.Errorf("taken %v on %q, want %q", move.Taken, move.EnPassant, tt.taken)
+			}
+			x, y, _ = parseSquare(tt.taken)
+			if game.Board[x][y].Piece != NONE {
+				t.Errorf("%s still holds %s", tt.taken, PIECE_NAMES[game.Board[x][y].Piece])
+			}
+			if game.Halfmoves != 0 {
+				t.Errorf("halfmoves %d after a capture", game.Halfmoves)
+			}
+		})
+	}
+}
+
+func TestGameEnd(t *testing.T) {
+	tests := []struct {
+		name   string
+		fen    string
+		moves  []string
+		move   string
+		result string
+		reason string
+	}{
+		{"checkmate", "", []string{"f2f3", "e7e5", "g2g4"}, "d8h4", BLACK_WINS, "checkmate"},
+		{"stalemate", "7k/8/6Q1/8/8/8/8/K7 w - - 0 1", nil, "g6f7", DRAW, "stalemate"},
+		{"fifty moves", "6k1/8/8/8/8/8/8/K6R w - - 99 60", nil, "h1h2", DRAW, "fifty-move rule"},
+		{"a capture on the fiftieth move", "6k1/8/8/8/8/8/7p/K6R w - - 99 60", nil, "h1h2", "", ""},
+		{"a pawn move on the fiftieth move", "6k1/8/8/8/8/8/P7/1K5R w - - 99 60", nil, "a2a3", "", ""},
+		{"checkmate on the fiftieth move", "6k1/5ppp/8/8/8/8/8/R5K1 w - - 99 60", nil, "a1a8", WHITE_WINS, "checkmate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			game := setup(t, tt.fen, tt.moves)
+			move, err := game.Play(tt.move)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if game.Result != tt.result || game.Reason != tt.reason {
+				t.Errorf("got %q by %q, want %q by %q", game.Result, game.Reason, tt.result, tt.reason)
+			}
+			if move.Checkmate != (tt.reason == "checkmate") {
+				t.Errorf("checkmate %v", move.Checkmate)
+			}
+			if over := len(game.LegalMoves()) == 0; over != (tt.result != "") {
+				t.Errorf("legal moves left %v after %q", !over, game.Result)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package pieces
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/Qinbeans/chess-htmx/storage"
+	"github.com/Qinbeans/chess-htmx/utils"
+	"github.com/flosch/pongo2/v6"
+	"github.com/labstack/echo/v4"
+)
+
+var ErrGameInProgress = errors.New("the game is still being played")
+
+// VALUES are the points a piece is worth in the material count, kings are never taken
+var VALUES = map[int]int{
+	PAWN:   1,
+	KNIGHT: 3,
+	BISHOP: 3,
+	ROOK:   5,
+	QUEEN:  9,
+}
+
+// TALLY_ORDER is the order taken pieces are listed in, the most valuable first
+var TALLY_ORDER = []int{QUEEN, ROOK, BISHOP, KNIGHT, PAWN}
+
+// ReplayMove is a move of a replayed game, Ply is the number of moves played once it's on the board
+type ReplayMove struct {
+	Ply int
+	SAN string
+}
+
+// ReplayRow is a line of the move list, black is nil when white's move ended the game
+type ReplayRow struct {
+	Number int
+	White  *ReplayMove
+	Black  *ReplayMove
+}
+
+// Replay is a finished game played again from the starting position up to a ply
+//   - Board: the position once Ply moves were played, 0 is the starting position
+//   - Last: the move that led to Board, its squares are highlighted
+//   - Rows: every move of the game in standard algebraic notation, numbered by pairs
+//   - TakenByWhite, TakenByBlack: piece codes such as "bQ" of the pieces each color took by the ply
+//   - Advantage: how much more material the color Ahead has by the ply, Ahead is empty when even
+type Replay struct {
+	Board        *Game
+	Ply          int
+	Plies        int
+	Last         Move
+	Rows         []ReplayRow
+	TakenByWhite []string
+	TakenByBlack []string
+	Advantage    int
+	Ahead        string
+	Result       string
+	Reason       string
+}
+
+// NewReplay plays the moves of a stored game up to ply, a ply out of range is clamped to the game
+func NewReplay(snapshot Snapshot, ply int) (*Replay, error) {
+	if ply < 0 || ply > len(snapshot.Moves) {
+		ply = len(snapshot.Moves)
+	}
+	replay := &Replay{
+		Ply:    ply,
+		Plies:  len(snapshot.Moves),
+		Result: snapshot.Result,
+		Reason: snapshot.Reason,
+	}
+	game := &Game{Board: STARTING_POSITION, Turn: WHITE, Castling: CASTLING}
+	replay.Board = &Game{Board: game.Board, Turn: game.Turn}
+	taken := []int{}
+	for i, uci := range snapshot.Moves {
+		san, err := game.SAN(uci)
+		if err != nil {
+			return nil, fmt.Errorf("move %d %q: %w", i+1, uci, err)
+		}
+		before := game.Board
+		move, err := game.Play(uci)
+		if err != nil {
+			return nil, fmt.Errorf("move %d %q: %w", i+1, uci, err)
+		}
+		if move.Taken && i < ply {
+			square := move.Dst
+			if move.EnPassant != "" {
+				square = move.EnPassant
+			}
+			x, y, _ := parseSquare(square)
+			taken = append(taken, before[x][y].Piece)
+		}
+		entry := &ReplayMove{Ply: i + 1, SAN: san}
+		if i%2 == 0 {
+			replay.Rows = append(replay.Rows, ReplayRow{Number: i/2 + 1, White: entry})
+		} else {
+			replay.Rows[len(replay.Rows)-1].Black = entry
+		}
+		if i+1 == ply {
+			replay.Board = &Game{Board: game.Board, Turn: game.Turn}
+			replay.Last = move
+		}
+	}
+	replay.tally(taken)
+	return replay, nil
+}
+
+// tally lists the pieces taken by the ply and weighs the material left on the board, a promoted
+// pawn counts as the piece it became
+func (r *Replay) tally(taken []int) {
+	count := map[int]int{}
+	for _, piece := range taken {
+		count[piece]++
+	}
+	r.TakenByWhite, r.TakenByBlack = []string{}, []string{}
+	for _, piece := range TALLY_ORDER {
+		for i := 0; i < count[piece+BLACK]; i++ {
+			r.TakenByWhite = append(r.TakenByWhite, PIECES[piece+BLACK])
+		}
+		for i := 0; i < count[piece]; i++ {
+			r.TakenByBlack = append(r.TakenByBlack, PIECES[piece])
+		}
+	}
+	balance := 0
+	for _, row := range r.Board.Board {
+		for _, square := range row {
+			if square.Piece&BLACK == BLACK {
+				balance -= VALUES[square.Piece&^BLACK]
+			} else {
+				balance += VALUES[square.Piece]
+			}
+		}
+	}
+	r.Advantage = utils.Abs(balance)
+	if balance > 0 {
+		r.Ahead = COLOR_NAMES[WHITE]
+	} else if balance < 0 {
+		r.Ahead = COLOR_NAMES[BLACK]
+	}
+}
+
+// Highlighted returns the squares the last move touched, none on the starting position
+func (r *Replay) Highlighted() map[string]bool {
+	squares := map[string]bool{}
+	if r.Ply == 0 {
+		return squares
+	}
+	if r.Last.Castle {
+		squares[r.Last.KingSrc], squares[r.Last.KingDst] = true, true
+		squares[r.Last.RookSrc], squares[r.Last.RookDst] = true, true
+		return squares
+	}
+	squares[r.Last.Src], squares[r.Last.Dst] = true, true
+	return squares
+}
+
+// *****************************************************************************
+
+// stored returns a finished game, either still in its room or archived once the room expired
+func (g *Server) stored(room string) (Snapshot, error) {
+	g.Hub.Lock()
+	defer g.Hub.Unlock()
+	err := g.acquire(room)
+	if err == nil {
+		defer g.release(room)
+		game := g.Games[room]
+		if game.Result == "" {
+			return Snapshot{}, ErrGameInProgress
+		}
+		return game.Snapshot(g.Hub.Room(room).LastActivity), nil
+	}
+	if !errors.Is(err, ErrRoomNotFound) {
+		return Snapshot{}, err
+	}
+	data, err := g.Store.Load(ARCHIVE, room)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Snapshot{}, ErrRoomNotFound
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// Replay is a callback for the replay of a finished game, the page is rendered whole and htmx
+// asks for the board of another ply as a fragment
+func (g *Server) Replay(c echo.Context) error {
+	logger := logging.FromContext(c)
+	room := c.QueryParam("game")
+	if room == "" {
+		logger.Debug("game parameter is required")
+		return c.Redirect(302, "/")
+	}
+	snapshot, err := g.stored(room)
+	if err != nil {
+		logger.Debug("game unavailable for replay", "room", room, "error", err)
+		return c.Redirect(302, "/")
+	}
+	// the final position unless a ply is asked for
+	ply, err := strconv.Atoi(c.QueryParam("ply"))
+	if err != nil {
+		ply = -1
+	}
+	replay, err := NewReplay(snapshot, ply)
+	if err != nil {
+		logger.Error("failed to replay game", "room", room, "error", err)
+		return err
+	}
+	color := WHITE
+	if c.QueryParam("orientation") == COLOR_NAMES[BLACK] {
+		color = BLACK
+	}
+	ranks, files := Labels(color)
+	// restoring the history of the browser takes the whole page
+	view := "replay.dj"
+	header := c.Request().Header
+	if header.Get("HX-Request") == "true" && header.Get("HX-History-Restore-Request") != "true" {
+		view = "replay_board.dj"
+	}
+	return c.Render(200, view, pongo2.Context{
+		"title":       "Replay",
+		"description": "Step through a finished game of chess",
+		"game":        room,
+		"replay":      replay,
+		"highlighted": replay.Highlighted(),
+		"first":       0,
+		"previous":    utils.Max(replay.Ply-1, 0),
+		"next":        utils.Min(replay.Ply+1, replay.Plies),
+		"last":        replay.Plies,
+		"orientation": COLOR_NAMES[color],
+		"flipped":     COLOR_NAMES[color^BLACK],
+		"ranks":       ranks,
+		"files":       files,
+		"board":       replay.Board.toSquareArray(color),
+	})
+}
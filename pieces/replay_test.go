@@ -0,0 +1,44 @@
+package pieces
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReplayTally(t *testing.T) {
+	// white's a pawn takes its way to b8 and becomes a queen, taking two pawns, a bishop and a rook
+	promotion := []string{"a2a4", "b7b5", "a4b5", "a7a6", "b5a6", "c8b7", "a6b7", "h7h6", "b7a8q"}
+	tests := []struct {
+		name      string
+		moves     []string
+		ply       int
+		white     string
+		black     string
+		advantage int
+		ahead     string
+	}{
+		{"starting position", promotion, 0, "", "", 0, ""},
+		{"pawn taken", promotion, 3, "bP", "", 1, "white"},
+		{"before the promotion", promotion, 7, "bB bP bP", "", 5, "white"},
+		{"promotion taking", promotion, 9, "bR bB bP bP", "", 18, "white"},
+		{"en passant", []string{"e2e4", "a7a6", "e4e5", "d7d5", "e5d6"}, 5, "bP", "", 1, "white"},
+		{"taken back", []string{"e2e4", "d7d5", "e4d5", "d8d5"}, 4, "bP", "wP", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replay, err := NewReplay(Snapshot{Moves: tt.moves}, tt.ply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(replay.TakenByWhite, " "); got != tt.white {
+				t.Errorf("taken by white %q, want %q", got, tt.white)
+			}
+			if got := strings.Join(replay.TakenByBlack, " "); got != tt.black {
+				t.Errorf("taken by black %q, want %q", got, tt.black)
+			}
+			if replay.Advantage != tt.advantage || replay.Ahead != tt.ahead {
+				t.Errorf("advantage %d %q, want %d %q", replay.Advantage, replay.Ahead, tt.advantage, tt.ahead)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package pieces
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrAmbiguousMove = errors.New("ambiguous move")
+
+// SAN_PIECES are the letters of the pieces in standard algebraic notation, pawns have none
+var SAN_PIECES = map[int]string{
+	PAWN:   "",
+	ROOK:   "R",
+	KNIGHT: "N",
+	BISHOP: "B",
+	QUEEN:  "Q",
+	KING:   "K",
+}
+
+// SAN returns a legal move in UCI notation in standard algebraic notation, e.g. Nbd2, exd5,
+// e8=Q, O-O or Qh4#
+func (g *Game) SAN(uci string) (string, error) {
+	src, dst, promotion, err := g.Squares(uci)
+	if err != nil {
+		return "", err
+	}
+	x1, y1, _ := parseSquare(src)
+	piece := g.Board[x1][y1].Piece &^ BLACK
+	// played on a copy, the clocks and players don't matter to the notation
+	next := &Game{Board: g.Board, Turn: g.Turn, Castling: g.Castling, EnPassant: g.EnPassant, Clocks: map[int]time.Duration{}}
+	move, err := next.Move(g.Turn, src, dst, promotion)
+	if err != nil {
+		return "", err
+	}
+	san := ""
+	if move.Castle {
+		san = "O-O"
+		if move.KingDst[0] == 'c' {
+			san = "O-O-O"
+		}
+	} else {
+		san = SAN_PIECES[piece]
+		if piece == PAWN {
+			if move.Taken {
+				san = src[:1]
+			}
+		} else {
+			san += g.disambiguation(piece, src, dst)
+		}
+		if move.Taken {
+			san += "x"
+		}
+		san += uci[2:4]
+		if move.Promotion != NONE {
+			san += "=" + SAN_PIECES[move.Promotion]
+		}
+	}
+	if move.Checkmate {
+		return san + "#", nil
+	}
+	if kingX, kingY := next.whereIsKing(next.Turn); kingX >= 0 && next.isCheck(kingX, kingY) {
+		san += "+"
+	}
+	return san, nil
+}
+
+// disambiguation returns the file, rank or square telling a piece apart from the others of its
+// kind that could move to the same square
+func (g *Game) disambiguation(piece int, src, dst string) string {
+	file, rank := false, false
+	others := false
+	for _, move := range g.LegalMoves() {
+		from := move[:2]
+		if from == src || move[2:4] != dst {
+			continue
+		}
+		x, y, _ := parseSquare(from)
+		if g.Board[x][y].Piece&^BLACK != piece {
+			continue
+		}
+		others = true
+		if from[0] == src[0] {
+			file = true
+		}
+		if from[1] == src[1] {
+			rank = true
+		}
+	}
+	switch {
+	case !others:
+		return ""
+	case !file:
+		return src[:1]
+	case !rank:
+		return src[1:]
+	}
+	return src
+}
+
+// ParseMove returns the legal move in UCI notation a player typed, in UCI or in standard algebraic
+// notation, checks, captures and annotations are optional
+func (g *Game) ParseMove(text string) (string, error) {
+	legal := g.LegalMoves()
+	text = strings.TrimSpace(text)
+	for _, move := range legal {
+		// a promotion left out of UCI is to a queen
+		if strings.EqualFold(text, move) || (len(move) == 5 && move[4] == 'q' && strings.EqualFold(text, move[:4])) {
+			return move, nil
+		}
+	}
+	san := strings.TrimRight(text, "+#!?")
+	san = strings.ReplaceAll(san, "0", "O")
+	if san == "O-O" || san == "O-O-O" {
+		y := "g"
+		if san == "O-O-O" {
+			y = "c"
+		}
+		rank := "1"
+		if g.Turn == BLACK {
+			rank = "8"
+		}
+		castle := "e" + rank + y + rank
+		for _, move := range legal {
+			x, y, _ := parseSquare(move[:2])
+			if move == castle && g.Board[x][y].Piece&^BLACK == KING {
+				return move, nil
+			}
+		}
+		return "", fmt.Errorf("%w %q", ErrIllegalMove, text)
+	}
+	// the piece a pawn becomes follows its square, a queen when it's left out
+	promotion := "q"
+	if n := len(san); n > 2 && strings.ContainsRune("QRBN", rune(san[n-1])) {
+		promotion = strings.ToLower(san[n-1:])
+		san = strings.TrimSuffix(san[:n-1], "=")
+	}
+	san = strings.ReplaceAll(san, "x", "")
+	if len(san) < 2 {
+		return "", fmt.Errorf("%w %q", ErrIllegalMove, text)
+	}
+	piece := PAWN
+	for kind, letter := range SAN_PIECES {
+		if letter != "" && strings.HasPrefix(san, letter) {
+			piece = kind
+			san = san[1:]
+			break
+		}
+	}
+	if len(san) < 2 {
+		return "", fmt.Errorf("%w %q", ErrIllegalMove, text)
+	}
+	dst, hint := san[len(san)-2:], san[:len(san)-2]
+	found := []string{}
+	for _, move := range legal {
+		x, y, _ := parseSquare(move[:2])
+		if move[2:4] != dst || g.Board[x][y].Piece&^BLACK != piece {
+			continue
+		}
+		if len(move) == 5 && move[4:] != promotion {
+			continue
+		}
+		if hint != "" && !strings.Contains(move[:2], hint) {
+			continue
+		}
+		found = append(found, move)
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w %q", ErrIllegalMove, text)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%w %q, it could be %s", ErrAmbiguousMove, text, strings.Join(found, " or "))
+}
@@ -0,0 +1,98 @@
+package pieces
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSAN(t *testing.T) {
+	cleared := []string{"e2e4", "e7e5", "g1f3", "b8c6", "f1c4", "g8f6", "d2d3", "d7d6", "b1c3", "c8g4", "c1e3", "d8d7", "d1d2", "a7a6"}
+	promotion := "1n5k/P7/8/8/8/8/8/K7 w - - 0 1"
+	tests := []struct {
+		name  string
+		fen   string
+		moves []string
+		uci   string
+		san   string
+	}{
+		{"knight", "", nil, "g1f3", "Nf3"},
+		{"pawn", "", nil, "e2e4", "e4"},
+		{"pawn taking", "", []string{"e2e4", "d7d5"}, "e4d5", "exd5"},
+		{"en passant", "", []string{"e2e4", "a7a6", "e4e5", "d7d5"}, "e5d6", "exd6"},
+		{"king side castle", "", cleared, "e1g1", "O-O"},
+		{"queen side castle", "", cleared, "e1c1", "O-O-O"},
+		{"check", "", []string{"e2e4", "e7e5", "f1c4", "b8c6"}, "c4f7", "Bxf7+"},
+		{"checkmate", "", []string{"f2f3", "e7e5", "g2g4"}, "d8h4", "Qh4#"},
+		{"file told apart", "4k3/8/8/8/8/8/8/1N2KN2 w - - 0 1", nil, "b1d2", "Nbd2"},
+		{"rank told apart", "4k3/8/8/R7/8/8/8/R3K3 w - - 0 1", nil, "a1a3", "R1a3"},
+		{"square told apart", "4k3/8/8/8/8/Q7/8/Q1Q1K3 w - - 0 1", nil, "a1b2", "Qa1b2"},
+		{"promotion", promotion, nil, "a7a8q", "a8=Q"},
+		{"underpromotion taking", promotion, nil, "a7b8n", "axb8=N"},
+		{"promotion with check", promotion, nil, "a7b8q", "axb8=Q+"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			game := setup(t, tt.fen, tt.moves)
+			san, err := game.SAN(tt.uci)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if san != tt.san {
+				t.Errorf("got %s, want %s", san, tt.san)
+			}
+			// the notation is worked out on a copy
+			if len(game.Moves) != len(tt.moves) {
+				t.Errorf("%d moves on the game after SAN", len(game.Moves))
+			}
+			if uci, err := game.ParseMove(san); err != nil || uci != tt.uci {
+				t.Errorf("parsing %s back: got %s, %v", san, uci, err)
+			}
+		})
+	}
+}
+
+func TestParseMove(t *testing.T) {
+	cleared := []string{"e2e4", "e7e5", "g1f3", "b8c6", "f1c4", "g8f6", "d2d3", "d7d6", "b1c3", "c8g4", "c1e3", "d8d7", "d1d2", "a7a6"}
+	knights := "4k3/8/8/8/8/8/8/1N2KN2 w - - 0 1"
+	promotion := "1n5k/P7/8/8/8/8/8/K7 w - - 0 1"
+	tests := []struct {
+		name  string
+		fen   string
+		moves []string
+		text  string
+		uci   string
+		err   error
+	}{
+		{"UCI", "", nil, "g1f3", "g1f3", nil},
+		{"UCI in upper case", "", nil, "G1F3", "g1f3", nil},
+		{"SAN", "", nil, "Nf3", "g1f3", nil},
+		{"pawn", "", nil, "e4", "e2e4", nil},
+		{"spaces and annotations", "", nil, " e4!? ", "e2e4", nil},
+		{"capture without the x", "", []string{"e2e4", "d7d5"}, "ed5", "e4d5", nil},
+		{"castle with zeros", "", cleared, "0-0", "e1g1", nil},
+		{"queen side castle", "", cleared, "O-O-O", "e1c1", nil},
+		{"castle in UCI", "", cleared, "e1g1", "e1g1", nil},
+		{"told apart", knights, nil, "Nbd2", "b1d2", nil},
+		{"ambiguous", knights, nil, "Nd2", "", ErrAmbiguousMove},
+		{"illegal", "", nil, "Ke2", "", ErrIllegalMove},
+		{"nonsense", "", nil, "x", "", ErrIllegalMove},
+		{"promotion", promotion, nil, "a8=Q", "a7a8q", nil},
+		{"promotion without the equals sign", promotion, nil, "a8N", "a7a8n", nil},
+		{"promotion left out", promotion, nil, "a8", "a7a8q", nil},
+		{"underpromotion taking", promotion, nil, "axb8=R+", "a7b8r", nil},
+		{"promotion in UCI", promotion, nil, "a7a8b", "a7a8b", nil},
+		{"promotion left out of UCI", promotion, nil, "a7a8", "a7a8q", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			game := setup(t, tt.fen, tt.moves)
+			uci, err := game.ParseMove(tt.text)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if uci != tt.uci {
+				t.Errorf("got %q, want %q", uci, tt.uci)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package pieces
+
+import (
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+)
+
+const (
+	// GAMES is the kind of the records holding games in flight during a restart
+	GAMES = "games"
+	// ARCHIVE is the kind of the records holding finished games
+	ARCHIVE = "archive"
+)
+
+// Snapshot is the state of a game kept in storage, connections are not part of it
+type Snapshot struct {
+	Board        [8][8]Square          `json:"board"`
+	ClientColors map[string]int        `json:"client_colors"`
+	Turn         int                   `json:"turn"`
+	TimeControl  config.TimeControl    `json:"time_control"`
+	Clocks       map[int]time.Duration `json:"clocks"`
+	Moves        []string              `json:"moves"`
+	Halfmoves    int                   `json:"halfmoves"`
+	Castling     string                `json:"castling"`
+	EnPassant    string                `json:"en_passant"`
+	Result       string                `json:"result"`
+	Reason       string                `json:"reason"`
+	DrawOffer    string                `json:"draw_offer"`
+	ResetRequest string                `json:"reset_request,omitempty"`
+	Bots         map[string]string     `json:"bots,omitempty"`
+	Challenge    *Challenge            `json:"challenge,omitempty"`
+	LastActivity time.Time             `json:"last_activity"`
+}
+
+// Snapshot returns the state of the game to be stored, a running clock is stopped at the current time
+func (g *Game) Snapshot(lastActivity time.Time) Snapshot {
+	clocks := map[int]time.Duration{}
+	for color := range g.Clocks {
+		clocks[color] = g.Remaining(color)
+	}
+	colors := map[string]int{}
+	for id, color := range g.ClientColors {
+		colors[id] = color
+	}
+	bots := map[string]string{}
+	for id, name := range g.Bots {
+		bots[id] = name
+	}
+	return Snapshot{
+		Board:        g.Board,
+		ClientColors: colors,
+		Turn:         g.Turn,
+		TimeControl:  g.TimeControl,
+		Clocks:       clocks,
+		Moves:        append([]string{}, g.Moves...),
+		Halfmoves:    g.Halfmoves,
+		Castling:     g.Castling,
+		EnPassant:    g.EnPassant,
+		Result:       g.Result,
+		Reason:       g.Reason,
+		DrawOffer:    g.DrawOffer,
+		ResetRequest: g.ResetRequest,
+		Bots:         bots,
+		Challenge:    g.Challenge,
+		LastActivity: lastActivity,
+	}
+}
+
+// FromSnapshot rebuilds a game from storage, every client may connect again and a running clock
+// starts again from the current time
+func FromSnapshot(snapshot Snapshot) *Game {
+	game := &Game{
+		Board:        snapshot.Board,
+		ClientColors: snapshot.ClientColors,
+		Turn:         snapshot.Turn,
+		TimeControl:  snapshot.TimeControl,
+		Clocks:       snapshot.Clocks,
+		Moves:        snapshot.Moves,
+		Halfmoves:    snapshot.Halfmoves,
+		Castling:     snapshot.Castling,
+		EnPassant:    snapshot.EnPassant,
+		Result:       snapshot.Result,
+		Reason:       snapshot.Reason,
+		DrawOffer:    snapshot.DrawOffer,
+		ResetRequest: snapshot.ResetRequest,
+		Bots:         snapshot.Bots,
+		Challenge:    snapshot.Challenge,
+		Muted:        map[string]bool{},
+	}
+	if game.ClientColors == nil {
+		game.ClientColors = map[string]int{}
+	}
+	if game.Bots == nil {
+		game.Bots = map[string]string{}
+	}
+	if game.Clocks == nil {
+		game.Clocks = map[int]time.Duration{}
+	}
+	if game.Castling == "" {
+		// stored before the rights were kept, the kings and rooks at home may castle
+		game.Castling = game.homeCastling()
+	}
+	if game.EnPassant == "" {
+		game.EnPassant = "-"
+	}
+	if game.timed() && game.Result == "" && len(game.Moves) > 0 {
+		// the clock was stopped when the game was stored, it runs again from now
+		game.LastMove = time.Now()
+	}
+	return game
+}
@@ -0,0 +1,112 @@
+package pieces
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+)
+
+// roundTrip stores a game and rebuilds it the way a restart does
+func roundTrip(t *testing.T, game *Game) *Game {
+	t.Helper()
+	data, err := json.Marshal(game.Snapshot(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	return FromSnapshot(snapshot)
+}
+
+func TestSnapshotClocks(t *testing.T) {
+	timeControl := config.TimeControl{Initial: time.Minute}
+	started := NewGame("white", timeControl)
+	for _, uci := range []string{"e2e4", "e7e5"} {
+		if _, err := started.Play(uci); err != nil {
+			t.Fatal(err)
+		}
+	}
+	finished := NewGame("white", timeControl)
+	if _, err := finished.Play("e2e4"); err != nil {
+		t.Fatal(err)
+	}
+	finished.win(WHITE, "resignation")
+	tests := []struct {
+		name    string
+		game    *Game
+		running bool
+	}{
+		{"not started", NewGame("white", timeControl), false},
+		{"started", started, true},
+		{"finished", finished, false},
+		{"untimed", play(t, "e2e4"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := map[int]time.Duration{WHITE: test.game.Remaining(WHITE), BLACK: test.game.Remaining(BLACK)}
+			restored := roundTrip(t, test.game)
+			if running := !restored.LastMove.IsZero(); running != test.running {
+				t.Fatalf("clock running = %v, want %v", running, test.running)
+			}
+			for color, remaining := range before {
+				// the clock to move may have run a little since
+				if got := restored.Remaining(color); got > remaining || got < remaining-100*time.Millisecond {
+					t.Errorf("%s has %v left, had %v", COLOR_NAMES[color], got, remaining)
+				}
+			}
+		})
+	}
+	// the restored clock keeps running towards the flag
+	restored := roundTrip(t, started)
+	time.Sleep(20 * time.Millisecond)
+	if restored.Remaining(WHITE) >= restored.Clocks[WHITE] {
+		t.Fatal("the restored clock is stopped")
+	}
+}
+
+func TestRestoreFlag(t *testing.T) {
+	g := newTestServer(t)
+	g.TimeControl = config.TimeControl{Initial: 50 * time.Millisecond}
+	g.Hub.Lock()
+	g.create("room", "white")
+	g.Hub.Unlock()
+	seat(t, g, "room")
+	g.Hub.Lock()
+	if _, err := g.play("white", "room", "e2", "e4", NONE, g.Logger); err != nil {
+		t.Fatal(err)
+	}
+	// stored as a shutdown would, then restored on a new server
+	data, err := json.Marshal(g.Games["room"].Snapshot(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Hub.Unlock()
+	restarted := newTestServer(t)
+	if err := restarted.Store.Save(GAMES, "room", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		restarted.Hub.Lock()
+		game := restarted.Games["room"]
+		result, reason := game.Result, game.Reason
+		restarted.Hub.Unlock()
+		if result != "" {
+			if result != WHITE_WINS || reason != "timeout" {
+				t.Fatalf("got %s by %s", result, reason)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the flag of the restored game didn't fall")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
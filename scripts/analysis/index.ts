@@ -0,0 +1,263 @@
+import * as htmx from 'htmx.org';
+import Sortable, { Swap } from 'sortablejs';
+import 'htmx.org';
+
+Sortable.mount(new Swap());
+
+type SerSquare = {
+    square: string;
+    color: string;
+    piece: string;
+};
+
+type TreeNode = {
+    id: number;
+    parent: number;
+    move?: string;
+    san?: string;
+    ply: number;
+    fen: string;
+    children: number[];
+};
+
+type State = {
+    current: number;
+    fen: string;
+    turn: string;
+    result?: string;
+    board: SerSquare[];
+    nodes: TreeNode[];
+    engine: boolean;
+};
+
+type Eval = {
+    node: number;
+    depth: number;
+    score: number;
+    mate?: number;
+    pv: string[];
+    san: string[];
+};
+
+const root = htmx.find('#analysis') as HTMLElement;
+const room = root.dataset.room;
+const owner = root.dataset.role === 'owner';
+const board = htmx.find('#board') as HTMLElement;
+const pieces = board.dataset.pieces;
+const moves = htmx.find('#moves') as HTMLElement;
+const evalLine = htmx.find('#eval') as HTMLElement;
+const notice = htmx.find('#notice') as HTMLElement;
+const engine = htmx.find('#engine') as HTMLInputElement;
+
+const protoc = window.location.protocol === 'https:' ? 'wss' : 'ws';
+// the token is sent along as a cookie
+const ws = new WebSocket(`${protoc}://${window.location.host}/analysis/ws?room=${room}`);
+
+let state: State = null;
+let flipped = false;
+
+const send = (message: { [key: string]: any }) => {
+    notice.textContent = '';
+    ws.send(JSON.stringify(message));
+}
+
+const renderBoard = () => {
+    const squares = flipped ? state.board.slice().reverse() : state.board;
+    board.innerHTML = '';
+    for (const square of squares) {
+        const element = document.createElement('div');
+        element.dataset.square = square.square;
+        if (square.piece) {
+            element.className = `square-${square.color}`;
+            const img = document.createElement('img');
+            img.src = `/themes/pieces/${pieces}/${square.piece}.svg`;
+            img.className = 'w-[5dvw] h-[5dvw]';
+            element.append(img);
+        } else {
+            element.className = `unswappable w-[5dvw] h-[5dvw] square-${square.color}`;
+        }
+        board.append(element);
+    }
+}
+
+// the labels are drawn for white and reversed when the board is flipped
+const flipLabels = () => {
+    for (const id of ['#ranks', '#files']) {
+        const labels = htmx.find(id) as HTMLElement;
+        for (let i = labels.children.length - 2; i >= 0; i--) {
+            labels.append(labels.children[i]);
+        }
+    }
+}
+
+// moveElement is a move of the tree, clicking it shows its position
+const moveElement = (node: TreeNode, numbered: boolean) => {
+    const span = document.createElement('span');
+    const white = node.ply % 2 === 1;
+    const number = Math.floor((node.ply - 1) / 2) + 1;
+    let text = node.san;
+    if (white) {
+        text = `${number}. ${text}`;
+    } else if (numbered) {
+        text = `${number}... ${text}`;
+    }
+    span.textContent = text + ' ';
+    span.className = 'cursor-pointer hover:bg-white/15';
+    if (node.id === state.current) {
+        span.className += ' bg-white/25';
+    }
+    if (owner) {
+        span.addEventListener('click', () => send({ 'type': 'goto', 'node': node.id }));
+    }
+    return span;
+}
+
+// renderLine writes the main line following a position, with every variation in parentheses
+// after the move it replaces
+const renderLine = (parent: HTMLElement, id: number, numbered: boolean) => {
+    let node = state.nodes[id];
+    while (node.children.length > 0) {
+        const main = state.nodes[node.children[0]];
+        parent.append(moveElement(main, numbered));
+        numbered = false;
+        for (const child of node.children.slice(1)) {
+            const variation = document.createElement('span');
+            variation.className = 'text-green-300';
+            variation.append('( ');
+            variation.append(moveElement(state.nodes[child], true));
+            renderLine(variation, child, false);
+            variation.append(') ');
+            parent.append(variation);
+            numbered = true;
+        }
+        node = main;
+    }
+}
+
+const renderMoves = () => {
+    moves.innerHTML = '';
+    renderLine(moves, 0, true);
+    if (state.result) {
+        moves.append(state.result);
+    }
+}
+
+const render = () => {
+    renderBoard();
+    renderMoves();
+    htmx.find('#fen').textContent = state.fen;
+    htmx.find('#turn').textContent = state.result ? `checkmate, ${state.result}` : state.turn;
+    if (engine) {
+        engine.checked = state.engine;
+    }
+    if (state.engine) {
+        evalLine.textContent = 'Thinking...';
+    } else if (root.dataset.engine) {
+        evalLine.textContent = 'Engine off';
+    }
+}
+
+const renderEval = (evaluation: Eval) => {
+    if (!state || evaluation.node !== state.current) {
+        return;
+    }
+    let score = (evaluation.score / 100).toFixed(2);
+    if (evaluation.score > 0) {
+        score = `+${score}`;
+    }
+    if (evaluation.mate) {
+        score = `#${evaluation.mate}`;
+    }
+    evalLine.textContent = `${score} (depth ${evaluation.depth}) ${evaluation.san.join(' ')}`;
+}
+
+ws.onmessage = (event) => {
+    const data = JSON.parse(event.data);
+    if (data.type === 'state') {
+        state = data.state;
+        render();
+    } else if (data.type === 'eval') {
+        renderEval(data.eval);
+    } else if (data.type === 'error') {
+        notice.textContent = data.msg;
+    } else if (data.type === 'closed') {
+        const reasons: { [msg: string]: string } = {
+            'terminated': 'The board was closed',
+            'expired': 'The board was closed after being inactive',
+            'shutdown': 'The server is shutting down',
+        };
+        alert(reasons[data.msg] || 'The board was closed');
+        window.location.href = '/';
+    }
+};
+
+ws.onclose = (event) => {
+    console.log('Connection closed');
+    if (event.code === 1009) {
+        alert('Message too large, the connection was closed');
+    }
+    window.location.href = '/';
+};
+
+const navs = document.querySelectorAll('.nav');
+for (let i = 0; i < navs.length; i++) {
+    const nav = navs[i] as HTMLElement;
+    nav.addEventListener('click', () => send({ 'type': nav.dataset.nav }));
+    nav.hidden = !owner;
+}
+
+document.addEventListener('keydown', (event) => {
+    if (!owner || (event.target as HTMLElement).tagName === 'INPUT') {
+        return;
+    }
+    const keys: { [key: string]: string } = {
+        'ArrowLeft': 'back',
+        'ArrowRight': 'forward',
+        'Home': 'start',
+        'End': 'end',
+    };
+    if (keys[event.key]) {
+        event.preventDefault();
+        send({ 'type': keys[event.key] });
+    }
+});
+
+htmx.find('#flip').addEventListener('click', () => {
+    flipped = !flipped;
+    flipLabels();
+    if (state) {
+        renderBoard();
+    }
+});
+
+htmx.find('#share').addEventListener('click', (event) => {
+    (event.target as HTMLInputElement).select();
+});
+
+if (owner) {
+    engine.addEventListener('change', () => send({ 'type': 'engine', 'on': engine.checked }));
+    htmx.on('#fen-form', 'submit', (event: Event) => {
+        event.preventDefault();
+        const input = htmx.find('#fen-input') as HTMLInputElement;
+        send({ 'type': 'fen', 'fen': input.value });
+        input.value = '';
+    });
+    // squares are swapped by the drag, the board is drawn again from the state that follows
+    new Sortable(board, {
+        animation: 150,
+        swap: true,
+        swapClass: 'bg-black',
+        filter: '.unswappable',
+        onEnd: (evt) => {
+            const target = evt.swapItem;
+            if (!target) {
+                return;
+            }
+            send({
+                'type': 'move',
+                'from': evt.item.dataset.square,
+                'to': target.dataset.square,
+            });
+        },
+    });
+}
@@ -1,107 +1,290 @@
 import * as htmx from 'htmx.org';
 import Sortable, { Swap } from 'sortablejs';
 import 'htmx.org';
+import './sse';
 
 Sortable.mount(new Swap());
 
-const board = htmx.find('#board');
+const board = htmx.find('#board') as HTMLElement;
+const pieces = board.dataset.pieces;
 const o_name = htmx.find('#o-name');
 
 const room = (htmx.find('#room-id') as HTMLTableCellElement).innerHTML;
-const client = (htmx.find('#client-id') as HTMLTableCellElement).innerHTML;
 const protoc = window.location.protocol === 'https:' ? 'wss' : 'ws';
 
-const ws = new WebSocket(`${protoc}:${window.location.host}/chess/ws?room=${room}&user=${client}`);
+// the player token is sent along as a cookie
+const ws = new WebSocket(`${protoc}://${window.location.host}/chess/ws?room=${room}`);
+let opened = false;
+
+// messages go over the websocket, or are posted once the page fell back to server-sent events
+let send = (message: { [key: string]: any }) => {
+    ws.send(JSON.stringify(message));
+}
 
 ws.onopen = () => {
     console.log('Connection opened');
+    opened = true;
 };
 
-ws.onclose = () => {
-    console.log('Connection closed');
+const closed = (code: number) => {
+    if (code === 1009) {
+        alert('Message too large, the connection was closed');
+    }
     window.location.href = '/';
+}
+
+ws.onclose = (event) => {
+    console.log('Connection closed');
+    if (!opened) {
+        // some proxies refuse websocket upgrades
+        connectEvents();
+        return;
+    }
+    closed(event.code);
 };
 
 ws.onerror = (event) => {
     console.log('Error:', event);
-    window.location.href = '/';
 };
 
-const swapElements = (obj1: HTMLElement, obj2: HTMLElement) => {
-    // create marker element and insert it where obj1 is
-    var temp = document.createElement("div");
-    obj1.parentNode.insertBefore(temp, obj1);
+// connectEvents receives the messages through the htmx SSE extension and posts the messages of
+// the player, the events carry the same messages as the websocket
+const connectEvents = () => {
+    console.log('Falling back to server-sent events');
+    const headers = JSON.parse(document.body.getAttribute('hx-headers') || '{}');
+    const events = document.createElement('div');
+    events.hidden = true;
+    events.setAttribute('hx-ext', 'sse');
+    events.setAttribute('sse-connect', `/chess/events?room=${room}`);
+    events.setAttribute('sse-swap', 'message,close');
+    events.setAttribute('hx-swap', 'none');
+    events.addEventListener('htmx:sseMessage', (event: any) => {
+        if (event.detail.type === 'close') {
+            closed(JSON.parse(event.detail.data).code);
+            return;
+        }
+        receive(JSON.parse(event.detail.data));
+    });
+    document.body.append(events);
+    htmx.process(events);
+    send = (message) => {
+        const path = message['type'] === 'move' ? 'move' : 'cmd';
+        fetch(`/chess/${path}?room=${room}`, {
+            method: 'POST',
+            headers: { ...headers, 'Content-Type': 'application/json' },
+            body: JSON.stringify(message),
+        }).then((response) => {
+            if (!response.ok) {
+                response.json().then((body) => console.log(body.error));
+            }
+        });
+    };
+}
+
+type SerSquare = {
+    square: string;
+    color: string;
+    piece: string;
+};
+
+const findSquare = (name: string) => {
+    return board.querySelector(`[data-square="${name}"]`) as HTMLElement;
+}
 
-    // move obj1 to right before obj2
-    obj2.parentNode.insertBefore(obj1, obj2);
+const renderSquare = (square: SerSquare) => {
+    const element = findSquare(square.square);
+    if (!element) {
+        return;
+    }
+    if (square.piece) {
+        element.className = `square-${square.color}`;
+        element.innerHTML = `<input type="hidden" name="square" value="${square.square}"/><img src="/themes/pieces/${pieces}/${square.piece}.svg" class="w-[5dvw] h-[5dvw]">`;
+    } else {
+        element.className = `unswappable w-[5dvw] h-[5dvw] square-${square.color}`;
+        element.innerHTML = `<input type="hidden" name="square" value="${square.square}" disabled/>`;
+    }
+}
 
-    // move obj2 to right before where obj1 used to be
-    temp.parentNode.insertBefore(obj2, temp);
+const renderSquares = (squares: string) => {
+    const parsed = JSON.parse(squares) as SerSquare[];
+    for (const square of parsed) {
+        renderSquare(square);
+    }
+}
 
-    // remove temporary marker node
-    temp.parentNode.removeChild(temp);
+const clocks = {
+    white: 0,
+    black: 0,
+    turn: '',
+};
+
+const formatClock = (ms: number) => {
+    const seconds = Math.max(0, Math.floor(ms / 1000));
+    const minutes = Math.floor(seconds / 60);
+    const rest = seconds % 60;
+    return `${minutes}:${rest < 10 ? '0' : ''}${rest}`;
 }
 
-ws.onmessage = (event) => {
-    const data = JSON.parse(event.data);
-    if (data.content.type === 'error') {
-        console.log(data.content.msg);
-        const src = data.content.src;
-        const src_square = board.children[src];
-        const src_piece = data.content.src_piece;
-        const src_color = data.content.src_color;
-
-        if (src_piece) {
-            src_square.className = `bg-${src_color}`;
-            src_square.innerHTML = `<input type="hidden" name="square" value="${src}"/><img src="https://upload.wikimedia.org/wikipedia/commons/${src_piece}" class="w-[5dvw] h-[5dvw]">`;
-        } else {
-            src_square.className = `unswappable w-[5dvw] h-[5dvw] bg-${src_color}`;
-            src_square.innerHTML = `<input type="hidden" name="square" value="${src}" disabled/>`;
+const renderClocks = () => {
+    htmx.find('#clock-white').innerHTML = formatClock(clocks.white);
+    htmx.find('#clock-black').innerHTML = formatClock(clocks.black);
+}
+
+// clocks are only sent for timed games
+const updateClocks = (content: any) => {
+    if (content.clock_white === undefined) {
+        return;
+    }
+    (htmx.find('#clocks') as HTMLElement).hidden = false;
+    clocks.white = parseInt(content.clock_white);
+    clocks.black = parseInt(content.clock_black);
+    clocks.turn = content.turn;
+    renderClocks();
+}
+
+setInterval(() => {
+    if (clocks.turn === 'white') {
+        clocks.white -= 1000;
+    } else if (clocks.turn === 'black') {
+        clocks.black -= 1000;
+    }
+    renderClocks();
+}, 1000);
+
+const chatMessages = htmx.find('#chat-messages') as HTMLElement;
+const chatInput = htmx.find('#chat-input') as HTMLInputElement;
+const chatMute = htmx.find('#chat-mute') as HTMLInputElement;
+const client = (htmx.find('#client-id') as HTMLTableCellElement).innerHTML;
+
+//  [hh:mm] <who>: <message>, text only so nobody can inject markup
+const appendChat = (who: string, text: string, time?: string) => {
+    const li = document.createElement('li');
+    const stamp = (time ? new Date(time) : new Date()).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+    li.textContent = `[${stamp}] [${who}]: ${text}`;
+    chatMessages.append(li);
+    chatMessages.scrollTop = chatMessages.scrollHeight;
+}
+
+const sendChat = (message: { [key: string]: string }) => {
+    message['type'] = 'chat';
+    send(message);
+}
+
+htmx.on('#chat-form', 'submit', (event: Event) => {
+    event.preventDefault();
+    sendChat({ 'msg': chatInput.value });
+    chatInput.value = '';
+});
+
+const presets = document.querySelectorAll('.chat-preset');
+for (let i = 0; i < presets.length; i++) {
+    const preset = presets[i] as HTMLElement;
+    preset.addEventListener('click', () => sendChat({ 'preset': preset.dataset.preset }));
+}
+
+// spectators have no game actions
+const resign = htmx.find('#resign');
+if (resign) {
+    resign.addEventListener('click', () => {
+        if (confirm('Resign the game?')) {
+            send({ 'type': 'cmd', 'msg': 'resign' });
         }
+    });
+    htmx.find('#draw-offer').addEventListener('click', () => send({ 'type': 'cmd', 'msg': 'draw-offer' }));
+}
+
+chatMute.addEventListener('change', () => {
+    send({ 'type': 'mute', 'muted': chatMute.checked });
+});
 
-        const trg = data.content.dst;
-        const trg_square = board.children[trg];
-        const trg_piece = data.content.dst_piece;
-        const trg_color = data.content.dst_color;
+// a finished game can be stepped through on its replay page
+const finished = () => {
+    clocks.turn = '';
+    (htmx.find('#replay') as HTMLElement).hidden = false;
+};
 
-        if (trg_piece) {
-            trg_square.className = `bg-${trg_color}`;
-            trg_square.innerHTML = `<input type="hidden" name="square" value="${trg}"/><img src="https://upload.wikimedia.org/wikipedia/commons/${trg_piece}" class="w-[5dvw] h-[5dvw]">`;
+const receive = (data: any) => {
+    updateClocks(data.content);
+    if (data.content.type === 'error') {
+        console.log(data.content.msg);
+        if (data.content.squares) {
+            renderSquares(data.content.squares);
         } else {
-            trg_square.className = `unswappable w-[5dvw] h-[5dvw] bg-${trg_color}`;
-            trg_square.innerHTML = `<input type="hidden" name="square" value="${trg}" disabled/>`;
+            appendChat('server', data.content.msg);
         }
-
-    } else if (data.content.type === 'move'){
-        // Swap the pieces
-        const trg_pos = data.content.src;
-        const src_pos = data.content.dst;
-        const source = board.children[src_pos] as HTMLElement;
-        const target = board.children[trg_pos] as HTMLElement;
-        const src_end = source.classList.length - 1;
-        const trg_end = target.classList.length - 1;
-        const src_bg = source.classList[src_end];
-        const trg_bg = target.classList[trg_end];
-        source.classList.remove(src_bg);
-        source.classList.add(trg_bg);
-        target.classList.remove(trg_bg);
-        target.classList.add(src_bg);
-        swapElements(source, target);
+    } else if (data.content.type === 'chat') {
+        const who = data.author === client ? 'me' : (data.content.color || 'spectator');
+        appendChat(who, data.content.msg, data.content.time);
+    } else if (data.content.type === 'mute') {
+        chatMute.checked = data.content.muted === 'true';
+    } else if (data.content.type === 'move' || data.content.type === 'castle') {
+        renderSquares(data.content.squares);
+    } else if (data.content.type === 'board') {
+        renderSquares(data.content.board);
+    } else if (data.content.type === 'checkmate') {
+        finished();
+        alert(`Checkmate, ${data.content.color} wins`);
+    } else if (data.content.type === 'timeout') {
+        finished();
+        alert(`Out of time, ${data.content.color} wins`);
+    } else if (data.content.type === 'resigned') {
+        finished();
+        alert(`Resigned, ${data.content.color} wins`);
+    } else if (data.content.type === 'draw') {
+        if (data.content.msg === 'agreement') {
+            finished();
+            alert('Draw agreed');
+        } else if (data.content.msg === 'stalemate') {
+            finished();
+            alert('Stalemate, the game is drawn');
+        } else if (data.content.msg === 'fifty-move rule') {
+            finished();
+            alert('Fifty moves without a capture or a pawn move, the game is drawn');
+        } else if (data.content.msg === 'offer' && data.author !== client) {
+            const accept = confirm(`${data.content.color} offers a draw, accept?`);
+            send({ 'type': 'cmd', 'msg': accept ? 'draw-accept' : 'draw-decline' });
+        } else if (data.content.msg === 'decline' && data.author !== client) {
+            appendChat('server', 'Draw declined');
+        }
+    } else if (data.content.type === 'abandoned') {
+        finished();
+        alert(`Opponent left the game, ${data.content.color} wins`);
     } else if (data.content.type === 'cmd') {
+        // spectators come and go without being anyone's opponent
         if (data.content.msg === 'connected') {
-            o_name.innerHTML = data.author;
-            const ack = JSON.stringify({
+            if (data.content.channel !== 'spectators') {
+                o_name.innerHTML = data.author;
+            }
+            send({
                 'type': 'cmd',
                 'msg': 'acknowledge',
             });
-            ws.send(ack);
         }
-        if (data.content.msg === 'acknowledge') {
+        if (data.content.msg === 'acknowledge' && data.content.channel !== 'spectators') {
             o_name.innerHTML = data.author;
         }
+        if (data.content.msg === 'reset-ack') {
+            renderSquares(data.content.board);
+            (htmx.find('#replay') as HTMLElement).hidden = true;
+        }
+        if (data.content.msg === 'kicked' || data.content.msg === 'terminated' || data.content.msg === 'expired' || data.content.msg === 'declined') {
+            clocks.turn = '';
+            const reasons: { [msg: string]: string } = {
+                'kicked': 'You were removed from the game',
+                'terminated': 'The game was closed',
+                'expired': 'The game was closed after being inactive',
+                'declined': 'The bot declined the challenge',
+            };
+            alert(reasons[data.content.msg]);
+            window.location.href = '/';
+        }
     }
 };
 
+ws.onmessage = (event) => {
+    receive(JSON.parse(event.data));
+};
+
 htmx.onLoad((ctt) => {
     const boards = ctt.querySelectorAll('#board');
     for (let i = 0; i < boards.length; i++) {
@@ -114,8 +297,11 @@ htmx.onLoad((ctt) => {
             onEnd: (evt) => {
                 const source = evt.item;
                 const target = evt.swapItem;
-                const src_pos = evt.oldIndex;
-                const trg_pos = evt.newIndex;
+                // squares keep their name and bg color, only the contents are swapped
+                const src_square = source.dataset.square;
+                const trg_square = target.dataset.square;
+                source.dataset.square = trg_square;
+                target.dataset.square = src_square;
                 //get bg colors from both, should be in class
                 const src_end = source.classList.length - 1;
                 const trg_end = target.classList.length - 1;
@@ -126,12 +312,11 @@ htmx.onLoad((ctt) => {
                 source.classList.add(trg_bg);
                 target.classList.remove(trg_bg);
                 target.classList.add(src_bg);
-                const information = JSON.stringify({
-                    'from': src_pos,
-                    'to': trg_pos,
+                send({
+                    'from': src_square,
+                    'to': trg_square,
                     'type': 'move'
                 });
-                ws.send(information);
             }
         });
         board.addEventListener('htmx:afterSwap', (event) => {
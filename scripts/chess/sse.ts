@@ -0,0 +1,5 @@
+import * as htmx from 'htmx.org';
+
+// the extension registers itself with the global htmx, which the bundle doesn't define
+(window as any).htmx = htmx;
+require('htmx.org/dist/ext/sse.js');
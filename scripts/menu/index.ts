@@ -14,7 +14,7 @@ htmx.on('htmx:afterRequest', (event: any) => {
             return;
         }
         alert('Joined room');
-        window.location.href = `/room?room=${response.room}&user=${response.id}`;
+        window.location.href = `/room?room=${response.room}`;
     } else if (response.type == "chess") {
         const input = htmx.find('#ichessid') as HTMLInputElement;
         if (input) {
@@ -25,6 +25,21 @@ htmx.on('htmx:afterRequest', (event: any) => {
             return;
         }
         alert('Joined game');
-        window.location.href = `/chess?room=${response.room}&user=${response.id}`;
+        window.location.href = `/chess?room=${response.room}`;
+    } else if (response.type == "analysis") {
+        if (response.error) {
+            alert(response.error);
+            return;
+        }
+        window.location.href = `/analysis?room=${response.room}`;
+    } else if (response.type == "theme") {
+        if (response.error) {
+            alert(response.error);
+            return;
+        }
+        alert(`Theme saved: ${response.board} board with ${response.pieces} pieces`);
+    } else if (response.error) {
+        // e.g. rate limits, which apply before any handler runs
+        alert(response.error);
     }
 });
\ No newline at end of file
@@ -0,0 +1,31 @@
+import * as htmx from 'htmx.org';
+import 'htmx.org';
+
+// the arrow keys step through the game like the buttons, the board is swapped by htmx
+document.addEventListener('keydown', (event) => {
+    if ((event.target as HTMLElement).tagName === 'INPUT') {
+        return;
+    }
+    const keys: { [key: string]: string } = {
+        'ArrowLeft': 'back',
+        'ArrowRight': 'forward',
+        'Home': 'start',
+        'End': 'end',
+    };
+    if (!keys[event.key]) {
+        return;
+    }
+    const button = htmx.find(`.nav[data-nav="${keys[event.key]}"]`) as HTMLButtonElement;
+    if (button && !button.disabled) {
+        event.preventDefault();
+        button.click();
+    }
+});
+
+// the move being shown stays in sight as the list scrolls
+htmx.on('htmx:afterSettle', () => {
+    const current = htmx.find('#moves .bg-white\\/25') as HTMLElement;
+    if (current) {
+        current.scrollIntoView({ block: 'nearest' });
+    }
+});
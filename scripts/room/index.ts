@@ -1,36 +1,131 @@
 import * as htmx from 'htmx.org';
 import 'htmx.org';
 
-const mhistory = htmx.find('#mhistory');
+// how long a member is shown typing without hearing from them again
+const TYPING_TIMEOUT = 5000;
+// how often the server is told this member is still typing
+const TYPING_INTERVAL = 3000;
+
+const mhistory = htmx.find('#mhistory') as HTMLElement;
 const textbar = htmx.find('#textbar') as HTMLInputElement;
+const presence = htmx.find('#presence') as HTMLElement;
+const typingbar = htmx.find('#typing') as HTMLElement;
+const client = mhistory.dataset.client;
+
+// nicknames of the members typing, by id, with the time they were last heard of
+let typing: { [id: string]: { nick: string, timer: number } } = {};
+let socket: any = null;
+let lastTyping = 0;
+
+function showTyping() {
+    const nicks = Object.keys(typing).map((id) => typing[id].nick);
+    if (nicks.length == 0) {
+        typingbar.textContent = '';
+    } else if (nicks.length == 1) {
+        typingbar.textContent = `${nicks[0]} is typing...`;
+    } else {
+        typingbar.textContent = `${nicks.join(', ')} are typing...`;
+    }
+}
+
+function stopTyping(id: string) {
+    if (typing[id]) {
+        window.clearTimeout(typing[id].timer);
+        delete typing[id];
+        showTyping();
+    }
+}
+
+//  [hh:mm] <nick>: <message>, text only so members can't inject markup
+function append(msg: any) {
+    const li = document.createElement('li');
+    const div = document.createElement('div');
+    const time = new Date(msg.time).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+    const nick = msg.author === client ? 'me' : msg.nick;
+    div.className = msg.type === 'notice' || msg.type === 'error' ? 'px-2 py-1 text-red-500' : 'px-2 py-1 text-green-500';
+    if (msg.type === 'action') {
+        div.textContent = `[${time}] * ${msg.nick} ${msg.content}`;
+    } else {
+        div.textContent = `[${time}] [${nick}]: ${msg.content}`;
+    }
+    li.appendChild(div);
+    mhistory.append(li);
+    mhistory.scrollTop = mhistory.scrollHeight;
+}
+
 htmx.on("htmx:wsConnecting", () => {
     window.location.href = '/';
 });
-htmx.on('htmx:wsOpen', () => {
+htmx.on('htmx:wsOpen', (evt: any) => {
     console.log("Connected!");
-    alert("Room is {{room}}")
+    socket = evt.detail.socketWrapper;
     mhistory.removeChild(mhistory.lastChild);
     textbar.hidden = false;
 });
 htmx.on('htmx:wsBeforeSend', () => {
-    const li = document.createElement('li');
     const chat = htmx.find('#chatm') as HTMLInputElement;
-//  Me: <message>
-    li.innerHTML = `<div class="px-2 py-1 text-green-500">[me]: ${chat.value}</div>`;
-    mhistory.append(li);
+    // commands are answered by the server
+    if (chat.value.charAt(0) !== '/') {
+        append({ type: 'message', author: client, content: chat.value, time: new Date() });
+    }
     chat.value = '';
+    lastTyping = 0;
 });
-htmx.on('htmx:wsClose', () => {
+htmx.on('htmx:wsClose', (evt: any) => {
+    if (evt.detail.event && evt.detail.event.code === 1009) {
+        alert('Message too large, the connection was closed');
+    }
     window.location.href = '/';
 });
 htmx.on('htmx:wsError', () => {
     window.location.href = '/';
 });
 htmx.on('htmx:wsAfterMessage', (evt: any) => {
-//    Insert into messages
     const msg = JSON.parse(evt.detail.message);
-    var li = document.createElement('li');
-//    <user>: <message>
-    li.innerHTML = `<div class="px-2 py-1 text-green-500">[${msg.author}]: ${msg.content}</div>`;
-    mhistory.append(li);
-});
\ No newline at end of file
+    switch (msg.type) {
+        case 'replay':
+            (msg.messages || []).forEach(append);
+            break;
+        case 'presence':
+            presence.textContent = (msg.members || [])
+                .map((member: any) => {
+                    let name = member.owner ? `${member.nick} (owner)` : member.nick;
+                    if (member.muted) {
+                        name += ' (muted)';
+                    }
+                    return member.online ? name : `${name} (away)`;
+                })
+                .join(', ');
+            break;
+        case 'typing':
+            stopTyping(msg.author);
+            if (msg.typing) {
+                typing[msg.author] = {
+                    nick: msg.nick,
+                    timer: window.setTimeout(() => stopTyping(msg.author), TYPING_TIMEOUT),
+                };
+                showTyping();
+            }
+            break;
+        default:
+            stopTyping(msg.author);
+            append(msg);
+    }
+});
+
+// tell the others while this member is typing, at most every TYPING_INTERVAL
+htmx.on('#chatm', 'input', () => {
+    const now = Date.now();
+    if (socket && now - lastTyping > TYPING_INTERVAL) {
+        lastTyping = now;
+        socket.send(JSON.stringify({ typing: true }));
+    }
+});
+
+htmx.on('htmx:afterRequest', (evt: any) => {
+    if (evt.detail.pathInfo.requestPath !== '/room/report') {
+        return;
+    }
+    const response = JSON.parse(evt.detail.xhr.response);
+    alert(response.error ? response.error : 'Thanks, the report will be reviewed');
+});
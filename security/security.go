@@ -0,0 +1,106 @@
+package security
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	// CSRF_KEY is where the CSRF token of a request is kept in the echo context
+	CSRF_KEY = "csrf"
+	// CSRF_FIELD is the form field holding the token for forms posted without htmx
+	CSRF_FIELD  = "_csrf"
+	CSRF_COOKIE = "_csrf"
+	// API_PREFIX is where the API lives, it only takes bearer tokens so it needs no CSRF token
+	API_PREFIX = "/api/"
+)
+
+// CheckOrigin returns the origin check of the websocket upgraders, the server's own origin is
+// always allowed as are requests without an Origin header, which don't come from browsers
+func CheckOrigin(cfg config.Security) func(r *http.Request) bool {
+	allowed := map[string]bool{}
+	for _, origin := range cfg.AllowedOrigins {
+		allowed[strings.ToLower(origin)] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowed["*"] || allowed[strings.ToLower(origin)] {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		return strings.EqualFold(u.Host, r.Host)
+	}
+}
+
+// CSRF returns a middleware issuing a token to every visitor and verifying it on state changing
+// requests, htmx sends it as a header and plain forms as a field, secure keeps the cookie to HTTPS
+func CSRF(secure bool) echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper: func(c echo.Context) bool {
+			return strings.HasPrefix(c.Request().URL.Path, API_PREFIX)
+		},
+		TokenLookup:    "header:" + echo.HeaderXCSRFToken + ",form:" + CSRF_FIELD,
+		ContextKey:     CSRF_KEY,
+		CookieName:     CSRF_COOKIE,
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSecure:   secure,
+		CookieSameSite: http.SameSiteStrictMode,
+		ErrorHandler: func(err error, c echo.Context) error {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"error": "invalid or missing csrf token, reload the page",
+			})
+		},
+	})
+}
+
+// Token returns the CSRF token of a request for the templates
+func Token(c echo.Context) string {
+	token, _ := c.Get(CSRF_KEY).(string)
+	return token
+}
+
+// Headers returns a middleware setting the security headers of every response, the content
+// security policy only allows our own origin and the configured asset origins
+func Headers(cfg config.Security) echo.MiddlewareFunc {
+	assets := strings.Join(append([]string{"'self'"}, cfg.AssetOrigins...), " ")
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			header := c.Response().Header()
+			host := c.Request().Host
+			policy := []string{
+				"default-src 'self'",
+				"script-src " + assets,
+				"style-src " + assets,
+				"img-src " + assets + " data:",
+				// older browsers don't count websockets to the same host as 'self'
+				"connect-src 'self' ws://" + host + " wss://" + host,
+				"frame-ancestors 'none'",
+				"base-uri 'self'",
+				"form-action 'self'",
+			}
+			if c.IsTLS() {
+				// pages served over TLS never fall back to plain websockets
+				policy[4] = "connect-src 'self' wss://" + host
+				policy = append(policy, "upgrade-insecure-requests")
+				if cfg.HSTS > 0 {
+					header.Set(echo.HeaderStrictTransportSecurity, fmt.Sprintf("max-age=%d; includeSubDomains", int(cfg.HSTS.Seconds())))
+				}
+			}
+			header.Set("Content-Security-Policy", strings.Join(policy, "; "))
+			header.Set(echo.HeaderXContentTypeOptions, "nosniff")
+			header.Set(echo.HeaderXFrameOptions, "DENY")
+			header.Set(echo.HeaderReferrerPolicy, "same-origin")
+			return next(c)
+		}
+	}
+}
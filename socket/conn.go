@@ -0,0 +1,141 @@
+package socket
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/metrics"
+	"github.com/gorilla/websocket"
+)
+
+// Conn is a websocket connection written to by its own goroutine
+//   - send: messages waiting to be written, a client that lets it fill up is disconnected
+//   - done: closed once Close is called, the writer then flushes the queue and closes the socket
+//   - closeMsg: the close frame written before the socket is closed
+type Conn struct {
+	ws        *websocket.Conn
+	cfg       config.Websocket
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	closeMsg  []byte
+}
+
+// New starts the writer of a freshly upgraded connection, the peer is expected to answer pings
+// within the pong timeout or the next read fails
+func New(ws *websocket.Conn, cfg config.Websocket) *Conn {
+	c := &Conn{
+		ws:       ws,
+		cfg:      cfg,
+		send:     make(chan []byte, cfg.SendQueue),
+		done:     make(chan struct{}),
+		closeMsg: websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+	}
+	ws.SetReadDeadline(time.Now().Add(cfg.PongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(cfg.PongTimeout))
+	})
+	go c.writer()
+	return c
+}
+
+// writer writes queued messages and pings until the connection is closed
+func (c *Conn) writer() {
+	ticker := time.NewTicker(c.cfg.PingInterval)
+	defer ticker.Stop()
+	defer c.ws.Close()
+	for {
+		select {
+		case msg := <-c.send:
+			if err := c.write(websocket.TextMessage, msg); err != nil {
+				c.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.write(websocket.PingMessage, nil); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			// messages queued before Close, such as the reason for closing, are still delivered
+		flush:
+			for {
+				select {
+				case msg := <-c.send:
+					if err := c.write(websocket.TextMessage, msg); err != nil {
+						return
+					}
+				default:
+					break flush
+				}
+			}
+			c.write(websocket.CloseMessage, c.closeMsg)
+			return
+		}
+	}
+}
+
+func (c *Conn) write(messageType int, data []byte) error {
+	c.ws.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+	return c.ws.WriteMessage(messageType, data)
+}
+
+// ReadMessage reads the next message, every message received pushes the read deadline back
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType, data, err := c.ws.ReadMessage()
+	if err == nil {
+		c.ws.SetReadDeadline(time.Now().Add(c.cfg.PongTimeout))
+	}
+	return messageType, data, err
+}
+
+// SetReadLimit sets the largest message the peer may send
+func (c *Conn) SetReadLimit(limit int64) {
+	c.ws.SetReadLimit(limit)
+}
+
+// Send queues a text message, a peer too slow to keep up with its queue is disconnected
+func (c *Conn) Send(msg []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		metrics.Limited.WithLabelValues("send_queue").Inc()
+		c.CloseWith(websocket.ClosePolicyViolation, "send queue full")
+		return false
+	}
+}
+
+// Close flushes the queued messages and closes the connection, it's safe to call more than once
+func (c *Conn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// CloseWith closes the connection with a close code and reason
+func (c *Conn) CloseWith(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, text)
+		close(c.done)
+	})
+}
+
+// Done is closed once the connection is closing
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Timeout tells whether a read failed because the peer stopped answering pings
+func Timeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,214 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/metrics"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrStreamClosed    = errors.New("stream closed")
+	ErrMessageTooLarge = errors.New("message too large")
+	ErrQueueFull       = errors.New("too many messages waiting, try again in a moment")
+)
+
+// Stream is a server-sent event stream standing in for a websocket behind proxies that refuse the
+// upgrade, the peer receives every message as an event and sends its own with requests that are
+// pushed into the stream
+//   - recv: messages pushed by the peer, waiting to be read
+//   - limit: the largest message the peer may push
+//   - closeMsg: data of the close event written before the stream ends
+//   - lines: messages are written as newline delimited JSON instead of events, see NewLines
+type Stream struct {
+	cfg       config.Websocket
+	limit     int64
+	lines     bool
+	send      chan []byte
+	recv      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	closeMsg  []byte
+}
+
+// NewStream returns a stream, its messages are written once it's served
+func NewStream(cfg config.Websocket) *Stream {
+	return &Stream{
+		cfg:      cfg,
+		send:     make(chan []byte, cfg.SendQueue),
+		recv:     make(chan []byte, cfg.SendQueue),
+		done:     make(chan struct{}),
+		closeMsg: closeEvent(websocket.CloseNormalClosure, ""),
+	}
+}
+
+// NewLines returns a stream of newline delimited JSON, every message is a line, keepalives are
+// empty lines and the stream ends without a close event
+func NewLines(cfg config.Websocket) *Stream {
+	stream := NewStream(cfg)
+	stream.lines = true
+	return stream
+}
+
+// closeEvent is the data of the close event, the same code and reason a websocket would close with
+func closeEvent(code int, text string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"code":   code,
+		"reason": text,
+	})
+	return data
+}
+
+// Serve writes the queued messages and a comment every ping interval to keep proxies from timing
+// the response out, until the stream is closed or the peer goes away with ctx
+func (s *Stream) Serve(ctx context.Context, w http.ResponseWriter) error {
+	controller := http.NewResponseController(w)
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	if s.lines {
+		header.Set("Content-Type", "application/x-ndjson")
+	}
+	header.Set("Cache-Control", "no-cache")
+	// nginx buffers responses unless told otherwise
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		s.Close()
+		return err
+	}
+	ticker := time.NewTicker(s.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-s.send:
+			if err := s.write(controller, w, "message", msg); err != nil {
+				s.Close()
+				return nil
+			}
+		case <-ticker.C:
+			if err := s.write(controller, w, "", nil); err != nil {
+				s.Close()
+				return nil
+			}
+		case <-ctx.Done():
+			s.Close()
+			return nil
+		case <-s.done:
+			// as with websockets the messages queued before Close are still delivered
+			for {
+				select {
+				case msg := <-s.send:
+					if err := s.write(controller, w, "message", msg); err != nil {
+						return nil
+					}
+				default:
+					s.write(controller, w, "close", s.closeMsg)
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// write writes an event and flushes it, an event without a name is a comment
+func (s *Stream) write(controller *http.ResponseController, w http.ResponseWriter, event string, data []byte) error {
+	controller.SetWriteDeadline(time.Now().Add(s.cfg.WriteTimeout))
+	var buf bytes.Buffer
+	if s.lines {
+		if event == "close" {
+			return nil
+		}
+		buf.Write(data)
+		buf.WriteString("\n")
+	} else if event == "" {
+		buf.WriteString(": ping\n\n")
+	} else {
+		fmt.Fprintf(&buf, "event: %s\n", event)
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			fmt.Fprintf(&buf, "data: %s\n", line)
+		}
+		buf.WriteString("\n")
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return controller.Flush()
+}
+
+// SetReadLimit sets the largest message the peer may push
+func (s *Stream) SetReadLimit(limit int64) {
+	s.limit = limit
+}
+
+// Push hands a message sent by the peer to the reader of the stream
+func (s *Stream) Push(data []byte) error {
+	if s.limit > 0 && int64(len(data)) > s.limit {
+		return ErrMessageTooLarge
+	}
+	select {
+	case <-s.done:
+		return ErrStreamClosed
+	default:
+	}
+	select {
+	case s.recv <- data:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// ReadMessage waits for the next message pushed by the peer, messages are always text
+func (s *Stream) ReadMessage() (int, []byte, error) {
+	select {
+	case data := <-s.recv:
+		return websocket.TextMessage, data, nil
+	case <-s.done:
+		return 0, nil, ErrStreamClosed
+	}
+}
+
+// Send queues a message, a peer too slow to keep up with its queue is disconnected
+func (s *Stream) Send(msg []byte) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	select {
+	case s.send <- msg:
+		return true
+	default:
+		metrics.Limited.WithLabelValues("send_queue").Inc()
+		s.CloseWith(websocket.ClosePolicyViolation, "send queue full")
+		return false
+	}
+}
+
+// Close flushes the queued messages and ends the stream, it's safe to call more than once
+func (s *Stream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// CloseWith ends the stream with the code and reason a websocket would close with
+func (s *Stream) CloseWith(code int, text string) {
+	s.closeOnce.Do(func() {
+		s.closeMsg = closeEvent(code, text)
+		close(s.done)
+	})
+}
+
+// Done is closed once the stream is closing
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
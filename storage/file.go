@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// EXTENSION is appended to the id of every record file
+const EXTENSION = ".json"
+
+// File is a store keeping every record in its own file, grouped in a directory per kind
+type File struct {
+	root string
+}
+
+// NewFile returns a store rooted at dir, creating it if needed
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &File{root: dir}, nil
+}
+
+// path returns the file of a record, rejecting names that would escape the root
+func (f *File) path(kind, id string) (string, error) {
+	for _, name := range []string{kind, id} {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return "", fmt.Errorf("invalid record name %q", name)
+		}
+	}
+	return filepath.Join(f.root, kind, id+EXTENSION), nil
+}
+
+func (f *File) Save(kind, id string, data []byte) error {
+	path, err := f.path(kind, id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash never leaves half a record
+	tmp, err := os.CreateTemp(filepath.Dir(path), id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *File) Load(kind, id string) ([]byte, error) {
+	path, err := f.path(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (f *File) List(kind string) ([]string, error) {
+	ids := []string{}
+	entries, err := os.ReadDir(filepath.Join(f.root, kind))
+	if errors.Is(err, os.ErrNotExist) {
+		return ids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), EXTENSION) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(entry.Name(), EXTENSION))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (f *File) Delete(kind, id string) error {
+	path, err := f.path(kind, id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Ping checks that the root directory is still there and writable
+func (f *File) Ping() error {
+	tmp, err := os.CreateTemp(f.root, ".ping.*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
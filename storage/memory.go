@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// Memory is a store that lives as long as the process
+type Memory struct {
+	records map[string]map[string][]byte
+	lock    sync.RWMutex
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		records: make(map[string]map[string][]byte),
+	}
+}
+
+func (m *Memory) Save(kind, id string, data []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.records[kind] == nil {
+		m.records[kind] = make(map[string][]byte)
+	}
+	// keep a copy so the caller can reuse its buffer
+	m.records[kind][id] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *Memory) Load(kind, id string) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	data, ok := m.records[kind][id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *Memory) List(kind string) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ids := []string{}
+	for id := range m.records[kind] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (m *Memory) Delete(kind, id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.records[kind], id)
+	return nil
+}
+
+func (m *Memory) Ping() error {
+	return nil
+}
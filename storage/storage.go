@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Qinbeans/chess-htmx/config"
+)
+
+// ErrNotFound is returned when a record doesn't exist
+var ErrNotFound = errors.New("record not found")
+
+// Store keeps records grouped by kind, e.g. every game is a record of kind "games"
+type Store interface {
+	// Save creates or replaces a record
+	Save(kind, id string, data []byte) error
+	// Load returns a record or ErrNotFound
+	Load(kind, id string) ([]byte, error)
+	// List returns the ids of every record of a kind
+	List(kind string) ([]string, error)
+	// Delete removes a record, deleting a missing record is not an error
+	Delete(kind, id string) error
+	// Ping checks that the store can be reached
+	Ping() error
+}
+
+// New returns the store selected by the configuration
+func New(cfg config.Storage) (Store, error) {
+	switch cfg.Backend {
+	case config.MEMORY:
+		return NewMemory(), nil
+	case config.FILE:
+		return NewFile(cfg.Path)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+}
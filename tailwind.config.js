@@ -5,6 +5,5 @@ module.exports = {
     extend: {},
   },
   plugins: [],
-  safelist: ['bg-white/35', 'bg-white/5'],
 }
 
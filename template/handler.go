@@ -3,63 +3,153 @@ package template
 import (
 	"errors"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
+	"sync"
+	"time"
 
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/Qinbeans/chess-htmx/security"
+	"github.com/Qinbeans/chess-htmx/themes"
 	"github.com/flosch/pongo2/v6"
 	"github.com/labstack/echo/v4"
 )
 
+// how often the override directory is checked for changes
+const RELOAD_INTERVAL = time.Second
+
 type Template struct {
 	templates map[string]*pongo2.Template
+	views     fs.FS
+	logger    *slog.Logger
+	lock      sync.RWMutex
+}
+
+// New loads every template in views, when dir is set the templates are read from
+// that directory instead and reloaded whenever a file in it changes
+func New(views fs.FS, dir string, logger *slog.Logger) (*Template, error) {
+	t := &Template{
+		views:  views,
+		logger: logger.With("component", "template"),
+	}
+	if dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+		t.views = os.DirFS(dir)
+		t.logger.Info("templates are loaded from disk", "dir", dir)
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		go t.watch()
+	}
+	return t, nil
 }
 
-func New() *Template {
+// load parses every template found in the views
+func (t *Template) load() error {
 	templates := make(map[string]*pongo2.Template)
-	// check public/views directory for templates
-	files, err := os.ReadDir("public/views")
+	// a fresh set so that extended templates are parsed again
+	set := pongo2.NewSet("views", pongo2.NewFSLoader(t.views))
+	files, err := fs.ReadDir(t.views, ".")
 	if err != nil {
-		// create the directory if it doesn't exist, then exit
-		if os.IsNotExist(err) {
-			os.Mkdir("public/views", 0755)
-			log.Println("public/views directory created")
-			os.Exit(0)
-		} else {
-			panic(err)
-		}
+		return err
 	}
 	for _, file := range files {
 		if file.IsDir() {
 			continue
 		}
 		// load the template
-		tpl, err := pongo2.FromFile("public/views/" + file.Name())
+		tpl, err := set.FromFile(file.Name())
 		if err != nil {
-			panic(err)
+			return err
 		}
 		// add the template to the map
 		templates[file.Name()] = tpl
 	}
 	for k := range templates {
-		log.Println("template loaded: ", k)
+		t.logger.Debug("template loaded", "name", k)
+	}
+	t.lock.Lock()
+	t.templates = templates
+	t.lock.Unlock()
+	return nil
+}
+
+// Loaded reports whether templates can be rendered
+func (t *Template) Loaded() error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if len(t.templates) == 0 {
+		return errors.New("no templates loaded")
+	}
+	return nil
+}
+
+// lastModified returns the latest modification time of the views
+func (t *Template) lastModified() time.Time {
+	var latest time.Time
+	files, err := fs.ReadDir(t.views, ".")
+	if err != nil {
+		return latest
+	}
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
 	}
-	return &Template{
-		templates: templates,
+	return latest
+}
+
+// watch reloads the templates when the views change on disk
+func (t *Template) watch() {
+	modified := t.lastModified()
+	for range time.Tick(RELOAD_INTERVAL) {
+		latest := t.lastModified()
+		if !latest.After(modified) {
+			continue
+		}
+		modified = latest
+		if err := t.load(); err != nil {
+			// keep serving the previous templates until the error is fixed
+			t.logger.Error("template reload failed", "error", err)
+		}
 	}
 }
 
 func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
 	var ctx pongo2.Context
 	var ok bool
-	c.Logger().Info("Rendering template: ", name)
+	logging.FromContext(c).Debug("rendering template", "name", name)
 	if data != nil {
 		ctx, ok = data.(pongo2.Context)
 		if !ok {
 			return errors.New("no pongo context found")
 		}
 	}
+	if ctx == nil {
+		ctx = pongo2.Context{}
+	}
+	// every page is drawn with the theme the user picked
+	ctx["theme"] = themes.FromRequest(c.Request())
+	// forms send it back on every POST
+	ctx["csrf"] = security.Token(c)
+	// websockets are opened with the scheme the page was served with, wss behind TLS
+	ctx["ws_origin"] = "ws://" + c.Request().Host
+	if c.Scheme() == "https" {
+		ctx["ws_origin"] = "wss://" + c.Request().Host
+	}
 	// check if the template exists
+	t.lock.RLock()
 	tpl, ok := t.templates[name]
+	t.lock.RUnlock()
 	if !ok {
 		return errors.New("template not found")
 	}
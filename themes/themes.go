@@ -0,0 +1,159 @@
+package themes
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	BOARD_COOKIE   = "board_theme"
+	PIECES_COOKIE  = "piece_theme"
+	DEFAULT_BOARD  = "slate"
+	DEFAULT_PIECES = "glyph"
+	// how long a theme preference is remembered
+	COOKIE_AGE = 365 * 24 * time.Hour
+)
+
+//go:embed pieces
+var assets embed.FS
+
+// Board is a colour scheme for the squares of the board
+type Board struct {
+	Name  string
+	Light string
+	Dark  string
+}
+
+// Theme is the board colour scheme and piece set selected by a user
+type Theme struct {
+	Board  string `json:"board"`
+	Pieces string `json:"pieces"`
+}
+
+var (
+	BOARDS = map[string]Board{
+		"slate": {Name: "slate", Light: "rgba(255, 255, 255, 0.35)", Dark: "rgba(255, 255, 255, 0.15)"},
+		"green": {Name: "green", Light: "#eeeed2", Dark: "#769656"},
+		"brown": {Name: "brown", Light: "#f0d9b5", Dark: "#b58863"},
+		"blue":  {Name: "blue", Light: "#dee3e6", Dark: "#8ca2ad"},
+	}
+
+	// PIECE_SETS is the list of piece sets found in the embedded assets
+	PIECE_SETS = pieceSets()
+
+	stylesheet = buildStylesheet()
+)
+
+// pieceSets lists the directories of the embedded pieces folder
+func pieceSets() []string {
+	var sets []string
+	entries, err := assets.ReadDir("pieces")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			sets = append(sets, entry.Name())
+		}
+	}
+	return sets
+}
+
+// BoardNames returns the names of the board colour schemes in a stable order
+func BoardNames() []string {
+	var names []string
+	for name := range BOARDS {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildStylesheet generates the css rules for every board colour scheme
+func buildStylesheet() []byte {
+	var css strings.Builder
+	for _, name := range BoardNames() {
+		board := BOARDS[name]
+		css.WriteString(".board-" + name + " .square-light { background-color: " + board.Light + "; }\n")
+		css.WriteString(".board-" + name + " .square-dark { background-color: " + board.Dark + "; }\n")
+	}
+	return []byte(css.String())
+}
+
+func isPieceSet(name string) bool {
+	for _, set := range PIECE_SETS {
+		if set == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FromRequest returns the theme stored in the request cookies, falling back to the defaults
+func FromRequest(r *http.Request) Theme {
+	theme := Theme{Board: DEFAULT_BOARD, Pieces: DEFAULT_PIECES}
+	if cookie, err := r.Cookie(BOARD_COOKIE); err == nil {
+		if _, ok := BOARDS[cookie.Value]; ok {
+			theme.Board = cookie.Value
+		}
+	}
+	if cookie, err := r.Cookie(PIECES_COOKIE); err == nil && isPieceSet(cookie.Value) {
+		theme.Pieces = cookie.Value
+	}
+	return theme
+}
+
+// *****************************************************************************
+
+// PieceFS returns the embedded piece sets, served under /themes/pieces
+func PieceFS() fs.FS {
+	return echo.MustSubFS(assets, "pieces")
+}
+
+// Stylesheet is a callback serving the css for every board colour scheme
+func Stylesheet(c echo.Context) error {
+	return c.Blob(http.StatusOK, "text/css; charset=utf-8", stylesheet)
+}
+
+// Select is a callback for storing the theme preference of a user in cookies
+func Select(c echo.Context) error {
+	theme := FromRequest(c.Request())
+	if board := c.FormValue("board"); board != "" {
+		if _, ok := BOARDS[board]; !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "unknown board theme",
+				"type":  "theme",
+			})
+		}
+		theme.Board = board
+	}
+	if pieces := c.FormValue("pieces"); pieces != "" {
+		if !isPieceSet(pieces) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "unknown piece set",
+				"type":  "theme",
+			})
+		}
+		theme.Pieces = pieces
+	}
+	for name, value := range map[string]string{BOARD_COOKIE: theme.Board, PIECES_COOKIE: theme.Pieces} {
+		c.SetCookie(&http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     "/",
+			MaxAge:   int(COOKIE_AGE.Seconds()),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"board":  theme.Board,
+		"pieces": theme.Pieces,
+		"type":   "theme",
+	})
+}
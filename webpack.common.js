@@ -5,6 +5,8 @@ module.exports = {
         'menu':'./scripts/menu/index.ts',
         'room':'./scripts/room/index.ts',
         'chess':'./scripts/chess/index.ts',
+        'analysis':'./scripts/analysis/index.ts',
+        'replay':'./scripts/replay/index.ts',
     },
     module: {
         rules: [
@@ -0,0 +1,131 @@
+package websockets
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// errors of the slash commands, sent back to the member who typed them
+var (
+	ErrUnknownCommand  = errors.New("unknown command, try /nick, /me, /mute, /unmute, /kick or /quit")
+	ErrMissingArgument = errors.New("the command needs an argument")
+	ErrNotOwner        = errors.New("only the owner of the room can do that")
+	ErrNoSuchMember    = errors.New("no member goes by that nickname")
+	ErrSelf            = errors.New("you can't do that to yourself")
+	ErrMuted           = errors.New("you are muted in this room")
+)
+
+// command splits a chat message starting with a slash into the name of the command and its
+// argument, e.g. "/nick bob" is nick and bob
+func command(text string) (string, string, bool) {
+	if !strings.HasPrefix(text, "/") {
+		return "", "", false
+	}
+	name, arg, _ := strings.Cut(text[1:], " ")
+	return strings.ToLower(name), strings.TrimSpace(arg), true
+}
+
+// owner returns the owner of a room, who created it until they leave
+func (ws *WSServer) owner(room string) string {
+	for _, member := range ws.Hub.Room(room).Members() {
+		if member.Role == OWNER {
+			return member.ID
+		}
+	}
+	return ""
+}
+
+// member returns the member of a room going by a nickname
+func (ws *WSServer) member(room, nick string) (string, bool) {
+	if ws.Hub.Room(room) == nil {
+		// the room is being created
+		return "", false
+	}
+	for _, member := range ws.Hub.Room(room).Members() {
+		if strings.EqualFold(ws.Nicknames[member.ID], nick) {
+			return member.ID, true
+		}
+	}
+	return "", false
+}
+
+// say sends what a member wrote to the others once filtered and keeps it in the history
+func (ws *WSServer) say(user, room, kind, text string, logger *slog.Logger) {
+	if ws.Muted[user] {
+		ws.SendError(user, room, ErrMuted)
+		return
+	}
+	msg := newMessage(kind, user, ws.Nicknames[user], ws.Filter.Clean(text))
+	if err := ws.History.Append(room, msg); err != nil {
+		logger.Error("failed to save history", "error", err)
+	}
+	exclude := user
+	if kind == ACTION {
+		// the author's page doesn't draw actions itself
+		exclude = ""
+	}
+	ws.announce(exclude, room, msg)
+}
+
+// handleCommand runs a slash command of a member, returning false when the member quits, the
+// owner of the room may mute, unmute and kick the others
+func (ws *WSServer) handleCommand(user, room, name, arg string, logger *slog.Logger) bool {
+	nick := ws.Nicknames[user]
+	switch name {
+	case "quit":
+		ws.announce(user, room, newMessage(LEFT, user, nick, "[left the room]"))
+		return false
+	case "me":
+		if arg == "" {
+			ws.SendError(user, room, ErrMissingArgument)
+			return true
+		}
+		ws.say(user, room, ACTION, arg, logger)
+	case "nick":
+		renamed, err := ws.nickname(room, arg)
+		if err == nil && renamed == "" {
+			err = ErrMissingArgument
+		}
+		if err != nil {
+			ws.SendError(user, room, err)
+			return true
+		}
+		ws.Nicknames[user] = renamed
+		ws.announce("", room, notice(NOTICE, fmt.Sprintf("[%s is now known as %s]", nick, renamed)))
+		ws.announce("", room, ws.presence(room))
+	case "mute", "unmute", "kick":
+		if ws.owner(room) != user {
+			ws.SendError(user, room, ErrNotOwner)
+			return true
+		}
+		target, ok := ws.member(room, arg)
+		if !ok {
+			ws.SendError(user, room, ErrNoSuchMember)
+			return true
+		}
+		if target == user {
+			ws.SendError(user, room, ErrSelf)
+			return true
+		}
+		switch name {
+		case "mute":
+			ws.Muted[target] = true
+			ws.announce("", room, notice(NOTICE, fmt.Sprintf("[%s was muted]", ws.Nicknames[target])))
+		case "unmute":
+			delete(ws.Muted, target)
+			ws.announce("", room, notice(NOTICE, fmt.Sprintf("[%s may talk again]", ws.Nicknames[target])))
+		case "kick":
+			ws.announce(target, room, notice(NOTICE, fmt.Sprintf("[%s was removed from the room]", ws.Nicknames[target])))
+			ws.kick(room, target)
+		}
+		if name != "kick" {
+			ws.announce("", room, ws.presence(room))
+		}
+		logger.Info("member moderated", "command", name, "target", target)
+	default:
+		ws.SendError(user, room, ErrUnknownCommand)
+	}
+	return true
+}
@@ -1,249 +1,635 @@
 package websockets
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"sort"
 	"strings"
-	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/Qinbeans/chess-htmx/auth"
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/hub"
+	"github.com/Qinbeans/chess-htmx/limits"
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/Qinbeans/chess-htmx/metrics"
+	"github.com/Qinbeans/chess-htmx/moderation"
+	"github.com/Qinbeans/chess-htmx/storage"
+	"github.com/flosch/pongo2/v6"
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 )
 
+// WSServer hosts the chat rooms
+//   - Hub: the rooms and their members, its lock guards Nicknames and Muted too, helpers expect
+//     the caller to hold it
+//   - Nicknames: the name each member chose when joining
+//   - Muted: members the owner of their room muted
+//   - History: the latest messages of each room, replayed to members when they connect
+//   - Filter: masks unwanted words before messages are sent
+type WSServer struct {
+	Hub       *hub.Hub
+	Nicknames map[string]string
+	Muted     map[string]bool
+	History   History
+	Filter    *moderation.Filter
+	Store     storage.Store
+	Expiry    config.Rooms
+	Chat      config.Chat
+	Signer    *auth.Signer
+	Logger    *slog.Logger
+}
+
+// roles of the members, the owner may moderate the room
 const (
-	READSIZE  = 1024
-	WRITESIZE = 1024
+	OWNER  = "owner"
+	MEMBER = "member"
 )
 
-type WSServer struct {
-	Upgrader    websocket.Upgrader
-	Connections map[string]*websocket.Conn
-	Rooms       map[string][]string
-}
+// types of the messages sent to members
+const (
+	// written by a member
+	MESSAGE = "message"
+	// written with /me, e.g. "* bob waves"
+	ACTION = "action"
+	JOINED = "joined"
+	LEFT   = "left"
+	TYPING = "typing"
+	// written by the server, e.g. the room expired
+	NOTICE = "notice"
+	ERROR  = "error"
+	// the members of the room, sent whenever someone connects or leaves
+	PRESENCE = "presence"
+	// the history of the room, sent once on connect
+	REPLAY = "replay"
+)
 
+// longest nickname in characters
+const NICK_SIZE = 24
+
+// Message is what members receive, Type tells them apart
+//   - Author: id of the member, or "server"
+//   - Typing: whether the author is typing, on typing messages
+//   - Members: who is in the room, on presence messages
+//   - Messages: the history of the room oldest first, on replay messages
 type Message struct {
-	Author  string `json:"author"`
-	Content string `json:"content"`
+	ID       string     `json:"id"`
+	Type     string     `json:"type"`
+	Author   string     `json:"author"`
+	Nick     string     `json:"nick"`
+	Content  string     `json:"content,omitempty"`
+	Time     time.Time  `json:"time"`
+	Typing   bool       `json:"typing,omitempty"`
+	Members  []Presence `json:"members,omitempty"`
+	Messages []Message  `json:"messages,omitempty"`
+}
+
+// Presence is a member as listed in presence messages
+type Presence struct {
+	ID     string `json:"id"`
+	Nick   string `json:"nick"`
+	Online bool   `json:"online"`
+	Owner  bool   `json:"owner,omitempty"`
+	Muted  bool   `json:"muted,omitempty"`
 }
 
-type Room struct {
-	Members []string
-	Lock    sync.Mutex
+// incoming is what members send, a chat message or whether they are typing
+type incoming struct {
+	Chatm  string `json:"chatm"`
+	Typing *bool  `json:"typing"`
 }
 
-func NewWSServer() *WSServer {
-	return &WSServer{
-		Upgrader: websocket.Upgrader{
-			ReadBufferSize:  READSIZE,
-			WriteBufferSize: WRITESIZE,
-		},
-		Connections: make(map[string]*websocket.Conn),
-		Rooms:       make(map[string][]string),
+// newMessage returns a message with a fresh id, written now
+func newMessage(kind, author, nick, content string) Message {
+	return Message{
+		ID:      uuid.New().String(),
+		Type:    kind,
+		Author:  author,
+		Nick:    nick,
+		Content: content,
+		Time:    time.Now().UTC(),
 	}
 }
 
-// Subscribe returns a unique id for the client to use to subscribe to the websocket
-func (ws *WSServer) SubscribeNewUser(room string) uuid.UUID {
+// notice returns a message written by the server
+func notice(kind, content string) Message {
+	return newMessage(kind, "server", "server", content)
+}
+
+// RoomStatus describes a chat room for the admin page
+type RoomStatus struct {
+	Room         string
+	Members      []MemberStatus
+	LastActivity time.Time
+}
+
+// MemberStatus describes a member of a chat room
+type MemberStatus struct {
+	ID        string
+	Nick      string
+	Connected bool
+}
+
+var (
+	ErrRoomNotFound   = errors.New("room does not exist")
+	ErrUserNotFound   = errors.New("user is not in the room")
+	ErrInvalidNick    = fmt.Errorf("nicknames are up to %d printable characters", NICK_SIZE)
+	ErrNickTaken      = errors.New("nickname is taken in this room")
+	ErrNickFiltered   = errors.New("nickname is not allowed")
+	ErrInvalidMessage = errors.New("invalid message")
+)
+
+func NewWSServer(cfg *config.Config, store storage.Store, signer *auth.Signer, history History, logger *slog.Logger) *WSServer {
+	ws := &WSServer{
+		Nicknames: make(map[string]string),
+		Muted:     make(map[string]bool),
+		History:   history,
+		Filter:    moderation.NewFilter(cfg.Chat.Filter),
+		Store:     store,
+		Expiry:    cfg.Rooms,
+		Chat:      cfg.Chat,
+		Signer:    signer,
+		Logger:    logger.With("server", "chat"),
+	}
+	ws.Hub = hub.New("chat", cfg, ws, ws.Logger)
+	return ws
+}
+
+// Subscribe returns a unique id for the client to use to subscribe to the websocket, members
+// without a nickname are called guest followed by the start of their id, whoever creates a room
+// owns it
+func (ws *WSServer) SubscribeNewUser(room, nick string) uuid.UUID {
 	id := uuid.New()
-	if ws.Rooms[room] == nil {
-		ws.Rooms[room] = []string{id.String()}
-	} else {
-		ws.Rooms[room] = append(ws.Rooms[room], id.String())
+	if nick == "" {
+		nick = "guest-" + id.String()[:4]
+	}
+	ws.Nicknames[id.String()] = nick
+	if ws.Hub.Room(room) == nil {
+		ws.Hub.Create(room)
 	}
-	ws.Connections[id.String()] = nil
+	// a room left by everyone is kept until it expires, whoever comes back owns it
+	role := MEMBER
+	if ws.Hub.Room(room).Len() == 0 {
+		role = OWNER
+	}
+	ws.Hub.Room(room).Join(id.String(), role)
 	return id
 }
 
-// Unsubscribe removes the client from the list of connections
+// Unsubscribe removes the member from the room, the oldest member left owns it after its owner
 func (ws *WSServer) Unsubscribe(id uuid.UUID, room string) {
-	delete(ws.Connections, id.String())
-	// remove user from room
-	for i, v := range ws.Rooms[room] {
-		if v == id.String() {
-			ws.Rooms[room] = append(ws.Rooms[room][:i], ws.Rooms[room][i+1:]...)
-		}
+	delete(ws.Nicknames, id.String())
+	delete(ws.Muted, id.String())
+	ws.Hub.Room(room).Leave(id.String())
+	if ws.owner(room) == "" && ws.Hub.Room(room).Len() > 0 {
+		ws.Hub.Room(room).Members()[0].Role = OWNER
 	}
 }
 
-func (ws *WSServer) GracefulDisconnect(room, user string, conn *websocket.Conn) {
-	conn.Close()
+// leave removes a member and tells the others, a room without members is kept with its history
+// until it expires
+func (ws *WSServer) leave(room, user string) {
 	ws.Unsubscribe(uuid.MustParse(user), room)
-	if len(ws.Rooms[room]) == 0 {
-		delete(ws.Rooms, room)
+	if ws.Hub.Room(room).Len() == 0 {
+		ws.Hub.Room(room).LastActivity = time.Now()
+	} else {
+		ws.announce("", room, ws.presence(room))
 	}
 }
 
-// handleConnection is a function that takes a websocket connection and handles it
-func (ws *WSServer) handleConnection(conn *websocket.Conn, user string, room string) {
-	jsonJoin, err := json.Marshal(Message{
-		Author:  user,
-		Content: "[joined the room]",
+// nickname checks the nickname asked for by someone joining a room, an empty one is left for
+// SubscribeNewUser to pick
+func (ws *WSServer) nickname(room, nick string) (string, error) {
+	nick = strings.TrimSpace(nick)
+	if utf8.RuneCountInString(nick) > NICK_SIZE {
+		return "", ErrInvalidNick
+	}
+	for _, r := range nick {
+		if !unicode.IsPrint(r) {
+			return "", ErrInvalidNick
+		}
+	}
+	if ws.Filter.Match(nick) {
+		return "", ErrNickFiltered
+	}
+	if _, taken := ws.member(room, nick); taken && nick != "" {
+		return "", ErrNickTaken
+	}
+	return nick, nil
+}
+
+// presence lists the members of a room, ordered by nickname
+func (ws *WSServer) presence(room string) Message {
+	msg := notice(PRESENCE, "")
+	for _, member := range ws.Hub.Room(room).Members() {
+		msg.Members = append(msg.Members, Presence{
+			ID:     member.ID,
+			Nick:   ws.Nicknames[member.ID],
+			Online: member.Conn != nil,
+			Owner:  member.Role == OWNER,
+			Muted:  ws.Muted[member.ID],
+		})
+	}
+	sort.Slice(msg.Members, func(i, j int) bool {
+		return msg.Members[i].Nick < msg.Members[j].Nick
 	})
+	return msg
+}
+
+// remove disconnects the members of a room and forgets it with its history, only once it expired
+// or was closed
+func (ws *WSServer) remove(room string) {
+	for _, member := range ws.Hub.Room(room).Members() {
+		delete(ws.Nicknames, member.ID)
+		delete(ws.Muted, member.ID)
+	}
+	ws.Hub.Remove(room)
+	if err := ws.History.Clear(room); err != nil {
+		ws.Logger.Error("failed to clear history", "room", room, "error", err)
+	}
+}
+
+// announce encodes a message and sends it to every connected member of a room but user
+func (ws *WSServer) announce(user, room string, msg Message) {
+	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Println(err)
-		ws.GracefulDisconnect(room, user, conn)
+		ws.Logger.Error("failed to encode message", "type", msg.Type, "error", err)
 		return
 	}
-	ws.Broadcast(user, room, jsonJoin)
-	for {
-		mtype, msg, err := conn.ReadMessage()
-		if err != nil {
-			break
+	ws.Broadcast(user, room, data)
+}
+
+// Connected replays the history of the room to a member and tells the others they joined
+func (ws *WSServer) Connected(room *hub.Room, member *hub.Member) {
+	// late joiners catch up on the conversation first
+	replay := notice(REPLAY, "")
+	history, err := ws.History.Recent(room.ID)
+	if err != nil {
+		member.Logger.Error("failed to load history", "error", err)
+	}
+	replay.Messages = history
+	if data, err := json.Marshal(replay); err == nil {
+		member.Send(data)
+	}
+	ws.announce(member.ID, room.ID, newMessage(JOINED, member.ID, ws.Nicknames[member.ID], "[joined the room]"))
+	ws.announce("", room.ID, ws.presence(room.ID))
+}
+
+// Message acts on a chat message or a typing update of a member, returning false when the member
+// quits
+func (ws *WSServer) Message(room *hub.Room, member *hub.Member, data []byte) bool {
+	user := member.ID
+	var in incoming
+	if err := json.Unmarshal(data, &in); err != nil {
+		ws.SendError(user, room.ID, ErrInvalidMessage)
+		return true
+	}
+	text := strings.TrimSpace(in.Chatm)
+	if in.Typing != nil {
+		if !ws.Muted[user] {
+			typing := newMessage(TYPING, user, ws.Nicknames[user], "")
+			typing.Typing = *in.Typing
+			ws.announce(user, room.ID, typing)
 		}
-		log.Printf("\tUser %s: %s - %d\n", user, room, mtype)
-		if strings.Contains(string(msg), "/quit") {
-			jsonMsg, err := json.Marshal(Message{
-				Author:  user,
-				Content: "[left the room]",
+	} else if utf8.RuneCountInString(text) > ws.Chat.Length {
+		ws.SendError(user, room.ID, fmt.Errorf("messages are up to %d characters", ws.Chat.Length))
+	} else if name, arg, ok := command(text); ok {
+		return ws.handleCommand(user, room.ID, name, arg, member.Logger)
+	} else if text != "" {
+		ws.say(user, room.ID, MESSAGE, text, member.Logger)
+	}
+	return true
+}
+
+// Limited tells a member their message was dropped
+func (ws *WSServer) Limited(room *hub.Room, member *hub.Member, err error) {
+	ws.SendError(member.ID, room.ID, err)
+}
+
+// Disconnected removes a member once their connection is gone
+func (ws *WSServer) Disconnected(room *hub.Room, member *hub.Member) {
+	ws.leave(room.ID, member.ID)
+}
+
+// Stats counts the rooms and the open connections
+func (ws *WSServer) Stats() metrics.ChatStats {
+	ws.Hub.Lock()
+	defer ws.Hub.Unlock()
+	rooms, roles := ws.Hub.Count()
+	return metrics.ChatStats{Rooms: rooms, Connections: roles[OWNER] + roles[MEMBER]}
+}
+
+// Status describes every room, ordered by room id
+func (ws *WSServer) Status() []RoomStatus {
+	ws.Hub.Lock()
+	defer ws.Hub.Unlock()
+	rooms := []RoomStatus{}
+	for id, room := range ws.Hub.Rooms {
+		status := RoomStatus{Room: id, LastActivity: room.LastActivity}
+		for _, member := range room.Members() {
+			status.Members = append(status.Members, MemberStatus{
+				ID:        member.ID,
+				Nick:      ws.Nicknames[member.ID],
+				Connected: member.Conn != nil,
 			})
-			if err != nil {
-				log.Println(err)
-			} else {
-				ws.Broadcast(user, room, jsonMsg)
-			}
-			break
 		}
-		var marsh_msg map[string]string
-		json.Unmarshal(msg, &marsh_msg)
-		jsonMsg, err := json.Marshal(Message{
-			Author:  user,
-			Content: marsh_msg["chatm"],
-		})
-		if err != nil {
-			ws.SendError(user, err)
-			continue
-		}
-		ws.Broadcast(user, room, jsonMsg)
+		rooms = append(rooms, status)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Room < rooms[j].Room
+	})
+	return rooms
+}
+
+// Terminate tells the members of a room it was closed, disconnects them and removes the room
+func (ws *WSServer) Terminate(room string) error {
+	ws.Hub.Lock()
+	defer ws.Hub.Unlock()
+	if ws.Hub.Room(room) == nil {
+		return ErrRoomNotFound
 	}
-	ws.GracefulDisconnect(room, user, conn)
+	ws.terminate(room, "[room closed]")
+	ws.Logger.Info("room terminated", "room", room)
+	return nil
+}
+
+// terminate tells the members of a room why it closes, disconnects them and removes the room
+func (ws *WSServer) terminate(room, reason string) {
+	ws.announce("", room, notice(NOTICE, reason))
+	ws.remove(room)
 }
 
-func (ws *WSServer) Close() {
-	// send every connection a close message (8)
-	log.Println("Graceful shutdown initiated...")
-	for _, v := range ws.Connections {
-		if v != nil {
-			v.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+// Reaper removes idle and abandoned rooms every reap interval until ctx is done
+func (ws *WSServer) Reaper(ctx context.Context) {
+	ticker := time.NewTicker(ws.Expiry.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ws.Reap(now)
 		}
 	}
-	// close the connections
-	for k, v := range ws.Connections {
-		if v != nil {
-			v.Close()
+}
+
+// Reap removes the rooms without activity for longer than their TTL, it returns how many
+// rooms were removed
+func (ws *WSServer) Reap(now time.Time) int {
+	ws.Hub.Lock()
+	defer ws.Hub.Unlock()
+	if ws.Hub.Closing() {
+		return 0
+	}
+	reaped := 0
+	for id, room := range ws.Hub.Rooms {
+		idle := now.Sub(room.LastActivity)
+		ttl := ws.Expiry.AbandonedTTL
+		if room.Online() {
+			ttl = ws.Expiry.IdleTTL
 		}
-		delete(ws.Connections, k)
+		if idle < ttl {
+			continue
+		}
+		ws.Logger.Info("room expired", "room", id, "idle", idle)
+		ws.terminate(id, "[room expired]")
+		metrics.RoomsExpired.WithLabelValues("chat").Inc()
+		reaped++
+	}
+	return reaped
+}
+
+// Kick tells a member they were removed and closes their connection
+func (ws *WSServer) Kick(room, user string) error {
+	ws.Hub.Lock()
+	defer ws.Hub.Unlock()
+	if ws.Hub.Room(room) == nil {
+		return ErrRoomNotFound
 	}
-	// delete the rooms
-	for k := range ws.Rooms {
-		delete(ws.Rooms, k)
+	if ws.Hub.Room(room).Member(user) == nil {
+		return ErrUserNotFound
 	}
-	log.Println("Graceful shutdown complete")
+	ws.kick(room, user)
+	ws.Logger.Info("member kicked", "room", room, "user", user)
+	return nil
 }
 
-func (ws *WSServer) Broadcast(user, room string, msg []byte) {
-	for _, v := range ws.Rooms[room] {
-		if v != user {
-			if ws.Connections[v] != nil {
-				ws.Connections[v].WriteMessage(websocket.TextMessage, msg)
-			}
-		}
+// kick tells a member they were removed and removes them, their connection is closed once the
+// notice is delivered
+func (ws *WSServer) kick(room, user string) {
+	if data, err := json.Marshal(notice(NOTICE, "[you were removed from the room]")); err == nil {
+		ws.Hub.Room(room).Send(user, data)
 	}
+	ws.leave(room, user)
+}
+
+// Shutdown stops accepting rooms, tells every member the server is going away and waits for
+// the connections to finish until ctx is done, the history is kept
+func (ws *WSServer) Shutdown(ctx context.Context) error {
+	// the last messages are written once the hub is closed
+	defer func() {
+		if err := ws.History.Flush(); err != nil {
+			ws.Logger.Error("failed to save history", "error", err)
+		}
+	}()
+	return ws.Hub.Shutdown(ctx, func() {
+		for room := range ws.Hub.Rooms {
+			ws.announce("", room, notice(NOTICE, "[server shutting down]"))
+		}
+	})
+}
+
+func (ws *WSServer) Broadcast(user, room string, msg []byte) {
+	ws.Hub.Room(room).Broadcast(user, msg)
 }
 
 // SendError is a function that takes a websocket connection and sends an error message
-func (ws *WSServer) SendError(user string, err error) {
-	jsonErr, _ := json.Marshal(Message{
-		Author:  "user",
-		Content: err.Error(),
+func (ws *WSServer) SendError(user, room string, err error) {
+	jsonErr, _ := json.Marshal(notice(ERROR, err.Error()))
+	ws.Logger.Debug("sending error", "user", user, "error", err)
+	ws.Hub.Room(room).Send(user, jsonErr)
+}
+
+// authorize returns the member a request was made by, the token must belong to a member still in
+// the room
+func (ws *WSServer) authorize(c echo.Context, room string) (string, error) {
+	claims, err := ws.Signer.FromRequest(c, auth.CHAT, room)
+	if err != nil {
+		return "", err
+	}
+	if ws.Hub.Room(room).Member(claims.User) == nil {
+		return "", ErrUserNotFound
+	}
+	return claims.User, nil
+}
+
+// issue signs a token for a member of a room, the browser gets it as a cookie and other clients
+// from the response
+func (ws *WSServer) issue(c echo.Context, room, user string) (string, error) {
+	token, err := ws.Signer.Issue(auth.CHAT, room, user, "")
+	if err != nil {
+		return "", err
+	}
+	ws.Signer.SetCookie(c, auth.CHAT, room, token)
+	return token, nil
+}
+
+// Room is a callback for rendering a chat room
+func (ws *WSServer) Room(c echo.Context) error {
+	logger := logging.FromContext(c)
+	room := c.QueryParam("room")
+	if room == "" {
+		return c.Redirect(http.StatusFound, "/")
+	}
+	ws.Hub.Lock()
+	defer ws.Hub.Unlock()
+	if ws.Hub.Room(room) == nil {
+		logger.Debug("room does not exist", "room", room)
+		return c.Redirect(http.StatusFound, "/")
+	}
+	client, err := ws.authorize(c, room)
+	if err != nil {
+		logger.Debug("unauthorized", "room", room, "error", err)
+		return c.Redirect(http.StatusFound, "/")
+	}
+	return c.Render(http.StatusOK, "room.dj", pongo2.Context{
+		"title":       "Chat Room",
+		"description": "Chat with a friend",
+		"room":        room,
+		"client":      client,
 	})
-	log.Println(string(jsonErr))
-	ws.Connections[user].WriteMessage(websocket.TextMessage, jsonErr)
 }
 
 // WSHandler is a function that takes a websocket connection and handles it
 func (ws *WSServer) WSHandler(c echo.Context) error {
+	logger := logging.FromContext(c)
 	if c.Request().Header.Get("Connection") == "Upgrade" {
 		params := c.QueryParams()
 		room := params.Get("room")
 		if room == "" {
-			log.Println("Room parameter is required")
+			logger.Debug("room parameter is required")
 			return c.JSON(http.StatusBadRequest, map[string]string{
 				"error": "room parameter is required",
 			})
 		}
-		user := params.Get("user")
-		if user == "" {
-			log.Println("User parameter is required")
-			return c.JSON(http.StatusBadRequest, map[string]string{
-				"error": "user parameter is required",
-			})
-		}
-		// check if the room exists
-		if ws.Rooms[room] == nil {
-			log.Println("Room does not exist")
-			return c.JSON(http.StatusBadRequest, map[string]string{
-				"error": "room does not exist",
-			})
-		}
-		// check if the user is in the room
-		check := false
-		for _, v := range ws.Rooms[room] {
-			if v == user {
-				check = true
+		// the hub is only locked to check the client, the upgrade happens once it's unlocked
+		user, answered := func() (string, error) {
+			ws.Hub.Lock()
+			defer ws.Hub.Unlock()
+			if ws.Hub.Closing() {
+				return "", shuttingDown(c)
 			}
+			// check if the room exists
+			if ws.Hub.Room(room) == nil {
+				logger.Debug("room does not exist", "room", room)
+				return "", c.JSON(http.StatusBadRequest, map[string]string{
+					"error": "room does not exist",
+				})
+			}
+			user, err := ws.authorize(c, room)
+			if err != nil {
+				logger.Debug("unauthorized", "room", room, "error", err)
+				return "", c.JSON(http.StatusUnauthorized, map[string]string{
+					"error": err.Error(),
+				})
+			}
+			return user, nil
+		}()
+		if user == "" {
+			return answered
 		}
-		if !check {
-			log.Println("User is not in the room")
-			return c.JSON(http.StatusBadRequest, map[string]string{
-				"error": "user is not in the room",
-			})
-		}
-		log.Println("Upgrading connection")
-		conn, err := ws.Upgrader.Upgrade(c.Response(), c.Request(), nil)
-		if err != nil {
-			log.Println(err)
-			return err
-		}
-		ws.Connections[user] = conn
-		go ws.handleConnection(conn, user, room)
-		log.Printf("User %s connected to room %s\n", user, room)
+		return ws.Hub.Connect(c, room, user, logger)
 	}
-	log.Println("Invalid request")
+	logger.Debug("invalid request")
 	return c.JSON(http.StatusBadRequest, map[string]string{
 		"error": "invalid request",
 	})
 }
 
+// shuttingDown is the response to requests made while the server shuts down
+func shuttingDown(c echo.Context) error {
+	return c.JSON(http.StatusServiceUnavailable, map[string]string{
+		"error": "server is shutting down",
+		"type":  "chat",
+	})
+}
+
+// invalidNick is the response to joining with a nickname that can't be used
+func invalidNick(c echo.Context, err error) error {
+	return c.JSON(http.StatusBadRequest, map[string]string{
+		"error": err.Error(),
+		"type":  "chat",
+	})
+}
+
 // getroom is a function that takes a websocket connection and handles it
 func (ws *WSServer) GetRoom(c echo.Context) error {
+	ws.Hub.Lock()
+	defer ws.Hub.Unlock()
+	if ws.Hub.Closing() {
+		return shuttingDown(c)
+	}
+	if ws.Hub.Full() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"error": limits.ErrTooManyRooms.Error(),
+			"type":  "chat",
+		})
+	}
 	// generate a unique id for the room
 	room := uuid.New()
+	nick, err := ws.nickname(room.String(), c.FormValue("nick"))
+	if err != nil {
+		return invalidNick(c, err)
+	}
 	// subscribe the user to the room
-	id := ws.SubscribeNewUser(room.String())
+	id := ws.SubscribeNewUser(room.String(), nick)
+	token, err := ws.issue(c, room.String(), id.String())
+	if err != nil {
+		return err
+	}
 	return c.JSON(http.StatusOK, map[string]string{
-		"room": room.String(),
-		"id":   id.String(),
-		"type": "chat",
+		"room":  room.String(),
+		"id":    id.String(),
+		"token": token,
+		"type":  "chat",
 	})
 }
 
 func (ws *WSServer) ConnectToRoom(c echo.Context) error {
 	// generate a unique id for the room
 	room := c.FormValue("room")
+	ws.Hub.Lock()
+	defer ws.Hub.Unlock()
+	if ws.Hub.Closing() {
+		return shuttingDown(c)
+	}
 	// check if the room exists
-	if ws.Rooms[room] == nil {
-		log.Println("Room does not exist")
+	if ws.Hub.Room(room) == nil {
+		logging.FromContext(c).Debug("room does not exist", "room", room)
 		return c.JSON(http.StatusBadRequest, map[string]string{
 			"error": "room does not exist",
 		})
 	}
+	nick, err := ws.nickname(room, c.FormValue("nick"))
+	if err != nil {
+		return invalidNick(c, err)
+	}
 	// subscribe the user to the room
-	id := ws.SubscribeNewUser(room)
+	id := ws.SubscribeNewUser(room, nick)
+	token, err := ws.issue(c, room, id.String())
+	if err != nil {
+		return err
+	}
 	return c.JSON(http.StatusOK, map[string]string{
-		"room": room,
-		"id":   id.String(),
-		"type": "chat",
+		"room":  room,
+		"id":    id.String(),
+		"token": token,
+		"type":  "chat",
 	})
 }
@@ -0,0 +1,61 @@
+package websockets
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/Qinbeans/chess-htmx/auth"
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/storage"
+)
+
+func newTestServer(t *testing.T) *WSServer {
+	t.Helper()
+	cfg := config.Default()
+	signer, err := auth.New(cfg.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := storage.NewMemory()
+	return NewWSServer(&cfg, store, signer, NewHistory(cfg.Chat, store, logger), logger)
+}
+
+func TestHistoryKept(t *testing.T) {
+	ws := newTestServer(t)
+	ws.Hub.Lock()
+	for _, room := range []string{"left", "closed"} {
+		id := ws.SubscribeNewUser(room, "")
+		ws.say(id.String(), room, MESSAGE, "hello", ws.Logger)
+		ws.leave(room, id.String())
+	}
+	// everyone left, the room waits to expire
+	if ws.Hub.Room("left") == nil {
+		t.Fatal("the room was removed with its last member")
+	}
+	back := ws.SubscribeNewUser("left", "")
+	if ws.owner("left") != back.String() {
+		t.Error("whoever comes back doesn't own the room")
+	}
+	ws.Hub.Unlock()
+	if err := ws.Terminate("closed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		room     string
+		messages int
+	}{
+		{"left", 1},
+		{"closed", 0},
+	}
+	for _, test := range tests {
+		if recent, _ := ws.History.Recent(test.room); len(recent) != test.messages {
+			t.Errorf("%s has %d messages, want %d", test.room, len(recent), test.messages)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package websockets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/Qinbeans/chess-htmx/config"
+	"github.com/Qinbeans/chess-htmx/storage"
+)
+
+// kind of the storage records holding the history of a room
+const HISTORY = "chat"
+
+// History keeps the latest messages of every room, at most the configured number per room
+type History interface {
+	// Append adds a message to a room, dropping the oldest one once the room is full
+	Append(room string, msg Message) error
+	// Recent returns the messages of a room, oldest first
+	Recent(room string) ([]Message, error)
+	// Clear forgets a room
+	Clear(room string) error
+	// Flush writes the changes still pending, the history in memory has none
+	Flush() error
+}
+
+// NewHistory returns the history selected by the configuration
+func NewHistory(cfg config.Chat, store storage.Store, logger *slog.Logger) History {
+	if cfg.Persist {
+		return NewStoredHistory(store, cfg.History, logger)
+	}
+	return NewMemoryHistory(cfg.History)
+}
+
+// trim keeps the last size messages
+func trim(messages []Message, size int) []Message {
+	if len(messages) > size {
+		return messages[len(messages)-size:]
+	}
+	return messages
+}
+
+// MemoryHistory keeps the history in memory, it's lost on restart
+type MemoryHistory struct {
+	size  int
+	rooms map[string][]Message
+	lock  sync.Mutex
+}
+
+func NewMemoryHistory(size int) *MemoryHistory {
+	return &MemoryHistory{size: size, rooms: make(map[string][]Message)}
+}
+
+func (h *MemoryHistory) Append(room string, msg Message) error {
+	if h.size == 0 {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.rooms[room] = trim(append(h.rooms[room], msg), h.size)
+	return nil
+}
+
+func (h *MemoryHistory) Recent(room string) ([]Message, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]Message{}, h.rooms[room]...), nil
+}
+
+func (h *MemoryHistory) Clear(room string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.rooms, room)
+	return nil
+}
+
+func (h *MemoryHistory) Flush() error {
+	return nil
+}
+
+// StoredHistory keeps the history of each room as one record of the storage backend, rooms don't
+// outlive the server so the history is read from memory. The records are written in the
+// background, the hub stays locked while a history changes and isn't held up by the store
+//   - pending: the latest history of each room waiting to be written, nil once it's cleared
+//   - writing: held while records are written so an older history doesn't overwrite a newer one
+type StoredHistory struct {
+	*MemoryHistory
+	store   storage.Store
+	logger  *slog.Logger
+	lock    sync.Mutex
+	writing sync.Mutex
+	pending map[string][]Message
+}
+
+func NewStoredHistory(store storage.Store, size int, logger *slog.Logger) *StoredHistory {
+	return &StoredHistory{
+		MemoryHistory: NewMemoryHistory(size),
+		store:         store,
+		logger:        logger,
+		pending:       make(map[string][]Message),
+	}
+}
+
+func (h *StoredHistory) Append(room string, msg Message) error {
+	if h.size == 0 {
+		return nil
+	}
+	h.MemoryHistory.Append(room, msg)
+	messages, _ := h.MemoryHistory.Recent(room)
+	h.queue(room, messages)
+	return nil
+}
+
+func (h *StoredHistory) Clear(room string) error {
+	h.MemoryHistory.Clear(room)
+	h.queue(room, nil)
+	return nil
+}
+
+// queue marks the history of a room to be written and starts writing it
+func (h *StoredHistory) queue(room string, messages []Message) {
+	h.lock.Lock()
+	h.pending[room] = messages
+	h.lock.Unlock()
+	go func() {
+		if err := h.Flush(); err != nil {
+			h.logger.Error("failed to save history", "error", err)
+		}
+	}()
+}
+
+// take empties the queue
+func (h *StoredHistory) take() map[string][]Message {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	pending := h.pending
+	h.pending = make(map[string][]Message)
+	return pending
+}
+
+// Flush writes the pending records, a cleared history is deleted
+func (h *StoredHistory) Flush() error {
+	h.writing.Lock()
+	defer h.writing.Unlock()
+	var errs []error
+	for room, messages := range h.take() {
+		if messages == nil {
+			if err := h.store.Delete(HISTORY, room); err != nil {
+				errs = append(errs, fmt.Errorf("room %s: %w", room, err))
+			}
+			continue
+		}
+		data, err := json.Marshal(messages)
+		if err == nil {
+			err = h.store.Save(HISTORY, room, data)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("room %s: %w", room, err))
+		}
+	}
+	return errors.Join(errs...)
+}
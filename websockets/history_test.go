@@ -0,0 +1,54 @@
+package websockets
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/Qinbeans/chess-htmx/storage"
+)
+
+func TestStoredHistory(t *testing.T) {
+	store := storage.NewMemory()
+	history := NewStoredHistory(store, 2, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for _, text := range []string{"one", "two", "three"} {
+		if err := history.Append("room", newMessage(MESSAGE, "user", "nick", text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := history.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	recent, err := history.Recent("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Load(HISTORY, "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []Message
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	// the oldest message is dropped from both
+	for _, messages := range [][]Message{recent, stored} {
+		if len(messages) != 2 || messages[0].Content != "two" || messages[1].Content != "three" {
+			t.Fatalf("got %+v", messages)
+		}
+	}
+	if err := history.Clear("room"); err != nil {
+		t.Fatal(err)
+	}
+	if err := history.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if recent, _ := history.Recent("room"); len(recent) != 0 {
+		t.Errorf("cleared history has %+v", recent)
+	}
+	if _, err := store.Load(HISTORY, "room"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("cleared record: got %v, want %v", err, storage.ErrNotFound)
+	}
+}
@@ -0,0 +1,124 @@
+package websockets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Qinbeans/chess-htmx/logging"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// kind of the storage records holding reports
+const REPORTS = "reports"
+
+var ErrMissingReason = errors.New("tell what happened")
+
+// Report is a complaint of a member about a chat room, kept with the history of the room at the
+// time so it can be reviewed after the room is gone
+//   - Reported: nickname of the member reported, empty for the room as a whole
+type Report struct {
+	ID       string    `json:"id"`
+	Room     string    `json:"room"`
+	Reporter string    `json:"reporter"`
+	Reported string    `json:"reported,omitempty"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+	Messages []Message `json:"messages"`
+}
+
+// reportError is the response to a report that can't be taken
+func reportError(c echo.Context, status int, err error) error {
+	return c.JSON(status, map[string]string{
+		"error": err.Error(),
+		"type":  "report",
+	})
+}
+
+// Report is a callback for reporting a chat room, the reason is the reason field or the answer
+// to the htmx prompt
+func (ws *WSServer) Report(c echo.Context) error {
+	logger := logging.FromContext(c)
+	room := c.FormValue("room")
+	reason := strings.TrimSpace(c.FormValue("reason"))
+	if reason == "" {
+		reason = strings.TrimSpace(c.Request().Header.Get("HX-Prompt"))
+	}
+	if reason == "" {
+		return reportError(c, http.StatusBadRequest, ErrMissingReason)
+	}
+	if utf8.RuneCountInString(reason) > ws.Chat.Length {
+		return reportError(c, http.StatusBadRequest, fmt.Errorf("reasons are up to %d characters", ws.Chat.Length))
+	}
+	ws.Hub.Lock()
+	if ws.Hub.Room(room) == nil {
+		ws.Hub.Unlock()
+		return reportError(c, http.StatusBadRequest, ErrRoomNotFound)
+	}
+	user, err := ws.authorize(c, room)
+	if err != nil {
+		ws.Hub.Unlock()
+		return reportError(c, http.StatusUnauthorized, err)
+	}
+	messages, err := ws.History.Recent(room)
+	ws.Hub.Unlock()
+	if err != nil {
+		return err
+	}
+	report := Report{
+		ID:       uuid.New().String(),
+		Room:     room,
+		Reporter: user,
+		Reported: strings.TrimSpace(c.FormValue("nick")),
+		Reason:   reason,
+		Time:     time.Now().UTC(),
+		Messages: messages,
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if err := ws.Store.Save(REPORTS, report.ID, data); err != nil {
+		return err
+	}
+	logger.Info("room reported", "room", room, "report", report.ID)
+	return c.JSON(http.StatusOK, map[string]string{
+		"report": report.ID,
+		"type":   "report",
+	})
+}
+
+// Reports returns the reports waiting for review, newest first
+func (ws *WSServer) Reports() ([]Report, error) {
+	ids, err := ws.Store.List(REPORTS)
+	if err != nil {
+		return nil, err
+	}
+	reports := []Report{}
+	for _, id := range ids {
+		data, err := ws.Store.Load(REPORTS, id)
+		if err != nil {
+			return nil, err
+		}
+		var report Report
+		if err := json.Unmarshal(data, &report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Time.After(reports[j].Time)
+	})
+	return reports, nil
+}
+
+// Dismiss removes a report once it was reviewed
+func (ws *WSServer) Dismiss(id string) error {
+	return ws.Store.Delete(REPORTS, id)
+}